@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// isBucketARN reports whether bucket is given as an ARN, such as an S3
+// access point ARN, rather than a plain bucket name.
+func isBucketARN(bucket string) bool {
+	return arn.IsARN(bucket)
+}
+
+// validateBucket checks bucket against the client config. Buckets given as
+// ARNs must be S3 access points, and unless UseARNRegion is set they must
+// be in the client's region.
+func (c *S3Config) validateBucket(bucket string) error {
+	if !isBucketARN(bucket) {
+		return nil
+	}
+
+	a, err := arn.Parse(bucket)
+	if err != nil {
+		return fmt.Errorf("bucket %s: %w", bucket, err)
+	}
+	if a.Service != "s3" || !strings.HasPrefix(a.Resource, "accesspoint/") && !strings.HasPrefix(a.Resource, "accesspoint:") {
+		return fmt.Errorf("bucket %s: only S3 access point ARNs are supported", bucket)
+	}
+	if a.Region == "" || a.AccountID == "" {
+		return fmt.Errorf("bucket %s: access point ARNs need a region and account ID", bucket)
+	}
+	if !c.UseARNRegion && a.Region != c.Region {
+		return fmt.Errorf("bucket %s is in region %s but the client is configured for %s, set use_arn_region to use the ARN's region", bucket, a.Region, c.Region)
+	}
+	return nil
+}
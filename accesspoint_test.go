@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testAccessPoint = "arn:aws:s3:us-west-2:123456789012:accesspoint/backups"
+
+func TestValidateBucket(t *testing.T) {
+	tests := []struct {
+		bucket       string
+		useARNRegion bool
+		ok           bool
+	}{
+		{"datahaven", false, true},
+		{testAccessPoint, false, true},
+		{"arn:aws:s3:eu-west-1:123456789012:accesspoint/backups", false, false},
+		{"arn:aws:s3:eu-west-1:123456789012:accesspoint/backups", true, true},
+		{"arn:aws:s3:::datahaven", false, false},
+		{"arn:aws:sqs:us-west-2:123456789012:accesspoint/backups", false, false},
+		{"arn:aws:s3:us-west-2::accesspoint/backups", false, false},
+	}
+	for _, tt := range tests {
+		cfg := &S3Config{Region: "us-west-2", UseARNRegion: tt.useARNRegion}
+		if err := cfg.validateBucket(tt.bucket); (err == nil) != tt.ok {
+			t.Errorf("validateBucket(%s) with use_arn_region %v = %v", tt.bucket, tt.useARNRegion, err)
+		}
+	}
+}
+
+func TestAccessPointRequestTarget(t *testing.T) {
+	client := NewS3Client(&S3Config{Region: "us-west-2", AccessKey: "access", SecretKey: "secret"})
+	req, _ := client.svc.HeadObjectRequest(&s3.HeadObjectInput{Bucket: aws.String(testAccessPoint), Key: aws.String("key")})
+	if err := req.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if host, want := req.HTTPRequest.URL.Host, "backups-123456789012.s3-accesspoint.us-west-2.amazonaws.com"; host != want {
+		t.Fatalf("request to %s, want the access point %s", host, want)
+	}
+	if path := req.HTTPRequest.URL.Path; path != "/key" {
+		t.Fatalf("request for %s, want /key", path)
+	}
+}
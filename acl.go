@@ -0,0 +1,38 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const posixACLAccessXattr = "system.posix_acl_access"
+
+// readACL returns the raw POSIX access ACL of path as stored in its
+// system.posix_acl_access xattr. Files without an extended ACL, and
+// filesystems that don't support ACLs at all, yield a nil ACL.
+func readACL(path string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, posixACLAccessXattr, nil)
+		if err != nil {
+			if err == unix.ENODATA || err == unix.ENOTSUP {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(path, posixACLAccessXattr, buf)
+		if err == unix.ERANGE {
+			// ACL grew between the two calls, size it again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// writeACL sets the raw POSIX access ACL of path, as read by readACL.
+func writeACL(path string, acl []byte) error {
+	return unix.Lsetxattr(path, posixACLAccessXattr, acl, 0)
+}
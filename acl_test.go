@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testACL encodes an access ACL granting uid read access on top of the
+// mode bits rw-r--r--, in the layout of system.posix_acl_access.
+func testACL(uid uint32) []byte {
+	const undefinedID = 0xffffffff
+	entries := []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, undefinedID}, // ACL_USER_OBJ
+		{0x02, 4, uid},         // ACL_USER
+		{0x04, 4, undefinedID}, // ACL_GROUP_OBJ
+		{0x10, 4, undefinedID}, // ACL_MASK
+		{0x20, 4, undefinedID}, // ACL_OTHER
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(2))
+	for _, e := range entries {
+		binary.Write(&b, binary.LittleEndian, e)
+	}
+	return b.Bytes()
+}
+
+func TestACLRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := readACL(src)
+	if err != nil {
+		t.Fatalf("readACL of a file without ACL: %v", err)
+	}
+	if acl != nil {
+		t.Fatalf("file without ACL has ACL %x", acl)
+	}
+
+	want := testACL(1234)
+	if err := writeACL(src, want); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("filesystem doesn't support POSIX ACLs")
+		}
+		t.Fatal(err)
+	}
+	acl, err = readACL(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(acl, want) {
+		t.Fatalf("readACL = %x, want %x", acl, want)
+	}
+
+	restore := filepath.Join(dir, "restore")
+	sink := NewLocalSink(restore, conflictOverwrite)
+	metadata := &FileMetadata{RelPath: "src", ACL: acl}
+	if err := sink.WriteFile(metadata, strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := readACL(filepath.Join(restore, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, want) {
+		t.Fatalf("restored ACL = %x, want %x", restored, want)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Calendar units of ages, fixed lengths are close enough to pick what to
+// clean up.
+const (
+	day   = 24 * time.Hour
+	month = 30 * day
+	year  = 365 * day
+)
+
+// parseAge parses an age like "30d", "6m" or "1y", in days, months or
+// years, or any duration time.ParseDuration accepts but minutes, "m" being
+// months.
+func parseAge(s string) (time.Duration, error) {
+	if len(s) > 1 {
+		unit := map[byte]time.Duration{'d': day, 'm': month, 'y': year}[s[len(s)-1]]
+		if n, err := strconv.Atoi(s[:len(s)-1]); err == nil && unit != 0 {
+			if n < 0 {
+				return 0, fmt.Errorf("age %s is negative", s)
+			}
+			if int64(n) > math.MaxInt64/int64(unit) {
+				return 0, fmt.Errorf("age %s is too long", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("age %s isn't a number of days, months or years, nor a duration", s)
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("age %s is negative", s)
+	}
+	return age, nil
+}
+
+// ageFlag is a flag.Value parsed by parseAge.
+type ageFlag time.Duration
+
+func (a *ageFlag) String() string {
+	return time.Duration(*a).String()
+}
+
+func (a *ageFlag) Set(s string) error {
+	age, err := parseAge(s)
+	if err != nil {
+		return err
+	}
+	*a = ageFlag(age)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		age  string
+		want time.Duration
+	}{
+		{"30d", 30 * 24 * time.Hour},
+		// m is months, not minutes.
+		{"6m", 180 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+		{"0d", 0},
+		{"36h", 36 * time.Hour},
+		{"1h30s", time.Hour + 30*time.Second},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.age)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("parseAge(%q) = %s, want %s", tt.age, got, tt.want)
+		}
+	}
+	// Too long to be a duration rather than wrapping around.
+	for _, age := range []string{"", "d", "1.5d", "-3d", "-1h", "30w", "soon", "300y", "106752d", "9223372036854775807m"} {
+		if _, err := parseAge(age); err == nil {
+			t.Errorf("parseAge(%q) succeeded", age)
+		}
+	}
+}
+
+func TestOlderThanFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var olderThan ageFlag
+	fs.Var(&olderThan, "older-than", "")
+	if err := fs.Parse([]string{"--older-than", "2d"}); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(olderThan) != 48*time.Hour {
+		t.Errorf("--older-than 2d is %s", time.Duration(olderThan))
+	}
+	if err := fs.Parse([]string{"--older-than", "2w"}); err == nil {
+		t.Error("--older-than 2w accepted")
+	}
+}
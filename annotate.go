@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func runAnnotate(args []string) error {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	path := fs.String("path", "", "annotate the file stored under this path or relative path instead of the snapshot")
+	note := fs.String("note", "", "the note to attach, empty to remove it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven annotate [--path path] --note text [snapshot-id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	snapshot, matched, err := annotate(client, fs.Arg(0), *path, *note)
+	if err != nil {
+		return err
+	}
+	if *path != "" {
+		fmt.Printf("Annotated %d files in snapshot %s.\n", matched, snapshot.ID)
+	} else {
+		fmt.Printf("Annotated snapshot %s.\n", snapshot.ID)
+	}
+	return nil
+}
+
+// annotate attaches note to the snapshot with the given ID, or to its files
+// stored under path, by path or relative path, when path isn't empty. An
+// empty note removes it. It returns the snapshot and how many records were
+// annotated.
+func annotate(client MongoDBClient, snapshotID, path, note string) (*Snapshot, int64, error) {
+	snapshot, err := client.FindSnapshot(snapshotID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	collections, filter, field := []string{snapshotsCollection}, bson.M{"_id": snapshot.ID}, "note"
+	if path != "" {
+		collections = snapshot.fileCollections()
+		filter = bson.M{"$or": bson.A{bson.M{"path": path}, bson.M{"relpath": path}}}
+		field = "annotation"
+	}
+
+	update := bson.M{"$set": bson.M{field: note}}
+	if note == "" {
+		update = bson.M{"$unset": bson.M{field: ""}}
+	}
+
+	var matched int64
+	for _, collection := range collections {
+		n, err := client.UpdateMany(collection, filter, update)
+		if err != nil {
+			return nil, 0, fmt.Errorf("annotating: %w", err)
+		}
+		matched += n
+	}
+	if matched == 0 {
+		return nil, 0, fmt.Errorf("no file %s in snapshot %s", path, snapshot.ID)
+	}
+	return snapshot, matched, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAnnotate(t *testing.T) {
+	store := newMemStore()
+	store.addSnapshot(&Snapshot{ID: "s1"}, []FileMetadata{
+		{Path: "/src/a", RelPath: "a"},
+		{Path: "/src/b", RelPath: "b"},
+	})
+	annotations := func() map[string]string {
+		found := map[string]string{}
+		store.ForEachFile("s1", func(metadata *FileMetadata) error {
+			found[metadata.RelPath] = metadata.Annotation
+			return nil
+		})
+		return found
+	}
+
+	if _, n, err := annotate(store, "s1", "/src/a", "pre-migration state"); err != nil || n != 1 {
+		t.Fatalf("annotating by path: %d files, %v", n, err)
+	}
+	if _, _, err := annotate(store, "s1", "b", "by relative path"); err != nil {
+		t.Fatal(err)
+	}
+	if got := annotations(); got["a"] != "pre-migration state" || got["b"] != "by relative path" {
+		t.Fatalf("annotations %v", got)
+	}
+	if _, _, err := annotate(store, "s1", "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := annotations(); got["a"] != "" || got["b"] != "by relative path" {
+		t.Fatalf("annotations %v after removing a's", got)
+	}
+	if _, _, err := annotate(store, "s1", "missing", "note"); err == nil {
+		t.Fatal("annotating a file the snapshot doesn't have succeeded")
+	}
+
+	// Without a path the snapshot itself is annotated.
+	if _, _, err := annotate(store, "", "", "before the upgrade"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := store.FindSnapshot("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Note != "before the upgrade" {
+		t.Fatalf("snapshot note %q", snapshot.Note)
+	}
+}
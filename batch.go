@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxBSONDocumentSize is MongoDB's limit on a single document.
+const maxBSONDocumentSize = 16 * 1024 * 1024
+
+// MetadataBatch buffers the file documents of a snapshot per collection and
+// inserts them together once either the configured count or BSON byte size
+// is reached. With a maximum number of files per snapshot, the run is split
+// into parts: once a part is full, further files go to a new snapshot
+// continuing the first one.
+type MetadataBatch struct {
+	client   MongoDBClient
+	cfg      *MongoDBConfig
+	head     *Snapshot
+	maxCount int
+	maxBytes int
+	maxFiles int64
+
+	mu       sync.Mutex
+	snapshot *Snapshot
+	files    int64
+	pending  map[string]*pendingDocs
+}
+
+type pendingDocs struct {
+	docs  []interface{}
+	bytes int
+}
+
+// NewMetadataBatch creates a new instance of MetadataBatch for the files of
+// snapshot, splitting it every maxFiles files. 0 never splits.
+func NewMetadataBatch(client MongoDBClient, snapshot *Snapshot, cfg *MongoDBConfig, maxFiles int64) *MetadataBatch {
+	maxCount := cfg.BatchSize
+	if maxCount <= 0 {
+		maxCount = 1
+	}
+	maxBytes := cfg.MaxBatchBytes
+	if maxBytes <= 0 || maxBytes > maxBSONDocumentSize {
+		maxBytes = maxBSONDocumentSize
+	}
+
+	return &MetadataBatch{
+		client:   client,
+		cfg:      cfg,
+		head:     snapshot,
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		snapshot: snapshot,
+		pending:  make(map[string]*pendingDocs),
+	}
+}
+
+// Add queues document, the metadata of the file at path, flushing its
+// collection's batch first if document would push it over the byte limit,
+// and afterwards if the batch is full.
+func (b *MetadataBatch) Add(path string, document interface{}) error {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.maxFiles > 0 && b.files >= b.maxFiles {
+		if err := b.split(); err != nil {
+			return err
+		}
+	}
+	b.files++
+
+	collection := b.snapshot.collectionFor(path)
+	p, ok := b.pending[collection]
+	if !ok {
+		p = &pendingDocs{}
+		b.pending[collection] = p
+	}
+
+	if len(p.docs) > 0 && p.bytes+len(raw) > b.maxBytes {
+		if err := b.flush(collection, p); err != nil {
+			return err
+		}
+	}
+
+	p.docs = append(p.docs, bson.Raw(raw))
+	p.bytes += len(raw)
+
+	if len(p.docs) >= b.maxCount || p.bytes >= b.maxBytes {
+		return b.flush(collection, p)
+	}
+	return nil
+}
+
+// Flush inserts whatever is buffered.
+func (b *MetadataBatch) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for collection, p := range b.pending {
+		if err := b.flush(collection, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split flushes the current part and starts the next one, registering it
+// on the first snapshot so reading that one covers every part.
+func (b *MetadataBatch) split() error {
+	for collection, p := range b.pending {
+		if err := b.flush(collection, p); err != nil {
+			return err
+		}
+	}
+
+	next := *b.head
+	next.ID = fmt.Sprintf("%s-%d", b.head.ID, len(b.head.Parts)+2)
+	next.Parts = nil
+	next.Continues = b.head.ID
+	collections, err := shardCollections(next.ID, b.cfg)
+	if err != nil {
+		return err
+	}
+	next.Collections = collections
+
+	if err := b.client.InsertOne(snapshotsCollection, &next); err != nil {
+		return fmt.Errorf("inserting snapshot %s: %w", next.ID, err)
+	}
+	if _, err := b.client.UpdateMany(snapshotsCollection, bson.M{"_id": b.head.ID}, bson.M{"$push": bson.M{"parts": next.ID}}); err != nil {
+		return fmt.Errorf("linking snapshot %s: %w", next.ID, err)
+	}
+	b.head.Parts = append(b.head.Parts, next.ID)
+	log.Printf("snapshot %s reached %d files, continuing in %s", b.snapshot.ID, b.files, next.ID)
+
+	b.snapshot = &next
+	b.files = 0
+	b.pending = make(map[string]*pendingDocs)
+	return nil
+}
+
+func (b *MetadataBatch) flush(collection string, p *pendingDocs) error {
+	if len(p.docs) == 0 {
+		return nil
+	}
+
+	docs := p.docs
+	p.docs = nil
+	p.bytes = 0
+
+	if err := b.client.InsertMany(collection, docs); err != nil {
+		return fmt.Errorf("insert %d documents: %w", len(docs), err)
+	}
+	return nil
+}
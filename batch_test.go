@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataBatchFlushesOnBytes(t *testing.T) {
+	store := newMemStore()
+	snapshot := &Snapshot{ID: "s1"}
+	// Every record is over 100 KiB of BSON, so four of them fill the byte
+	// limit long before the count limit.
+	batch := NewMetadataBatch(store, snapshot, &MongoDBConfig{BatchSize: 1000, MaxBatchBytes: 400 << 10}, 0)
+	for i := 0; i < 10; i++ {
+		path := fmt.Sprintf("/src/%d", i)
+		metadata := &FileMetadata{Path: path, ACL: []byte(strings.Repeat("x", 100<<10))}
+		if err := batch.Add(path, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []int{3, 3, 3}; !reflect.DeepEqual(store.batches, want) {
+		t.Fatalf("inserted batches of %v before the flush, want %v", store.batches, want)
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 3, 3, 1}; !reflect.DeepEqual(store.batches, want) {
+		t.Fatalf("inserted batches of %v, want %v", store.batches, want)
+	}
+	if n, _ := store.CountFiles("s1"); n != 10 {
+		t.Fatalf("%d files stored, want 10", n)
+	}
+}
+
+func TestMetadataBatchFlushesOnCount(t *testing.T) {
+	store := newMemStore()
+	batch := NewMetadataBatch(store, &Snapshot{ID: "s1"}, &MongoDBConfig{BatchSize: 4}, 0)
+	for i := 0; i < 9; i++ {
+		path := fmt.Sprintf("/src/%d", i)
+		if err := batch.Add(path, &FileMetadata{Path: path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{4, 4, 1}; !reflect.DeepEqual(store.batches, want) {
+		t.Fatalf("inserted batches of %v, want %v", store.batches, want)
+	}
+}
+
+func TestMaxFilesPerSnapshotSplits(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 7; i++ {
+		files[fmt.Sprintf("file%d", i)] = fmt.Sprintf("content %d", i)
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.MaxFilesPerSnapshot = 3
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := store.FindSnapshot(summary.SnapshotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{summary.SnapshotID + "-2", summary.SnapshotID + "-3"}; !reflect.DeepEqual(head.Parts, want) {
+		t.Fatalf("parts %v, want %v", head.Parts, want)
+	}
+	for _, id := range head.Parts {
+		part, err := store.FindSnapshot(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Continues != summary.SnapshotID {
+			t.Errorf("part %s continues %q, want %s", id, part.Continues, summary.SnapshotID)
+		}
+	}
+	for _, collection := range store.fileCollections(summary.SnapshotID) {
+		if n := len(store.collections[collection]); n > 3 {
+			t.Errorf("collection %s holds %d files, more than 3", collection, n)
+		}
+	}
+
+	// The first snapshot stands for all of them.
+	if n, err := store.CountFiles(summary.SnapshotID); err != nil || n != 7 {
+		t.Fatalf("snapshot covers %d files (%v), want 7", n, err)
+	}
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+}
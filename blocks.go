@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// blockHasher hashes what is written to it in fixed-size blocks.
+type blockHasher struct {
+	size   int64
+	h      hash.Hash
+	filled int64
+	blocks []string
+}
+
+func newBlockHasher(size int64, algorithm string) *blockHasher {
+	return &blockHasher{size: size, h: newHash(algorithm)}
+}
+
+func (b *blockHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := b.size - b.filled
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		b.h.Write(p[:n])
+		b.filled += n
+		p = p[n:]
+		if b.filled == b.size {
+			b.endBlock()
+		}
+	}
+	return written, nil
+}
+
+func (b *blockHasher) endBlock() {
+	b.blocks = append(b.blocks, hex.EncodeToString(b.h.Sum(nil)))
+	b.h.Reset()
+	b.filled = 0
+}
+
+// Sum returns the hashes of every block, the last one possibly short.
+func (b *blockHasher) Sum() []string {
+	if b.filled > 0 {
+		b.endBlock()
+	}
+	return b.blocks
+}
+
+// calculateHashWithBlocks hashes filePath like calculateHash and, in the
+// same read, every blockSize bytes of it with the same algorithm.
+func calculateHashWithBlocks(filePath, algorithm string, blockSize int64) (string, int64, []string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer file.Close()
+
+	h := newHash(algorithm)
+	blocks := newBlockHasher(blockSize, algorithm)
+	n, err := io.Copy(io.MultiWriter(h, blocks), file)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return formatHash(algorithm, h), n, blocks.Sum(), nil
+}
+
+// DownloadRange returns length bytes of versionID of the object, or of its
+// latest version when versionID is "", starting at offset.
+func (c *S3Client) DownloadRange(bucketName, key, versionID string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(key)),
+		Range:        aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		RequestPayer: c.requestPayer(),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	output, err := c.svc.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// corruptBlocks range-reads every block of the object stored for metadata
+// and returns the indexes of those whose hash doesn't match. Only objects
+// stored as is, without transforms or bundling, can be read by block.
+func (c *S3Client) corruptBlocks(bucketName string, metadata *FileMetadata) ([]int, error) {
+	var corrupt []int
+	// The blocks were hashed with the algorithm of the whole file.
+	if _, err := hasherFor(metadata.Hash); err != nil {
+		return nil, err
+	}
+	for i, want := range metadata.BlockHashes {
+		offset := int64(i) * metadata.BlockSize
+		length := metadata.BlockSize
+		if offset+length > metadata.Size {
+			length = metadata.Size - offset
+		}
+
+		body, err := c.DownloadRange(bucketName, metadata.objectKey(), metadata.VersionID, offset, length)
+		if err != nil {
+			return nil, err
+		}
+		h, _ := hasherFor(metadata.Hash)
+		n, err := io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if n != length || hex.EncodeToString(h.Sum(nil)) != want {
+			corrupt = append(corrupt, i)
+		}
+	}
+	return corrupt, nil
+}
+
+// blockCheckable reports whether the object of metadata can be checked
+// block by block.
+func blockCheckable(metadata *FileMetadata) bool {
+	return len(metadata.BlockHashes) > 0 && metadata.BlockSize > 0 &&
+		!metadata.Inline && metadata.BundleKey == "" && len(metadata.Transforms) == 0
+}
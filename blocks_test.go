@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBlockHasher(t *testing.T) {
+	content := testLines(1, 50)
+	var want []string
+	for offset := 0; offset < len(content); offset += 16 {
+		end := offset + 16
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha256.Sum256(content[offset:end])
+		want = append(want, hex.EncodeToString(sum[:]))
+	}
+
+	// Writes that end mid-block, span blocks or end on a boundary.
+	blocks := newBlockHasher(16, defaultHashAlgorithm)
+	for _, n := range []int{5, 20, 7, 16, 2} {
+		blocks.Write(content[:n])
+		content = content[n:]
+	}
+	if got := blocks.Sum(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("block hashes %v, want %v", got, want)
+	}
+}
+
+func TestVerifyBlocksLocalizesCorruption(t *testing.T) {
+	src := t.TempDir()
+	content := testLines(2, 50)
+	writeFiles(t, src, map[string]string{"large": string(content), "small": "below the block size"})
+	cfg := testBackupConfig(t)
+	cfg.BlockHashBytes = 16
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var large *FileMetadata
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		if metadata.RelPath == "large" {
+			large = metadata
+		}
+		return nil
+	})
+	if large == nil || large.BlockSize != 16 || len(large.BlockHashes) != 4 {
+		t.Fatalf("large file recorded with blocks %+v", large)
+	}
+
+	// One flipped byte in the third block.
+	corrupted := append([]byte(nil), content...)
+	corrupted[40] ^= 1
+	s3.put(cfg.Bucket, large.objectKey(), corrupted, nil)
+
+	gets := s3.count("GET")
+	corrupt, err := s3.client().corruptBlocks(cfg.Bucket, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(corrupt, []int{2}) {
+		t.Fatalf("corrupt blocks %v, want [2]", corrupt)
+	}
+	if n := s3.count("GET") - gets; n != 4 {
+		t.Fatalf("%d reads, want one per block", n)
+	}
+
+	out := captureOutput(t)
+	got, err := engine.Verify(NewVerifier(s3.client(), cfg.Bucket, false, true), summary.SnapshotID, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (VerifySummary{Files: 2, Present: 2, ContentVerified: 1, Corrupt: 1}); got != want {
+		t.Fatalf("summary %+v, want %+v", got, want)
+	}
+	if !strings.Contains(out.String(), "blocks [2] of 16 bytes are corrupt") {
+		t.Fatalf("corrupt block not reported: %q", out.String())
+	}
+}
+
+func TestVerifyBlocksOfPinnedVersion(t *testing.T) {
+	src := t.TempDir()
+	content := testLines(3, 50)
+	writeFiles(t, src, map[string]string{"large": string(content)})
+	cfg := testBackupConfig(t)
+	cfg.BlockHashBytes = 16
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var large *FileMetadata
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		large = metadata
+		return nil
+	})
+
+	// The pinned version is intact, the one written over it isn't.
+	corrupted := append([]byte(nil), content...)
+	corrupted[40] ^= 1
+	s3.putVersion(cfg.Bucket, large.objectKey(), "v1", content, nil)
+	s3.putVersion(cfg.Bucket, large.objectKey(), "v2", corrupted, nil)
+	large.VersionID = "v1"
+
+	corrupt, err := s3.client().corruptBlocks(cfg.Bucket, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 0 {
+		t.Fatalf("corrupt blocks %v of the intact pinned version", corrupt)
+	}
+}
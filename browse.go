@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pathNode is a file or directory of the tree of a snapshot's paths. The
+// tree browse walks holds names and sizes only, of the directories it
+// listed; the metadata of the files is read again when they are restored,
+// so browsing a large snapshot doesn't hold all of its records.
+type pathNode struct {
+	name   string
+	parent *pathNode
+	// children are the entries of a directory, nil for a file, and listed
+	// whether those of a directory browse walks were read.
+	children map[string]*pathNode
+	listed   bool
+	// size is the size of a file, or the total of the files below a
+	// directory, and files how many of them there are.
+	size  int64
+	files int
+	// metadata is the record of the file, kept by a mounted snapshot to
+	// read its content, and ino its inode number there.
+	metadata *FileMetadata
+	ino      uint64
+}
+
+func newPathDir(name string, parent *pathNode) *pathNode {
+	return &pathNode{name: name, parent: parent, children: make(map[string]*pathNode)}
+}
+
+func (n *pathNode) isDir() bool {
+	return n.children != nil
+}
+
+// add adds the file or, with dir, the directory at relPath below n, with
+// the directories leading to it, and returns it.
+func (n *pathNode) add(relPath string, size int64, dir bool) *pathNode {
+	names := strings.Split(relPath, "/")
+	node := n
+	for i, name := range names {
+		if name == "" || name == "." {
+			continue
+		}
+		if !node.isDir() {
+			node.children = make(map[string]*pathNode)
+		}
+		child, ok := node.children[name]
+		if ok && i == len(names)-1 {
+			// Sources recording the same path add it once.
+			return child
+		}
+		if !ok {
+			if i < len(names)-1 || dir {
+				child = newPathDir(name, node)
+			} else {
+				child = &pathNode{name: name, parent: node}
+			}
+			node.children[name] = child
+		}
+		node = child
+	}
+	if node.isDir() {
+		return node
+	}
+	node.size, node.files = size, 1
+	for dir := node.parent; dir != nil; dir = dir.parent {
+		dir.size += size
+		dir.files++
+	}
+	return node
+}
+
+// list sets the children of the directory n to entries, as read by
+// ListDir.
+func (n *pathNode) list(entries []SnapshotEntry) {
+	n.children = make(map[string]*pathNode, len(entries))
+	for _, entry := range entries {
+		child := &pathNode{name: entry.Name, parent: n, size: entry.Size, files: entry.Files}
+		if entry.Dir {
+			child.children = make(map[string]*pathNode)
+		}
+		n.children[entry.Name] = child
+	}
+	n.listed = true
+}
+
+// path returns the relative path of n, "" for the root.
+func (n *pathNode) path() string {
+	if n.parent == nil {
+		return ""
+	}
+	return path.Join(n.parent.path(), n.name)
+}
+
+// lookup returns the node at name, relative to n or, starting with a
+// slash, to the root.
+func (n *pathNode) lookup(name string) (*pathNode, bool) {
+	node := n
+	if strings.HasPrefix(name, "/") {
+		for node.parent != nil {
+			node = node.parent
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if node.parent != nil {
+				node = node.parent
+			}
+		default:
+			child, ok := node.children[part]
+			if !ok {
+				return nil, false
+			}
+			node = child
+		}
+	}
+	return node, true
+}
+
+// entries returns the children of a directory, directories first, by name.
+func (n *pathNode) entries() []*pathNode {
+	entries := make([]*pathNode, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, child)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].isDir() != entries[j].isDir() {
+			return entries[i].isDir()
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+// SnapshotEntry is a file or directory in a directory of a snapshot, as
+// listed by ListDir: a directory with the total size and number of the
+// files below it.
+type SnapshotEntry struct {
+	Name  string `bson:"_id"`
+	Dir   bool   `bson:"dir"`
+	Size  int64  `bson:"size"`
+	Files int    `bson:"files"`
+}
+
+// ListDir returns the entries of the directory dir of a snapshot, "" for
+// its root, in no particular order. Only the records below dir are
+// matched, by the prefix of their paths, and grouped by the first name
+// below it, so listing a directory doesn't read the rest of the snapshot.
+// Denied files and those that failed their checksum can't be restored and
+// are left out.
+func (mc *MongoClient) ListDir(snapshotID, dir string) ([]SnapshotEntry, error) {
+	collections, err := mc.fileCollections(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		prefix = dir + "/"
+	}
+	match := bson.D{{Key: "$match", Value: bson.M{
+		"relpath":        bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)},
+		"denied":         bson.M{"$ne": true},
+		"checksumfailed": bson.M{"$ne": true},
+	}}}
+	pipeline := mongo.Pipeline{match}
+	for _, name := range collections[1:] {
+		pipeline = append(pipeline, bson.D{{Key: "$unionWith", Value: bson.M{"coll": name, "pipeline": mongo.Pipeline{match}}}})
+	}
+	pipeline = append(pipeline,
+		// Sources recording the same path count it once.
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":        "$relpath",
+			"size":       bson.M{"$first": "$size"},
+			"mountpoint": bson.M{"$max": "$mountpoint"},
+		}}},
+		bson.D{{Key: "$project", Value: bson.M{
+			"size":       1,
+			"mountpoint": 1,
+			"names": bson.M{"$split": bson.A{
+				bson.M{"$substrCP": bson.A{"$_id", utf8.RuneCountInString(prefix), bson.M{"$strLenCP": "$_id"}}},
+				"/",
+			}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$arrayElemAt": bson.A{"$names", 0}},
+			"dir":   bson.M{"$max": bson.M{"$or": bson.A{bson.M{"$gt": bson.A{bson.M{"$size": "$names"}, 1}}, "$mountpoint"}}},
+			"size":  bson.M{"$sum": "$size"},
+			"files": bson.M{"$sum": bson.M{"$cond": bson.A{"$mountpoint", 0, 1}}},
+		}}},
+	)
+
+	collection := mc.database().Collection(collections[0])
+	cursor, err := collection.Aggregate(context.Background(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var entries []SnapshotEntry
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// browseRestore is the restore a browse session ended with: the selected
+// paths of a snapshot, size bytes, and where to restore them.
+type browseRestore struct {
+	snapshotID  string
+	paths       []string
+	size        int64
+	destination string
+}
+
+// The results of the reads a browseModel makes outside of Update.
+type (
+	snapshotsReadMsg struct {
+		snapshots []*Snapshot
+		err       error
+	}
+	snapshotOpenedMsg struct {
+		snapshot *Snapshot
+		root     *pathNode
+		err      error
+	}
+	dirListedMsg struct {
+		dir     *pathNode
+		entries []SnapshotEntry
+		err     error
+	}
+)
+
+const (
+	browseSnapshotsHelp = "↑/↓ move  enter open  q quit"
+	browseTreeHelp      = "↑/↓ move  enter/→ open  ←/backspace up  space select  r restore  esc snapshots  q quit"
+	browsePromptHelp    = "enter restore  esc cancel"
+)
+
+// browseModel is the terminal UI of browse: it lists the snapshots, walks
+// the tree of one, reading each directory when it is first opened, and
+// ends with the files and directories selected to restore.
+type browseModel struct {
+	client    MongoDBClient
+	snapshots []*Snapshot
+	snapshot  *Snapshot
+	root, cwd *pathNode
+	// cursor is the row of the snapshot or entry the keys act on, and
+	// height that of the terminal.
+	cursor, height int
+	selected       map[string]bool
+	// loading is set while a read is made, which the keys but quit wait
+	// for.
+	loading bool
+	// prompting is set while the destination is typed.
+	prompting   bool
+	destination string
+	status      string
+	restore     *browseRestore
+}
+
+// newBrowseModel returns a browseModel starting at the list of snapshots,
+// or at the root of snapshotID if it isn't empty.
+func newBrowseModel(client MongoDBClient, snapshotID string) *browseModel {
+	m := &browseModel{client: client, loading: true}
+	if snapshotID != "" {
+		m.snapshot = &Snapshot{ID: snapshotID}
+	}
+	return m
+}
+
+func (m *browseModel) Init() tea.Cmd {
+	if m.snapshot != nil {
+		return m.open(m.snapshot.ID)
+	}
+	return m.readSnapshots
+}
+
+func (m *browseModel) readSnapshots() tea.Msg {
+	var snapshots []*Snapshot
+	err := m.client.ForEachSnapshot(func(snapshot *Snapshot) error {
+		snapshots = append(snapshots, snapshot)
+		return nil
+	})
+	return snapshotsReadMsg{snapshots: snapshots, err: err}
+}
+
+// open reads a snapshot and the entries of its root.
+func (m *browseModel) open(snapshotID string) tea.Cmd {
+	return func() tea.Msg {
+		snapshot, err := m.client.FindSnapshot(snapshotID)
+		if err != nil {
+			return snapshotOpenedMsg{err: fmt.Errorf("finding snapshot: %w", err)}
+		}
+		entries, err := m.client.ListDir(snapshot.ID, "")
+		if err != nil {
+			return snapshotOpenedMsg{err: fmt.Errorf("reading snapshot: %w", err)}
+		}
+		root := newPathDir("", nil)
+		root.list(entries)
+		for _, entry := range entries {
+			root.size += entry.Size
+			root.files += entry.Files
+		}
+		return snapshotOpenedMsg{snapshot: snapshot, root: root}
+	}
+}
+
+// listDir reads the entries of dir.
+func (m *browseModel) listDir(dir *pathNode) tea.Cmd {
+	snapshotID := m.snapshot.ID
+	return func() tea.Msg {
+		entries, err := m.client.ListDir(snapshotID, dir.path())
+		return dirListedMsg{dir: dir, entries: entries, err: err}
+	}
+}
+
+func (m *browseModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.height = msg.Height
+	case snapshotsReadMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.status = fmt.Sprintf("error: listing snapshots: %v", msg.err)
+			break
+		}
+		m.snapshots, m.cursor = msg.snapshots, 0
+	case snapshotOpenedMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.snapshot = nil
+			m.status = fmt.Sprintf("error: %v", msg.err)
+			if m.snapshots == nil {
+				m.loading = true
+				return m, m.readSnapshots
+			}
+			break
+		}
+		m.snapshot, m.root, m.cwd, m.cursor = msg.snapshot, msg.root, msg.root, 0
+		m.selected = make(map[string]bool)
+		m.status = fmt.Sprintf("snapshot %s: %d files, %d bytes", msg.snapshot.ID, msg.root.files, msg.root.size)
+	case dirListedMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.status = fmt.Sprintf("error: reading /%s: %v", msg.dir.path(), msg.err)
+			break
+		}
+		msg.dir.list(msg.entries)
+		m.cwd, m.cursor = msg.dir, 0
+	case tea.KeyMsg:
+		return m.key(msg)
+	}
+	return m, nil
+}
+
+func (m *browseModel) key(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	key := msg.String()
+	if key == "ctrl+c" {
+		return m, tea.Quit
+	}
+	if m.prompting {
+		return m.prompt(msg)
+	}
+	if key == "q" {
+		return m, tea.Quit
+	}
+	if m.loading {
+		return m, nil
+	}
+	m.status = ""
+
+	if m.snapshot == nil {
+		switch key {
+		case "up", "k":
+			m.move(-1, len(m.snapshots))
+		case "down", "j":
+			m.move(1, len(m.snapshots))
+		case "enter", "right", "l":
+			if m.cursor < len(m.snapshots) {
+				m.loading = true
+				m.snapshot = m.snapshots[m.cursor]
+				return m, m.open(m.snapshot.ID)
+			}
+		}
+		return m, nil
+	}
+
+	entries := m.cwd.entries()
+	var entry *pathNode
+	if m.cursor < len(entries) {
+		entry = entries[m.cursor]
+	}
+	switch key {
+	case "up", "k":
+		m.move(-1, len(entries))
+	case "down", "j":
+		m.move(1, len(entries))
+	case "enter", "right", "l":
+		if entry == nil || !entry.isDir() {
+			break
+		}
+		if !entry.listed {
+			m.loading = true
+			return m, m.listDir(entry)
+		}
+		m.cwd, m.cursor = entry, 0
+	case "left", "h", "backspace":
+		if m.cwd.parent == nil {
+			break
+		}
+		from := m.cwd
+		m.cwd, m.cursor = m.cwd.parent, 0
+		for i, entry := range m.cwd.entries() {
+			if entry == from {
+				m.cursor = i
+			}
+		}
+	case " ":
+		if entry == nil {
+			break
+		}
+		switch {
+		case m.selected[entry.path()]:
+			delete(m.selected, entry.path())
+		case m.isSelected(entry):
+			m.status = fmt.Sprintf("error: %s is selected with a directory above it, unselect that one", entry.path())
+		default:
+			m.selected[entry.path()] = true
+		}
+	case "r":
+		if len(m.selected) == 0 {
+			m.status = "error: nothing selected"
+			break
+		}
+		m.prompting, m.destination = true, ""
+	case "esc":
+		m.snapshot, m.root, m.cwd, m.cursor = nil, nil, nil, 0
+		if m.snapshots == nil {
+			m.loading = true
+			return m, m.readSnapshots
+		}
+	}
+	return m, nil
+}
+
+// prompt reads the destination to restore the selection to, and ends the
+// session with it on enter.
+func (m *browseModel) prompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		if m.destination == "" {
+			break
+		}
+		paths := m.selection()
+		var size int64
+		for _, path := range paths {
+			node, _ := m.root.lookup(path)
+			size += node.size
+		}
+		m.prompting = false
+		m.restore = &browseRestore{snapshotID: m.snapshot.ID, paths: paths, size: size, destination: m.destination}
+		return m, tea.Quit
+	case tea.KeyEsc:
+		m.prompting = false
+	case tea.KeyBackspace:
+		if m.destination != "" {
+			_, n := utf8.DecodeLastRuneInString(m.destination)
+			m.destination = m.destination[:len(m.destination)-n]
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.destination += string(msg.Runes)
+	}
+	return m, nil
+}
+
+// move moves the cursor by delta, within n rows.
+func (m *browseModel) move(delta, n int) {
+	m.cursor += delta
+	if m.cursor >= n {
+		m.cursor = n - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+}
+
+// isSelected reports whether n or a directory above it is selected.
+func (m *browseModel) isSelected(n *pathNode) bool {
+	for ; n != nil; n = n.parent {
+		if m.selected[n.path()] {
+			return true
+		}
+	}
+	return false
+}
+
+// selection returns the selected paths, sorted, leaving out those below
+// another selected directory.
+func (m *browseModel) selection() []string {
+	var paths []string
+	for path := range m.selected {
+		node, _ := m.root.lookup(path)
+		if !m.isSelected(node.parent) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (m *browseModel) View() string {
+	var header string
+	var rows []string
+	help := browseSnapshotsHelp
+	if m.snapshot == nil || m.root == nil {
+		header = "Snapshots"
+		for _, snapshot := range m.snapshots {
+			row := fmt.Sprintf("%s  %s  %s", snapshot.ID, time.Unix(0, snapshot.StartTime).Format(time.RFC3339), strings.Join(snapshot.SourcePaths(), ", "))
+			if snapshot.Note != "" {
+				row += "  " + snapshot.Note
+			}
+			rows = append(rows, row)
+		}
+	} else {
+		header = fmt.Sprintf("%s:/%s  (%d files, %d bytes, %d selected)", m.snapshot.ID, m.cwd.path(), m.cwd.files, m.cwd.size, len(m.selection()))
+		help = browseTreeHelp
+		for _, entry := range m.cwd.entries() {
+			mark := " "
+			if m.isSelected(entry) {
+				mark = "*"
+			}
+			if entry.isDir() {
+				rows = append(rows, fmt.Sprintf("%s %s/  (%d files, %d bytes)", mark, entry.name, entry.files, entry.size))
+			} else {
+				rows = append(rows, fmt.Sprintf("%s %s  (%d bytes)", mark, entry.name, entry.size))
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, header)
+	// The rows shown are those fitting the terminal below the header and
+	// above the status and help lines, scrolled to keep the cursor's.
+	top, bottom := 0, len(rows)
+	if visible := m.height - 3; m.height > 0 && visible < len(rows) {
+		if visible < 1 {
+			visible = 1
+		}
+		if m.cursor >= visible {
+			top = m.cursor - visible + 1
+		}
+		bottom = top + visible
+	}
+	for i := top; i < bottom; i++ {
+		cursor := "  "
+		if i == m.cursor {
+			cursor = "> "
+		}
+		fmt.Fprintln(&b, cursor+rows[i])
+	}
+	switch {
+	case m.prompting:
+		fmt.Fprintf(&b, "restore %d selected paths to (dir or sftp://user@host/dir): %s_\n", len(m.selection()), m.destination)
+		help = browsePromptHelp
+	case m.loading:
+		fmt.Fprintln(&b, "reading...")
+	default:
+		fmt.Fprintln(&b, m.status)
+	}
+	b.WriteString(help)
+	return b.String()
+}
+
+func runBrowse(args []string) error {
+	fs := flag.NewFlagSet("browse", flag.ExitOnError)
+	flags := addRestoreFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven browse [--force] [--hard-link] [--on-conflict policy] [--verify-on-restore=false] [--thaw-tier tier] [--thaw-days n] [--thaw-poll interval] [snapshot-id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most a snapshot")
+	}
+	if err := flags.validate(); err != nil {
+		return err
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	final, err := tea.NewProgram(newBrowseModel(client, fs.Arg(0)), tea.WithAltScreen()).Run()
+	if err != nil {
+		return err
+	}
+	request := final.(*browseModel).restore
+	if request == nil {
+		return nil
+	}
+
+	// The selection is restored once the UI is left, reporting progress
+	// as restore does.
+	engine := NewEngine(&Cfg, client, func() []Storage {
+		return newDestinations(NewS3Client(&Cfg.S3), &Cfg.Backup)
+	})
+	stats := NewStats()
+	sink, closeDestination, err := flags.open(request.destination, stats, func() (int64, error) {
+		return request.size, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer closeDestination()
+	stopProgress := reportProgress(stats, "restoring")
+	defer stopProgress()
+	if err := engine.RestoreSnapshot(request.snapshotID, sink, flags.options(stats, request.paths)); err != nil {
+		return err
+	}
+	log.Printf("restored %d selected paths of snapshot %s to %s", len(request.paths), request.snapshotID, request.destination)
+	return nil
+}
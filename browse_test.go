@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestBrowseTreeFromPaths(t *testing.T) {
+	root := newPathDir("", nil)
+	root.add("docs/a.txt", 10, false)
+	root.add("docs/deep/b.txt", 20, false)
+	root.add("top", 5, false)
+	root.add("mnt", 0, true)
+	// The same path from another source is counted once.
+	root.add("top", 5, false)
+
+	if root.files != 3 || root.size != 35 {
+		t.Errorf("root holds %d files of %d bytes, want 3 of 35", root.files, root.size)
+	}
+	var names []string
+	for _, entry := range root.entries() {
+		names = append(names, entry.name)
+	}
+	if want := []string{"docs", "mnt", "top"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("root lists %v, want %v", names, want)
+	}
+
+	docs, ok := root.lookup("docs")
+	if !ok || !docs.isDir() || docs.files != 2 || docs.size != 30 {
+		t.Fatalf("docs = %+v", docs)
+	}
+	b, ok := docs.lookup("deep/b.txt")
+	if !ok || b.isDir() || b.size != 20 || b.path() != "docs/deep/b.txt" {
+		t.Fatalf("deep/b.txt = %+v", b)
+	}
+	if node, ok := b.lookup("../../a.txt"); !ok || node.path() != "docs/a.txt" {
+		t.Errorf("../../a.txt from b.txt = %+v", node)
+	}
+	if node, ok := b.lookup("/top"); !ok || node.path() != "top" {
+		t.Errorf("/top from b.txt = %+v", node)
+	}
+	if node, ok := root.lookup("../.."); !ok || node != root {
+		t.Errorf("../.. from the root = %+v", node)
+	}
+	if mnt, ok := root.lookup("mnt"); !ok || !mnt.isDir() || mnt.files != 0 {
+		t.Errorf("mount point mnt = %+v", mnt)
+	}
+	if _, ok := root.lookup("docs/missing"); ok {
+		t.Error("found docs/missing")
+	}
+}
+
+// listCounter records the directories listed through it.
+type listCounter struct {
+	MongoDBClient
+	listed []string
+}
+
+func (c *listCounter) ListDir(snapshotID, dir string) ([]SnapshotEntry, error) {
+	c.listed = append(c.listed, dir)
+	return c.MongoDBClient.ListDir(snapshotID, dir)
+}
+
+// browseKey returns the message of pressing key, a name like enter or
+// the text typed.
+func browseKey(key string) tea.KeyMsg {
+	switch key {
+	case "enter":
+		return tea.KeyMsg{Type: tea.KeyEnter}
+	case "esc":
+		return tea.KeyMsg{Type: tea.KeyEsc}
+	case "left":
+		return tea.KeyMsg{Type: tea.KeyLeft}
+	case "down":
+		return tea.KeyMsg{Type: tea.KeyDown}
+	case "up":
+		return tea.KeyMsg{Type: tea.KeyUp}
+	case "space":
+		return tea.KeyMsg{Type: tea.KeySpace, Runes: []rune{' '}}
+	}
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)}
+}
+
+// browseRun feeds msg to m, then the results of the commands it returns,
+// as a program would, and reports whether m quit.
+func browseRun(m *browseModel, msg tea.Msg) bool {
+	for msg != nil {
+		if _, ok := msg.(tea.QuitMsg); ok {
+			return true
+		}
+		_, cmd := m.Update(msg)
+		if cmd == nil {
+			return false
+		}
+		msg = cmd()
+	}
+	return false
+}
+
+func TestBrowseModelRestoresSelection(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"keep/a.txt":     "a",
+		"keep/sub/b.txt": "b",
+		"skip/c.txt":     "c",
+		"one.txt":        "one",
+		"other.txt":      "other",
+	})
+	cfg := testBackupConfig(t)
+	engine, store, _ := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &listCounter{MongoDBClient: store}
+	m := newBrowseModel(client, "")
+	browseRun(m, m.Init()())
+	if !strings.Contains(m.View(), "> "+summary.SnapshotID) {
+		t.Fatalf("snapshots lack %s:\n%s", summary.SnapshotID, m.View())
+	}
+	press := func(keys ...string) bool {
+		for _, key := range keys {
+			if browseRun(m, browseKey(key)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Open the snapshot, keep/sub, and select b.txt in it.
+	press("enter", "enter", "enter", "space", "left")
+	if view := m.View(); !strings.Contains(view, ":/keep  (2 files, 2 bytes, 1 selected)") || !strings.Contains(view, ">   sub/") {
+		t.Errorf("back in keep:\n%s", view)
+	}
+	// Select keep, which b.txt is below, then try to unselect a.txt in it.
+	press("left", "space", "enter", "down", "space")
+	if !strings.Contains(m.View(), "error: keep/a.txt is selected with a directory above it") {
+		t.Errorf("unselected a.txt below keep:\n%s", m.View())
+	}
+	// Select skip and one.txt, and unselect skip again.
+	press("left", "down", "space", "space", "down", "space")
+	view := m.View()
+	for _, row := range []string{
+		"  * keep/  (2 files, 2 bytes)",
+		"    skip/  (1 files, 1 bytes)",
+		"> * one.txt  (3 bytes)",
+		"    other.txt  (5 bytes)",
+	} {
+		if !strings.Contains(view, row) {
+			t.Errorf("root lacks %q:\n%s", row, view)
+		}
+	}
+	// Only the directories opened were read.
+	if want := []string{"", "keep", "keep/sub"}; !reflect.DeepEqual(client.listed, want) {
+		t.Errorf("listed %q, want %q", client.listed, want)
+	}
+
+	dst := t.TempDir()
+	if press(append([]string{"r"}, strings.Split(dst, "")...)...) {
+		t.Fatal("quit while typing the destination")
+	}
+	if !press("enter") {
+		t.Fatal("didn't quit to restore")
+	}
+	request := m.restore
+	if request == nil || request.snapshotID != summary.SnapshotID || request.destination != dst {
+		t.Fatalf("restore request %+v", request)
+	}
+	if want := []string{"keep", "one.txt"}; !reflect.DeepEqual(request.paths, want) {
+		t.Errorf("restoring %v, want %v", request.paths, want)
+	}
+	if request.size != 5 {
+		t.Errorf("restoring %d bytes, want 5", request.size)
+	}
+	if err := engine.RestoreSnapshot(request.snapshotID, NewLocalSink(dst, conflictOverwrite), RestoreOptions{Paths: request.paths}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"keep/a.txt": "a", "keep/sub/b.txt": "b", "one.txt": "one"}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+}
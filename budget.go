@@ -0,0 +1,53 @@
+package main
+
+import "sync"
+
+// Budget bounds how many heavy operations, hashing a file or uploading an
+// object, run at once across the whole backup. A nil Budget, or one with a
+// limit of 0, is unlimited.
+type Budget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+// NewBudget creates a new instance of Budget allowing n concurrent
+// operations, or no limit when n isn't positive.
+func NewBudget(n int) *Budget {
+	b := &Budget{}
+	b.cond = sync.NewCond(&b.mu)
+	b.SetLimit(n)
+	return b
+}
+
+// SetLimit changes how many operations may run at once. Operations already
+// running over a lowered limit finish, new ones wait until they have.
+func (b *Budget) SetLimit(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	b.limit = n
+	b.cond.Broadcast()
+}
+
+// Acquire blocks until a slot is free and returns the function releasing it.
+func (b *Budget) Acquire() func() {
+	if b == nil {
+		return func() {}
+	}
+	b.mu.Lock()
+	for b.limit > 0 && b.used >= b.limit {
+		b.cond.Wait()
+	}
+	b.used++
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		b.used--
+		b.cond.Signal()
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// runBudgeted runs n operations at once under budget and returns how many
+// ran concurrently at most.
+func runBudgeted(budget *Budget, n int) int {
+	var (
+		mu        sync.Mutex
+		running   int
+		most      int
+		wg        sync.WaitGroup
+		heavyWork = func() { time.Sleep(5 * time.Millisecond) }
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := budget.Acquire()
+			defer release()
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			heavyWork()
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return most
+}
+
+func TestBudgetBoundsConcurrency(t *testing.T) {
+	if most := runBudgeted(NewBudget(3), 30); most > 3 {
+		t.Fatalf("%d operations ran at once with a budget of 3", most)
+	}
+	if most := runBudgeted(NewBudget(0), 30); most < 2 {
+		t.Fatalf("at most %d operations ran at once without a limit", most)
+	}
+	if most := runBudgeted(nil, 30); most < 2 {
+		t.Fatalf("at most %d operations ran at once with a nil budget", most)
+	}
+}
+
+func TestBudgetSetLimit(t *testing.T) {
+	budget := NewBudget(1)
+	release := budget.Acquire()
+	acquired := make(chan func())
+	go func() { acquired <- budget.Acquire() }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a second slot of a budget of 1")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Raising the limit lets the waiting operation run.
+	budget.SetLimit(2)
+	select {
+	case second := <-acquired:
+		second()
+	case <-time.After(5 * time.Second):
+		t.Fatal("raising the limit didn't wake the waiting operation")
+	}
+	release()
+
+	budget.SetLimit(1)
+	if most := runBudgeted(budget, 30); most > 1 {
+		t.Fatalf("%d operations ran at once after lowering the budget to 1", most)
+	}
+}
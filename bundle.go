@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bundler packs the files of each directory into one tar object, keyed by
+// the tar's content hash, so archival workloads don't pay per-object
+// overhead for every small file.
+type Bundler struct {
+	uploader *Uploader
+	pipeline *Pipeline
+	tracer   *Tracer
+	cfg      *BackupConfig
+}
+
+// NewBundler creates a new instance of Bundler. Bundles go through the
+// configured transforms, with gzip added when none of them compresses.
+func NewBundler(uploader *Uploader, cfg *BackupConfig, tracer *Tracer) (*Bundler, error) {
+	pipeline, err := NewPipeline(bundleTransforms(cfg.Transforms))
+	if err != nil {
+		return nil, err
+	}
+	return &Bundler{uploader: uploader, pipeline: pipeline, tracer: tracer, cfg: cfg}, nil
+}
+
+func bundleTransforms(names []string) []string {
+	for _, name := range names {
+		if factory, ok := transformRegistry[name]; ok && factory.stage == stageCompress {
+			return names
+		}
+	}
+	return append([]string{"gzip"}, names...)
+}
+
+// Run reads scanned files from in and writes them to out once stored,
+// closing out when in is drained. Files that aren't bundled pass straight
+// through. The walk visits a directory's subtrees between its files, so a
+// directory is only bundled once the walk has left it.
+func (b *Bundler) Run(in <-chan FileMetadata, out chan<- FileMetadata) {
+	defer close(out)
+
+	pending := make(map[string][]FileMetadata)
+	for metadata := range in {
+		if planAction(&metadata, b.cfg) != actionBundle {
+			out <- metadata
+			continue
+		}
+
+		dir := filepath.Dir(metadata.Path)
+		for other, files := range pending {
+			if other != dir && !strings.HasPrefix(dir, other+string(filepath.Separator)) {
+				b.flush(other, files, out)
+				delete(pending, other)
+			}
+		}
+		pending[dir] = append(pending[dir], metadata)
+	}
+
+	for dir, files := range pending {
+		b.flush(dir, files, out)
+	}
+}
+
+// flush stores the bundle of dir and sends its files to out. If the bundle
+// can't be stored the files are sent without a bundle key, and the Uploader
+// stores them one by one.
+func (b *Bundler) flush(dir string, files []FileMetadata, out chan<- FileMetadata) {
+	endSpan := b.tracer.Start(dir, "bundle")
+	bundled, err := b.store(dir, files)
+	endSpan()
+	if err != nil {
+		log.Printf("bundling [%s] failed, uploading its files separately: %v", dir, err)
+	}
+	for _, metadata := range bundled {
+		out <- metadata
+	}
+}
+
+func (b *Bundler) store(dir string, files []FileMetadata) ([]FileMetadata, error) {
+	tmp, err := os.CreateTemp(tempDir(b.cfg), "bundle-*.tar")
+	if err != nil {
+		return files, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := newHash(b.cfg.HashAlgorithm)
+	tw := tar.NewWriter(io.MultiWriter(tmp, h))
+
+	// Files that can't be read now are left out of the bundle and handed to
+	// the Uploader, which reports them like any other failed file.
+	var members, skipped []FileMetadata
+	for _, metadata := range files {
+		if err := addToBundle(tw, metadata.contentPath(), metadata.Name); err != nil {
+			log.Printf("adding [%s] to bundle failed: %v", metadata.Path, err)
+			skipped = append(skipped, metadata)
+			continue
+		}
+		members = append(members, metadata)
+	}
+	if err := tw.Close(); err != nil {
+		return files, err
+	}
+	if len(members) == 0 {
+		return skipped, nil
+	}
+
+	key := b.uploader.scopedKey(dir, formatHash(b.cfg.HashAlgorithm, h))
+	unlock := b.uploader.storing.Lock(key)
+	defer unlock()
+	transforms, held, ok := b.uploader.storedAlready(dir, key, b.pipeline)
+	var statuses []DestinationStatus
+	if ok {
+		log.Printf("bundle %s of [%s] is stored already", key, dir)
+	} else {
+		transforms, statuses, err = b.uploader.store(key, tmp.Name(), b.pipeline, held)
+		if err != nil {
+			return files, err
+		}
+		if storedInAll(statuses) {
+			b.uploader.dedup.Add(key, transforms)
+		}
+		log.Printf("stored %d files of [%s] in bundle %s", len(members), dir, key)
+	}
+
+	for i := range members {
+		members[i].BundleKey = key
+		members[i].BundlePath = members[i].Name
+		members[i].Transforms = transforms
+		members[i].Destinations = statuses
+	}
+	return append(members, skipped...), nil
+}
+
+// addToBundle writes the file at path to tw as name.
+func addToBundle(tw *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// The header carries the size from Stat, so copy exactly that much in
+	// case the file grows while it is being read.
+	if _, err := io.CopyN(tw, file, info.Size()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bundleMember advances r, the content of a bundle, to the member called
+// name and returns a reader for that member's content.
+func bundleMember(r io.Reader, name string) (io.Reader, error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in bundle", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == name {
+			return tr, nil
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBundleRestoresMember(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a/one":   "first of a",
+		"a/two":   "second of a",
+		"a/three": "third of a",
+		"b/only":  "only of b",
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.Bundle = true
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One object per directory.
+	if keys := s3.keys(cfg.Bucket); len(keys) != 2 {
+		t.Fatalf("bucket holds %v, want a bundle per directory", keys)
+	}
+	var two *FileMetadata
+	err = store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		if metadata.BundleKey == "" || metadata.BundlePath != metadata.Name {
+			t.Errorf("%s recorded with bundle %q, member %q", metadata.RelPath, metadata.BundleKey, metadata.BundlePath)
+		}
+		if metadata.RelPath == "a/two" {
+			two = metadata
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single member is read out of its bundle.
+	body, err := s3.client().Download(cfg.Bucket, two.BundleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	content, err := Unwrap(body, two.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := bundleMember(content, two.BundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(member); string(got) != files["a/two"] {
+		t.Fatalf("member a/two holds %q, want %q", got, files["a/two"])
+	}
+
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+}
+
+func TestBundleStoredAlreadyIsKept(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	src := t.TempDir()
+	files := map[string]string{"a/one": "first of a", "b/only": "only of b"}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.Bundle = true
+	engine, store, s3 := testEngine(t, cfg)
+	first, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same bundles with encryption turned on aren't written again over
+	// those the first snapshot refers to.
+	engine.cfg.Backup.Transforms = []string{"aes-gcm"}
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("PUT"); n != 2 {
+		t.Fatalf("%d PUTs, want a bundle per directory once", n)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, first.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+}
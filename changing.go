@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Policies, chosen with backup.changing_files, for files whose size or
+// mtime changed while they were hashed.
+const (
+	// changingFlag stores the file as it is read, marking it Inconsistent.
+	changingFlag = "flag"
+	// changingSkip leaves the file out of the snapshot.
+	changingSkip = "skip"
+	// changingCopy copies the file to the temp dir and stores the copy,
+	// so the stored content matches its hash.
+	changingCopy = "copy"
+)
+
+func validateChangingPolicy(policy string) error {
+	switch policy {
+	case changingFlag, changingSkip, changingCopy:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q, expected %s, %s or %s", policy, changingFlag, changingSkip, changingCopy)
+	}
+}
+
+// fileChanged reports whether the size or mtime of path differ from info.
+func fileChanged(path string, info fs.FileInfo) (bool, error) {
+	current, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	return current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()), nil
+}
+
+// copyAndHash copies path into dir and hashes the copy while writing it. It
+// returns the copy's path, size and hash.
+func copyAndHash(path, dir, algorithm string) (string, int64, string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(dir, "copy-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	h := newHash(algorithm)
+	n, err := io.Copy(io.MultiWriter(dst, h), src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", 0, "", err
+	}
+	return dst.Name(), n, formatHash(algorithm, h), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// growOnStat is a trace output that appends to a file once the scan has
+// stat'ed it, so the file grows between its stat and its hash.
+type growOnStat struct {
+	path string
+}
+
+func (g growOnStat) Write(p []byte) (int, error) {
+	var span traceSpan
+	if err := json.Unmarshal(p, &span); err == nil && span.Phase == "stat" && span.Path == g.path {
+		f, err := os.OpenFile(g.path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		f.WriteString(" and more")
+	}
+	return len(p), nil
+}
+
+func TestChangingFilesPolicy(t *testing.T) {
+	tests := []struct {
+		policy       string
+		recorded     bool
+		inconsistent bool
+		copied       bool
+	}{
+		{changingFlag, true, true, false},
+		{changingSkip, false, false, false},
+		{changingCopy, true, false, true},
+	}
+	for _, tt := range tests {
+		src := t.TempDir()
+		writeFiles(t, src, map[string]string{"growing.log": "logged", "steady": "steady"})
+		growing := filepath.Join(src, "growing.log")
+		cfg := testBackupConfig(t)
+		cfg.ChangingFiles = tt.policy
+
+		metadataChan := make(chan FileMetadata, 1)
+		go scanSources([]SourceConfig{{Path: src}}, cfg, NewTracer(growOnStat{growing}), NewGate(), nil, nil, metadataChan)
+		var files []FileMetadata
+		for metadata := range metadataChan {
+			files = append(files, metadata)
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+		if !tt.recorded {
+			if got := relPaths(files); len(got) != 1 || got[0] != "steady" {
+				t.Errorf("%s: scanned %v, want only steady", tt.policy, got)
+			}
+			continue
+		}
+		if len(files) != 2 || files[1].Inconsistent {
+			t.Fatalf("%s: scanned %+v", tt.policy, files)
+		}
+		metadata := files[0]
+		if metadata.Inconsistent != tt.inconsistent {
+			t.Errorf("%s: inconsistent %v, want %v", tt.policy, metadata.Inconsistent, tt.inconsistent)
+		}
+		if copied := metadata.ContentPath != ""; copied != tt.copied {
+			t.Errorf("%s: content path %q", tt.policy, metadata.ContentPath)
+		}
+		// Either way the hash and size are those of the content stored.
+		if want := sha256Hash("logged and more"); metadata.Hash != want || metadata.Size != int64(len("logged and more")) {
+			t.Errorf("%s: recorded %d bytes hashing to %s, want the grown content", tt.policy, metadata.Size, metadata.Hash)
+		}
+		if tt.inconsistent && metadata.StatSize != int64(len("logged")) {
+			t.Errorf("%s: stat size %d, want %d", tt.policy, metadata.StatSize, len("logged"))
+		}
+	}
+}
+
+// truncateOnStat is a trace output that empties a file once the scan has
+// stat'ed it, so the file is truncated between its stat and its read.
+type truncateOnStat struct {
+	path string
+}
+
+func (tr truncateOnStat) Write(p []byte) (int, error) {
+	var span traceSpan
+	if err := json.Unmarshal(p, &span); err == nil && span.Phase == "stat" && span.Path == tr.path {
+		if err := os.Truncate(tr.path, 0); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func TestTruncatedBeforeRead(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"truncated": "about to go"})
+	truncated := filepath.Join(src, "truncated")
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Tracer: NewTracer(truncateOnStat{truncated})})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []*FileMetadata
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		files = append(files, metadata)
+		return nil
+	})
+	if len(files) != 1 {
+		t.Fatalf("recorded %d files, want 1", len(files))
+	}
+	metadata := files[0]
+	object := s3.get(cfg.Bucket, metadata.Hash)
+	if object == nil {
+		t.Fatalf("no object stored at %s", metadata.Hash)
+	}
+	// The record describes the bytes uploaded, not the stat.
+	if metadata.Hash != sha256Hash("") || metadata.Size != int64(len(object.data)) || metadata.Size != 0 {
+		t.Errorf("recorded %d bytes hashing to %s, uploaded %d", metadata.Size, metadata.Hash, len(object.data))
+	}
+	if !metadata.Inconsistent || metadata.StatSize != int64(len("about to go")) {
+		t.Errorf("truncation not flagged: inconsistent %v, stat size %d", metadata.Inconsistent, metadata.StatSize)
+	}
+}
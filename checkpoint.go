@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// hashCheckpoint is the persisted progress of hashing a large file. The
+// digest state of every hash algorithm is marshalable, so an interrupted
+// hash resumes from Offset and still yields the plain hash of the whole
+// file.
+type hashCheckpoint struct {
+	Path      string
+	Algorithm string
+	Size      int64
+	Mtime     int64
+	Offset    int64
+	State     []byte
+}
+
+func checkpointPath(dir, filePath string) string {
+	sum := sha256.Sum256([]byte(filePath))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// calculateHashResumable hashes filePath like calculateHash, but
+// saves its progress to checkpointDir every interval bytes. A checkpoint left
+// by an interrupted run is picked up if the file's size and mtime haven't
+// changed since.
+func calculateHashResumable(filePath string, info fs.FileInfo, algorithm, checkpointDir string, interval int64) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	ckptPath := checkpointPath(checkpointDir, filePath)
+	hash := newHash(algorithm)
+	ckpt := hashCheckpoint{Path: filePath, Algorithm: algorithm, Size: info.Size(), Mtime: info.ModTime().UnixNano()}
+
+	if saved, err := loadHashCheckpoint(ckptPath); err == nil && saved.Algorithm == ckpt.Algorithm && saved.Size == ckpt.Size && saved.Mtime == ckpt.Mtime {
+		if err := resumeHash(hash, file, saved); err == nil {
+			ckpt.Offset = saved.Offset
+		} else {
+			hash.Reset()
+		}
+	}
+
+	if err := os.MkdirAll(checkpointDir, 0o700); err != nil {
+		return "", 0, err
+	}
+
+	for {
+		n, err := io.CopyN(hash, file, interval)
+		ckpt.Offset += n
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		ckpt.State, err = hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return "", 0, err
+		}
+		if err := saveHashCheckpoint(ckptPath, &ckpt); err != nil {
+			return "", 0, err
+		}
+	}
+
+	os.Remove(ckptPath)
+
+	return formatHash(algorithm, hash), ckpt.Offset, nil
+}
+
+func resumeHash(h hash.Hash, file *os.File, ckpt *hashCheckpoint) error {
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(ckpt.State); err != nil {
+		return err
+	}
+	_, err := file.Seek(ckpt.Offset, io.SeekStart)
+	return err
+}
+
+func loadHashCheckpoint(path string) (*hashCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ckpt hashCheckpoint
+	if err := json.Unmarshal(data, &ckpt); err != nil {
+		return nil, err
+	}
+	return &ckpt, nil
+}
+
+func saveHashCheckpoint(path string, ckpt *hashCheckpoint) error {
+	return saveCheckpoint(path, ckpt)
+}
+
+// saveCheckpoint writes the checkpoint through a temp file and rename so a
+// crash mid-write never leaves a torn checkpoint behind.
+func saveCheckpoint(path string, ckpt any) error {
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
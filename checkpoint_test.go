@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashResumesFromCheckpoint(t *testing.T) {
+	const interval = 64 << 10
+	content := testLines(1, 10*interval+123)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, _, err := calculateHash(path, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The checkpoint a run interrupted after four intervals leaves behind.
+	checkpoints := filepath.Join(dir, "checkpoints")
+	if err := os.MkdirAll(checkpoints, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write(content[:4*interval])
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ckpt := &hashCheckpoint{Path: path, Algorithm: "sha256", Size: info.Size(), Mtime: info.ModTime().UnixNano(), Offset: 4 * interval, State: state}
+	if err := saveHashCheckpoint(checkpointPath(checkpoints, path), ckpt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the part already hashed, keeping size and mtime: only a
+	// hash resumed from the checkpoint still matches the original.
+	garbled := append([]byte(nil), content...)
+	for i := 0; i < 4*interval; i++ {
+		garbled[i] = '#'
+	}
+	if err := os.WriteFile(path, garbled, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path)
+
+	got, n, err := calculateHashResumable(path, info, "sha256", checkpoints, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want || n != int64(len(content)) {
+		t.Fatalf("resumed hash %s of %d bytes, want %s of %d", got, n, want, len(content))
+	}
+	if _, err := os.Stat(checkpointPath(checkpoints, path)); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint left after hashing completed: %v", err)
+	}
+}
+
+func TestHashIgnoresStaleCheckpoint(t *testing.T) {
+	const interval = 64 << 10
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big")
+	if err := os.WriteFile(path, testLines(2, 3*interval), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, _, err := calculateHash(path, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+
+	// A checkpoint of the file as it was before it was modified.
+	checkpoints := filepath.Join(dir, "checkpoints")
+	os.MkdirAll(checkpoints, 0o700)
+	h := sha256.New()
+	h.Write([]byte("other content"))
+	state, _ := h.(encoding.BinaryMarshaler).MarshalBinary()
+	stale := &hashCheckpoint{Path: path, Algorithm: "sha256", Size: info.Size(), Mtime: info.ModTime().Add(-time.Hour).UnixNano(), Offset: interval, State: state}
+	if err := saveHashCheckpoint(checkpointPath(checkpoints, path), stale); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := calculateHashResumable(path, info, "sha256", checkpoints, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("hash %s resumed from a stale checkpoint, want %s", got, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// What happens to a file whose upload keeps failing the server's checksum
+// check, chosen with backup.on_checksum_mismatch.
+const (
+	checksumAbort = "abort"
+	checksumSkip  = "skip"
+)
+
+// checksumMismatchCodes are the error codes S3 rejects a body with when it
+// doesn't match the checksum sent along.
+var checksumMismatchCodes = map[string]struct{}{
+	"BadDigest":                 {},
+	"InvalidDigest":             {},
+	"XAmzContentSHA256Mismatch": {},
+}
+
+func validateChecksumPolicy(policy string) error {
+	switch policy {
+	case checksumAbort, checksumSkip:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q, expected %s or %s", policy, checksumAbort, checksumSkip)
+	}
+}
+
+// isChecksumMismatch reports whether err is S3 rejecting a body that
+// doesn't match its checksum, as opposed to the request failing to arrive.
+// A multipart upload fails with the error of the part S3 rejected as its
+// OrigErr, which is looked at too.
+func isChecksumMismatch(err error) bool {
+	var aerr awserr.Error
+	for errors.As(err, &aerr) {
+		if _, ok := checksumMismatchCodes[aerr.Code()]; ok {
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// ChecksumError is an upload that failed the server's checksum check on
+// every attempt.
+type ChecksumError struct {
+	Key      string
+	Attempts int
+	Err      error
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s failed the checksum check %d times: %v", e.Key, e.Attempts, e.Err)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return e.Err
+}
+
+// uploadChecked uploads key to destination, uploading it again up to
+// retries times while the destination rejects it for a checksum mismatch.
+// Other errors are returned as they are, the retry queue deals with them.
+func (u *Uploader) uploadChecked(destination Storage, key, filePath string, pipeline *Pipeline) ([]TransformInfo, error) {
+	for attempt := 1; ; attempt++ {
+		transforms, err := destination.Upload(key, filePath, pipeline)
+		if err == nil || !isChecksumMismatch(err) {
+			return transforms, err
+		}
+		if attempt > u.cfg.ChecksumRetries {
+			return nil, &ChecksumError{Key: key, Attempts: attempt, Err: err}
+		}
+		log.Printf("[%s] failed the checksum check of %s, uploading it again: %v", filePath, destination.Name(), err)
+	}
+}
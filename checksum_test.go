@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestIsChecksumMismatch(t *testing.T) {
+	badDigest := awserr.New("BadDigest", "the Content-MD5 you specified did not match", nil)
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{badDigest, true},
+		{fmt.Errorf("upload key: %w", badDigest), true},
+		// A part rejected in a multipart upload.
+		{awserr.New("MultipartUpload", "upload multipart failed", badDigest), true},
+		{awserr.New("MultipartUpload", "upload multipart failed", awserr.New("RequestError", "send request failed", nil)), false},
+		{awserr.New("RequestError", "send request failed", errors.New("connection reset")), false},
+		{errors.New("BadDigest"), false},
+	}
+	for _, tt := range tests {
+		if got := isChecksumMismatch(tt.err); got != tt.want {
+			t.Errorf("isChecksumMismatch(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumMismatchPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		// op is the request rejected, attempt the one counting attempts.
+		op, attempt string
+		size        int
+		policy      string
+	}{
+		{"single put skipped", "PUT", "PUT", 100, checksumSkip},
+		{"single put aborting", "PUT", "PUT", 100, checksumAbort},
+		{"multipart skipped", "UPLOAD-PART", "CREATE-MULTIPART", 6 << 20, checksumSkip},
+		{"multipart aborting", "UPLOAD-PART", "CREATE-MULTIPART", 6 << 20, checksumAbort},
+	}
+	for _, tt := range tests {
+		captureOutput(t)
+		src := t.TempDir()
+		writeFiles(t, src, map[string]string{"file": string(testLines(1, tt.size))})
+		cfg := testBackupConfig(t)
+		cfg.ChecksumRetries = 2
+		cfg.OnChecksumMismatch = tt.policy
+		engine, store, s3 := testEngine(t, cfg)
+		// Every upload of the object is rejected for its checksum.
+		s3.fail(tt.op, "BadDigest")
+
+		summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: "s1"})
+		// The upload and its 2 retries, the retry queue doesn't try again.
+		if n := s3.count(tt.attempt); n != 3 {
+			t.Errorf("%s: %d attempts, want 3", tt.name, n)
+		}
+		if s3.get(cfg.Bucket, sha256Hash(string(testLines(1, tt.size)))) != nil {
+			t.Errorf("%s: content stored", tt.name)
+		}
+		var checksumErr *ChecksumError
+		switch tt.policy {
+		case checksumSkip:
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			var recorded []*FileMetadata
+			store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+				recorded = append(recorded, metadata)
+				return nil
+			})
+			if len(recorded) != 1 || !recorded[0].ChecksumFailed || recorded[0].objectKey() != "" {
+				t.Errorf("%s: recorded %+v, want the file marked as failing the checksum", tt.name, recorded)
+			}
+		case checksumAbort:
+			if !errors.As(err, &checksumErr) || checksumErr.Attempts != 3 {
+				t.Errorf("%s: Backup = %v, want a checksum error after 3 attempts", tt.name, err)
+			}
+		}
+	}
+}
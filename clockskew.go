@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxClockSkew is how far S3 lets a request's signing time be from its own
+// clock.
+const maxClockSkew = 15 * time.Minute
+
+// clockSkewCodes are the error codes S3 answers a request signed at the
+// wrong time with.
+var clockSkewCodes = map[string]struct{}{
+	"RequestTimeTooSkewed": {},
+	"RequestExpired":       {},
+}
+
+// clockSkew is the offset of the server's clock from the local one, as
+// learned from the Date header of rejected requests.
+type clockSkew struct {
+	offset int64
+}
+
+func (s *clockSkew) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&s.offset)))
+}
+
+// serverOffset returns how far the Date of the response to r is from the
+// local clock.
+func serverOffset(r *request.Request) (time.Duration, bool) {
+	if r.HTTPResponse == nil {
+		return 0, false
+	}
+	date, err := http.ParseTime(r.HTTPResponse.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	return time.Until(date), true
+}
+
+// isClockSkew reports whether r failed because it was signed at the wrong
+// time, and by how far the clocks are off when the server said. Signature
+// errors, and HEAD responses which carry no error code, count when the
+// server's Date is too far off.
+func isClockSkew(r *request.Request) (time.Duration, bool) {
+	aerr, ok := r.Error.(awserr.Error)
+	if !ok {
+		return 0, false
+	}
+	offset, known := serverOffset(r)
+	if _, ok := clockSkewCodes[aerr.Code()]; ok {
+		return offset, true
+	}
+	if r.HTTPResponse != nil && r.HTTPResponse.StatusCode == http.StatusForbidden && known {
+		return offset, offset > maxClockSkew || offset < -maxClockSkew
+	}
+	return 0, false
+}
+
+// handleClockSkew makes svc explain failures caused by the local clock
+// being off. With correct, requests are signed with the server's time as
+// learned from the failed request, which is retried.
+func handleClockSkew(svc *s3.S3, correct bool) {
+	skew := &clockSkew{}
+	if correct {
+		svc.Handlers.Sign.SwapNamed(request.NamedHandler{
+			Name: v4.SignRequestHandler.Name,
+			Fn: func(r *request.Request) {
+				v4.SignSDKRequestWithCurrentTime(r, skew.now, func(s *v4.Signer) {
+					s.DisableURIPathEscaping = true
+				})
+			},
+		})
+		svc.Handlers.Retry.PushBack(func(r *request.Request) {
+			offset, ok := isClockSkew(r)
+			if !ok || offset > -time.Second && offset < time.Second || r.RetryCount > 0 {
+				return
+			}
+			atomic.StoreInt64(&skew.offset, int64(offset))
+			r.Retryable = aws.Bool(true)
+		})
+	}
+
+	// Once the retry handlers left an error, it is the one returned.
+	svc.Handlers.AfterRetry.PushBack(func(r *request.Request) {
+		offset, ok := isClockSkew(r)
+		if !ok {
+			return
+		}
+		aerr := r.Error.(awserr.Error)
+		msg := "the request was rejected as signed at the wrong time, check the system clock and NTP"
+		if offset != 0 {
+			msg = fmt.Sprintf("the local clock is %s off from the server's, check the system clock and NTP", offset.Round(time.Second))
+		}
+		if !correct {
+			msg += ", or set correct_clock_skew"
+		}
+		err := awserr.New(aerr.Code(), msg, aerr)
+		if rerr, ok := aerr.(awserr.RequestFailure); ok {
+			r.Error = awserr.NewRequestFailure(err, rerr.StatusCode(), rerr.RequestID())
+		} else {
+			r.Error = err
+		}
+	})
+}
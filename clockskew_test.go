@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// skewedS3 is an S3 endpoint whose clock is ahead by an hour. It rejects
+// requests signed too far from its time, as S3 does, and accepts others.
+func skewedS3(t *testing.T, requests *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		now := time.Now().Add(time.Hour)
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		signed, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil || now.Sub(signed) > maxClockSkew || signed.Sub(now) > maxClockSkew {
+			s3Error(w, http.StatusForbidden, "RequestTimeTooSkewed")
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClockSkew(t *testing.T) {
+	tests := []struct {
+		correct  bool
+		requests int32
+	}{
+		// The error explains itself, the SDK doesn't retry it.
+		{false, 1},
+		// Signed again with the server's time, the retry succeeds.
+		{true, 2},
+	}
+	for _, tt := range tests {
+		var requests int32
+		server := skewedS3(t, &requests)
+		client := NewS3Client(&S3Config{Region: "us-east-1", Endpoint: server.URL, AccessKey: "access", SecretKey: "secret", CorrectClockSkew: tt.correct})
+		err := client.putObject("datahaven", "key", strings.NewReader("content"), nil)
+
+		if tt.correct && err != nil {
+			t.Errorf("correcting: %v", err)
+		}
+		if !tt.correct {
+			if err == nil {
+				t.Fatal("not correcting: request signed an hour off succeeded")
+			}
+			for _, want := range []string{"RequestTimeTooSkewed", "off from the server's", "check the system clock and NTP", "set correct_clock_skew"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("not correcting: error %q doesn't mention %q", err, want)
+				}
+			}
+		}
+		if n := atomic.LoadInt32(&requests); n != tt.requests {
+			t.Errorf("correct %v: %d requests, want %d", tt.correct, n, tt.requests)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandPrefix marks a source that is the output of a command, such as
+// "cmd:pg_dump mydb", rather than a directory tree. Its stdout is backed up
+// as a single file named after the source's Label.
+const commandPrefix = "cmd:"
+
+// command returns the shell command of a command source.
+func (s *SourceConfig) command() (string, bool) {
+	return strings.CutPrefix(s.Path, commandPrefix)
+}
+
+func validateCommandSource(source *SourceConfig) error {
+	command, ok := source.command()
+	if !ok {
+		return nil
+	}
+	if strings.TrimSpace(command) == "" {
+		return fmt.Errorf("source %s has no command", source.Path)
+	}
+	if source.Label == "" {
+		return fmt.Errorf("source %s needs a label to name its output", source.Path)
+	}
+	return nil
+}
+
+// scanCommand runs the command of source and sends its output as one file.
+// The output is spilled to the temp dir to be hashed and uploaded from
+// there. A command that fails marks its source as failed, which fails the
+// run.
+func scanCommand(source *SourceConfig, command string, cfg *BackupConfig, tracer *Tracer, budget *Budget, metadataChan chan FileMetadata) {
+	path := source.Path
+
+	release := budget.Acquire()
+	endSpan := tracer.Start(path, "command")
+	contentPath, size, hash, err := runSourceCommand(command, tempDir(cfg), cfg.HashAlgorithm)
+	endSpan()
+	release()
+	if err != nil {
+		log.Printf("source [%s] failed: %v", path, err)
+		source.failed = err
+		return
+	}
+
+	now := time.Now().UnixNano()
+	metadata := FileMetadata{
+		Ctime:       now,
+		Mtime:       now,
+		Atime:       now,
+		Name:        source.Label,
+		Path:        path,
+		RelPath:     source.Label,
+		Size:        size,
+		Uid:         os.Getuid(),
+		Gid:         os.Getgid(),
+		Hash:        hash,
+		ContentPath: contentPath,
+	}
+	log.Printf("source [%s] produced %d bytes", path, size)
+	if _, ok := denySet(cfg.DenyHashes)[hash]; ok {
+		log.Printf("[%s] matches deny-listed hash %s, it won't be uploaded", path, hash)
+		metadata.Denied = true
+	}
+	metadataChan <- metadata
+}
+
+// runSourceCommand runs command with the shell and copies its stdout into
+// dir, hashing it on the way. It returns the copy's path, size and hash.
+// Stderr goes to the log.
+func runSourceCommand(command, dir, algorithm string) (string, int64, string, error) {
+	dst, err := os.CreateTemp(dir, "command-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = logOutput
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", 0, "", err
+	}
+	if err := cmd.Start(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", 0, "", err
+	}
+
+	h := newHash(algorithm)
+	n, err := io.Copy(io.MultiWriter(dst, h), stdout)
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", 0, "", err
+	}
+	return dst.Name(), n, formatHash(algorithm, h), nil
+}
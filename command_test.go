@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandSource(t *testing.T) {
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	source := SourceConfig{Path: `cmd:printf 'line one\nline two\n'`, Label: "dump.sql"}
+	summary, err := engine.Backup(context.Background(), []SourceConfig{source}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := engine.Restore(bundle, hashCheckSink{NewLocalSink(dst, conflictOverwrite)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readDir(t, dst), map[string]string{"dump.sql": "line one\nline two\n"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %v, want %v", got, want)
+	}
+	// Nothing of the output is left behind in the temp dir.
+	if leftover, _ := filepath.Glob(filepath.Join(cfg.TempDir, "command-*")); len(leftover) > 0 {
+		t.Errorf("output left in the temp dir: %v", leftover)
+	}
+}
+
+func TestCommandSourceFails(t *testing.T) {
+	captureOutput(t)
+	cfg := testBackupConfig(t)
+	engine, _, _ := testEngine(t, cfg)
+	// Some output is produced before the command fails, as a dump cut
+	// short would.
+	source := SourceConfig{Path: "cmd:echo partial; exit 3", Label: "dump.sql"}
+	_, err := engine.Backup(context.Background(), []SourceConfig{source}, BackupOptions{})
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("Backup = %v, want the command's exit status", err)
+	}
+}
+
+func TestCommandSourceDenied(t *testing.T) {
+	captureOutput(t)
+	cfg := testBackupConfig(t)
+	cfg.DenyHashes = []string{sha256Hash("secret\n")}
+	engine, store, s3 := testEngine(t, cfg)
+	source := SourceConfig{Path: "cmd:echo secret", Label: "dump.sql"}
+	summary, err := engine.Backup(context.Background(), []SourceConfig{source}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := s3.keys(cfg.Bucket); len(keys) != 0 {
+		t.Fatalf("deny-listed output uploaded as %v", keys)
+	}
+	var denied bool
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		denied = metadata.RelPath == "dump.sql" && metadata.Denied
+		return nil
+	})
+	if !denied {
+		t.Error("output not recorded as denied")
+	}
+}
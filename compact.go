@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionSize is what collStats reports about a collection's footprint.
+type collectionSize struct {
+	Size           int64 `bson:"size"`
+	StorageSize    int64 `bson:"storageSize"`
+	TotalIndexSize int64 `bson:"totalIndexSize"`
+}
+
+func (s collectionSize) String() string {
+	return fmt.Sprintf("%d bytes data, %d bytes storage, %d bytes indexes", s.Size, s.StorageSize, s.TotalIndexSize)
+}
+
+func (s *collectionSize) add(other collectionSize) {
+	s.Size += other.Size
+	s.StorageSize += other.StorageSize
+	s.TotalIndexSize += other.TotalIndexSize
+}
+
+func (mc *MongoClient) collectionSize(name string) (collectionSize, error) {
+	var size collectionSize
+	err := mc.database().RunCommand(context.Background(), bson.D{{Key: "collStats", Value: name}}).Decode(&size)
+	return size, err
+}
+
+// rebuildIndexes drops and recreates the secondary indexes of a collection
+// and returns how many were rebuilt. The _id index can't be dropped and is
+// left as it is.
+func (mc *MongoClient) rebuildIndexes(name string) (int, error) {
+	indexes := mc.database().Collection(name).Indexes()
+
+	cursor, err := indexes.List(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var specs []bson.M
+	if err := cursor.All(context.Background(), &specs); err != nil {
+		return 0, err
+	}
+
+	var models []mongo.IndexModel
+	for _, spec := range specs {
+		if spec["name"] == "_id_" {
+			continue
+		}
+		models = append(models, indexModelFromSpec(spec))
+	}
+	if len(models) == 0 {
+		return 0, nil
+	}
+
+	if _, err := indexes.DropAll(context.Background()); err != nil {
+		return 0, err
+	}
+	for _, model := range models {
+		if _, err := indexes.CreateOne(context.Background(), model); err != nil {
+			return 0, fmt.Errorf("recreating index %s: %w", *model.Options.Name, err)
+		}
+	}
+	return len(models), nil
+}
+
+// indexModelFromSpec turns an index spec, as listed by listIndexes, back
+// into the model that creates it.
+func indexModelFromSpec(spec bson.M) mongo.IndexModel {
+	opts := options.Index()
+	name, _ := spec["name"].(string)
+	opts.SetName(name)
+	if unique, ok := spec["unique"].(bool); ok {
+		opts.SetUnique(unique)
+	}
+	if sparse, ok := spec["sparse"].(bool); ok {
+		opts.SetSparse(sparse)
+	}
+	if filter, ok := spec["partialFilterExpression"]; ok {
+		opts.SetPartialFilterExpression(filter)
+	}
+	switch ttl := spec["expireAfterSeconds"].(type) {
+	case int32:
+		opts.SetExpireAfterSeconds(ttl)
+	case int64:
+		opts.SetExpireAfterSeconds(int32(ttl))
+	case float64:
+		opts.SetExpireAfterSeconds(int32(ttl))
+	}
+	return mongo.IndexModel{Keys: spec["key"], Options: opts}
+}
+
+func (mc *MongoClient) compactCollection(name string) error {
+	return mc.database().RunCommand(context.Background(), bson.D{{Key: "compact", Value: name}}).Err()
+}
+
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	mongoCompact := fs.Bool("mongo-compact", false, "also run MongoDB's compact on every collection, which can block other operations while it runs")
+	yes := fs.Bool("yes", false, "rebuild indexes (and compact), without it only sizes are reported")
+	fs.Parse(args)
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	collections := []string{snapshotsCollection}
+	err = client.ForEachSnapshot(func(snapshot *Snapshot) error {
+		collections = append(collections, snapshot.fileCollections()...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing snapshots: %w", err)
+	}
+
+	var before, after collectionSize
+	for _, name := range collections {
+		size, err := client.collectionSize(name)
+		if err != nil {
+			return fmt.Errorf("reading size of %s: %w", name, err)
+		}
+		before.add(size)
+		if !*yes {
+			fmt.Printf("%s: %s\n", name, size)
+			continue
+		}
+
+		rebuilt, err := client.rebuildIndexes(name)
+		if err != nil {
+			return fmt.Errorf("rebuilding indexes of %s: %w", name, err)
+		}
+		if *mongoCompact {
+			if err := client.compactCollection(name); err != nil {
+				return fmt.Errorf("compacting %s: %w", name, err)
+			}
+		}
+
+		compacted, err := client.collectionSize(name)
+		if err != nil {
+			return fmt.Errorf("reading size of %s: %w", name, err)
+		}
+		after.add(compacted)
+		fmt.Printf("%s: %d indexes rebuilt, %s -> %s\n", name, rebuilt, size, compacted)
+	}
+
+	fmt.Printf("total before: %s\n", before)
+	if !*yes {
+		fmt.Println("Nothing changed, run with --yes to rebuild indexes.")
+		return nil
+	}
+	fmt.Printf("total after:  %s\n", after)
+	return nil
+}
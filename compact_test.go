@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestIndexModelFromSpec(t *testing.T) {
+	spec := bson.M{
+		"name":                    "path_1",
+		"key":                     bson.D{{Key: "path", Value: 1}},
+		"unique":                  true,
+		"sparse":                  true,
+		"partialFilterExpression": bson.M{"size": bson.M{"$gt": 0}},
+		"expireAfterSeconds":      int32(60),
+	}
+	model := indexModelFromSpec(spec)
+	opts := model.Options
+	if *opts.Name != "path_1" || !*opts.Unique || !*opts.Sparse || *opts.ExpireAfterSeconds != 60 {
+		t.Fatalf("options %+v", opts)
+	}
+	if !reflect.DeepEqual(model.Keys, spec["key"]) || !reflect.DeepEqual(opts.PartialFilterExpression, spec["partialFilterExpression"]) {
+		t.Fatalf("model %+v from spec %v", model, spec)
+	}
+}
+
+// testMongoClient connects to the MongoDB at DATAHAVEN_TEST_MONGODB, as
+// host:port, with DATAHAVEN_TEST_MONGODB_USER and _PASSWORD. Tests using it
+// are skipped without it, and use a tenant of their own.
+func testMongoClient(t *testing.T) *MongoClient {
+	t.Helper()
+	addr := os.Getenv("DATAHAVEN_TEST_MONGODB")
+	if addr == "" {
+		t.Skip("DATAHAVEN_TEST_MONGODB isn't set")
+	}
+	host, port, _ := strings.Cut(addr, ":")
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("DATAHAVEN_TEST_MONGODB %q: %v", addr, err)
+	}
+	client, err := NewMongoClient(&MongoDBConfig{
+		Host: host, Port: portNumber,
+		User: os.Getenv("DATAHAVEN_TEST_MONGODB_USER"), Password: os.Getenv("DATAHAVEN_TEST_MONGODB_PASSWORD"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.tenant = "test-" + strconv.FormatInt(int64(os.Getpid()), 10)
+	t.Cleanup(func() {
+		client.database().Drop(context.Background())
+		client.Close()
+	})
+	return client
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	client := testMongoClient(t)
+	collection := client.database().Collection("s1")
+	if _, err := collection.InsertOne(context.Background(), FileMetadata{Path: "/src/a", Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "path", Value: 1}},
+		Options: options.Index().SetName("path_1").SetUnique(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := client.rebuildIndexes("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt != 1 {
+		t.Fatalf("%d indexes rebuilt, want 1", rebuilt)
+	}
+	cursor, err := collection.Indexes().List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var specs []bson.M
+	if err := cursor.All(context.Background(), &specs); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec["name"].(string))
+		if spec["name"] == "path_1" && spec["unique"] != true {
+			t.Errorf("path_1 rebuilt without unique")
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"_id_", "path_1"}) {
+		t.Fatalf("indexes %v after rebuilding", names)
+	}
+	if _, err := client.collectionSize("s1"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// What restoring does with a file whose path already exists below the
+// destination, chosen with restore-export --on-conflict.
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictRename    = "rename"
+	conflictNewer     = "newer"
+)
+
+var conflictPolicies = []string{conflictOverwrite, conflictSkip, conflictRename, conflictNewer}
+
+// errConflictSkipped is returned by an OutputSink's WriteFile for a file left
+// alone because its path exists, before any of the content is read.
+var errConflictSkipped = errors.New("existing file kept")
+
+func validateConflictPolicy(policy string) error {
+	for _, p := range conflictPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown policy %q, expected one of %s", policy, strings.Join(conflictPolicies, ", "))
+}
+
+// resolveConflict returns where the file of metadata is written under
+// policy when target is its path, or errConflictSkipped. lstat looks paths
+// up in the destination, failing with fs.ErrNotExist for missing ones.
+func resolveConflict(policy string, metadata *FileMetadata, target string, lstat func(string) (fs.FileInfo, error)) (string, error) {
+	info, err := lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch policy {
+	case conflictSkip:
+		return "", errConflictSkipped
+	case conflictNewer:
+		// A backup that didn't record the mtime isn't known to be newer.
+		if !time.Unix(0, metadata.Mtime).After(info.ModTime()) {
+			return "", errConflictSkipped
+		}
+		return target, nil
+	case conflictRename:
+		for i := 1; ; i++ {
+			renamed := fmt.Sprintf("%s.restored-%d", target, i)
+			if _, err := lstat(renamed); errors.Is(err, fs.ErrNotExist) {
+				return renamed, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	default:
+		return target, nil
+	}
+}
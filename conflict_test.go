@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestoreConflictPolicies(t *testing.T) {
+	older := time.Now().Add(-time.Hour).UnixNano()
+	newer := time.Now().Add(time.Hour).UnixNano()
+	// c shares a's object, so it restores whether a is written or kept.
+	files := []*FileMetadata{
+		{RelPath: "a", Size: 8, Hash: "sha256:aa", Mtime: older},
+		{RelPath: "b", Size: 8, Hash: "sha256:bb", Mtime: newer},
+		{RelPath: "c", Size: 8, Hash: "sha256:aa", Mtime: older},
+	}
+	bundle := writeTestBundle(t, &Snapshot{ID: "s1"}, files, map[string][]byte{
+		"sha256:aa": []byte("backup a"),
+		"sha256:bb": []byte("backup b"),
+	})
+
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{conflictOverwrite, map[string]string{"a": "backup a", "b": "backup b", "c": "backup a"}},
+		{conflictSkip, map[string]string{"a": "existing a", "b": "existing b", "c": "backup a"}},
+		{conflictRename, map[string]string{
+			"a": "existing a", "a.restored-1": "backup a",
+			"b": "existing b", "b.restored-1": "backup b",
+			"c": "backup a",
+		}},
+		{conflictNewer, map[string]string{"a": "existing a", "b": "backup b", "c": "backup a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"a": "existing a", "b": "existing b"})
+			if err := RestoreFromBundle(bundle, NewLocalSink(dir, tt.policy), NewStats()); err != nil {
+				t.Fatal(err)
+			}
+			if got := readDir(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("restored %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateConflictPolicy(t *testing.T) {
+	for _, policy := range conflictPolicies {
+		if err := validateConflictPolicy(policy); err != nil {
+			t.Errorf("validateConflictPolicy(%q) = %v", policy, err)
+		}
+	}
+	if err := validateConflictPolicy("merge"); err == nil {
+		t.Error("validateConflictPolicy accepted an unknown policy")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gate lets callers through unless it is paused, in which case they block
+// until it is resumed. A gate with windows also holds callers outside of
+// them.
+type Gate struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	paused  bool
+	windows *UploadWindows
+}
+
+// NewGate creates a new instance of Gate, initially open.
+func NewGate() *Gate {
+	g := &Gate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+}
+
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.cond.Broadcast()
+}
+
+func (g *Gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// Wait blocks while the gate is paused or outside of its windows. The
+// windows are looked up again on every check, so callers follow windows
+// replaced while they wait.
+func (g *Gate) Wait() {
+	waiting := false
+	for {
+		g.mu.Lock()
+		for g.paused {
+			g.cond.Wait()
+		}
+		windows := g.windows
+		g.mu.Unlock()
+
+		if windows.Open() {
+			if waiting {
+				log.Printf("inside an upload window, resuming")
+			}
+			return
+		}
+		if !waiting {
+			log.Printf("outside of the upload windows, waiting %s for the next one", windows.untilOpen().Round(time.Second))
+			waiting = true
+		}
+		time.Sleep(windows.recheckIn())
+	}
+}
+
+// SetWindows makes the gate hold callers outside of windows.
+func (g *Gate) SetWindows(windows *UploadWindows) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.windows = windows
+}
+
+// ControlServer accepts commands on a Unix socket to steer a running backup:
+//
+//	pause      pause uploads, scanning and hashing continue
+//	pause all  pause uploads as well as scanning and hashing
+//	resume     resume everything
+//	status     report what is paused and the current stats
+type ControlServer struct {
+	listener net.Listener
+	path     string
+	uploads  *Gate
+	scan     *Gate
+	stats    *Stats
+}
+
+// NewControlServer creates a new instance of ControlServer listening on path.
+func NewControlServer(path string, uploads, scan *Gate, stats *Stats) (*ControlServer, error) {
+	// A socket left behind by a run that didn't exit cleanly would make
+	// Listen fail. Anything else at path is left alone, it is more likely
+	// a mistyped path than a stale socket.
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and isn't a socket", path)
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ControlServer{listener: listener, path: path, uploads: uploads, scan: scan, stats: stats}
+	go s.serve()
+	return s, nil
+}
+
+func (s *ControlServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fmt.Fprintln(conn, s.execute(strings.TrimSpace(scanner.Text())))
+	}
+}
+
+func (s *ControlServer) execute(command string) string {
+	switch command {
+	case "pause":
+		s.uploads.Pause()
+		log.Println("uploads paused")
+		return "ok"
+	case "pause all":
+		s.uploads.Pause()
+		s.scan.Pause()
+		log.Println("uploads and scanning paused")
+		return "ok"
+	case "resume":
+		s.uploads.Resume()
+		s.scan.Resume()
+		log.Println("uploads and scanning resumed")
+		return "ok"
+	case "status":
+		return fmt.Sprintf("uploads paused: %t, scan paused: %t, %s", s.uploads.Paused(), s.scan.Paused(), s.stats.Snapshot())
+	default:
+		return fmt.Sprintf("unknown command %q", command)
+	}
+}
+
+// Close stops accepting commands and removes the socket.
+func (s *ControlServer) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
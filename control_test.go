@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// controlCommand sends command on the control socket at path and returns
+// the reply.
+func controlCommand(t *testing.T, path, command string) string {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(reply)
+}
+
+func TestControlPauseResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	uploads, scan := NewGate(), NewGate()
+	server, err := NewControlServer(path, uploads, scan, NewStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if reply := controlCommand(t, path, "pause"); reply != "ok" {
+		t.Fatalf("pause: %s", reply)
+	}
+	passed := make(chan struct{})
+	go func() {
+		uploads.Wait()
+		close(passed)
+	}()
+	select {
+	case <-passed:
+		t.Fatal("upload went through the paused gate")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Scanning goes on while only uploads are paused.
+	scan.Wait()
+	if reply := controlCommand(t, path, "status"); !strings.HasPrefix(reply, "uploads paused: true, scan paused: false") {
+		t.Fatalf("status: %s", reply)
+	}
+
+	if reply := controlCommand(t, path, "resume"); reply != "ok" {
+		t.Fatalf("resume: %s", reply)
+	}
+	select {
+	case <-passed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload still held after resume")
+	}
+
+	controlCommand(t, path, "pause all")
+	if !uploads.Paused() || !scan.Paused() {
+		t.Fatal("pause all didn't pause both gates")
+	}
+	if reply := controlCommand(t, path, "stop"); !strings.HasPrefix(reply, "unknown command") {
+		t.Fatalf("stop: %s", reply)
+	}
+}
+
+func TestControlSocketPath(t *testing.T) {
+	// A stale socket is replaced.
+	path := filepath.Join(t.TempDir(), "control.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	server, err := NewControlServer(path, NewGate(), NewGate(), NewStats())
+	if err != nil {
+		t.Fatalf("replacing a stale socket: %v", err)
+	}
+	server.Close()
+
+	// A file that isn't a socket is kept.
+	path = filepath.Join(t.TempDir(), "datahaven.toml")
+	if err := os.WriteFile(path, []byte("config"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewControlServer(path, NewGate(), NewGate(), NewStats()); err == nil {
+		t.Fatal("listening in place of a regular file")
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "config" {
+		t.Fatalf("regular file at the socket path changed: %q, %v", content, err)
+	}
+}
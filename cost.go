@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// CostConfig holds the prices used to estimate what a snapshot costs to
+// keep in S3. Zero prices fall back to the defaults of the storage class.
+type CostConfig struct {
+	StorageClass           string  `mapstructure:"storage_class"`
+	StoragePerGBMonth      float64 `mapstructure:"storage_per_gb_month"`
+	PutRequestsPerThousand float64 `mapstructure:"put_requests_per_thousand"`
+}
+
+type storagePrices struct {
+	perGBMonth      float64
+	putsPerThousand float64
+}
+
+// defaultStoragePrices are the us-east-1 list prices per storage class.
+var defaultStoragePrices = map[string]storagePrices{
+	"STANDARD":     {perGBMonth: 0.023, putsPerThousand: 0.005},
+	"STANDARD_IA":  {perGBMonth: 0.0125, putsPerThousand: 0.01},
+	"ONEZONE_IA":   {perGBMonth: 0.01, putsPerThousand: 0.01},
+	"GLACIER_IR":   {perGBMonth: 0.004, putsPerThousand: 0.02},
+	"GLACIER":      {perGBMonth: 0.0036, putsPerThousand: 0.03},
+	"DEEP_ARCHIVE": {perGBMonth: 0.00099, putsPerThousand: 0.05},
+}
+
+const bytesPerGB = 1024 * 1024 * 1024
+
+// CostEstimate is the estimated S3 cost of a snapshot. Objects are keyed by
+// content hash, so only unique content is stored and uploaded.
+type CostEstimate struct {
+	StorageClass  string
+	Files         int64
+	LogicalBytes  int64
+	UniqueObjects int64
+	UniqueBytes   int64
+
+	MonthlyStorageCost float64
+	RequestCost        float64
+}
+
+// costEstimator accumulates file records into a CostEstimate.
+type costEstimator struct {
+	prices   storagePrices
+	estimate CostEstimate
+	seen     map[string]struct{}
+	// members are the contents counted in UniqueBytes, by object and
+	// path in the bundle.
+	members map[string]struct{}
+}
+
+func newCostEstimator(cfg *CostConfig) (*costEstimator, error) {
+	class := strings.ToUpper(cfg.StorageClass)
+	if class == "" {
+		class = "STANDARD"
+	}
+
+	prices, ok := defaultStoragePrices[class]
+	if !ok && (cfg.StoragePerGBMonth == 0 || cfg.PutRequestsPerThousand == 0) {
+		return nil, fmt.Errorf("no default prices for storage class %s, configure them explicitly", class)
+	}
+	if cfg.StoragePerGBMonth != 0 {
+		prices.perGBMonth = cfg.StoragePerGBMonth
+	}
+	if cfg.PutRequestsPerThousand != 0 {
+		prices.putsPerThousand = cfg.PutRequestsPerThousand
+	}
+
+	return &costEstimator{
+		prices:   prices,
+		estimate: CostEstimate{StorageClass: class},
+		seen:     make(map[string]struct{}),
+		members:  make(map[string]struct{}),
+	}, nil
+}
+
+func (e *costEstimator) add(metadata *FileMetadata) {
+	if metadata.MountPoint {
+		return
+	}
+	e.estimate.Files++
+	e.estimate.LogicalBytes += metadata.Size
+
+	// Inline, denied and failed files have no object. The files of a
+	// directory bundle share one, holding each of its members once.
+	key := metadata.objectKey()
+	if key == "" {
+		return
+	}
+	if _, ok := e.seen[key]; !ok {
+		e.seen[key] = struct{}{}
+		e.estimate.UniqueObjects++
+	}
+	member := key + "\x00" + metadata.BundlePath
+	if _, ok := e.members[member]; ok {
+		return
+	}
+	e.members[member] = struct{}{}
+	e.estimate.UniqueBytes += metadata.Size
+}
+
+func (e *costEstimator) result() CostEstimate {
+	estimate := e.estimate
+	estimate.MonthlyStorageCost = float64(estimate.UniqueBytes) / bytesPerGB * e.prices.perGBMonth
+	estimate.RequestCost = float64(estimate.UniqueObjects) / 1000 * e.prices.putsPerThousand
+	return estimate
+}
+
+func (ce CostEstimate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "storage class:    %s\n", ce.StorageClass)
+	fmt.Fprintf(&b, "files:            %d (%d bytes)\n", ce.Files, ce.LogicalBytes)
+	fmt.Fprintf(&b, "unique objects:   %d (%d bytes)\n", ce.UniqueObjects, ce.UniqueBytes)
+	fmt.Fprintf(&b, "storage:          $%.4f / month\n", ce.MonthlyStorageCost)
+	fmt.Fprintf(&b, "requests:         $%.4f one-time", ce.RequestCost)
+	return b.String()
+}
+
+func runCost(args []string) error {
+	fs := flag.NewFlagSet("cost", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven cost [snapshot-id]")
+	}
+	fs.Parse(args)
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	snapshot, err := client.FindSnapshot(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	estimator, err := newCostEstimator(&Cfg.Cost)
+	if err != nil {
+		return fmt.Errorf("estimating cost: %w", err)
+	}
+
+	err = client.ForEachFile(snapshot.ID, func(metadata *FileMetadata) error {
+		estimator.add(metadata)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading snapshot files: %w", err)
+	}
+
+	fmt.Printf("snapshot:         %s\n", snapshot.ID)
+	fmt.Println(estimator.result())
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCostEstimate(t *testing.T) {
+	estimator, err := newCostEstimator(&CostConfig{StoragePerGBMonth: 0.02, PutRequestsPerThousand: 0.004})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []*FileMetadata{
+		{Size: bytesPerGB, Hash: "sha256:aa"},
+		// The same content is stored once.
+		{Size: bytesPerGB, Hash: "sha256:aa"},
+		{Size: bytesPerGB / 2, Hash: "sha256:bb", ObjectKey: "path-mtime/b"},
+		// Two members of one directory bundle, and a directory with the
+		// same content sharing it.
+		{Size: bytesPerGB / 4, Hash: "sha256:c1", BundleKey: "bundle/c", BundlePath: "c1"},
+		{Size: bytesPerGB / 4, Hash: "sha256:c2", BundleKey: "bundle/c", BundlePath: "c2"},
+		{Size: bytesPerGB / 4, Hash: "sha256:c1", BundleKey: "bundle/c", BundlePath: "c1"},
+		// Nothing of these is in S3.
+		{Size: 100, Hash: "sha256:dd", Inline: true},
+		{Size: bytesPerGB, Hash: "sha256:ee", Denied: true},
+		{Size: bytesPerGB, Hash: "sha256:ff", ChecksumFailed: true},
+		{MountPoint: true},
+	}
+	for _, metadata := range files {
+		estimator.add(metadata)
+	}
+
+	got := estimator.result()
+	want := CostEstimate{
+		StorageClass:  "STANDARD",
+		Files:         9,
+		LogicalBytes:  4*bytesPerGB + bytesPerGB/2 + 3*bytesPerGB/4 + 100,
+		UniqueObjects: 3,
+		UniqueBytes:   2 * bytesPerGB,
+	}
+	if got.Files != want.Files || got.LogicalBytes != want.LogicalBytes || got.UniqueObjects != want.UniqueObjects || got.UniqueBytes != want.UniqueBytes {
+		t.Fatalf("estimate %+v, want %+v", got, want)
+	}
+	if math.Abs(got.MonthlyStorageCost-0.04) > 1e-9 {
+		t.Errorf("monthly storage cost %v, want 0.04", got.MonthlyStorageCost)
+	}
+	if math.Abs(got.RequestCost-0.000012) > 1e-12 {
+		t.Errorf("request cost %v, want 0.000012", got.RequestCost)
+	}
+}
+
+func TestCostDefaultPrices(t *testing.T) {
+	estimator, err := newCostEstimator(&CostConfig{StorageClass: "deep_archive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimator.add(&FileMetadata{Size: 10 * bytesPerGB, Hash: "sha256:aa"})
+	got := estimator.result()
+	if got.StorageClass != "DEEP_ARCHIVE" || math.Abs(got.MonthlyStorageCost-0.0099) > 1e-9 || math.Abs(got.RequestCost-0.00005) > 1e-12 {
+		t.Fatalf("estimate %+v", got)
+	}
+
+	if _, err := newCostEstimator(&CostConfig{StorageClass: "REDUCED_REDUNDANCY"}); err == nil {
+		t.Error("storage class without default prices accepted without configured prices")
+	}
+}
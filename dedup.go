@@ -0,0 +1,231 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// transformsMetadataKey is the object metadata recording the transform
+// chain an object was stored with, so a later run can reuse the object
+// without knowing how it was written.
+const transformsMetadataKey = "Datahaven-Transforms"
+
+func transformsMetadata(transforms []TransformInfo) map[string]*string {
+	if transforms == nil {
+		transforms = []TransformInfo{}
+	}
+	encoded, err := json.Marshal(transforms)
+	if err != nil {
+		return nil
+	}
+	return map[string]*string{transformsMetadataKey: aws.String(string(encoded))}
+}
+
+// StoredTransforms reports whether key is in the bucket and returns the
+// transforms it was stored with. Objects stored without the transforms
+// recorded count as absent, since a file can't safely refer to them.
+func (c *S3Client) StoredTransforms(bucketName, key string) ([]TransformInfo, bool, error) {
+	head, err := c.Head(bucketName, key)
+	if err != nil || head == nil {
+		return nil, false, err
+	}
+	encoded, ok := head.Metadata[transformsMetadataKey]
+	if !ok {
+		return nil, false, nil
+	}
+	var transforms []TransformInfo
+	if err := json.Unmarshal([]byte(aws.StringValue(encoded)), &transforms); err != nil {
+		return nil, false, nil
+	}
+	return transforms, true, nil
+}
+
+// DedupCache remembers the transforms of recently stored objects, by key,
+// so files with the same content are recorded without storing it again.
+// It holds at most size entries and evicts the least recently used. Only
+// objects confirmed present in every destination are added, so a miss
+// costs a HeadObject, never a wrong skip. An object deleted behind the
+// cache's back is skipped until Revalidate finds it gone. A nil DedupCache
+// never hits.
+type DedupCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key        string
+	transforms []TransformInfo
+	// checked is when the object was last confirmed stored.
+	checked time.Time
+}
+
+// NewDedupCache creates a new instance of DedupCache holding up to size
+// keys, or returns nil when size is 0.
+func NewDedupCache(size int) *DedupCache {
+	if size <= 0 {
+		return nil
+	}
+	return &DedupCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get returns the transforms key was stored with, if it is cached.
+func (c *DedupCache) Get(key string) ([]TransformInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*dedupEntry).transforms, true
+}
+
+// Add records that key is stored with transforms.
+func (c *DedupCache) Add(key string, transforms []TransformInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		entry.transforms = transforms
+		entry.checked = time.Now()
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&dedupEntry{key: key, transforms: transforms, checked: time.Now()})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dedupEntry).key)
+	}
+}
+
+// Revalidate looks up the n keys confirmed stored longest ago with stored,
+// and forgets those no longer stored. It returns the keys forgotten.
+func (c *DedupCache) Revalidate(n int, stored func(key string) bool) []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	entries := make([]*dedupEntry, 0, c.order.Len())
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, e.Value.(*dedupEntry))
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].checked.Before(entries[j].checked) })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.key
+	}
+	c.mu.Unlock()
+
+	// The lookups run unlocked, uploads keep using the cache meanwhile.
+	var gone []string
+	for _, key := range keys {
+		ok := stored(key)
+		c.mu.Lock()
+		if e, cached := c.entries[key]; cached {
+			if ok {
+				e.Value.(*dedupEntry).checked = time.Now()
+			} else {
+				c.order.Remove(e)
+				delete(c.entries, key)
+				gone = append(gone, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return gone
+}
+
+// dedupRevalidateSample is how many keys each revalidation looks up.
+const dedupRevalidateSample = 100
+
+// RevalidateEvery runs Revalidate every interval until the returned
+// function is called.
+func (c *DedupCache) RevalidateEvery(interval time.Duration, stored func(key string) bool) func() {
+	if c == nil || interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, key := range c.Revalidate(dedupRevalidateSample, stored) {
+					log.Printf("%s is no longer stored, storing its content again when it comes up", key)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// keyLocks serializes the workers storing the same key, so content met by
+// several of them at once is stored once: the others find it stored when
+// their turn comes.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	holders int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+// Lock locks key and returns the function unlocking it. A nil keyLocks
+// locks nothing.
+func (l *keyLocks) Lock(key string) func() {
+	if l == nil {
+		return func() {}
+	}
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		l.locks[key] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.holders--; lock.holders == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
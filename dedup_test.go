@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDedupCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewDedupCache(2)
+	cache.Add("a", nil)
+	cache.Add("b", nil)
+	cache.Get("a")
+	cache.Add("c", nil)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.Get(key); ok != want {
+			t.Errorf("Get(%s) = %v, want %v", key, ok, want)
+		}
+	}
+	if NewDedupCache(0) != nil {
+		t.Error("a cache of size 0 isn't disabled")
+	}
+}
+
+func TestDedupCacheRevalidate(t *testing.T) {
+	cache := NewDedupCache(10)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Add(key, nil)
+	}
+	stored := map[string]bool{"a": true, "c": true}
+	var looked []string
+	lookup := func(key string) bool {
+		looked = append(looked, key)
+		return stored[key]
+	}
+
+	// The two confirmed longest ago are looked up first.
+	if gone := cache.Revalidate(2, lookup); len(gone) != 1 || gone[0] != "b" {
+		t.Fatalf("Revalidate forgot %v, want b", gone)
+	}
+	if strings.Join(looked, ",") != "a,b" {
+		t.Fatalf("looked up %v, want a and b", looked)
+	}
+	// Then the one not looked up yet.
+	looked = nil
+	if gone := cache.Revalidate(1, lookup); len(gone) != 0 || strings.Join(looked, ",") != "c" {
+		t.Fatalf("Revalidate looked up %v and forgot %v, want c kept", looked, gone)
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.Get(key); ok != want {
+			t.Errorf("Get(%s) = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+// removeOnUpload is a trace output that deletes an object from the fake
+// once the file at path is uploaded, as if it were deleted behind the
+// backup's back.
+type removeOnUpload struct {
+	s3     *fakeS3
+	path   string
+	bucket string
+	key    string
+}
+
+func (r removeOnUpload) Write(p []byte) (int, error) {
+	var span traceSpan
+	if err := json.Unmarshal(p, &span); err == nil && span.Phase == "upload:s3://"+r.bucket && span.Path == r.path {
+		r.s3.remove(r.bucket, r.key)
+	}
+	return len(p), nil
+}
+
+func TestDedupCacheNoSkipAfterEviction(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a": "first", "b": "second", "c": "first"})
+	cfg := testBackupConfig(t)
+	cfg.UploadWorkers = 1
+	// b's key evicts a's, so c's content must be looked up again.
+	cfg.DedupCacheSize = 1
+	engine, _, s3 := testEngine(t, cfg)
+	first := sha256Hash("first")
+	tracer := NewTracer(removeOnUpload{s3: s3, path: filepath.Join(src, "b"), bucket: cfg.Bucket, key: first})
+
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Tracer: tracer}); err != nil {
+		t.Fatal(err)
+	}
+	if s3.get(cfg.Bucket, first) == nil {
+		t.Fatal("content deleted after it was cached isn't stored again")
+	}
+	if n := s3.count("PUT"); n != 3 {
+		t.Fatalf("%d PUTs, want 3", n)
+	}
+}
+
+func BenchmarkDedupCache(b *testing.B) {
+	const size = 1000
+	cache := NewDedupCache(size)
+	transforms := []TransformInfo{{Name: "gzip"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("sha256:%064x", i)
+		if _, ok := cache.Get(key); !ok {
+			cache.Add(key, transforms)
+		}
+	}
+	// However many keys went through, the cache holds at most size.
+	if cache.order.Len() > size || len(cache.entries) > size {
+		b.Fatalf("cache holds %d entries, more than %d", cache.order.Len(), size)
+	}
+	b.ReportMetric(float64(cache.order.Len()), "entries")
+}
+
+func TestDedupHitWithOtherTransforms(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "content"})
+	cfg := testBackupConfig(t)
+	cfg.DedupCacheSize = 10
+	engine, store, _ := testEngine(t, cfg)
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Encryption is turned on later. The stored object stays as it is,
+	// and saying so, the new snapshot records how it is stored.
+	out := captureOutput(t)
+	engine.cfg.Backup.Transforms = []string{"aes-gcm"}
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: "encrypted"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "with transforms none rather than the configured ones") {
+		t.Errorf("reusing the unencrypted object isn't logged: %q", out.String())
+	}
+	store.ForEachFile("encrypted", func(metadata *FileMetadata) error {
+		if len(metadata.Transforms) != 0 {
+			t.Errorf("recorded transforms %v of the unencrypted object", metadata.Transforms)
+		}
+		return nil
+	})
+
+	// With the configured transforms nothing is logged.
+	out = captureOutput(t)
+	engine.cfg.Backup.Transforms = nil
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: "plain-again"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "rather than the configured ones") {
+		t.Errorf("reuse with the configured transforms logged: %q", out.String())
+	}
+}
+
+func TestDedupWithoutCacheKeepsStoredObject(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "content"})
+	cfg := testBackupConfig(t)
+	cfg.DedupCacheSize = 0
+	engine, store, s3 := testEngine(t, cfg)
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a cache the bucket is still asked, and the object the first
+	// snapshot refers to isn't written again compressed.
+	engine.cfg.Backup.Transforms = []string{"gzip"}
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: "gzip"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("PUT"); n != 1 {
+		t.Fatalf("%d PUTs, want 1", n)
+	}
+	if object := s3.get(cfg.Bucket, sha256Hash("content")); object == nil || string(object.data) != "content" {
+		t.Fatalf("stored object is %v, want the uncompressed content", object)
+	}
+	store.ForEachFile("gzip", func(metadata *FileMetadata) error {
+		if len(metadata.Transforms) != 0 {
+			t.Errorf("recorded transforms %v of the uncompressed object", metadata.Transforms)
+		}
+		return nil
+	})
+}
+
+func TestPipelineApplies(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	pipeline, err := NewPipeline([]string{"gzip", "aes-gcm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := aesGCMTransform{key: testEncryptionKey}.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := TransformInfo{Name: "aes-gcm", Params: map[string]string{"key": "0000000000000000"}}
+	gzip := TransformInfo{Name: "gzip"}
+	tests := []struct {
+		chain []TransformInfo
+		want  bool
+	}{
+		{[]TransformInfo{gzip, encrypted}, true},
+		// Compressed content isn't compressed again.
+		{[]TransformInfo{encrypted}, true},
+		{[]TransformInfo{gzip}, false},
+		{nil, false},
+		{[]TransformInfo{gzip, rotated}, false},
+	}
+	for _, tt := range tests {
+		if got := pipeline.Applies(tt.chain); got != tt.want {
+			t.Errorf("Applies(%s) = %v, want %v", describeTransforms(tt.chain), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// How far content is deduplicated, chosen with backup.dedup_scope.
+const (
+	// dedupGlobal stores identical content once across all snapshots.
+	dedupGlobal = "global"
+	// dedupSnapshot stores identical content once per snapshot, so no
+	// two snapshots share an object.
+	dedupSnapshot = "snapshot"
+	// dedupNone stores every file of every snapshot as its own object.
+	dedupNone = "none"
+)
+
+func validateDedupScope(scope string) error {
+	switch scope {
+	case dedupGlobal, dedupSnapshot, dedupNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown scope %q, expected %s, %s or %s", scope, dedupGlobal, dedupSnapshot, dedupNone)
+	}
+}
+
+// scopedKey returns the key content keyed key is stored under, for the file
+// or directory at path of the snapshot snapshotID.
+func scopedKey(scope, snapshotID, path, key string) string {
+	switch scope {
+	case dedupSnapshot:
+		return snapshotID + "/" + key
+	case dedupNone:
+		sum := sha256.Sum256([]byte(path))
+		return snapshotID + "/" + hex.EncodeToString(sum[:8]) + "/" + key
+	default:
+		return key
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDedupScopeKeys(t *testing.T) {
+	tests := []struct {
+		scope string
+		// Whether the same content gets the same key in two snapshots, and
+		// at two paths of one snapshot.
+		acrossSnapshots, acrossPaths bool
+	}{
+		{dedupGlobal, true, true},
+		{dedupSnapshot, false, true},
+		{dedupNone, false, false},
+	}
+	for _, tt := range tests {
+		src := t.TempDir()
+		writeFiles(t, src, map[string]string{"a": "same content", "b": "same content"})
+		cfg := testBackupConfig(t)
+		cfg.DedupScope = tt.scope
+		cfg.DedupCacheSize = 10
+		engine, store, s3 := testEngine(t, cfg)
+
+		keys := map[string]map[string]string{}
+		for _, id := range []string{"first", "second"} {
+			if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: id}); err != nil {
+				t.Fatal(err)
+			}
+			keys[id] = map[string]string{}
+			store.ForEachFile(id, func(metadata *FileMetadata) error {
+				keys[id][metadata.RelPath] = metadata.objectKey()
+				return nil
+			})
+		}
+
+		if same := keys["first"]["a"] == keys["second"]["a"]; same != tt.acrossSnapshots {
+			t.Errorf("%s: keys %s and %s across snapshots", tt.scope, keys["first"]["a"], keys["second"]["a"])
+		}
+		if same := keys["first"]["a"] == keys["first"]["b"]; same != tt.acrossPaths {
+			t.Errorf("%s: keys %s and %s across paths", tt.scope, keys["first"]["a"], keys["first"]["b"])
+		}
+		// Every key the files refer to is stored.
+		for _, files := range keys {
+			for rel, key := range files {
+				if s3.get(cfg.Bucket, key) == nil {
+					t.Errorf("%s: %s refers to missing %s", tt.scope, rel, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readPatternFile reads one entry per line from path, skipping blank lines
+// and lines starting with #.
+func readPatternFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+// denySet returns the deny-listed hashes as a set. Hashes without an
+// algorithm prefix are taken to be sha256.
+func denySet(hashes []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(hashes))
+	for _, hash := range hashes {
+		hash = strings.ToLower(hash)
+		if !strings.Contains(hash, ":") {
+			hash = "sha256:" + hash
+		}
+		set[hash] = struct{}{}
+	}
+	return set
+}
+
+// validateDenyHashes checks that every deny-listed hash is of algorithm,
+// the one content is hashed with. Others could never match, and the content
+// they deny would be uploaded.
+func validateDenyHashes(hashes []string, algorithm string) error {
+	for hash := range denySet(hashes) {
+		if denied, _, _ := strings.Cut(hash, ":"); denied != algorithm {
+			return fmt.Errorf("%s is a %s hash, content is hashed with %s", hash, denied, algorithm)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDenyListedFileNotUploaded(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"leaked.key": "secret key", "notes": "fine"})
+	cfg := testBackupConfig(t)
+	// Bare and upper-case, as hashes are often pasted.
+	cfg.DenyHashes = []string{strings.ToUpper(strings.TrimPrefix(sha256Hash("secret key"), "sha256:"))}
+	engine, store, s3 := testEngine(t, cfg)
+
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.get(cfg.Bucket, sha256Hash("secret key")) != nil {
+		t.Error("deny-listed content was uploaded")
+	}
+	if s3.get(cfg.Bucket, sha256Hash("fine")) == nil {
+		t.Error("other file wasn't uploaded")
+	}
+	denied := map[string]bool{}
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		denied[metadata.Name] = metadata.Denied
+		return nil
+	})
+	if !denied["leaked.key"] || denied["notes"] {
+		t.Fatalf("recorded as denied: %v", denied)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Actions a backup takes for a scanned file.
+const (
+	actionUpload = "upload"
+	actionInline = "inline"
+	actionDenied = "denied"
+	actionBundle = "bundle"
+	actionMount  = "mount"
+)
+
+// Actions a dry run plans for files a real run would upload but finds
+// already stored: content repeated in the run, and content the previous
+// snapshot recorded at the same path.
+const (
+	actionSkipDedup     = "skip-dedup"
+	actionSkipUnchanged = "skip-unchanged"
+)
+
+// planAction decides what a backup does with a scanned file. Dry runs and
+// the Uploader share it, so the plan matches what a real run does.
+func planAction(metadata *FileMetadata, cfg *BackupConfig) string {
+	switch {
+	case metadata.MountPoint:
+		return actionMount
+	case metadata.Denied:
+		return actionDenied
+	case metadata.Size < cfg.InlineThresholdBytes:
+		return actionInline
+	case cfg.Bundle:
+		return actionBundle
+	default:
+		return actionUpload
+	}
+}
+
+type plannedAction struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+	Action string `json:"action"`
+}
+
+// previousHashes returns the content hash of every file of the latest
+// snapshot, by path.
+func previousHashes(store MongoDBClient) (map[string]string, error) {
+	var latest *Snapshot
+	err := store.ForEachSnapshot(func(snapshot *Snapshot) error {
+		if snapshot.Continues == "" {
+			latest = snapshot
+		}
+		return nil
+	})
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	err = store.ForEachFile(latest.ID, func(metadata *FileMetadata) error {
+		if metadata.Hash != "" && !metadata.Inconsistent {
+			hashes[metadata.Path] = metadata.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot %s: %w", latest.ID, err)
+	}
+	return hashes, nil
+}
+
+// dryRun scans sources and writes the planned action for every file to plan
+// as JSON lines, without uploading or recording anything. It ends with a
+// summary and an estimate of the S3 requests the backup would make, written
+// to report. With dedup, files are compared with the latest snapshot in
+// store, unless store is nil.
+func dryRun(sources []SourceConfig, s3Cfg *S3Config, cfg *BackupConfig, tracer *Tracer, store MongoDBClient, plan, report io.Writer) error {
+	// Content is found stored in every scope but none, and only kept
+	// across snapshots in the global scope.
+	dedup := cfg.DedupScope != dedupNone
+	var previous map[string]string
+	if dedup && cfg.DedupScope == dedupGlobal && store != nil {
+		var err error
+		previous, err = previousHashes(store)
+		if err != nil {
+			log.Printf("not comparing with the previous snapshot: %v", err)
+		}
+	}
+	seen := make(map[string]struct{})
+
+	// Commands aren't run, they may be expensive or have side effects.
+	var scanned []SourceConfig
+	for _, source := range sources {
+		if _, ok := source.command(); ok {
+			log.Printf("source [%s] is a command, not running it in a dry run", source.Path)
+			continue
+		}
+		scanned = append(scanned, source)
+	}
+
+	metadataChan := make(chan FileMetadata, 1)
+	go scanSources(scanned, cfg, tracer, NewGate(), nil, nil, metadataChan)
+
+	enc := json.NewEncoder(plan)
+	counts := make(map[string]int)
+	estimator := newRequestEstimator(s3Cfg, cfg)
+	var encodeErr error
+	for metadata := range metadataChan {
+		action := planAction(&metadata, cfg)
+		estimator.add(&metadata, action)
+		if action == actionUpload && dedup && metadata.Hash != "" {
+			key := scopedKey(cfg.DedupScope, "", metadata.Path, metadata.Hash)
+			if _, ok := seen[key]; ok {
+				action = actionSkipDedup
+			} else if previous[metadata.Path] == metadata.Hash {
+				action = actionSkipUnchanged
+			}
+			seen[key] = struct{}{}
+		}
+		counts[action]++
+		if encodeErr == nil {
+			encodeErr = enc.Encode(plannedAction{
+				Path:   metadata.Path,
+				Size:   metadata.Size,
+				Hash:   metadata.Hash,
+				Action: action,
+			})
+		}
+	}
+	if encodeErr != nil {
+		return fmt.Errorf("writing plan: %w", encodeErr)
+	}
+
+	fmt.Fprintf(report, "Dry run: %d to upload, %d already stored, %d unchanged, %d to bundle, %d to inline, %d denied, %d mount points.\n",
+		counts[actionUpload], counts[actionSkipDedup], counts[actionSkipUnchanged], counts[actionBundle], counts[actionInline], counts[actionDenied], counts[actionMount])
+	fmt.Fprintln(report, estimator.result())
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDryRunPlan(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"a.txt":   "new content",
+		"b.txt":   "new content",
+		"old.txt": "old content",
+	})
+	cfg := testBackupConfig(t)
+	cfg.DedupCacheSize = 100
+	store := newMemStore()
+	store.addSnapshot(&Snapshot{ID: "previous"}, []FileMetadata{
+		{Path: filepath.Join(src, "old.txt"), Hash: sha256Hash("old content")},
+	})
+
+	var plan, report bytes.Buffer
+	if err := dryRun([]SourceConfig{{Path: src}}, &S3Config{}, cfg, nil, store, &plan, &report); err != nil {
+		t.Fatal(err)
+	}
+	var got []plannedAction
+	dec := json.NewDecoder(&plan)
+	for dec.More() {
+		var action plannedAction
+		if err := dec.Decode(&action); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, action)
+	}
+	want := []plannedAction{
+		{Path: filepath.Join(src, "a.txt"), Size: 11, Hash: sha256Hash("new content"), Action: actionUpload},
+		{Path: filepath.Join(src, "b.txt"), Size: 11, Hash: sha256Hash("new content"), Action: actionSkipDedup},
+		{Path: filepath.Join(src, "old.txt"), Size: 11, Hash: sha256Hash("old content"), Action: actionSkipUnchanged},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("plan:\n%+v\nwant:\n%+v", got, want)
+	}
+	if !strings.Contains(report.String(), "1 to upload, 1 already stored, 1 unchanged") {
+		t.Fatalf("report %q doesn't count the actions", report.String())
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The aes-gcm transform encrypts content in segments of encryptSegmentSize
+// bytes, each sealed on its own, so neither side holds more than a segment.
+// The stream starts with a random nonce prefix. Every segment's nonce is the
+// prefix and its index, and the last segment is sealed with different
+// additional data, so a stream cut at a segment boundary fails to decrypt.
+const (
+	encryptSegmentSize = 64 * 1024
+	encryptPrefixSize  = 8
+)
+
+var (
+	encryptSegmentAD = []byte{0}
+	encryptLastAD    = []byte{1}
+)
+
+// parseEncryptionKey decodes a hex AES-256 key.
+func parseEncryptionKey(key string) ([]byte, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key isn't hex: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key has %d bytes, expected 32", len(raw))
+	}
+	return raw, nil
+}
+
+// keyFingerprint identifies a key in the transform chain without revealing
+// it, so decrypting with another key fails with a clear error.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newEncryptTransform() Transform {
+	return aesGCMTransform{key: Cfg.Backup.EncryptionKey}
+}
+
+type aesGCMTransform struct {
+	key string
+}
+
+func (t aesGCMTransform) Info() (TransformInfo, error) {
+	key, err := parseEncryptionKey(t.key)
+	if err != nil {
+		return TransformInfo{}, fmt.Errorf("backup.encryption_key: %w", err)
+	}
+	return TransformInfo{Name: "aes-gcm", Params: map[string]string{"key": keyFingerprint(key)}}, nil
+}
+
+func (t aesGCMTransform) Wrap(r io.Reader) (io.Reader, TransformInfo, error) {
+	key, err := parseEncryptionKey(t.key)
+	if err != nil {
+		return nil, TransformInfo{}, fmt.Errorf("backup.encryption_key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, TransformInfo{}, err
+	}
+	prefix := make([]byte, encryptPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, TransformInfo{}, err
+	}
+	info := TransformInfo{Name: "aes-gcm", Params: map[string]string{"key": keyFingerprint(key)}}
+	return &encryptReader{aead: aead, src: bufio.NewReader(r), prefix: prefix, out: prefix}, info, nil
+}
+
+func unwrapAESGCM(r io.Reader, info TransformInfo) (io.Reader, error) {
+	key, err := parseEncryptionKey(Cfg.Backup.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("backup.encryption_key: %w", err)
+	}
+	if fingerprint := keyFingerprint(key); fingerprint != info.Params["key"] {
+		return nil, fmt.Errorf("content is encrypted with key %s, backup.encryption_key is %s", info.Params["key"], fingerprint)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encryptPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("reading nonce: %w", err)
+	}
+	return &decryptReader{aead: aead, src: bufio.NewReader(r), prefix: prefix}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(aead cipher.AEAD, prefix []byte, index uint32) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], index)
+	return nonce
+}
+
+// encryptReader seals its source segment by segment as it is read.
+type encryptReader struct {
+	aead   cipher.AEAD
+	src    *bufio.Reader
+	prefix []byte
+	index  uint32
+	out    []byte
+	done   bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) seal() error {
+	plain := make([]byte, encryptSegmentSize)
+	n, err := io.ReadFull(e.src, plain)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	// A full segment is the last one when nothing follows it.
+	last := n < encryptSegmentSize
+	if !last {
+		if _, err := e.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	ad := encryptSegmentAD
+	if last {
+		ad = encryptLastAD
+		e.done = true
+	}
+	e.out = e.aead.Seal(nil, segmentNonce(e.aead, e.prefix, e.index), plain[:n], ad)
+	e.index++
+	return nil
+}
+
+// decryptReader opens the segments sealed by encryptReader.
+type decryptReader struct {
+	aead   cipher.AEAD
+	src    *bufio.Reader
+	prefix []byte
+	index  uint32
+	out    []byte
+	done   bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	sealed := make([]byte, encryptSegmentSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.src, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("encrypted content is truncated")
+		}
+		return err
+	}
+	last := n < len(sealed)
+	if !last {
+		if _, err := d.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	ad := encryptSegmentAD
+	if last {
+		ad = encryptLastAD
+		d.done = true
+	}
+	plain, err := d.aead.Open(nil, segmentNonce(d.aead, d.prefix, d.index), sealed[:n], ad)
+	if err != nil {
+		return fmt.Errorf("decrypting segment %d: %w", d.index, err)
+	}
+	d.out = plain
+	d.index++
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Engine runs backups, verifications and restores for a configuration,
+// against the metadata store and storage it is given. The CLI commands are
+// thin wrappers over it, and other code can drive it the same way.
+type Engine struct {
+	cfg   *Config
+	store MongoDBClient
+	// destinations returns the storage a backup writes to. It is called
+	// once per upload worker with backup.per_worker_clients, once per run
+	// otherwise.
+	destinations func() []Storage
+
+	mu   sync.Mutex
+	live *liveBackup
+}
+
+// liveBackup is what of a running backup a config reload changes.
+type liveBackup struct {
+	cfg     *BackupConfig
+	budget  *Budget
+	uploads *Gate
+	scan    *Gate
+}
+
+// NewEngine creates a new instance of Engine.
+func NewEngine(cfg *Config, store MongoDBClient, destinations func() []Storage) *Engine {
+	return &Engine{cfg: cfg, store: store, destinations: destinations}
+}
+
+// BackupOptions are the per-run settings of Engine.Backup.
+type BackupOptions struct {
+	Note string
+	// SnapshotID is the ID to record the snapshot as. An existing snapshot
+	// with that ID is replaced. When empty the ID is derived from the
+	// start time, or from the content with backup.deterministic_snapshot_id.
+	SnapshotID string
+	Tracer     *Tracer
+	// Stats tracks the run's progress. A new one is used when nil.
+	Stats *Stats
+}
+
+// BackupSummary is the outcome of Engine.Backup.
+type BackupSummary struct {
+	SnapshotID string
+	Stats      StatsSnapshot
+	// Failed are the files that couldn't be backed up after every retry.
+	Failed []*RetryItem
+}
+
+// Backup takes a snapshot of sources. Cancelling ctx stops storing files:
+// the scan runs to its end but whatever isn't stored yet counts as failed.
+func (e *Engine) Backup(ctx context.Context, sources []SourceConfig, opts BackupOptions) (BackupSummary, error) {
+	cfg := &e.cfg.Backup
+	// A checksum failure under the abort policy cancels the run.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	abortOnChecksum := func(err error) {
+		var checksumErr *ChecksumError
+		if errors.As(err, &checksumErr) {
+			cancel(checksumErr)
+		}
+	}
+	tracer := opts.Tracer
+	stats := opts.Stats
+	if stats == nil {
+		stats = NewStats()
+	}
+	var summary BackupSummary
+
+	pipeline, err := NewPipeline(cfg.Transforms)
+	if err != nil {
+		return summary, fmt.Errorf("creating transform pipeline: %w", err)
+	}
+
+	uploadGate, scanGate := NewGate(), NewGate()
+	windows, err := NewUploadWindows(cfg.UploadWindows, cfg.UploadWindowsTimezone)
+	if err != nil {
+		return summary, fmt.Errorf("backup.upload_windows: %w", err)
+	}
+	uploadGate.SetWindows(windows)
+	if cfg.UploadWindowsPauseScan {
+		scanGate.SetWindows(windows)
+	}
+	budget := NewBudget(cfg.MaxConcurrency)
+	cfg.excludes = newPatternSet(cfg.Exclude)
+	e.setLive(&liveBackup{cfg: cfg, budget: budget, uploads: uploadGate, scan: scanGate})
+	defer e.setLive(nil)
+	dedup := NewDedupCache(cfg.DedupCacheSize)
+	storing := newKeyLocks()
+	space := NewSpaceGuard(tempDir(cfg), uint64(cfg.MinFreeSpaceBytes), cfg.MinFreeSpaceAction)
+	if cfg.ControlSocket != "" {
+		control, err := NewControlServer(cfg.ControlSocket, uploadGate, scanGate, stats)
+		if err != nil {
+			return summary, fmt.Errorf("creating control socket: %w", err)
+		}
+		defer control.Close()
+	}
+
+	if cfg.IntentLog {
+		if err := recoverIntents(e.store, e.destinations(), pipeline, gcGrace); err != nil {
+			return summary, fmt.Errorf("recovering intents: %w", err)
+		}
+	}
+
+	if cfg.QuickHashBytes > 0 && cfg.KeyStrategy != keyPathMtime {
+		cfg.quickHashes, err = loadQuickHashes(e.store, cfg.HashAlgorithm)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	snapshotID := opts.SnapshotID
+	if snapshotID == "" && cfg.DeterministicSnapshotID {
+		if err := validateDeterministicSnapshotID(cfg, sources); err != nil {
+			return summary, err
+		}
+		var files int64
+		snapshotID, files = contentSnapshotID(sources, cfg)
+		// A snapshot missing files is what an interrupted or failed run
+		// leaves, and is replaced rather than reused.
+		recorded, err := e.recordedFiles(snapshotID)
+		if err != nil {
+			return summary, err
+		}
+		if recorded == files {
+			log.Printf("snapshot %s already holds this content, reusing it", snapshotID)
+			summary.SnapshotID = snapshotID
+			return summary, nil
+		}
+	}
+	if snapshotID != "" {
+		if err := e.replaceSnapshot(snapshotID); err != nil {
+			return summary, err
+		}
+	}
+
+	snapshot := NewSnapshot(sources, cfg)
+	if snapshotID != "" {
+		snapshot.ID = snapshotID
+	}
+	snapshot.Note = opts.Note
+	snapshot.Collections, err = shardCollections(snapshot.ID, &e.cfg.MongoDB)
+	if err != nil {
+		return summary, err
+	}
+	if err := e.store.InsertOne(snapshotsCollection, snapshot); err != nil {
+		return summary, fmt.Errorf("inserting snapshot: %w", err)
+	}
+	summary.SnapshotID = snapshot.ID
+	batch := NewMetadataBatch(e.store, snapshot, &e.cfg.MongoDB, cfg.MaxFilesPerSnapshot)
+	intents, err := NewIntentLog(e.store, snapshot.ID, cfg.IntentLog)
+	if err != nil {
+		return summary, err
+	}
+	defer intents.Close()
+
+	clientMode := "a shared S3 client"
+	if cfg.PerWorkerClients {
+		clientMode = "per-worker S3 clients"
+	}
+	log.Printf("uploading with %d workers using %s, %d connections per host", cfg.UploadWorkers, clientMode, e.cfg.S3.MaxConnections)
+
+	uploaders := make([]*Uploader, cfg.UploadWorkers)
+	var destinations []Storage
+	for i := range uploaders {
+		if destinations == nil || cfg.PerWorkerClients {
+			destinations = e.destinations()
+		}
+		uploaders[i], err = NewUploader(destinations, pipeline, batch, tracer, uploadGate, budget, dedup, storing, intents, cfg)
+		if err != nil {
+			return summary, fmt.Errorf("creating uploader: %w", err)
+		}
+	}
+
+	stopRevalidating := dedup.RevalidateEvery(cfg.DedupRevalidateInterval, func(key string) bool {
+		_, ok := uploaders[0].storedEverywhere(key)
+		return ok
+	})
+	defer stopRevalidating()
+
+	metadataChan := make(chan FileMetadata, 1)
+
+	if cfg.Bundle {
+		bundler, err := NewBundler(uploaders[0], cfg, tracer)
+		if err != nil {
+			return summary, fmt.Errorf("creating bundler: %w", err)
+		}
+		scanChan := make(chan FileMetadata, 1)
+		go scanSources(sources, cfg, tracer, scanGate, budget, space, scanChan)
+		go bundler.Run(scanChan, metadataChan)
+	} else {
+		go scanSources(sources, cfg, tracer, scanGate, budget, space, metadataChan)
+	}
+
+	retryQueue := NewRetryQueue(cfg.MaxAttempts, cfg.RetryBackoff)
+	// Retries are spread over the uploaders, one per retry worker.
+	retry := func(worker int, metadata FileMetadata) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := uploaders[worker].Process(metadata)
+		abortOnChecksum(err)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, uploader := range uploaders {
+		wg.Add(1)
+		go func(uploader *Uploader) {
+			defer wg.Done()
+			for metadata := range metadataChan {
+				stats.AddScanned(metadata.Size)
+				err := ctx.Err()
+				if err == nil {
+					err = uploader.Process(metadata)
+				}
+				abortOnChecksum(err)
+				if err != nil {
+					log.Printf("backing up [%s] failed, queued for retry: %v", metadata.Path, err)
+					retryQueue.Push(metadata, err)
+					continue
+				}
+				stats.AddDone(metadata.Size)
+			}
+		}(uploader)
+	}
+
+	wg.Wait()
+
+	succeeded, failed := retryQueue.Drain(len(uploaders), retry)
+	for _, metadata := range succeeded {
+		stats.AddDone(metadata.Size)
+	}
+	for _, item := range failed {
+		stats.AddFailed()
+		if item.Metadata.ContentPath != "" {
+			os.Remove(item.Metadata.ContentPath)
+		}
+	}
+	summary.Failed = failed
+
+	if err := batch.Flush(); err != nil {
+		return summary, fmt.Errorf("inserting metadata: %w", err)
+	}
+	if err := intents.Commit(); err != nil {
+		return summary, fmt.Errorf("committing intents: %w", err)
+	}
+	summary.Stats = stats.Snapshot()
+	log.Println("stats:", summary.Stats)
+	if err := ctx.Err(); err != nil {
+		return summary, fmt.Errorf("backup cancelled: %w", context.Cause(ctx))
+	}
+	if err := space.Err(); err != nil {
+		return summary, fmt.Errorf("backup stopped before scanning everything: %w", err)
+	}
+	for _, source := range sources {
+		if source.failed != nil {
+			return summary, fmt.Errorf("source %s: %w", source.Path, source.failed)
+		}
+	}
+	if summary.Stats.FilesFailed > 0 {
+		return summary, fmt.Errorf("%d files failed to back up", summary.Stats.FilesFailed)
+	}
+	return summary, nil
+}
+
+func (e *Engine) setLive(live *liveBackup) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.live = live
+}
+
+// Reload applies the settings of next that can change while a backup runs
+// to the running backup, if there is one: the excludes, max_concurrency and
+// the upload windows. Files already scanned keep the excludes they were
+// scanned with.
+func (e *Engine) Reload(next *Config) error {
+	e.mu.Lock()
+	live := e.live
+	e.mu.Unlock()
+	if live == nil {
+		return nil
+	}
+
+	cfg := &next.Backup
+	windows, err := NewUploadWindows(cfg.UploadWindows, cfg.UploadWindowsTimezone)
+	if err != nil {
+		return fmt.Errorf("backup.upload_windows: %w", err)
+	}
+	live.cfg.excludes.set(cfg.Exclude)
+	live.budget.SetLimit(cfg.MaxConcurrency)
+	live.uploads.SetWindows(windows)
+	if cfg.UploadWindowsPauseScan {
+		live.scan.SetWindows(windows)
+	} else {
+		live.scan.SetWindows(nil)
+	}
+	return nil
+}
+
+// recordedFiles returns how many files the snapshot with the given ID
+// records, or -1 when there is no such snapshot.
+func (e *Engine) recordedFiles(id string) (int64, error) {
+	if _, err := e.store.FindSnapshot(id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return -1, nil
+		}
+		return 0, fmt.Errorf("finding snapshot %s: %w", id, err)
+	}
+	files, err := e.store.CountFiles(id)
+	if err != nil {
+		return 0, fmt.Errorf("counting files of snapshot %s: %w", id, err)
+	}
+	return files, nil
+}
+
+// replaceSnapshot deletes the snapshot with the given ID, if there is one,
+// so a new snapshot can take over its ID and collections.
+func (e *Engine) replaceSnapshot(id string) error {
+	if _, err := e.store.FindSnapshot(id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return fmt.Errorf("finding snapshot %s: %w", id, err)
+	}
+	log.Printf("replacing snapshot %s", id)
+	if err := e.store.DeleteSnapshot(id); err != nil {
+		return fmt.Errorf("deleting snapshot %s: %w", id, err)
+	}
+	return nil
+}
+
+// Verify checks every file of a snapshot with verifier, workers at a time,
+// saving its progress to checkpoint unless that is empty.
+func (e *Engine) Verify(verifier *Verifier, snapshotID string, workers int, checkpoint string) (VerifySummary, error) {
+	return verifySnapshot(e.store, verifier, snapshotID, workers, checkpoint)
+}
+
+// RestoreOptions are the per-run settings of Engine.RestoreSnapshot.
+type RestoreOptions struct {
+	// HardLink restores files of the same content as hard links to one
+	// file, when the sink can link files.
+	HardLink bool
+	// Stats tracks the run's progress. A new one is used when nil.
+	Stats *Stats
+	// Paths are the relative paths of the files and directories restored.
+	// The whole snapshot is restored when it is empty.
+	Paths []string
+	// Thaw thaws the objects found archived when they are read, once the
+	// others are restored, when the storage archives objects. Without it
+	// reading one fails.
+	Thaw *ThawOptions
+}
+
+// RestoreSnapshot restores the snapshot snapshotID to sink, reading its
+// files from the metadata store and their objects from the first of the
+// destinations, the primary bucket.
+func (e *Engine) RestoreSnapshot(snapshotID string, sink OutputSink, opts RestoreOptions) error {
+	if e.store == nil || e.destinations == nil {
+		return fmt.Errorf("restoring a snapshot needs a metadata store and storage")
+	}
+	return RestoreSnapshot(e.store, e.destinations()[0], snapshotID, sink, opts)
+}
+
+// Restore restores the snapshot exported to bundlePath to sink. Restoring
+// from the export doesn't need the metadata store or storage.
+func (e *Engine) Restore(bundlePath string, sink OutputSink, stats *Stats) error {
+	if stats == nil {
+		stats = NewStats()
+	}
+	return RestoreFromBundle(bundlePath, sink, stats)
+}
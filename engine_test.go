@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memStorage is a Storage holding objects in memory, standing in for any
+// destination the engine is given.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	chains  map[string][]TransformInfo
+	uploads int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string][]byte{}, chains: map[string][]TransformInfo{}}
+}
+
+func (s *memStorage) Name() string {
+	return "mem"
+}
+
+func (s *memStorage) Upload(key, filePath string, pipeline *Pipeline) ([]TransformInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	body, chain, err := pipeline.Wrap(file)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	s.chains[key] = chain
+	s.uploads++
+	return chain, nil
+}
+
+func (s *memStorage) Stored(key string) ([]TransformInfo, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chain, ok := s.chains[key]
+	return chain, ok, nil
+}
+
+func (s *memStorage) Download(key, versionID string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	delete(s.chains, key)
+	return nil
+}
+
+func TestEngineWithFakes(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "alpha alpha alpha", "sub/b.txt": "beta", "sub/c.txt": "beta"}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.Transforms = []string{"gzip"}
+	cfg.DedupCacheSize = 10
+	storage := newMemStorage()
+	store := newMemStore()
+	engine := NewEngine(&Config{Backup: *cfg}, store, func() []Storage { return []Storage{storage} })
+
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Note: "embedded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Stats.FilesDone != 3 || len(summary.Failed) != 0 {
+		t.Fatalf("summary %+v", summary)
+	}
+	snapshot, err := store.FindSnapshot(summary.SnapshotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Note != "embedded" {
+		t.Errorf("note %q", snapshot.Note)
+	}
+	// b.txt and c.txt share an object.
+	if storage.uploads != 2 {
+		t.Fatalf("%d uploads, want 2", storage.uploads)
+	}
+	err = store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		stored := storage.objects[metadata.objectKey()]
+		r, err := Unwrap(bytes.NewReader(stored), metadata.Transforms)
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if string(content) != files[metadata.RelPath] {
+			t.Errorf("%s stored as %q", metadata.RelPath, content)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing new to store the second time.
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if storage.uploads != 2 {
+		t.Fatalf("%d uploads after a second backup, want 2", storage.uploads)
+	}
+}
+
+func TestEngineBackupCancelled(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a": "a", "b": "b"})
+	cfg := testBackupConfig(t)
+	storage := newMemStorage()
+	engine := NewEngine(&Config{Backup: *cfg}, newMemStore(), func() []Storage { return []Storage{storage} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	summary, err := engine.Backup(ctx, []SourceConfig{{Path: src}}, BackupOptions{})
+	if err == nil || !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("Backup = %v, want it cancelled", err)
+	}
+	if len(summary.Failed) != 2 || storage.uploads != 0 {
+		t.Fatalf("%d failed and %d uploaded after cancelling, want 2 and 0", len(summary.Failed), storage.uploads)
+	}
+}
+
+func TestEngineRestoresSnapshot(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	src := t.TempDir()
+	files := map[string]string{"a.txt": strings.Repeat("alpha ", 100), "sub/b.txt": "beta", "sub/c.txt": "beta"}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.Transforms = []string{"gzip", "aes-gcm"}
+	engine, _, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gets := s3.count("GET")
+	dst := t.TempDir()
+	if err := engine.RestoreSnapshot(summary.SnapshotID, hashCheckSink{NewLocalSink(dst, conflictOverwrite)}, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+	// b.txt and c.txt share an object.
+	if n := s3.count("GET") - gets; n != 2 {
+		t.Errorf("%d downloads, want 2", n)
+	}
+
+	if err := engine.RestoreSnapshot("missing", NewLocalSink(t.TempDir(), conflictOverwrite), RestoreOptions{}); err == nil {
+		t.Error("restoring a missing snapshot succeeded")
+	}
+	if err := NewEngine(&Config{}, nil, nil).RestoreSnapshot(summary.SnapshotID, NewLocalSink(t.TempDir(), conflictOverwrite), RestoreOptions{}); err == nil {
+		t.Error("restoring without a store or storage succeeded")
+	}
+}
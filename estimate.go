@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// RequestEstimate predicts the S3 requests a backup makes, counted over
+// all destinations. Multipart uploads make a request to create the upload,
+// one per part and one to complete it, all billed like PUTs. With dedup,
+// new content is looked up before it is stored and repeated content is
+// stored once; the estimate assumes none of it is in the bucket yet and
+// that the dedup cache holds everything seen in the run.
+type RequestEstimate struct {
+	Objects          int64
+	UniqueObjects    int64
+	Puts             int64
+	MultipartUploads int64
+	Parts            int64
+	Heads            int64
+}
+
+// requestEstimator accumulates planned actions into a RequestEstimate.
+type requestEstimator struct {
+	destinations []*S3Config
+	cached       bool
+	scope        string
+	estimate     RequestEstimate
+	seen         map[string]struct{}
+	bundles      map[string]int64
+}
+
+// newRequestEstimator creates a requestEstimator for uploads to the
+// primary bucket and every destination in cfg.
+func newRequestEstimator(primary *S3Config, cfg *BackupConfig) *requestEstimator {
+	return &requestEstimator{
+		destinations: append([]*S3Config{primary}, destinationS3Configs(cfg)...),
+		cached:       cfg.DedupCacheSize > 0,
+		scope:        cfg.DedupScope,
+		seen:         make(map[string]struct{}),
+		bundles:      make(map[string]int64),
+	}
+}
+
+func (e *requestEstimator) add(metadata *FileMetadata, action string) {
+	switch action {
+	case actionUpload:
+		// Streamed files aren't hashed yet and, like any file without
+		// dedup, count as unique.
+		key := metadata.Hash
+		if key == "" || e.scope == dedupNone {
+			key = "path:" + metadata.Path
+		} else {
+			// Content the cache remembers isn't looked up again, without
+			// a cache every file is.
+			_, seen := e.seen[key]
+			if !seen || !e.cached {
+				e.estimate.Heads += int64(len(e.destinations))
+			}
+			if seen {
+				e.estimate.Objects++
+				return
+			}
+		}
+		e.addObject(key, metadata.Size)
+	case actionBundle:
+		// The Bundler stores a directory's small files as one object, about
+		// as large as the files together.
+		e.bundles[filepath.Dir(metadata.Path)] += metadata.Size
+	}
+}
+
+func (e *requestEstimator) addObject(key string, size int64) {
+	e.estimate.Objects++
+	if _, ok := e.seen[key]; !ok {
+		e.seen[key] = struct{}{}
+		e.estimate.UniqueObjects++
+	}
+
+	for _, cfg := range e.destinations {
+		if size < cfg.multipartThreshold() {
+			e.estimate.Puts++
+			continue
+		}
+		parts := (size + cfg.partSize() - 1) / cfg.partSize()
+		e.estimate.MultipartUploads++
+		e.estimate.Parts += parts
+		e.estimate.Puts += parts + 2
+	}
+}
+
+func (e *requestEstimator) result() RequestEstimate {
+	for dir, size := range e.bundles {
+		e.addObject("bundle:"+dir, size)
+	}
+	e.bundles = make(map[string]int64)
+	return e.estimate
+}
+
+func (re RequestEstimate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "objects:          %d (%d unique)\n", re.Objects, re.UniqueObjects)
+	fmt.Fprintf(&b, "PUT requests:     %d\n", re.Puts)
+	fmt.Fprintf(&b, "multipart:        %d uploads, %d parts\n", re.MultipartUploads, re.Parts)
+	fmt.Fprintf(&b, "HEAD requests:    %d", re.Heads)
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestEstimate(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"a.txt":   "same content",
+		"b.txt":   "same content",
+		"c.txt":   "other",
+		"big.bin": strings.Repeat("x", 25),
+	})
+	// Only big.bin is uploaded in parts, three of them.
+	s3Cfg := &S3Config{PartSize: 10, MultipartThreshold: 20}
+
+	tests := []struct {
+		name  string
+		scope string
+		cache int
+		want  RequestEstimate
+	}{
+		// Every file is stored without a lookup, as its own object.
+		{"without dedup", dedupNone, 100, RequestEstimate{Objects: 4, UniqueObjects: 4, Puts: 8, MultipartUploads: 1, Parts: 3}},
+		// b.txt is a.txt's content, looked up again but not stored.
+		{"without cache", dedupGlobal, 0, RequestEstimate{Objects: 4, UniqueObjects: 3, Puts: 7, MultipartUploads: 1, Parts: 3, Heads: 4}},
+		// b.txt is a.txt's content, found in the cache: no lookup, no PUT.
+		{"with dedup", dedupGlobal, 100, RequestEstimate{Objects: 4, UniqueObjects: 3, Puts: 7, MultipartUploads: 1, Parts: 3, Heads: 3}},
+	}
+	for _, tt := range tests {
+		cfg := testBackupConfig(t)
+		cfg.DedupScope = tt.scope
+		cfg.DedupCacheSize = tt.cache
+		estimator := newRequestEstimator(s3Cfg, cfg)
+		for _, metadata := range scanFiles(t, []SourceConfig{{Path: src}}, cfg) {
+			metadata := metadata
+			estimator.add(&metadata, planAction(&metadata, cfg))
+		}
+		if got := estimator.result(); got != tt.want {
+			t.Errorf("%s: estimate %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// validateExcludes checks that every exclude pattern is well formed, so a
+// typo fails the config instead of silently matching nothing.
+func validateExcludes(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// excluded reports whether the file or directory at rel, relative to the
+// source root, matches one of patterns. Patterns containing a slash are
+// matched against rel, others against the base name, as in filepath.Match.
+func excluded(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	name := rel[strings.LastIndex(rel, "/")+1:]
+	for _, pattern := range patterns {
+		target := name
+		if strings.Contains(pattern, "/") {
+			target = rel
+		}
+		if ok, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// patternSet holds patterns that can be replaced while they are matched
+// against.
+type patternSet struct {
+	mu       sync.RWMutex
+	patterns []string
+}
+
+func newPatternSet(patterns []string) *patternSet {
+	return &patternSet{patterns: patterns}
+}
+
+func (s *patternSet) get() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.patterns
+}
+
+func (s *patternSet) set(patterns []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.patterns = patterns
+}
+
+// excludePatterns returns the exclude patterns in effect, which change with
+// config reloads while a backup runs.
+func (c *BackupConfig) excludePatterns() []string {
+	if c.excludes == nil {
+		return c.Exclude
+	}
+	return c.excludes.get()
+}
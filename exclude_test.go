@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExcludeFile(t *testing.T) {
+	patterns := filepath.Join(t.TempDir(), "excludes")
+	if err := os.WriteFile(patterns, []byte("# build output\n*.o\n\n  cache  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadTestConfig(t, fmt.Sprintf("[backup]\nexclude = [\"*.log\"]\nexclude_file = %q\n", patterns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.log", "*.o", "cache"}; !reflect.DeepEqual(loaded.Backup.Exclude, want) {
+		t.Fatalf("excludes %q, want %q", loaded.Backup.Exclude, want)
+	}
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"main.c":       "int main;",
+		"main.o":       "object",
+		"run.log":      "log",
+		"cache/a.txt":  "cached",
+		"docs/cache.d": "kept",
+	})
+	cfg := testBackupConfig(t)
+	cfg.Exclude = loaded.Backup.Exclude
+	got := relPaths(scanFiles(t, []SourceConfig{{Path: src}}, cfg))
+	if want := []string{"docs/cache.d", "main.c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("backed up %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(patterns, []byte("[unclosed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTestConfig(t, fmt.Sprintf("[backup]\nexclude_file = %q\n", patterns)); err == nil {
+		t.Error("malformed pattern in the exclude file accepted")
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sys/unix"
+)
+
+// An export bundle holds a snapshot's catalog and the bytes of every object
+// it refers to, so the snapshot can be restored without S3 or MongoDB. It is
+// written and read front to back:
+//
+//	magic    "DHEXPORT" and a uint32 format version
+//	catalog  the snapshot document, then one document per file, as BSON,
+//	         ended by a zero int32
+//	objects  per object: uint16 key length, key, uint64 size and the
+//	         object exactly as it is stored, transformed; ended by a zero
+//	         key length
+//	index    per object: uint16 key length, key and the uint64 offset of
+//	         its size field; ended by a zero key length
+//	trailer  the uint64 offset of the index and "DHINDEX!"
+//
+// Numbers are big-endian.
+const (
+	exportMagic        = "DHEXPORT"
+	exportTrailerMagic = "DHINDEX!"
+	exportVersion      = 1
+)
+
+// countingWriter tracks the offset of what has been written through it.
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeKey(w io.Writer, key string) error {
+	if len(key) > 0xffff {
+		return fmt.Errorf("object key %s is too long", key)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(key))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, key)
+	return err
+}
+
+// ExportBundle writes the snapshot and every object it refers to in bucket to
+// a single file at outPath.
+func ExportBundle(client MongoDBClient, s3Client *S3Client, bucket, snapshotID, outPath string) error {
+	snapshot, err := client.FindSnapshot(snapshotID)
+	if err != nil {
+		return fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := &countingWriter{w: bufio.NewWriter(f)}
+
+	if _, err := io.WriteString(w, exportMagic); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(exportVersion)); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	raw, err := bson.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return fmt.Errorf("writing catalog: %w", err)
+	}
+
+	var keys []string
+	// versions are the pinned versions to export, by key. The first file
+	// of an object decides which one it is.
+	versions := make(map[string]string)
+	err = client.ForEachFile(snapshot.ID, func(metadata *FileMetadata) error {
+		raw, err := bson.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+		if key := metadata.objectKey(); key != "" {
+			if _, ok := versions[key]; !ok {
+				versions[key] = metadata.VersionID
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, int32(0))
+	}
+	if err != nil {
+		return fmt.Errorf("writing catalog: %w", err)
+	}
+
+	offsets := make([]int64, len(keys))
+	for i, key := range keys {
+		if err := exportObject(w, s3Client, bucket, key, versions[key], &offsets[i]); err != nil {
+			return fmt.Errorf("exporting %s: %w", key, err)
+		}
+	}
+	if err := writeKey(w, ""); err != nil {
+		return fmt.Errorf("writing objects: %w", err)
+	}
+
+	indexOffset := w.n
+	for i, key := range keys {
+		if err := writeKey(w, key); err != nil {
+			return fmt.Errorf("writing index: %w", err)
+		}
+		if err := binary.Write(w, binary.BigEndian, uint64(offsets[i])); err != nil {
+			return fmt.Errorf("writing index: %w", err)
+		}
+	}
+	if err := writeKey(w, ""); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint64(indexOffset)); err != nil {
+		return fmt.Errorf("writing trailer: %w", err)
+	}
+	if _, err := io.WriteString(w, exportTrailerMagic); err != nil {
+		return fmt.Errorf("writing trailer: %w", err)
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("exported snapshot %s with %d objects to [%s]", snapshot.ID, len(keys), outPath)
+	return nil
+}
+
+func exportObject(w *countingWriter, s3Client *S3Client, bucket, key, versionID string, offset *int64) error {
+	head, err := s3Client.HeadVersion(bucket, key, versionID)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return fmt.Errorf("object is missing")
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	body, err := s3Client.DownloadVersion(bucket, key, versionID)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := writeKey(w, key); err != nil {
+		return err
+	}
+	*offset = w.n
+	if err := binary.Write(w, binary.BigEndian, uint64(size)); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, body, size)
+	return err
+}
+
+// RestoreFromBundle restores every file of the snapshot exported to
+// bundlePath to sink, at its relative path. Only the bundle is read. The
+// files of the catalog are counted as scanned in stats, and as done once
+// they are written.
+func RestoreFromBundle(bundlePath string, sink OutputSink, stats *Stats) error {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	snapshot, err := readBundleHeader(r, bundlePath)
+	if err != nil {
+		return err
+	}
+
+	// Files are grouped by the object holding them, so each object is
+	// unpacked once, when the stream reaches it.
+	run := newRestoreRun(sink, stats, false)
+	for {
+		var metadata FileMetadata
+		err := readCatalogDocument(r, &metadata)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading catalog: %w", err)
+		}
+		if err := run.add(&metadata); err != nil {
+			return err
+		}
+	}
+
+	for {
+		key, err := readKey(r)
+		if err != nil {
+			return fmt.Errorf("reading objects: %w", err)
+		}
+		if key == "" {
+			break
+		}
+		var size uint64
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return err
+		}
+
+		object := io.LimitReader(r, int64(size))
+		if err := run.object(key, object); err != nil {
+			return err
+		}
+
+		// Whatever the object's transforms didn't read is skipped.
+		if _, err := io.Copy(io.Discard, object); err != nil {
+			return err
+		}
+	}
+
+	for key, files := range run.byKey {
+		log.Printf("object %s of %d files is missing from the bundle", key, len(files))
+	}
+	log.Printf("restored %d files of snapshot %s to [%s], kept %d existing files", run.restored, snapshot.ID, sink, run.kept)
+	if len(run.byKey) > 0 {
+		return fmt.Errorf("%d objects are missing from the bundle", len(run.byKey))
+	}
+	return nil
+}
+
+// readBundleHeader checks the magic and version of the bundle read by r and
+// reads the snapshot document starting its catalog.
+func readBundleHeader(r io.Reader, bundlePath string) (*Snapshot, error) {
+	magic := make([]byte, len(exportMagic))
+	var version uint32
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != exportMagic {
+		return nil, fmt.Errorf("%s is not an export bundle", bundlePath)
+	}
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != exportVersion {
+		return nil, fmt.Errorf("unsupported export bundle version %d", version)
+	}
+
+	var snapshot Snapshot
+	if err := readCatalogDocument(r, &snapshot); err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// bundleRestoreSize returns how many bytes restoring the bundle at
+// bundlePath writes, the sum of the sizes of its restorable files. Only the
+// catalog is read.
+func bundleRestoreSize(bundlePath string) (int64, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if _, err := readBundleHeader(r, bundlePath); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for {
+		var metadata FileMetadata
+		err := readCatalogDocument(r, &metadata)
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading catalog: %w", err)
+		}
+		if !metadata.MountPoint && !metadata.Denied && !metadata.ChecksumFailed {
+			total += metadata.Size
+		}
+	}
+}
+
+// restoreObject writes the files stored in object, either a whole file
+// shared by every one of files, or a directory bundle. It returns how many
+// files were written and how many the sink kept as they were. With
+// hardLink, files of the same content are linked to the first one written.
+func restoreObject(object io.Reader, sink OutputSink, files []*FileMetadata, hardLink bool) (int, int, error) {
+	if len(files) == 0 {
+		return 0, 0, nil
+	}
+	content, err := Unwrap(object, files[0].Transforms)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if files[0].BundleKey == "" {
+		return writeShared(sink, files, content, hardLink)
+	}
+
+	members := make(map[string][]*FileMetadata)
+	for _, metadata := range files {
+		members[metadata.BundlePath] = append(members[metadata.BundlePath], metadata)
+	}
+	restored, kept := 0, 0
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return restored, kept, nil
+		}
+		if err != nil {
+			return restored, kept, err
+		}
+		// Directories with identical content share a bundle, so a member
+		// can belong to several files.
+		matching := members[header.Name]
+		if len(matching) == 0 {
+			continue
+		}
+		n, skipped, err := writeShared(sink, matching, tr, hardLink)
+		restored += n
+		kept += skipped
+		if err != nil {
+			return restored, kept, err
+		}
+	}
+}
+
+// writeShared writes content, read once, as every one of files. The first
+// file the sink doesn't keep as it was is written from content, the others
+// are copied from it, or linked to it with hardLink when the sink can.
+func writeShared(sink OutputSink, files []*FileMetadata, content io.Reader, hardLink bool) (int, int, error) {
+	var written *FileMetadata
+	restored, kept := 0, 0
+	for _, metadata := range files {
+		var err error
+		switch {
+		case written == nil:
+			err = sink.WriteFile(metadata, content)
+		case hardLink:
+			err = linkFile(sink, written, metadata)
+			if errors.Is(err, errLinkUnsupported) {
+				err = copyRestoredFile(sink, written, metadata)
+			}
+		default:
+			err = copyRestoredFile(sink, written, metadata)
+		}
+		if errors.Is(err, errConflictSkipped) {
+			log.Printf("[%s] exists, keeping it", metadata.RelPath)
+			kept++
+			continue
+		}
+		if err != nil {
+			return restored, kept, err
+		}
+		if written == nil {
+			written = metadata
+		}
+		restored++
+	}
+	return restored, kept, nil
+}
+
+func copyRestoredFile(sink OutputSink, from, metadata *FileMetadata) error {
+	src, err := sink.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return sink.WriteFile(metadata, src)
+}
+
+// readCatalogDocument decodes the next BSON document of the catalog into v.
+// It returns io.EOF at the zero length ending the catalog.
+func readCatalogDocument(r io.Reader, v interface{}) error {
+	var length int32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	if length == 0 {
+		return io.EOF
+	}
+	if length < 5 || length > maxBSONDocumentSize {
+		return fmt.Errorf("invalid document length %d", length)
+	}
+
+	// BSON documents start with their own little-endian length.
+	doc := make([]byte, length)
+	binary.LittleEndian.PutUint32(doc, uint32(length))
+	if _, err := io.ReadFull(r, doc[4:]); err != nil {
+		return err
+	}
+	return bson.Unmarshal(doc, v)
+}
+
+func readKey(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	key := make([]byte, length)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven export <file> [snapshot-id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return fmt.Errorf("missing output file")
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	return ExportBundle(client, NewS3Client(&Cfg.S3), Cfg.Backup.Bucket, fs.Arg(1), fs.Arg(0))
+}
+
+func runRestoreExport(args []string) error {
+	fs := flag.NewFlagSet("restore-export", flag.ExitOnError)
+	sourceRoot := fs.String("verify-against-source", "", "compare every restored file with the file at the same path below this directory, if it still exists")
+	force := fs.Bool("force", false, "restore even if the destination doesn't have enough free space")
+	verify := fs.Bool("verify-on-restore", true, "check that the content of every file hashes to its recorded hash before writing it")
+	onConflict := fs.String("on-conflict", conflictOverwrite, "what to do with files that exist in the destination: overwrite, skip, rename (restore next to them with a suffix) or newer (overwrite only with a newer backup)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven restore-export [--force] [--on-conflict policy] [--verify-on-restore=false] [--verify-against-source dir] <file> <dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected an export file and a destination directory")
+	}
+	if err := validateConflictPolicy(*onConflict); err != nil {
+		return fmt.Errorf("--on-conflict: %w", err)
+	}
+
+	need, err := bundleRestoreSize(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := checkRestoreSpace(fs.Arg(1), need, unix.Statfs); err != nil {
+		if !*force {
+			return fmt.Errorf("%w, run with --force to restore anyway", err)
+		}
+		log.Printf("restoring anyway: %v", err)
+	}
+
+	stats := NewStats()
+	stopProgress := reportProgress(stats, "restoring")
+	defer stopProgress()
+
+	var sink OutputSink = progressSink{NewLocalSink(fs.Arg(1), *onConflict), stats}
+	if *verify {
+		sink = hashCheckSink{sink}
+	}
+	var check *sourceCheckSink
+	if *sourceRoot != "" {
+		check = newSourceCheckSink(sink, *sourceRoot)
+		sink = check
+	}
+	if err := NewEngine(&Cfg, nil, nil).Restore(fs.Arg(0), sink, stats); err != nil {
+		return err
+	}
+	if check != nil {
+		return check.Err()
+	}
+	return nil
+}
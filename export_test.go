@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writeTestBundle writes an export bundle of snapshot with files and the
+// objects, by key, they are stored in, the way ExportBundle lays it out.
+func writeTestBundle(t *testing.T, snapshot *Snapshot, files []*FileMetadata, objects map[string][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := &countingWriter{w: bufio.NewWriter(f)}
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDoc := func(v interface{}) {
+		t.Helper()
+		raw, err := bson.Marshal(v)
+		must(err)
+		_, err = w.Write(raw)
+		must(err)
+	}
+
+	_, err = io.WriteString(w, exportMagic)
+	must(err)
+	must(binary.Write(w, binary.BigEndian, uint32(exportVersion)))
+	writeDoc(snapshot)
+	for _, metadata := range files {
+		writeDoc(metadata)
+	}
+	must(binary.Write(w, binary.BigEndian, int32(0)))
+
+	var keys []string
+	offsets := make(map[string]int64)
+	for _, metadata := range files {
+		key := metadata.objectKey()
+		if _, ok := objects[key]; !ok {
+			continue
+		}
+		if _, ok := offsets[key]; ok {
+			continue
+		}
+		must(writeKey(w, key))
+		offsets[key] = w.n
+		keys = append(keys, key)
+		must(binary.Write(w, binary.BigEndian, uint64(len(objects[key]))))
+		_, err = w.Write(objects[key])
+		must(err)
+	}
+	must(writeKey(w, ""))
+
+	indexOffset := w.n
+	for _, key := range keys {
+		must(writeKey(w, key))
+		must(binary.Write(w, binary.BigEndian, uint64(offsets[key])))
+	}
+	must(writeKey(w, ""))
+	must(binary.Write(w, binary.BigEndian, uint64(indexOffset)))
+	_, err = io.WriteString(w, exportTrailerMagic)
+	must(err)
+	must(w.w.Flush())
+	return path
+}
+
+func TestBundleRestoreSize(t *testing.T) {
+	files := []*FileMetadata{
+		{RelPath: "a", Size: 100, Hash: "sha256:aa"},
+		{RelPath: "b", Size: 50, Hash: "sha256:aa"},
+		{RelPath: "denied", Size: 1000, Denied: true},
+		{RelPath: "mnt", MountPoint: true},
+	}
+	path := writeTestBundle(t, &Snapshot{ID: "s1"}, files, map[string][]byte{"sha256:aa": make([]byte, 100)})
+
+	size, err := bundleRestoreSize(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 150 {
+		t.Fatalf("bundleRestoreSize = %d, want 150", size)
+	}
+}
+
+func TestRestoreDownloadsSharedContentOnce(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("dir%d/copy%d", i%4, i)] = "the same content"
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("GET"); n != 1 {
+		t.Fatalf("%d downloads for 20 files of one content, want 1", n)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+}
+
+func TestExportBundleWriteError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail writes")
+	}
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "content"})
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, "/dev/full"); err == nil {
+		t.Fatal("exporting to a full device succeeded")
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	src := t.TempDir()
+	files := map[string]string{
+		"empty":          "",
+		"text":           "hello, hello, hello",
+		"dir/large":      string(testLines(1, 3*encryptSegmentSize+17)),
+		"dir/sub/nested": "nested",
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.Transforms = []string{"gzip", "aes-gcm"}
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	// The bundle is all a restore needs.
+	for _, key := range s3.keys(cfg.Bucket) {
+		s3.remove(cfg.Bucket, key)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %d files differing from the %d backed up", len(got), len(files))
+	}
+	if n := s3.count("GET"); n != len(files) {
+		t.Fatalf("%d downloads, want one per object while exporting", n)
+	}
+}
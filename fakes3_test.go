@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObject is an object held by fakeS3.
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	modified time.Time
+	version  string
+	// acl is the canned ACL the object was written with.
+	acl string
+	// storageClass is the class of an object archived with archive, and
+	// thaw the thaw requested for it, if any.
+	storageClass string
+	thaw         *fakeThaw
+}
+
+// fakeThaw is a thaw of an archived object, done once the object was
+// headed heads more times.
+type fakeThaw struct {
+	tier  string
+	days  int
+	heads int
+}
+
+// fakeS3 is an in-memory S3 endpoint serving the requests S3Client makes:
+// object puts, copies, heads, gets with a range, deletes, multipart uploads
+// and their listing, ListObjectsV2, versions of objects put with putVersion
+// and thaws of objects archived with archive. Objects are addressed
+// path-style, bucket then key.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	// versions holds every version of the objects put with putVersion,
+	// oldest first.
+	versions map[string][]*fakeObject
+	uploads  map[string]map[int][]byte
+	// requests counts the requests served by operation, such as "PUT",
+	// "COPY" or "LIST".
+	requests map[string]int
+	// paid counts the requests sent with the requester paying, by
+	// operation.
+	paid map[string]int
+	// failures makes requests of an operation fail with an error code,
+	// as a 400 the SDK doesn't retry.
+	failures map[string]string
+	// thawHeads is how many heads a thaw requested takes.
+	thawHeads int
+	server    *httptest.Server
+}
+
+func newFakeS3(t testing.TB) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{
+		objects:  map[string]*fakeObject{},
+		versions: map[string][]*fakeObject{},
+		uploads:  map[string]map[int][]byte{},
+		requests: map[string]int{},
+		paid:     map[string]int{},
+		failures: map[string]string{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// client returns an S3Client talking to the fake.
+func (f *fakeS3) client() *S3Client {
+	return NewS3Client(&S3Config{Region: "us-east-1", Endpoint: f.server.URL, AccessKey: "access", SecretKey: "secret"})
+}
+
+// put stores an object as if it had been uploaded.
+func (f *fakeS3) put(bucket, key string, data []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = &fakeObject{data: data, metadata: metadata, modified: time.Now()}
+}
+
+// putVersion stores a new version of an object, as a versioned bucket does
+// on every put, and makes it the latest.
+func (f *fakeS3) putVersion(bucket, key, version string, data []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object := &fakeObject{data: data, metadata: metadata, modified: time.Now(), version: version}
+	f.versions[bucket+"/"+key] = append(f.versions[bucket+"/"+key], object)
+	f.objects[bucket+"/"+key] = object
+}
+
+// backdate makes the object look written at modified.
+func (f *fakeS3) backdate(bucket, key string, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key].modified = modified
+}
+
+// get returns the object, or nil when there is none.
+// archive moves an object to an archive storage class, thawed when it was
+// headed heads times after a thaw is requested.
+func (f *fakeS3) archive(bucket, key, class string, heads int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object := f.objects[bucket+"/"+key]
+	object.storageClass = class
+	object.thaw = nil
+	f.thawHeads = heads
+}
+
+func (f *fakeS3) get(bucket, key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[bucket+"/"+key]
+}
+
+// remove deletes an object, as if it had been lost.
+func (f *fakeS3) remove(bucket, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, bucket+"/"+key)
+}
+
+// keys returns the keys in bucket, sorted.
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && !strings.Contains(key, "?upload=") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fail makes every later request of op fail with code, or succeed again
+// when code is "".
+func (f *fakeS3) fail(op, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = code
+}
+
+// count returns how many requests of op were served.
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[op]
+}
+
+// countPaid returns how many requests of op were sent with the requester
+// paying.
+func (f *fakeS3) countPaid(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paid[op]
+}
+
+// total returns how many requests were served.
+func (f *fakeS3) total() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, count := range f.requests {
+		n += count
+	}
+	return n
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op := operation(r, key)
+	f.requests[op]++
+	if r.Header.Get("X-Amz-Request-Payer") == "requester" {
+		f.paid[op]++
+	}
+	if code := f.failures[op]; code != "" {
+		s3Error(w, http.StatusBadRequest, code)
+		return
+	}
+	name := bucket + "/" + key
+	switch op {
+	case "LIST":
+		f.list(w, bucket, query.Get("prefix"))
+	case "LIST-VERSIONS":
+		f.listVersions(w, bucket, query.Get("prefix"))
+	case "LIST-MULTIPART":
+		f.listUploads(w, bucket, query.Get("prefix"))
+	case "CREATE-MULTIPART":
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+		f.objects[name+"?upload="+id] = &fakeObject{metadata: objectMetadata(r.Header), modified: time.Now(), acl: r.Header.Get("X-Amz-Acl")}
+	case "UPLOAD-PART":
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][part] = body
+		w.Header().Set("ETag", etag(body))
+	case "COMPLETE-MULTIPART":
+		id := query.Get("uploadId")
+		parts := f.uploads[id]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		pending := f.objects[name+"?upload="+id]
+		delete(f.objects, name+"?upload="+id)
+		delete(f.uploads, id)
+		f.objects[name] = &fakeObject{data: data, metadata: pending.metadata, modified: time.Now(), acl: pending.acl}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case "ABORT-MULTIPART":
+		delete(f.objects, name+"?upload="+query.Get("uploadId"))
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case "COPY":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		object, ok := f.objects[strings.TrimPrefix(source, "/")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		metadata := object.metadata
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			metadata = objectMetadata(r.Header)
+		}
+		f.objects[name] = &fakeObject{data: object.data, metadata: metadata, modified: time.Now(), acl: r.Header.Get("X-Amz-Acl")}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string
+		}{ETag: etag(object.data)})
+	case "PUT":
+		if sum := r.Header.Get("Content-Md5"); sum != "" && sum != contentMD5(body) {
+			s3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		f.objects[name] = &fakeObject{data: body, metadata: objectMetadata(r.Header), modified: time.Now(), acl: r.Header.Get("X-Amz-Acl")}
+		w.Header().Set("ETag", etag(body))
+	case "HEAD", "GET":
+		object, ok := f.objects[name]
+		if version := query.Get("versionId"); version != "" {
+			object, ok = nil, false
+			for _, v := range f.versions[name] {
+				if v.version == version {
+					object, ok = v, true
+				}
+			}
+		}
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if object.version != "" {
+			w.Header().Set("X-Amz-Version-Id", object.version)
+		}
+		for k, v := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("ETag", etag(object.data))
+		if object.storageClass != "" {
+			w.Header().Set("X-Amz-Storage-Class", object.storageClass)
+			thawed := object.thaw != nil && object.thaw.heads == 0
+			switch {
+			case r.Method == http.MethodHead && object.thaw != nil && !thawed:
+				object.thaw.heads--
+				w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+			case r.Method == http.MethodHead && thawed:
+				w.Header().Set("X-Amz-Restore", `ongoing-request="false", expiry-date="Fri, 23 Dec 2044 00:00:00 GMT"`)
+			case r.Method == http.MethodGet && !thawed:
+				s3Error(w, http.StatusForbidden, "InvalidObjectState")
+				return
+			}
+		}
+		data := object.data
+		status := http.StatusOK
+		if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && r.Method == http.MethodGet {
+			first, last, _ := strings.Cut(spec, "-")
+			start, _ := strconv.Atoi(first)
+			end := len(data) - 1
+			if last != "" {
+				end, _ = strconv.Atoi(last)
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case "RESTORE":
+		object, ok := f.objects[name]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if object.thaw != nil && object.thaw.heads > 0 {
+			s3Error(w, http.StatusConflict, "RestoreAlreadyInProgress")
+			return
+		}
+		var request struct {
+			Days                 int
+			GlacierJobParameters struct{ Tier string }
+		}
+		if err := xml.Unmarshal(body, &request); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		object.thaw = &fakeThaw{tier: request.GlacierJobParameters.Tier, days: request.Days, heads: f.thawHeads}
+		w.WriteHeader(http.StatusAccepted)
+	case "DELETE":
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// operation names the S3 operation of a request.
+func operation(r *http.Request, key string) string {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Has("versions"):
+		return "LIST-VERSIONS"
+	case r.Method == http.MethodGet && key == "" && query.Has("uploads"):
+		return "LIST-MULTIPART"
+	case r.Method == http.MethodGet && key == "":
+		return "LIST"
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		return "CREATE-MULTIPART"
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		return "UPLOAD-PART"
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		return "COMPLETE-MULTIPART"
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		return "ABORT-MULTIPART"
+	case r.Method == http.MethodPost && query.Has("restore"):
+		return "RESTORE"
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		return "COPY"
+	default:
+		return r.Method
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		ETag         string
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: prefix}
+	for name, object := range f.objects {
+		key, ok := strings.CutPrefix(name, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) || strings.Contains(key, "?upload=") {
+			continue
+		}
+		result.Contents = append(result.Contents, content{Key: key, Size: len(object.data), ETag: etag(object.data), LastModified: object.modified})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func (f *fakeS3) listVersions(w http.ResponseWriter, bucket, prefix string) {
+	type version struct {
+		Key          string
+		VersionId    string
+		IsLatest     bool
+		LastModified time.Time
+		Size         int
+		ETag         string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListVersionsResult"`
+		Name        string
+		Prefix      string
+		IsTruncated bool
+		Versions    []version `xml:"Version"`
+	}{Name: bucket, Prefix: prefix}
+	var names []string
+	for name := range f.versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key, ok := strings.CutPrefix(name, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		// Newest first, as S3 lists them.
+		versions := f.versions[name]
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			result.Versions = append(result.Versions, version{
+				Key: key, VersionId: v.version, IsLatest: i == len(versions)-1,
+				LastModified: v.modified, Size: len(v.data), ETag: etag(v.data),
+			})
+		}
+	}
+	writeXML(w, result)
+}
+
+// listUploads lists the multipart uploads in progress, started at the
+// modified time of their pending object.
+func (f *fakeS3) listUploads(w http.ResponseWriter, bucket, prefix string) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated time.Time
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		Prefix      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Bucket: bucket, Prefix: prefix}
+	for name, object := range f.objects {
+		key, id, ok := strings.Cut(strings.TrimPrefix(name, bucket+"/"), "?upload=")
+		if !ok || !strings.HasPrefix(name, bucket+"/") || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Uploads = append(result.Uploads, upload{Key: key, UploadId: id, Initiated: object.modified})
+	}
+	sort.Slice(result.Uploads, func(i, j int) bool { return result.Uploads[i].Key < result.Uploads[j].Key })
+	writeXML(w, result)
+}
+
+// objectMetadata returns the user metadata sent with a request.
+func objectMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k := range header {
+		if name, ok := strings.CutPrefix(k, "X-Amz-Meta-"); ok {
+			metadata[name] = header.Get(k)
+		}
+	}
+	return metadata
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// contentMD5 is the Content-MD5 header of data.
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// readFileFlags returns the inode flags of path, such as FS_IMMUTABLE_FL and
+// FS_APPEND_FL, as reported by FS_IOC_GETFLAGS. Filesystems without inode
+// flags yield 0.
+func readFileFlags(path string) (uint32, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if err == unix.ENOTTY || err == unix.ENOTSUP || err == unix.EINVAL {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return flags, nil
+}
+
+// writeFileFlags sets the inode flags of path, as read by readFileFlags.
+// Setting immutable or append-only takes CAP_LINUX_IMMUTABLE.
+func writeFileFlags(path string, flags uint32) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fsAppendFlag is FS_APPEND_FL, which x/sys/unix doesn't define.
+const fsAppendFlag = 0x20
+
+// appendOnly sets the append-only flag on path, skipping the test when that isn't
+// possible, and clears it again when the test ends so the file can be
+// removed.
+func appendOnly(t *testing.T, path string) {
+	t.Helper()
+	if err := writeFileFlags(path, fsAppendFlag); err != nil {
+		t.Skipf("can't set the append-only flag: %v", err)
+	}
+	t.Cleanup(func() { writeFileFlags(path, 0) })
+}
+
+func TestFileFlagsRecorded(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"log": "appended"})
+	appendOnly(t, filepath.Join(src, "log"))
+
+	cfg := testBackupConfig(t)
+	if files := scanFiles(t, []SourceConfig{{Path: src}}, cfg); files[0].FileFlags != 0 {
+		t.Errorf("flags %#x recorded without backup.preserve_file_flags", files[0].FileFlags)
+	}
+	cfg.PreserveFileFlags = true
+	files := scanFiles(t, []SourceConfig{{Path: src}}, cfg)
+	if files[0].FileFlags&fsAppendFlag == 0 {
+		t.Fatalf("recorded flags %#x, want append-only", files[0].FileFlags)
+	}
+}
+
+func TestRestoreAttributes(t *testing.T) {
+	files := []*FileMetadata{
+		{RelPath: "plain", Size: 4, Hash: sha256Hash("data"), Mode: 0o640},
+		{RelPath: "owned", Size: 4, Hash: sha256Hash("data"), Mode: 0o4750, Uid: 1234, Gid: 5678, FileFlags: fsAppendFlag},
+	}
+	bundle := writeTestBundle(t, &Snapshot{ID: "s1"}, files, map[string][]byte{sha256Hash("data"): []byte("data")})
+	dst := t.TempDir()
+	t.Cleanup(func() { writeFileFlags(filepath.Join(dst, "owned"), 0) })
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Sys().(*syscall.Stat_t).Mode & 0o7777; mode != 0o640 {
+		t.Errorf("plain restored with mode %o, want 640", mode)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("restoring owners and file flags takes root")
+	}
+	path := filepath.Join(dst, "owned")
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if stat.Uid != 1234 || stat.Gid != 5678 {
+		t.Errorf("owned restored as %d:%d, want 1234:5678", stat.Uid, stat.Gid)
+	}
+	// The mode comes after the owner, which would clear setuid.
+	if mode := stat.Mode & 0o7777; mode != 0o4750 {
+		t.Errorf("owned restored with mode %o, want 4750", mode)
+	}
+	flags, err := readFileFlags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&fsAppendFlag == 0 {
+		t.Skipf("restored flags %#x, the filesystem may not support append-only", flags)
+	}
+}
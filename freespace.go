@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// What a SpaceGuard does when the working filesystem runs low, chosen with
+// backup.min_free_space_action.
+const (
+	spacePause = "pause"
+	spaceAbort = "abort"
+)
+
+// spaceCheckInterval is how long a free-space reading is reused, and how
+// often a paused guard checks again.
+const spaceCheckInterval = 5 * time.Second
+
+// SpaceGuard keeps the scan from filling the filesystem datahaven spills
+// working files to: hash checkpoints, copies of changing files and
+// bundles. When free space drops below the minimum it either holds the
+// scan until space is freed, which happens as uploads finish and their
+// working files are removed, or stops it. A nil SpaceGuard never
+// intervenes.
+type SpaceGuard struct {
+	dir     string
+	min     uint64
+	action  string
+	statfs  func(path string, buf *unix.Statfs_t) error
+	mu      sync.Mutex
+	checked time.Time
+	free    uint64
+	err     error
+}
+
+// NewSpaceGuard creates a new instance of SpaceGuard for dir, or returns
+// nil when min is 0.
+func NewSpaceGuard(dir string, min uint64, action string) *SpaceGuard {
+	if min == 0 {
+		return nil
+	}
+	return &SpaceGuard{dir: dir, min: min, action: action, statfs: unix.Statfs}
+}
+
+func validateSpaceAction(action string) error {
+	switch action {
+	case spacePause, spaceAbort:
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q, expected %s or %s", action, spacePause, spaceAbort)
+	}
+}
+
+// Check returns once there is enough free space. In abort mode it returns an
+// error instead of waiting, and keeps returning it.
+func (g *SpaceGuard) Check() error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	logged := false
+	for {
+		if g.err != nil {
+			return g.err
+		}
+
+		free, err := g.available()
+		if err != nil {
+			// Not knowing the free space is no reason to stop the backup.
+			log.Printf("checking free space of [%s] failed: %v", g.dir, err)
+			return nil
+		}
+		if free >= g.min {
+			if logged {
+				log.Printf("[%s] has %d bytes free again, resuming", g.dir, free)
+			}
+			return nil
+		}
+
+		if g.action == spaceAbort {
+			g.err = fmt.Errorf("%s has %d bytes free, below backup.min_free_space_bytes %d", g.dir, free, g.min)
+			return g.err
+		}
+		if !logged {
+			log.Printf("[%s] has %d bytes free, below %d, pausing the scan", g.dir, free, g.min)
+			logged = true
+		}
+		time.Sleep(spaceCheckInterval)
+	}
+}
+
+// Err returns the error that aborted the scan, if any.
+func (g *SpaceGuard) Err() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+func (g *SpaceGuard) available() (uint64, error) {
+	if time.Since(g.checked) < spaceCheckInterval {
+		return g.free, nil
+	}
+
+	var st unix.Statfs_t
+	if err := g.statfs(g.dir, &st); err != nil {
+		return 0, err
+	}
+	g.free = st.Bavail * uint64(st.Bsize)
+	g.checked = time.Now()
+	return g.free, nil
+}
+
+// checkRestoreSpace fails when the filesystem a restore to dir writes to has
+// fewer than need bytes available. dir doesn't have to exist yet, the
+// closest parent that does is checked.
+func checkRestoreSpace(dir string, need int64, statfs func(path string, buf *unix.Statfs_t) error) error {
+	dir = filepath.Clean(dir)
+	var st unix.Statfs_t
+	for {
+		err := statfs(dir, &st)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, unix.ENOENT) || parent == dir {
+			return fmt.Errorf("checking free space of %s: %w", dir, err)
+		}
+		dir = parent
+	}
+
+	free := st.Bavail * uint64(st.Bsize)
+	if need > 0 && uint64(need) > free {
+		return fmt.Errorf("restoring needs %d bytes but %s has %d bytes free", need, dir, free)
+	}
+	return nil
+}
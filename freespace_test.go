@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeStatfs reports free bytes for every path under root and ENOENT for
+// the paths in missing.
+func fakeStatfs(free uint64, missing ...string) func(string, *unix.Statfs_t) error {
+	return func(path string, buf *unix.Statfs_t) error {
+		for _, m := range missing {
+			if path == m {
+				return unix.ENOENT
+			}
+		}
+		buf.Bsize = 4096
+		buf.Bavail = free / 4096
+		return nil
+	}
+}
+
+func TestCheckRestoreSpace(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "new")
+
+	tests := []struct {
+		name    string
+		free    uint64
+		need    int64
+		wantErr bool
+	}{
+		{"enough", 1 << 20, 1 << 19, false},
+		{"exactly", 1 << 20, 1 << 20, false},
+		{"insufficient", 1 << 20, 1<<20 + 1, true},
+		{"nothing to restore", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRestoreSpace(missing, tt.need, fakeStatfs(tt.free, missing))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRestoreSpace = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), dir) {
+				t.Fatalf("error %q doesn't name the existing parent %s", err, dir)
+			}
+		})
+	}
+}
+
+func TestSpaceGuardAbort(t *testing.T) {
+	g := NewSpaceGuard(t.TempDir(), 1<<20, spaceAbort)
+	g.statfs = fakeStatfs(1 << 10)
+	if err := g.Check(); err == nil {
+		t.Fatal("Check with too little space = nil, want an error")
+	}
+	if g.Err() == nil {
+		t.Fatal("Err after an abort = nil")
+	}
+
+	if g := NewSpaceGuard(t.TempDir(), 0, spaceAbort); g != nil {
+		t.Fatal("NewSpaceGuard with a minimum of 0 isn't nil")
+	}
+}
+
+func TestSpaceGuardPauses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a free-space check interval")
+	}
+	var mu sync.Mutex
+	free := uint64(1 << 10)
+	g := NewSpaceGuard(t.TempDir(), 1<<20, spacePause)
+	g.statfs = func(path string, buf *unix.Statfs_t) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return fakeStatfs(free)(path, buf)
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Check() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Check with too little space returned %v instead of pausing", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Space freed by finished uploads resumes the scan.
+	mu.Lock()
+	free = 1 << 30
+	mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Check after space was freed = %v", err)
+		}
+	case <-time.After(2 * spaceCheckInterval):
+		t.Fatal("Check still paused after space was freed")
+	}
+	if g.Err() != nil {
+		t.Fatalf("Err after a pause = %v", g.Err())
+	}
+}
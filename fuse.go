@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// mountValid is how long the kernel may cache names and attributes. A
+	// snapshot doesn't change.
+	mountValid = time.Hour
+	// mountMaxBackground bounds the requests the kernel sends without
+	// waiting for an answer, like read-ahead. The others come from the
+	// processes reading the mount, one at a time each.
+	mountMaxBackground = 12
+)
+
+// snapshotNode is a file or directory of a snapshotFS, as served to the
+// kernel. Its children are only made into nodes when they are looked up.
+type snapshotNode struct {
+	fs.Inode
+	fsys *snapshotFS
+	node *pathNode
+}
+
+var (
+	_ = (fs.NodeLookuper)((*snapshotNode)(nil))
+	_ = (fs.NodeReaddirer)((*snapshotNode)(nil))
+	_ = (fs.NodeGetattrer)((*snapshotNode)(nil))
+	_ = (fs.NodeOpener)((*snapshotNode)(nil))
+)
+
+// stableAttr returns the type and inode number n is known by.
+func stableAttr(n *pathNode) fs.StableAttr {
+	if n.isDir() {
+		return fs.StableAttr{Mode: syscall.S_IFDIR, Ino: n.ino}
+	}
+	return fs.StableAttr{Mode: syscall.S_IFREG, Ino: n.ino}
+}
+
+// attr fills out with the attributes of n.
+func (n *snapshotNode) attr(out *fuse.Attr) {
+	info := n.fsys.info(n.node)
+	out.Ino = n.node.ino
+	out.Size = uint64(info.Size())
+	out.Blocks = (out.Size + 511) / 512
+	out.Mode = stableAttr(n.node).Mode | uint32(info.Mode().Perm())
+	out.Nlink = 1
+	if n.node.isDir() {
+		out.Nlink = 2
+	}
+	mtime := info.ModTime()
+	out.SetTimes(&mtime, &mtime, &mtime)
+	out.Uid, out.Gid = uint32(info.uid), uint32(info.gid)
+}
+
+func (n *snapshotNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	child, ok := n.node.children[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	node := &snapshotNode{fsys: n.fsys, node: child}
+	node.attr(&out.Attr)
+	return n.NewInode(ctx, node, stableAttr(child)), 0
+}
+
+func (n *snapshotNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries := n.node.entries()
+	list := make([]fuse.DirEntry, len(entries))
+	for i, entry := range entries {
+		attr := stableAttr(entry)
+		list[i] = fuse.DirEntry{Name: entry.name, Mode: attr.Mode, Ino: attr.Ino}
+	}
+	return fs.NewListDirStream(list), 0
+}
+
+func (n *snapshotNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.attr(&out.Attr)
+	return 0
+}
+
+// Open reads the content of the file into the cache, if it isn't there,
+// and serves reads from the cached file.
+func (n *snapshotNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if n.node.isDir() {
+		return nil, 0, syscall.EISDIR
+	}
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, 0, syscall.EROFS
+	}
+	f, err := n.fsys.content(n.node)
+	if err != nil {
+		log.Printf("opening %s: %v", n.node.path(), err)
+		return nil, 0, syscall.EIO
+	}
+	// The pages read of a file stay valid between opens.
+	return &snapshotHandle{f: f}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// snapshotHandle is a file of a mounted snapshot opened for reading.
+type snapshotHandle struct {
+	f *os.File
+}
+
+var (
+	_ = (fs.FileReader)((*snapshotHandle)(nil))
+	_ = (fs.FileReleaser)((*snapshotHandle)(nil))
+)
+
+func (h *snapshotHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.f.ReadAt(dest, off)
+	if n == 0 && err != nil && !errors.Is(err, io.EOF) {
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *snapshotHandle) Release(ctx context.Context) syscall.Errno {
+	return fs.ToErrno(h.f.Close())
+}
+
+// mountSnapshotFS mounts fsys read-only at dir through fusermount, so it
+// needs no privilege beyond access to /dev/fuse.
+func mountSnapshotFS(fsys *snapshotFS, dir string) (*fuse.Server, error) {
+	valid := mountValid
+	root := &snapshotNode{fsys: fsys, node: fsys.root}
+	server, err := fs.Mount(dir, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:        "datahaven",
+			Name:          "datahaven",
+			Options:       []string{"ro", "default_permissions"},
+			MaxBackground: mountMaxBackground,
+		},
+		EntryTimeout: &valid,
+		AttrTimeout:  &valid,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mounting %s: %w", dir, err)
+	}
+	return server, nil
+}
+
+// mountCacheDir creates the directory keeping the content of the files read
+// from a mount: a new one below dir, or below the temp dir when dir is
+// empty, so removing it on unmount never removes what dir held.
+func mountCacheDir(dir string) (string, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", err
+		}
+	} else {
+		dir = Cfg.Backup.TempDir
+	}
+	return os.MkdirTemp(dir, "mount-cache-")
+}
+
+func runMount(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	cacheDir := flags.String("cache-dir", "", "directory to keep the content of the files read below, in a new directory removed on unmount; the temp dir when empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: datahaven mount [--cache-dir dir] <dir> [snapshot-id]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return fmt.Errorf("expected a mount point and optionally a snapshot")
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	cache, err := mountCacheDir(*cacheDir)
+	if err != nil {
+		return fmt.Errorf("creating cache directory: %w", err)
+	}
+	defer os.RemoveAll(cache)
+
+	objects := newDestinations(NewS3Client(&Cfg.S3), &Cfg.Backup)[0]
+	fsys, err := newSnapshotFS(client, objects, flags.Arg(1), cache)
+	if err != nil {
+		return err
+	}
+	mountPoint := flags.Arg(0)
+	server, err := mountSnapshotFS(fsys, mountPoint)
+	if err != nil {
+		return err
+	}
+	log.Printf("mounted snapshot %s at [%s], %d files, unmount with fusermount -u or Ctrl-C", fsys.snapshot.ID, mountPoint, fsys.root.files)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	unmounted := make(chan struct{})
+	defer close(unmounted)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				// A mount in use can't be unmounted, the next signal
+				// tries again.
+				err := server.Unmount()
+				if err == nil {
+					return
+				}
+				log.Printf("unmounting [%s]: %v", mountPoint, err)
+			case <-unmounted:
+				return
+			}
+		}
+	}()
+	server.Wait()
+	return nil
+}
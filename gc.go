@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// gcGrace is how long an unreferenced object is kept by default, so a
+// backup still in progress has time to record the files referring to it.
+const gcGrace = 24 * time.Hour
+
+// gcObject is an object of the bucket no snapshot references.
+type gcObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// GCReport lists what a collection removes: unreferenced objects older than
+// the grace period, and the unreferenced objects kept because they are
+// newer, which may belong to a backup still in progress.
+type GCReport struct {
+	Candidates       []gcObject `json:"candidates"`
+	Excluded         []gcObject `json:"excluded"`
+	ReclaimableBytes int64      `json:"reclaimable_bytes"`
+}
+
+func (r *GCReport) String() string {
+	var b strings.Builder
+	for _, object := range r.Candidates {
+		fmt.Fprintf(&b, "delete  %s  %d bytes  %s\n", object.Key, object.Size, object.LastModified.Format(time.RFC3339))
+	}
+	for _, object := range r.Excluded {
+		fmt.Fprintf(&b, "keep    %s  %d bytes  %s (within grace period)\n", object.Key, object.Size, object.LastModified.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "%d objects to delete, %d bytes reclaimable, %d kept within the grace period", len(r.Candidates), r.ReclaimableBytes, len(r.Excluded))
+	return b.String()
+}
+
+// findGarbage returns the objects of bucket that no file of any snapshot
+// refers to. Only keys of the client's namespace that look like datahaven
+// object keys are considered, and only the primary bucket; destinations
+// and the replica are left alone.
+func findGarbage(client MongoDBClient, s3Client *S3Client, bucket string, grace time.Duration) (*GCReport, error) {
+	referenced := make(map[string]struct{})
+	err := client.ForEachSnapshot(func(snapshot *Snapshot) error {
+		return client.ForEachFile(snapshot.ID, func(metadata *FileMetadata) error {
+			if key := metadata.objectKey(); key != "" {
+				referenced[key] = struct{}{}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshots: %w", err)
+	}
+
+	cutoff := time.Now().Add(-grace)
+	report := &GCReport{}
+	err = s3Client.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:       aws.String(bucket),
+		Prefix:       aws.String(s3Client.prefix),
+		RequestPayer: s3Client.requestPayer(),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if !s3Client.ownsKey(aws.StringValue(object.Key)) {
+				continue
+			}
+			key := s3Client.unprefixed(aws.StringValue(object.Key))
+			if _, ok := referenced[key]; ok || !isObjectKey(key) {
+				continue
+			}
+
+			garbage := gcObject{Key: key, Size: aws.Int64Value(object.Size), LastModified: aws.TimeValue(object.LastModified)}
+			if garbage.LastModified.After(cutoff) {
+				report.Excluded = append(report.Excluded, garbage)
+				continue
+			}
+			report.Candidates = append(report.Candidates, garbage)
+			report.ReclaimableBytes += garbage.Size
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing bucket %s: %w", bucket, err)
+	}
+	return report, nil
+}
+
+// isObjectKey reports whether key is named like the objects datahaven
+// stores, a hash with its algorithm prefix or a path-mtime key, possibly
+// scoped to a snapshot. Temporary keys of streamed uploads are included,
+// an interrupted upload leaves them behind.
+func isObjectKey(key string) bool {
+	if isStreamTempKey(key) {
+		return true
+	}
+	key = key[strings.LastIndex(key, "/")+1:]
+	if isPathMtimeKey(key) {
+		return true
+	}
+	_, err := hasherFor(key)
+	return err == nil
+}
+
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list what would be deleted without deleting anything")
+	jsonOutput := fs.Bool("json", false, "write the report as JSON")
+	yes := fs.Bool("yes", false, "don't ask for confirmation before deleting")
+	grace := fs.Duration("grace", gcGrace, "keep unreferenced objects written less than this long ago")
+	var olderThan ageFlag
+	fs.Var(&olderThan, "older-than", "only delete objects written longer ago than this, like 30d, 6m or 1y; at least --grace")
+	wait := fs.Bool("wait", false, "wait for running backups to the bucket rather than failing")
+	fs.Parse(args)
+	if olderThan != 0 {
+		if time.Duration(olderThan) < *grace {
+			return fmt.Errorf("--older-than %s is less than the grace period %s, lower --grace to delete newer objects", time.Duration(olderThan), *grace)
+		}
+		*grace = time.Duration(olderThan)
+	}
+
+	// A running backup may refer to an unreferenced object it found stored
+	// before recording the files that do.
+	unlock, err := acquireBucketLock(bucketLockPath(&Cfg.Backup, Cfg.S3.Endpoint, Cfg.Backup.Bucket), true, *wait)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	s3Client := NewS3Client(&Cfg.S3)
+	report, err := findGarbage(client, s3Client, Cfg.Backup.Bucket, *grace)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return fmt.Errorf("writing report: %w", err)
+		}
+	} else {
+		fmt.Println(report)
+	}
+
+	if *dryRun || len(report.Candidates) == 0 {
+		return nil
+	}
+	if !*yes {
+		fmt.Fprintf(os.Stderr, "Delete %d objects? [y/N] ", len(report.Candidates))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			return nil
+		}
+	}
+
+	for _, object := range report.Candidates {
+		if err := s3Client.deleteObject(Cfg.Backup.Bucket, object.Key); err != nil {
+			return fmt.Errorf("deleting %s: %w", object.Key, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %d objects, %d bytes.\n", len(report.Candidates), report.ReclaimableBytes)
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCDryRunReport(t *testing.T) {
+	s3 := newFakeS3(t)
+	store := newMemStore()
+	referenced, old, recent := sha256Hash("referenced"), sha256Hash("old orphan"), sha256Hash("recent orphan")
+	store.addSnapshot(&Snapshot{ID: "s1"}, []FileMetadata{{Path: "/src/file", Hash: referenced}})
+	s3.put("datahaven", referenced, []byte("referenced"), nil)
+	s3.put("datahaven", old, []byte("old orphan"), nil)
+	s3.put("datahaven", recent, []byte("recent orphan"), nil)
+	// Not named like anything datahaven stores.
+	s3.put("datahaven", "notes.txt", []byte("someone else's"), nil)
+	s3.backdate("datahaven", old, time.Now().Add(-48*time.Hour))
+	s3.backdate("datahaven", "notes.txt", time.Now().Add(-48*time.Hour))
+
+	report, err := findGarbage(store, s3.client(), "datahaven", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := func(objects []gcObject) []string {
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+	if got := keys(report.Candidates); !reflect.DeepEqual(got, []string{old}) {
+		t.Errorf("candidates %v, want %v", got, []string{old})
+	}
+	if got := keys(report.Excluded); !reflect.DeepEqual(got, []string{recent}) {
+		t.Errorf("excluded %v, want %v", got, []string{recent})
+	}
+	if report.ReclaimableBytes != int64(len("old orphan")) {
+		t.Errorf("%d bytes reclaimable, want %d", report.ReclaimableBytes, len("old orphan"))
+	}
+	if want := "1 objects to delete, 10 bytes reclaimable, 1 kept within the grace period"; !strings.HasSuffix(report.String(), want) {
+		t.Errorf("report %q doesn't end with %q", report, want)
+	}
+	if n := s3.count("DELETE"); n != 0 || len(s3.keys("datahaven")) != 4 {
+		t.Fatalf("finding garbage deleted objects: %d deletes, %v left", n, s3.keys("datahaven"))
+	}
+}
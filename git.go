@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitInfo is the checked out branch and commit of a git working tree.
+type GitInfo struct {
+	Branch string `bson:",omitempty"`
+	Commit string
+}
+
+// readGitInfo reads the HEAD of the git working tree rooted at dir by parsing
+// its .git directly. A dir that isn't a git repo yields nil.
+func readGitInfo(dir string) (*GitInfo, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil || gitDir == "" {
+		return nil, err
+	}
+
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: ") {
+		// Detached HEAD holds the commit itself.
+		return &GitInfo{Commit: ref}, nil
+	}
+	ref = strings.TrimPrefix(ref, "ref: ")
+
+	commit, err := resolveGitRef(gitDir, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &GitInfo{Branch: strings.TrimPrefix(ref, "refs/heads/"), Commit: commit}, nil
+}
+
+// findGitDir returns the git dir of the working tree at dir. .git is either
+// the git dir itself or, for worktrees and submodules, a file pointing to it.
+func findGitDir(dir string) (string, error) {
+	dotGit := filepath.Join(dir, ".git")
+	info, err := os.Stat(dotGit)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return dotGit, nil
+	}
+
+	content, err := os.ReadFile(dotGit)
+	if err != nil {
+		return "", err
+	}
+	gitDir := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(dir, gitDir)
+	}
+	return gitDir, nil
+}
+
+// resolveGitRef looks ref up as a loose ref and then in packed-refs. Linked
+// worktrees keep their refs in the common dir.
+func resolveGitRef(gitDir, ref string) (string, error) {
+	dirs := []string{gitDir}
+	if common, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir := strings.TrimSpace(string(common))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+		dirs = append(dirs, commonDir)
+	}
+
+	for _, d := range dirs {
+		if content, err := os.ReadFile(filepath.Join(d, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(content)), nil
+		}
+
+		packed, err := os.Open(filepath.Join(d, "packed-refs"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(packed)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && fields[1] == ref {
+				packed.Close()
+				return fields[0], nil
+			}
+		}
+		packed.Close()
+	}
+
+	// An unborn branch has no commit yet.
+	return "", nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testCommit  = "3b18e512dba79e4c8300dd08aeb37f8e728b8dad"
+	otherCommit = "9c1185a5c5e9fc54612808977ee8f548b2258d31"
+)
+
+func TestReadGitInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  *GitInfo
+	}{
+		{
+			name:  "not a repo",
+			files: map[string]string{"README": "hello"},
+		},
+		{
+			name: "loose ref",
+			files: map[string]string{
+				".git/HEAD":            "ref: refs/heads/main\n",
+				".git/refs/heads/main": testCommit + "\n",
+			},
+			want: &GitInfo{Branch: "main", Commit: testCommit},
+		},
+		{
+			name: "packed ref",
+			files: map[string]string{
+				".git/HEAD":        "ref: refs/heads/release/1.0\n",
+				".git/packed-refs": "# pack-refs with: peeled fully-peeled sorted\n" + otherCommit + " refs/heads/main\n" + testCommit + " refs/heads/release/1.0\n",
+			},
+			want: &GitInfo{Branch: "release/1.0", Commit: testCommit},
+		},
+		{
+			name:  "detached HEAD",
+			files: map[string]string{".git/HEAD": testCommit + "\n"},
+			want:  &GitInfo{Commit: testCommit},
+		},
+		{
+			name:  "unborn branch",
+			files: map[string]string{".git/HEAD": "ref: refs/heads/main\n"},
+			want:  &GitInfo{Branch: "main"},
+		},
+		{
+			name: "linked worktree",
+			files: map[string]string{
+				".git":                             "gitdir: main/.git/worktrees/wt\n",
+				"main/.git/worktrees/wt/HEAD":      "ref: refs/heads/feature\n",
+				"main/.git/worktrees/wt/commondir": "../..\n",
+				"main/.git/refs/heads/feature":     testCommit + "\n",
+			},
+			want: &GitInfo{Branch: "feature", Commit: testCommit},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+			got, err := readGitInfo(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("readGitInfo = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotRecordsGitInfo(t *testing.T) {
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{
+		".git/HEAD":            "ref: refs/heads/main\n",
+		".git/refs/heads/main": testCommit + "\n",
+	})
+	plain := filepath.Join(t.TempDir(), "plain")
+
+	cfg := testBackupConfig(t)
+	cfg.GitAware = true
+	snapshot := NewSnapshot([]SourceConfig{{Path: repo}, {Path: plain}}, cfg)
+	if got := snapshot.Sources[0].Git; got == nil || got.Commit != testCommit || got.Branch != "main" {
+		t.Fatalf("git info of the repo source = %+v", got)
+	}
+	if got := snapshot.Sources[1].Git; got != nil {
+		t.Fatalf("git info of a source that isn't a repo = %+v", got)
+	}
+
+	cfg.GitAware = false
+	if got := NewSnapshot([]SourceConfig{{Path: repo}}, cfg).Sources[0].Git; got != nil {
+		t.Fatalf("git info recorded without backup.git_aware: %+v", got)
+	}
+}
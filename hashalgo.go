@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// defaultHashAlgorithm is what content was hashed with before snapshots
+// recorded an algorithm.
+const defaultHashAlgorithm = "sha256"
+
+// hashAlgorithms are the algorithms content can be hashed with, by the
+// name that prefixes their hashes.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func validateHashAlgorithm(algorithm string) error {
+	if _, ok := hashAlgorithms[algorithm]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown algorithm %q, expected one of %s", algorithm, strings.Join(names, ", "))
+}
+
+// newHash returns a hash for algorithm, which must be valid. "" is the
+// default algorithm.
+func newHash(algorithm string) hash.Hash {
+	if algorithm == "" {
+		algorithm = defaultHashAlgorithm
+	}
+	return hashAlgorithms[algorithm]()
+}
+
+// formatHash returns the content hash h computed with algorithm, prefixed
+// with it.
+func formatHash(algorithm string, h hash.Hash) string {
+	if algorithm == "" {
+		algorithm = defaultHashAlgorithm
+	}
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// hashAlgorithm returns the algorithm the content of the snapshot's files
+// was hashed with.
+func (s *Snapshot) hashAlgorithm() string {
+	if s.HashAlgorithm == "" {
+		return defaultHashAlgorithm
+	}
+	return s.HashAlgorithm
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotsOfDifferentHashAlgorithms(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		engine.cfg.Backup.HashAlgorithm = algorithm
+		if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{SnapshotID: algorithm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The default changes after both were taken.
+	engine.cfg.Backup.HashAlgorithm = "sha512"
+
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		snapshot, err := store.FindSnapshot(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := snapshot.hashAlgorithm(); got != algorithm {
+			t.Errorf("snapshot %s records algorithm %s", algorithm, got)
+		}
+		store.ForEachFile(algorithm, func(metadata *FileMetadata) error {
+			if !strings.HasPrefix(metadata.Hash, algorithm+":") {
+				t.Errorf("snapshot %s: %s hashed as %s", algorithm, metadata.RelPath, metadata.Hash)
+			}
+			return nil
+		})
+
+		verified, err := engine.Verify(NewVerifier(s3.client(), cfg.Bucket, true, false), algorithm, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verified.ContentVerified != 2 || verified.Corrupt != 0 {
+			t.Errorf("snapshot %s: verified %+v, want both files' content", algorithm, verified)
+		}
+
+		bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+		if err := ExportBundle(store, s3.client(), cfg.Bucket, algorithm, bundle); err != nil {
+			t.Fatal(err)
+		}
+		dst := t.TempDir()
+		if err := engine.Restore(bundle, hashCheckSink{NewLocalSink(dst, conflictOverwrite)}, nil); err != nil {
+			t.Fatalf("restoring snapshot %s: %v", algorithm, err)
+		}
+		if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+			t.Errorf("snapshot %s restores %v, want %v", algorithm, got, files)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testBackupConfig returns a backup config with the defaults InitConfig
+// sets, working files in a temp dir of the test.
+func testBackupConfig(t *testing.T) *BackupConfig {
+	t.Helper()
+	return &BackupConfig{
+		Bucket:             "datahaven",
+		TempDir:            t.TempDir(),
+		UploadWorkers:      2,
+		MountPolicy:        mountDescend,
+		ChangingFiles:      changingFlag,
+		MinFreeSpaceAction: spacePause,
+		KeyStrategy:        keyContentHash,
+		HashAlgorithm:      defaultHashAlgorithm,
+		ChecksumRetries:    3,
+		OnChecksumMismatch: checksumAbort,
+		OnMissingSource:    missingAbort,
+		DedupScope:         dedupGlobal,
+		MaxAttempts:        3,
+	}
+}
+
+// writeFiles creates the files, by slash-separated path relative to dir,
+// with their content.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// scanFiles scans sources and returns what the scan emits, sorted by path.
+func scanFiles(t *testing.T, sources []SourceConfig, cfg *BackupConfig) []FileMetadata {
+	t.Helper()
+	metadataChan := make(chan FileMetadata, 1)
+	go scanSources(sources, cfg, nil, NewGate(), nil, nil, metadataChan)
+	var files []FileMetadata
+	for metadata := range metadataChan {
+		files = append(files, metadata)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// relPaths returns the RelPath of every file.
+func relPaths(files []FileMetadata) []string {
+	paths := make([]string, len(files))
+	for i, metadata := range files {
+		paths[i] = metadata.RelPath
+	}
+	return paths
+}
+
+// readDir returns the content of every file below dir, by slash-separated
+// relative path.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// memStore is an in-memory MongoDBClient holding snapshots and the files
+// of their collections. Methods it doesn't implement panic.
+type memStore struct {
+	MongoDBClient
+	mu          sync.Mutex
+	snapshots   []*Snapshot
+	collections map[string][]FileMetadata
+	// batches are the sizes of the InsertMany calls, in order.
+	batches []int
+}
+
+func newMemStore() *memStore {
+	return &memStore{collections: map[string][]FileMetadata{}}
+}
+
+// addSnapshot records a snapshot with files, after the existing ones.
+func (s *memStore) addSnapshot(snapshot *Snapshot, files []FileMetadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = append(s.snapshots, snapshot)
+	collection := snapshot.fileCollections()[0]
+	s.collections[collection] = append(s.collections[collection], files...)
+}
+
+func (s *memStore) InsertOne(collectionName string, document interface{}) error {
+	if collectionName != snapshotsCollection {
+		return s.InsertMany(collectionName, []interface{}{document})
+	}
+	var snapshot Snapshot
+	if err := convertBSON(document, &snapshot); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = append(s.snapshots, &snapshot)
+	return nil
+}
+
+func (s *memStore) InsertMany(collectionName string, documents []interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, document := range documents {
+		var metadata FileMetadata
+		if err := convertBSON(document, &metadata); err != nil {
+			return err
+		}
+		s.collections[collectionName] = append(s.collections[collectionName], metadata)
+	}
+	s.batches = append(s.batches, len(documents))
+	return nil
+}
+
+// UpdateMany supports filters of field equality and $or, and updates with
+// $set, $unset and $push, on snapshots and files.
+func (s *memStore) UpdateMany(collectionName string, filter, update interface{}) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched int64
+	if collectionName == snapshotsCollection {
+		for i, snapshot := range s.snapshots {
+			var updated Snapshot
+			ok, err := updateDocument(snapshot, &updated, filter.(bson.M), update.(bson.M))
+			if err != nil {
+				return matched, err
+			}
+			if ok {
+				s.snapshots[i] = &updated
+				matched++
+			}
+		}
+		return matched, nil
+	}
+	files := s.collections[collectionName]
+	for i := range files {
+		var updated FileMetadata
+		ok, err := updateDocument(&files[i], &updated, filter.(bson.M), update.(bson.M))
+		if err != nil {
+			return matched, err
+		}
+		if ok {
+			files[i] = updated
+			matched++
+		}
+	}
+	return matched, nil
+}
+
+// updateDocument applies update to document into updated if document
+// matches filter.
+func updateDocument(document, updated interface{}, filter, update bson.M) (bool, error) {
+	var doc bson.M
+	if err := convertBSON(document, &doc); err != nil {
+		return false, err
+	}
+	if !matchDocument(doc, filter) {
+		return false, nil
+	}
+	for op, fields := range update {
+		for field, value := range fields.(bson.M) {
+			switch op {
+			case "$set":
+				doc[field] = value
+			case "$unset":
+				delete(doc, field)
+			case "$push":
+				values, _ := doc[field].(bson.A)
+				doc[field] = append(values, value)
+			default:
+				panic("memStore: unsupported update " + op)
+			}
+		}
+	}
+	return true, convertBSON(doc, updated)
+}
+
+func matchDocument(doc, filter bson.M) bool {
+	for field, want := range filter {
+		if field == "$or" {
+			matched := false
+			for _, alternative := range want.(bson.A) {
+				matched = matched || matchDocument(doc, alternative.(bson.M))
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		if doc[field] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Find supports the filters UpdateMany does, on files.
+func (s *memStore) Find(collectionName string, filter, results interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []FileMetadata
+	for i := range s.collections[collectionName] {
+		var doc bson.M
+		if err := convertBSON(&s.collections[collectionName][i], &doc); err != nil {
+			return err
+		}
+		if matchDocument(doc, filter.(bson.M)) {
+			found = append(found, s.collections[collectionName][i])
+		}
+	}
+	*results.(*[]FileMetadata) = found
+	return nil
+}
+
+func (s *memStore) FindSnapshot(id string) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.findSnapshot(id)
+}
+
+func (s *memStore) findSnapshot(id string) (*Snapshot, error) {
+	var found *Snapshot
+	for _, snapshot := range s.snapshots {
+		if id == "" && snapshot.Continues == "" || snapshot.ID == id {
+			found = snapshot
+		}
+	}
+	if found == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	copied := *found
+	return &copied, nil
+}
+
+func (s *memStore) ForEachSnapshot(fn func(*Snapshot) error) error {
+	s.mu.Lock()
+	snapshots := append([]*Snapshot(nil), s.snapshots...)
+	s.mu.Unlock()
+	for _, snapshot := range snapshots {
+		if err := fn(snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileCollections resolves a snapshot's collections as MongoClient does.
+func (s *memStore) fileCollections(snapshotID string) []string {
+	snapshot, err := s.findSnapshot(snapshotID)
+	if err != nil {
+		return []string{snapshotID}
+	}
+	collections := snapshot.fileCollections()
+	for _, part := range snapshot.Parts {
+		collections = append(collections, s.fileCollections(part)...)
+	}
+	return collections
+}
+
+func (s *memStore) ForEachFile(snapshotID string, fn func(*FileMetadata) error) error {
+	s.mu.Lock()
+	var files []FileMetadata
+	for _, collection := range s.fileCollections(snapshotID) {
+		files = append(files, s.collections[collection]...)
+	}
+	s.mu.Unlock()
+	for i := range files {
+		if err := fn(&files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDir reads the entries of dir from the tree of every file, as browse
+// builds it from the paths.
+func (s *memStore) ListDir(snapshotID, dir string) ([]SnapshotEntry, error) {
+	root := newPathDir("", nil)
+	err := s.ForEachFile(snapshotID, func(metadata *FileMetadata) error {
+		if !metadata.Denied && !metadata.ChecksumFailed {
+			root.add(metadata.RelPath, metadata.Size, metadata.MountPoint)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	node, ok := root.lookup(dir)
+	if !ok || !node.isDir() {
+		return nil, nil
+	}
+	var entries []SnapshotEntry
+	for _, child := range node.entries() {
+		entries = append(entries, SnapshotEntry{Name: child.name, Dir: child.isDir(), Size: child.size, Files: child.files})
+	}
+	return entries, nil
+}
+
+func (s *memStore) CountFiles(snapshotID string) (int64, error) {
+	var n int64
+	err := s.ForEachFile(snapshotID, func(*FileMetadata) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (s *memStore) DeleteSnapshot(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, collection := range s.fileCollections(id) {
+		delete(s.collections, collection)
+	}
+	kept := s.snapshots[:0]
+	for _, snapshot := range s.snapshots {
+		if snapshot.ID != id && snapshot.Continues != id {
+			kept = append(kept, snapshot)
+		}
+	}
+	s.snapshots = kept
+	return nil
+}
+
+func (s *memStore) Close() {}
+
+// convertBSON copies document into v through its BSON encoding, as a
+// round trip through MongoDB would.
+func convertBSON(document, v interface{}) error {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+// testEngine returns an Engine backing up with cfg to a fake S3, recording
+// to an in-memory store.
+func testEngine(t *testing.T, cfg *BackupConfig) (*Engine, *memStore, *fakeS3) {
+	t.Helper()
+	store := newMemStore()
+	s3 := newFakeS3(t)
+	config := &Config{Backup: *cfg}
+	destinations := func() []Storage {
+		return newDestinations(s3.client(), &config.Backup)
+	}
+	return NewEngine(config, store, destinations), store, s3
+}
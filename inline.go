@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// inlineFile reads the content of a small file through the transform
+// pipeline so it can be stored in its metadata document instead of S3.
+func inlineFile(filePath string, pipeline *Pipeline) ([]byte, []TransformInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	body, transforms, err := pipeline.Wrap(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, transforms, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTinyFilesInlined(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"small":     "tiny content",
+		"dir/other": strings.Repeat("z", 100),
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	cfg.InlineThresholdBytes = 4096
+	cfg.Transforms = []string{"gzip"}
+	engine, store, s3 := testEngine(t, cfg)
+
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		if !metadata.Inline || len(metadata.InlineData) == 0 {
+			t.Errorf("%s isn't inlined", metadata.RelPath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.total(); n != 0 {
+		t.Fatalf("%d S3 requests backing up and exporting inlined files", n)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+}
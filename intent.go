@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	intentsCollection = "intents"
+	// intentRunsCollection holds a heartbeat per run writing intents.
+	intentRunsCollection = "intentruns"
+)
+
+// intentHeartbeatInterval is how often a run writing intents records that
+// it is alive. One whose heartbeat is older than intentStaleAfter stopped,
+// and a later run reconciles its intents.
+const (
+	intentHeartbeatInterval = 30 * time.Second
+	intentStaleAfter        = 4 * intentHeartbeatInterval
+)
+
+// Intent records that an object is being stored for a snapshot. It is
+// written before the upload and removed once the snapshot's metadata is all
+// inserted. An intent that outlives its run means the run stopped somewhere
+// in between.
+type Intent struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Snapshot string
+	Key      string
+	Path     string
+	Started  int64
+}
+
+// intentRun is the heartbeat of the run recording a snapshot's intents.
+type intentRun struct {
+	Snapshot  string `bson:"_id"`
+	Heartbeat int64
+}
+
+// IntentLog writes the intents of one run. A nil IntentLog writes nothing.
+type IntentLog struct {
+	client     MongoDBClient
+	snapshotID string
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewIntentLog creates a new instance of IntentLog for the run recording
+// snapshotID, or returns nil when disabled. It records the run's heartbeat
+// before any intent and keeps it fresh until Close.
+func NewIntentLog(client MongoDBClient, snapshotID string, enabled bool) (*IntentLog, error) {
+	if !enabled {
+		return nil, nil
+	}
+	// A run stopped while recording the same snapshot left its heartbeat.
+	if _, err := client.DeleteMany(intentRunsCollection, bson.M{"_id": snapshotID}); err != nil {
+		return nil, fmt.Errorf("recording intent heartbeat: %w", err)
+	}
+	if err := client.InsertOne(intentRunsCollection, &intentRun{Snapshot: snapshotID, Heartbeat: time.Now().UnixNano()}); err != nil {
+		return nil, fmt.Errorf("recording intent heartbeat: %w", err)
+	}
+	l := &IntentLog{client: client, snapshotID: snapshotID, stop: make(chan struct{}), done: make(chan struct{})}
+	go l.heartbeat()
+	return l, nil
+}
+
+func (l *IntentLog) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(intentHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			if _, err := l.client.UpdateMany(intentRunsCollection, bson.M{"_id": l.snapshotID}, bson.M{"$set": bson.M{"heartbeat": now.UnixNano()}}); err != nil {
+				log.Printf("recording intent heartbeat of snapshot %s: %v", l.snapshotID, err)
+			}
+		}
+	}
+}
+
+// Close stops the heartbeat. Intents left uncommitted are reconciled by a
+// later run once the heartbeat is stale.
+func (l *IntentLog) Close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+}
+
+// Begin records the intent to store the content of path as key.
+func (l *IntentLog) Begin(key, path string) error {
+	if l == nil {
+		return nil
+	}
+	intent := Intent{ID: primitive.NewObjectID(), Snapshot: l.snapshotID, Key: key, Path: path, Started: time.Now().UnixNano()}
+	if err := l.client.InsertOne(intentsCollection, &intent); err != nil {
+		return fmt.Errorf("recording intent for %s: %w", key, err)
+	}
+	return nil
+}
+
+// Commit removes the run's intents and heartbeat once its metadata is
+// inserted.
+func (l *IntentLog) Commit() error {
+	if l == nil {
+		return nil
+	}
+	if _, err := l.client.DeleteMany(intentsCollection, bson.M{"snapshot": l.snapshotID}); err != nil {
+		return err
+	}
+	_, err := l.client.DeleteMany(intentRunsCollection, bson.M{"_id": l.snapshotID})
+	return err
+}
+
+// recoverIntents reconciles the intents runs left behind, those of runs
+// whose heartbeat is stale or gone. Intents of runs still alive, on this
+// host or another, are left to them. An object no snapshot refers to is
+// deleted from every destination once its intent is older than grace:
+// dedup hits record no intent, so a run backing up other sources may refer
+// to the object without having recorded it yet. Until then the intent is
+// kept for a later run. An object referenced but missing from a
+// destination is uploaded again from the intent's path, if that still holds
+// the same content. In every other case the intent is just dropped.
+func recoverIntents(client MongoDBClient, destinations []Storage, pipeline *Pipeline, grace time.Duration) error {
+	var runs []intentRun
+	if err := client.Find(intentRunsCollection, bson.M{}, &runs); err != nil {
+		return fmt.Errorf("reading intent heartbeats: %w", err)
+	}
+	cutoff := time.Now().Add(-intentStaleAfter).UnixNano()
+	alive := make(map[string]struct{})
+	for _, run := range runs {
+		if run.Heartbeat >= cutoff {
+			alive[run.Snapshot] = struct{}{}
+		}
+	}
+	var all []Intent
+	if err := client.Find(intentsCollection, bson.M{}, &all); err != nil {
+		return fmt.Errorf("reading intents: %w", err)
+	}
+	var intents []Intent
+	for _, intent := range all {
+		if _, ok := alive[intent.Snapshot]; !ok {
+			intents = append(intents, intent)
+		}
+	}
+	// A missing heartbeat is as stale as an old one, so the stale ones
+	// can go before their intents are reconciled.
+	for _, run := range runs {
+		if _, ok := alive[run.Snapshot]; !ok {
+			if _, err := client.DeleteMany(intentRunsCollection, bson.M{"_id": run.Snapshot}); err != nil {
+				return fmt.Errorf("removing intent heartbeat of snapshot %s: %w", run.Snapshot, err)
+			}
+		}
+	}
+	if len(intents) == 0 {
+		return nil
+	}
+	log.Printf("reconciling %d intents left by interrupted runs", len(intents))
+
+	var collections []string
+	err := client.ForEachSnapshot(func(snapshot *Snapshot) error {
+		collections = append(collections, snapshot.fileCollections()...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading snapshots: %w", err)
+	}
+
+	graceCutoff := time.Now().Add(-grace).UnixNano()
+	for _, intent := range intents {
+		isReferenced, err := referencedIn(client, collections, intent.Key)
+		if err != nil {
+			return fmt.Errorf("looking up %s: %w", intent.Key, err)
+		}
+		if !isReferenced && intent.Started > graceCutoff {
+			continue
+		}
+		for _, destination := range destinations {
+			_, stored, err := destination.Stored(intent.Key)
+			if err != nil {
+				return fmt.Errorf("checking %s in %s: %w", intent.Key, destination.Name(), err)
+			}
+			switch {
+			case !isReferenced && stored:
+				if err := destination.Delete(intent.Key); err != nil {
+					return fmt.Errorf("deleting %s from %s: %w", intent.Key, destination.Name(), err)
+				}
+				log.Printf("deleted unrecorded object %s from %s", intent.Key, destination.Name())
+			case isReferenced && !stored:
+				if !sameContent(intent.Path, intent.Key) {
+					log.Printf("object %s is recorded but missing from %s, and [%s] no longer holds it", intent.Key, destination.Name(), intent.Path)
+					continue
+				}
+				if _, err := destination.Upload(intent.Key, intent.Path, pipeline); err != nil {
+					return fmt.Errorf("uploading %s to %s again: %w", intent.Key, destination.Name(), err)
+				}
+				log.Printf("uploaded recorded object %s to %s again from [%s]", intent.Key, destination.Name(), intent.Path)
+			}
+		}
+		if _, err := client.DeleteMany(intentsCollection, bson.M{"_id": intent.ID}); err != nil {
+			return fmt.Errorf("removing intent for %s: %w", intent.Key, err)
+		}
+	}
+	return nil
+}
+
+// referencedIn reports whether a file recorded in one of collections refers
+// to the object key, looking its records up by key rather than reading
+// them all.
+func referencedIn(client MongoDBClient, collections []string, key string) (bool, error) {
+	filter := bson.M{"$or": bson.A{bson.M{"hash": key}, bson.M{"objectkey": key}, bson.M{"bundlekey": key}}}
+	for _, name := range collections {
+		var files []FileMetadata
+		if err := client.Find(name, filter, &files); err != nil {
+			return false, err
+		}
+		// A file inlined or stored elsewhere may share the hash.
+		for i := range files {
+			if files[i].objectKey() == key {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sameContent reports whether the file at path still hashes to the content
+// hash key ends in.
+func sameContent(path, key string) bool {
+	hash := key[strings.LastIndex(key, "/")+1:]
+	algorithm, _, _ := strings.Cut(hash, ":")
+	if validateHashAlgorithm(algorithm) != nil {
+		return false
+	}
+	current, _, err := calculateHash(path, algorithm)
+	return err == nil && current == hash
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// intentStore is a memStore that also holds the documents of the intent
+// collections, filtered by field equality.
+type intentStore struct {
+	*memStore
+	mu   sync.Mutex
+	docs map[string][]bson.M
+}
+
+func newIntentStore() *intentStore {
+	return &intentStore{memStore: newMemStore(), docs: map[string][]bson.M{}}
+}
+
+func isIntentCollection(collectionName string) bool {
+	return collectionName == intentsCollection || collectionName == intentRunsCollection
+}
+
+func (s *intentStore) InsertOne(collectionName string, document interface{}) error {
+	if !isIntentCollection(collectionName) {
+		return s.memStore.InsertOne(collectionName, document)
+	}
+	var doc bson.M
+	if err := convertBSON(document, &doc); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[collectionName] = append(s.docs[collectionName], doc)
+	return nil
+}
+
+func (s *intentStore) UpdateMany(collectionName string, filter, update interface{}) (int64, error) {
+	if !isIntentCollection(collectionName) {
+		return s.memStore.UpdateMany(collectionName, filter, update)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched int64
+	for i, doc := range s.docs[collectionName] {
+		var updated bson.M
+		ok, err := updateDocument(doc, &updated, filter.(bson.M), update.(bson.M))
+		if err != nil {
+			return matched, err
+		}
+		if ok {
+			s.docs[collectionName][i] = updated
+			matched++
+		}
+	}
+	return matched, nil
+}
+
+func (s *intentStore) DeleteMany(collectionName string, filter interface{}) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []bson.M
+	for _, doc := range s.docs[collectionName] {
+		if !matchDocument(doc, filter.(bson.M)) {
+			kept = append(kept, doc)
+		}
+	}
+	deleted := int64(len(s.docs[collectionName]) - len(kept))
+	s.docs[collectionName] = kept
+	return deleted, nil
+}
+
+func (s *intentStore) Find(collectionName string, filter, results interface{}) error {
+	if !isIntentCollection(collectionName) {
+		return s.memStore.Find(collectionName, filter, results)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slice := reflect.ValueOf(results).Elem()
+	for _, doc := range s.docs[collectionName] {
+		if !matchDocument(doc, filter.(bson.M)) {
+			continue
+		}
+		elem := reflect.New(slice.Type().Elem())
+		if err := convertBSON(doc, elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return nil
+}
+
+// addIntent records an intent of snapshotID's run, started age ago.
+func (s *intentStore) addIntent(t *testing.T, snapshotID, key, path string, age time.Duration) {
+	t.Helper()
+	intent := Intent{ID: primitive.NewObjectID(), Snapshot: snapshotID, Key: key, Path: path, Started: time.Now().Add(-age).UnixNano()}
+	if err := s.InsertOne(intentsCollection, &intent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// intentSnapshots returns the snapshots of the recorded intents, sorted.
+func (s *intentStore) intentSnapshots(t *testing.T) []string {
+	t.Helper()
+	var intents []Intent
+	if err := s.Find(intentsCollection, bson.M{}, &intents); err != nil {
+		t.Fatal(err)
+	}
+	var snapshots []string
+	for _, intent := range intents {
+		snapshots = append(snapshots, intent.Snapshot)
+	}
+	sort.Strings(snapshots)
+	return snapshots
+}
+
+func TestRecoverIntents(t *testing.T) {
+	captureOutput(t)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"recorded": "recorded content", "orphan": "orphan content", "unowned": "unowned content", "live": "live content", "recent": "recent content"})
+	recordedPath := filepath.Join(src, "recorded")
+	recorded, orphan, unowned, live, recent := sha256Hash("recorded content"), sha256Hash("orphan content"), sha256Hash("unowned content"), sha256Hash("live content"), sha256Hash("recent content")
+	const grace = time.Hour
+
+	cfg := testBackupConfig(t)
+	s3 := newFakeS3(t)
+	destinations := newDestinations(s3.client(), cfg)
+	pipeline, err := NewPipeline(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(key, name string) {
+		t.Helper()
+		if _, err := destinations[0].Upload(key, filepath.Join(src, name), pipeline); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := newIntentStore()
+	store.addSnapshot(&Snapshot{ID: "crashed"}, []FileMetadata{{RelPath: "recorded", Hash: recorded}})
+
+	// The crashed run stopped after uploading an object but before
+	// recording it, and after recording one whose upload never made it.
+	stale := intentRun{Snapshot: "crashed", Heartbeat: time.Now().Add(-2 * intentStaleAfter).UnixNano()}
+	if err := store.InsertOne(intentRunsCollection, &stale); err != nil {
+		t.Fatal(err)
+	}
+	upload(orphan, "orphan")
+	store.addIntent(t, "crashed", orphan, "", 2*grace)
+	store.addIntent(t, "crashed", recorded, recordedPath, 2*grace)
+	// A run without a heartbeat at all is gone too.
+	upload(unowned, "unowned")
+	store.addIntent(t, "unowned", unowned, "", 2*grace)
+	// Another run may have found the object it uploaded last stored and
+	// not recorded it yet, so it is kept until the grace period is over.
+	upload(recent, "recent")
+	store.addIntent(t, "crashed", recent, "", 0)
+
+	// A run still going, however long it has been, keeps its intents and
+	// its object not recorded yet.
+	running, err := NewIntentLog(store, "running", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+	upload(live, "live")
+	store.addIntent(t, "running", live, "", 2*grace)
+
+	if err := recoverIntents(store, destinations, pipeline, grace); err != nil {
+		t.Fatal(err)
+	}
+
+	if s3.get(cfg.Bucket, orphan) != nil || s3.get(cfg.Bucket, unowned) != nil {
+		t.Error("objects no snapshot refers to are kept")
+	}
+	if object := s3.get(cfg.Bucket, recorded); object == nil || string(object.data) != "recorded content" {
+		t.Error("recorded object missing from storage isn't uploaded again")
+	}
+	if s3.get(cfg.Bucket, live) == nil {
+		t.Error("object of a running backup is deleted")
+	}
+	if s3.get(cfg.Bucket, recent) == nil {
+		t.Error("object uploaded within the grace period is deleted")
+	}
+	if got := store.intentSnapshots(t); !reflect.DeepEqual(got, []string{"crashed", "running"}) {
+		t.Errorf("intents of %v left, want the running backup's and the one within the grace period", got)
+	}
+	var runs []intentRun
+	if err := store.Find(intentRunsCollection, bson.M{}, &runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Snapshot != "running" {
+		t.Errorf("heartbeats %+v left, want the running backup's", runs)
+	}
+
+	// Committed, the running backup leaves nothing behind.
+	if err := running.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	runs = nil
+	if err := store.Find(intentRunsCollection, bson.M{}, &runs); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.intentSnapshots(t); !reflect.DeepEqual(got, []string{"crashed"}) || len(runs) != 0 {
+		t.Errorf("intents of %v and heartbeats %+v left after commit, want the one within the grace period", got, runs)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// Key strategies, chosen with backup.key_strategy.
+const (
+	keyContentHash = "content-hash"
+	keyPathMtime   = "path-mtime"
+)
+
+func validateKeyStrategy(strategy string) error {
+	switch strategy {
+	case keyContentHash, keyPathMtime:
+		return nil
+	default:
+		return fmt.Errorf("unknown key strategy %q, expected %s or %s", strategy, keyContentHash, keyPathMtime)
+	}
+}
+
+// pathMtimeKey identifies the file at path by its path, size and mtime. It
+// changes whenever any of them do, but two files with identical content
+// never share it.
+func pathMtimeKey(path string, info fs.FileInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())
+	return keyPathMtime + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// isPathMtimeKey reports whether key was derived by pathMtimeKey rather than
+// from the content.
+func isPathMtimeKey(key string) bool {
+	return strings.HasPrefix(key, keyPathMtime+":")
+}
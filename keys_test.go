@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPathMtimeSkipsReading(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a": "same content", "b": "same content"})
+	cfg := testBackupConfig(t)
+	cfg.KeyStrategy = keyPathMtime
+	cfg.DedupCacheSize = 100
+	engine, store, s3 := testEngine(t, cfg)
+
+	var trace bytes.Buffer
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Tracer: NewTracer(&trace)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(trace.String(), `"phase":"hash"`) {
+		t.Fatalf("files hashed under path-mtime:\n%s", trace.String())
+	}
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		if !isPathMtimeKey(metadata.Hash) {
+			t.Errorf("%s keyed %s", metadata.RelPath, metadata.Hash)
+		}
+		return nil
+	})
+	// Identical content under different paths doesn't dedupe.
+	if keys := s3.keys(cfg.Bucket); len(keys) != 2 {
+		t.Fatalf("bucket holds %v, want an object per file", keys)
+	}
+
+	// Unchanged files keep their keys and aren't read to be uploaded again.
+	puts := s3.count("PUT")
+	trace.Reset()
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Tracer: NewTracer(&trace)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("PUT") - puts; n != 0 {
+		t.Fatalf("%d unchanged files uploaded again", n)
+	}
+	for _, phase := range []string{`"phase":"hash"`, `"phase":"upload`} {
+		if strings.Contains(trace.String(), phase) {
+			t.Fatalf("unchanged files read in phase %s:\n%s", phase, trace.String())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localTransformsSuffix names the file next to an object recording the
+// transforms it was stored with, what S3 keeps in the object's metadata.
+const localTransformsSuffix = ".transforms"
+
+// LocalStorage stores objects as files below a directory of the local
+// filesystem, such as a mounted disk kept as another copy. An object is
+// written to a temp file, synced and renamed into place, so it is never
+// seen partially written, even after a crash.
+type LocalStorage struct {
+	name string
+	root string
+}
+
+// NewLocalStorage creates a new instance of LocalStorage. An empty name
+// defaults to the directory.
+func NewLocalStorage(name, root string) *LocalStorage {
+	if name == "" {
+		name = root
+	}
+	return &LocalStorage{name: name, root: root}
+}
+
+func (s *LocalStorage) Name() string {
+	return s.name
+}
+
+// path returns the file of key, refusing keys that would leave the root.
+func (s *LocalStorage) path(key string) (string, error) {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if !isWithin(path, s.root) || strings.HasSuffix(key, localTransformsSuffix) {
+		return "", fmt.Errorf("invalid object key %s", key)
+	}
+	return path, nil
+}
+
+// Upload stores the transformed content of the file at filePath under key.
+// The transforms are recorded first, so a stored object always has them.
+func (s *LocalStorage) Upload(key, filePath string, pipeline *Pipeline) ([]TransformInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	body, transforms, err := pipeline.Wrap(file)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	encoded, err := json.Marshal(transforms)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSynced(path+localTransformsSuffix, strings.NewReader(string(encoded))); err != nil {
+		return nil, fmt.Errorf("storing %s: %w", key, err)
+	}
+	if err := writeSynced(path, body); err != nil {
+		return nil, fmt.Errorf("storing %s: %w", key, err)
+	}
+	return transforms, nil
+}
+
+// writeSynced writes content to a temp file next to path, syncs it and
+// renames it to path, then syncs the directory so the rename is durable.
+func writeSynced(path string, content io.Reader) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".storing-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := io.Copy(f, content); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Stored reports whether key is stored and returns its transforms. An object
+// without them recorded counts as absent, like on S3.
+func (s *LocalStorage) Stored(key string) ([]TransformInfo, bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	encoded, err := os.ReadFile(path + localTransformsSuffix)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var transforms []TransformInfo
+	if err := json.Unmarshal(encoded, &transforms); err != nil {
+		return nil, false, nil
+	}
+	return transforms, true, nil
+}
+
+// Download reads the object of key. Local storage keeps no versions, so
+// only the current one can be read.
+func (s *LocalStorage) Download(key, versionID string) (io.ReadCloser, error) {
+	if versionID != "" {
+		return nil, fmt.Errorf("%s keeps no versions, can't read version %s of %s", s.name, versionID, key)
+	}
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path + localTransformsSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	content := strings.Repeat("local content ", 100)
+	writeFiles(t, src, map[string]string{"file": content})
+	pipeline, err := NewPipeline([]string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewLocalStorage("disk", t.TempDir())
+	key := "scoped/" + sha256Hash(content)
+
+	transforms, err := storage.Upload(key, filepath.Join(src, "file"), pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, ok, err := storage.Stored(key)
+	if err != nil || !ok || !sameTransforms(stored, transforms) || len(stored) != 1 {
+		t.Fatalf("Stored = %v, %v, %v, want the gzip chain", stored, ok, err)
+	}
+	body, err := storage.Download(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Unwrap(body, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	body.Close()
+	if err != nil || string(data) != content {
+		t.Fatalf("read back %d bytes, %v", len(data), err)
+	}
+
+	if err := storage.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := storage.Stored(key); ok || err != nil {
+		t.Fatalf("Stored after Delete = %v, %v", ok, err)
+	}
+	for _, bad := range []string{"../escaped", "key" + localTransformsSuffix} {
+		if _, err := storage.Upload(bad, filepath.Join(src, "file"), pipeline); err == nil {
+			t.Errorf("storing %s succeeded", bad)
+		}
+	}
+}
+
+func TestLocalStorageInterruptedUpload(t *testing.T) {
+	root := t.TempDir()
+	storage := NewLocalStorage("disk", root)
+	pipeline, _ := NewPipeline(nil)
+
+	// Reading a directory fails once the object is being written.
+	if _, err := storage.Upload("sha256:aa", t.TempDir(), pipeline); err == nil {
+		t.Fatal("storing unreadable content succeeded")
+	}
+	// A crash after recording the transforms leaves them without the
+	// object.
+	writeFiles(t, root, map[string]string{"sha256:bb" + localTransformsSuffix: "[]"})
+
+	for _, key := range []string{"sha256:aa", "sha256:bb"} {
+		if _, ok, err := storage.Stored(key); ok || err != nil {
+			t.Errorf("%s Stored = %v, %v, want it absent", key, ok, err)
+		}
+		if body, err := storage.Download(key, ""); err == nil {
+			body.Close()
+			t.Errorf("%s can be downloaded", key)
+		}
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".storing-") {
+			t.Errorf("temp file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestBackupToLocalDestination(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a": "alpha", "sub/b": "beta"}
+	writeFiles(t, src, files)
+	disk := t.TempDir()
+	cfg := testBackupConfig(t)
+	cfg.Destinations = []DestinationConfig{{Name: "disk", Path: disk}}
+	engine, store, _ := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The disk alone restores the snapshot.
+	dst := t.TempDir()
+	if err := RestoreSnapshot(store, NewLocalStorage("disk", disk), summary.SnapshotID, NewLocalSink(dst, conflictOverwrite), RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPath returns the lock file of backups of sources with the config at
+// configFile. Runs sharing both share the lock.
+func lockPath(cfg *BackupConfig, configFile string, sources []SourceConfig) string {
+	h := sha256.New()
+	if abs, err := filepath.Abs(configFile); err == nil {
+		configFile = abs
+	}
+	fmt.Fprintf(h, "%s\x00", configFile)
+	for _, source := range sources {
+		fmt.Fprintf(h, "%s\x00", source.Path)
+	}
+	return filepath.Join(tempDir(cfg), "datahaven-"+hex.EncodeToString(h.Sum(nil))[:16]+".lock")
+}
+
+// bucketLockPath returns the lock file backups and collections of bucket at
+// endpoint share. Backups hold it shared, so they run together, and gc
+// holds it exclusively: an object a running backup found stored, and
+// refers to before the files referring to it are recorded, is never
+// deleted under it. Only runs on this host see the lock.
+func bucketLockPath(cfg *BackupConfig, endpoint, bucket string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", endpoint, bucket)
+	return filepath.Join(tempDir(cfg), "datahaven-bucket-"+hex.EncodeToString(h.Sum(nil))[:16]+".lock")
+}
+
+// lockPollInterval is how often a waiting run retries the lock.
+const lockPollInterval = time.Second
+
+// acquireLock takes an exclusive flock on path. If another run holds it,
+// acquireLock waits for it when wait is set and fails otherwise. The lock
+// belongs to the open file, so the kernel releases it however the process
+// ends, signals included; the returned function releases it earlier.
+func acquireLock(path string, wait bool) (func(), error) {
+	return flockFile(path, unix.LOCK_EX, wait, "another backup of the same sources")
+}
+
+// acquireBucketLock takes the lock at bucketLockPath, shared for a backup
+// and exclusive for gc, waiting for the runs holding it when wait is set.
+func acquireBucketLock(path string, exclusive, wait bool) (func(), error) {
+	if exclusive {
+		return flockFile(path, unix.LOCK_EX, wait, "a backup to the bucket")
+	}
+	return flockFile(path, unix.LOCK_SH, wait, "a gc of the bucket")
+}
+
+// flockFile takes a flock of kind how on path, held by holder when taken.
+func flockFile(path string, how int, wait bool, holder string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	logged := false
+	for {
+		err = unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, err
+		}
+		if !wait {
+			f.Close()
+			return nil, fmt.Errorf("%s is running, it holds %s (use --wait to wait for it)", holder, path)
+		}
+		if !logged {
+			log.Printf("%s holds [%s], waiting for it", holder, path)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Record who holds it, for whoever finds the lock taken. A shared
+	// lock has several holders.
+	if how == unix.LOCK_EX {
+		f.Truncate(0)
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHoldLock isn't a test: run by TestLockAcrossProcesses as another
+// process, it holds the lock at DATAHAVEN_TEST_HOLD_LOCK until its stdin
+// closes.
+func TestHoldLock(t *testing.T) {
+	path := os.Getenv("DATAHAVEN_TEST_HOLD_LOCK")
+	if path == "" {
+		t.Skip("only run by TestLockAcrossProcesses")
+	}
+	unlock, err := acquireLock(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	os.Stdout.WriteString("locked\n")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+func TestLockAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.lock")
+	holder := exec.Command(os.Args[0], "-test.run=^TestHoldLock$")
+	holder.Env = append(os.Environ(), "DATAHAVEN_TEST_HOLD_LOCK="+path)
+	release, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Wait()
+	defer release.Close()
+	if line, _ := bufio.NewReader(out).ReadString('\n'); line != "locked\n" {
+		t.Fatalf("the other process didn't take the lock: %q", line)
+	}
+
+	if _, err := acquireLock(path, false); err == nil || !strings.Contains(err.Error(), "another backup") {
+		t.Fatalf("acquireLock without waiting = %v, want the lock reported as held", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		unlock, err := acquireLock(path, true)
+		if err == nil {
+			unlock()
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("waiting acquireLock returned while the lock was held: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	release.Close()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting acquireLock didn't get the lock once it was released")
+	}
+}
+
+func TestBucketLockSharedByBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bucket.lock")
+	first, err := acquireBucketLock(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acquireBucketLock(path, false, false)
+	if err != nil {
+		t.Fatalf("a second backup didn't share the lock: %v", err)
+	}
+	if _, err := acquireBucketLock(path, true, false); err == nil || !strings.Contains(err.Error(), "a backup to the bucket") {
+		t.Fatalf("gc during backups = %v, want the lock reported as held", err)
+	}
+	first()
+	second()
+
+	gc, err := acquireBucketLock(path, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gc()
+	if _, err := acquireBucketLock(path, false, false); err == nil || !strings.Contains(err.Error(), "a gc of the bucket") {
+		t.Fatalf("backup during gc = %v, want the lock reported as held", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// LogConfig controls the log lines written to stderr.
+type LogConfig struct {
+	// Microseconds adds microseconds to log timestamps, which makes the
+	// order of lines from concurrent uploads visible.
+	Microseconds bool `mapstructure:"microseconds"`
+}
+
+// syncWriter serializes writes to w. Everything written to stderr, log
+// lines, trace spans and stats, goes through one, so each record reaches
+// stderr whole even though it's written from many goroutines.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+// logOutput is the serialized stderr every record is written to.
+var logOutput = &syncWriter{w: os.Stderr}
+
+// setupLogging routes the standard logger through logOutput.
+func setupLogging(cfg *LogConfig) {
+	log.SetOutput(logOutput)
+	flags := log.LstdFlags
+	if cfg.Microseconds {
+		flags |= log.Lmicroseconds
+	}
+	log.SetFlags(flags)
+}
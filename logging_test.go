@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// byteWriter writes a byte at a time, yielding in between, so concurrent
+// records written to it unserialized would interleave.
+type byteWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *byteWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.buf.WriteByte(b)
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func TestLogLinesStayWhole(t *testing.T) {
+	setupLogging(&LogConfig{Microseconds: true})
+	var out byteWriter
+	logOutput.mu.Lock()
+	prev := logOutput.w
+	logOutput.w = &out
+	logOutput.mu.Unlock()
+	defer func() {
+		logOutput.mu.Lock()
+		logOutput.w = prev
+		logOutput.mu.Unlock()
+	}()
+
+	const workers, records = 16, 50
+	tracer := NewTracer(logOutput)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			payload := strings.Repeat(string(rune('a'+worker)), 40)
+			for j := 0; j < records; j++ {
+				log.Printf("worker %d record %d: %s", worker, j, payload)
+				tracer.Start(fmt.Sprintf("/data/%d/%s", worker, payload), "upload")()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	logLine := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} worker (\d+) record \d+: ([a-z]+)$`)
+	logs, spans := 0, 0
+	for _, line := range strings.Split(strings.TrimSuffix(out.buf.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "{") {
+			var span traceSpan
+			if err := json.Unmarshal([]byte(line), &span); err != nil || span.Phase != "upload" {
+				t.Fatalf("trace line %q is split or mixed: %v", line, err)
+			}
+			spans++
+			continue
+		}
+		m := logLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("log line %q is split or mixed", line)
+		}
+		var worker int
+		fmt.Sscan(m[1], &worker)
+		if want := strings.Repeat(string(rune('a'+worker)), 40); m[2] != want {
+			t.Fatalf("log line %q carries another worker's payload", line)
+		}
+		logs++
+	}
+	if logs != workers*records || spans != workers*records {
+		t.Fatalf("got %d log lines and %d spans, want %d of each", logs, spans, workers*records)
+	}
+}
@@ -1,24 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -30,6 +41,17 @@ type MongoDBConfig struct {
 	Password string `mapstructure:"password"`
 	Host     string `mapstructure:"host"`
 	Port     int    `mapstructure:"port"`
+
+	// A metadata batch is inserted once it holds BatchSize documents or
+	// MaxBatchBytes of BSON, whichever comes first.
+	BatchSize     int `mapstructure:"batch_size"`
+	MaxBatchBytes int `mapstructure:"max_batch_bytes"`
+
+	// ShardBy spreads each snapshot's file metadata over several
+	// collections: by host, or by a hash of the path over ShardCount
+	// collections. The snapshot document records which ones it used.
+	ShardBy    string `mapstructure:"shard_by"`
+	ShardCount int    `mapstructure:"shard_count"`
 }
 
 type S3Config struct {
@@ -37,31 +59,545 @@ type S3Config struct {
 	Endpoint  string `mapstructure:"endpoint"`
 	AccessKey string `mapstructure:"access_key"`
 	SecretKey string `mapstructure:"secret_key"`
+
+	// Objects smaller than MultipartThreshold are sent with a single
+	// PutObject, larger ones as multipart uploads of PartSize parts.
+	MultipartThreshold int64 `mapstructure:"multipart_threshold"`
+	PartSize           int64 `mapstructure:"part_size"`
+
+	// RequestPayer acknowledges that requests to requester-pays buckets are
+	// charged to this account.
+	RequestPayer bool `mapstructure:"request_payer"`
+
+	// MaxConnections is the number of idle connections kept per host. It
+	// defaults to enough for every upload worker sharing the client.
+	MaxConnections int `mapstructure:"max_connections"`
+
+	// UseARNRegion sends requests for access point ARN buckets to the
+	// ARN's region instead of Region.
+	UseARNRegion bool `mapstructure:"use_arn_region"`
+
+	// ObjectACL is the canned ACL objects are written with, such as
+	// bucket-owner-full-control for a bucket of another account. Empty
+	// leaves it to the bucket.
+	ObjectACL string `mapstructure:"object_acl"`
+
+	// CorrectClockSkew signs requests with the server's time once one is
+	// rejected for the local clock being off, and retries it. Without it
+	// such requests fail with a hint to fix the clock.
+	CorrectClockSkew bool `mapstructure:"correct_clock_skew"`
+
+	// uploadConcurrency is how many parts of a multipart upload are sent
+	// at once, lowered by the memory budget.
+	uploadConcurrency int
+}
+
+func (c *S3Config) partSize() int64 {
+	if c.PartSize > 0 {
+		return c.PartSize
+	}
+	return s3manager.DefaultUploadPartSize
+}
+
+func (c *S3Config) partConcurrency() int {
+	if c.uploadConcurrency > 0 {
+		return c.uploadConcurrency
+	}
+	return s3manager.DefaultUploadConcurrency
+}
+
+// maxPutObjectSize is the largest object S3 stores with a single PutObject.
+const maxPutObjectSize = 5 * 1024 * 1024 * 1024
+
+func (c *S3Config) multipartThreshold() int64 {
+	if c.MultipartThreshold > 0 {
+		return c.MultipartThreshold
+	}
+	return c.partSize()
+}
+
+func validateObjectACL(acl string) error {
+	if acl == "" {
+		return nil
+	}
+	for _, canned := range s3.ObjectCannedACL_Values() {
+		if acl == canned {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ACL %q, expected one of %s", acl, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+}
+
+func (c *S3Config) validate() error {
+	if err := validateObjectACL(c.ObjectACL); err != nil {
+		return fmt.Errorf("object_acl: %w", err)
+	}
+	if c.PartSize != 0 && c.PartSize < s3manager.MinUploadPartSize {
+		return fmt.Errorf("part_size must be at least %d", s3manager.MinUploadPartSize)
+	}
+	if c.multipartThreshold() < c.partSize() {
+		return fmt.Errorf("multipart_threshold %d is smaller than part_size %d", c.multipartThreshold(), c.partSize())
+	}
+	if c.multipartThreshold() > maxPutObjectSize {
+		return fmt.Errorf("multipart_threshold %d is larger than %d, the most a single PutObject stores", c.multipartThreshold(), int64(maxPutObjectSize))
+	}
+	return nil
+}
+
+type BackupConfig struct {
+	Sources []SourceConfig `mapstructure:"sources"`
+
+	Bucket       string   `mapstructure:"bucket"`
+	PreserveACLs bool     `mapstructure:"preserve_acls"`
+	Transforms   []string `mapstructure:"transforms"`
+	TempDir      string   `mapstructure:"temp_dir"`
+	GitAware     bool     `mapstructure:"git_aware"`
+	RecordBtime  bool     `mapstructure:"record_btime"`
+	// QuickHashBytes is the size of each of the first, middle and last blocks
+	// read for the quick hash. A file whose size and quick hash are those
+	// the previous snapshot recorded isn't hashed again. Zero disables the
+	// quick hash.
+	QuickHashBytes int64 `mapstructure:"quick_hash_bytes"`
+	// EncryptionKey is the hex AES-256 key of the aes-gcm transform. It is
+	// needed again to restore or verify what was encrypted with it.
+	EncryptionKey string `mapstructure:"encryption_key"`
+	// Files smaller than InlineThresholdBytes are stored in their metadata
+	// document rather than uploaded to S3. Zero disables inlining.
+	InlineThresholdBytes int64 `mapstructure:"inline_threshold_bytes"`
+	// Hashing files larger than HashCheckpointBytes saves its progress every
+	// HashCheckpointBytes, so an interrupted run resumes the hash. Zero
+	// disables checkpoints.
+	HashCheckpointBytes int64 `mapstructure:"hash_checkpoint_bytes"`
+
+	// Destinations are written to in addition to the primary bucket. A file
+	// is stored once MinDestinations of them hold it, all of them by default.
+	Destinations    []DestinationConfig `mapstructure:"destinations"`
+	MinDestinations int                 `mapstructure:"min_destinations"`
+
+	// Files whose hash is in DenyHashes, or listed one per line in
+	// DenyHashesFile, are recorded as denied and never uploaded. Content
+	// hashes aren't computed under key_strategy path-mtime, which rules
+	// them out. They must be of HashAlgorithm, unprefixed ones are sha256.
+	DenyHashes     []string `mapstructure:"deny_hashes"`
+	DenyHashesFile string   `mapstructure:"deny_hashes_file"`
+
+	// Files and directories matching a pattern in Exclude, or listed one
+	// per line in ExcludeFile, are left out of the backup. ExcludeFile is
+	// read at startup and when the config is reloaded.
+	Exclude     []string `mapstructure:"exclude"`
+	ExcludeFile string   `mapstructure:"exclude_file"`
+	// excludes replaces Exclude while a backup runs, so a config reload
+	// can change it under the scan.
+	excludes *patternSet
+	// quickHashes are the files of the previous snapshot whose hash is
+	// reused when their size and quick hash are unchanged.
+	quickHashes quickHashIndex
+
+	// Only files owned by one of OnlyUIDs and one of OnlyGIDs, when set,
+	// and by none of ExcludeUIDs and ExcludeGIDs are backed up.
+	OnlyUIDs    []int `mapstructure:"only_uids"`
+	OnlyGIDs    []int `mapstructure:"only_gids"`
+	ExcludeUIDs []int `mapstructure:"exclude_uids"`
+	ExcludeGIDs []int `mapstructure:"exclude_gids"`
+
+	// Files that fail are retried after the main pass until they have been
+	// tried MaxAttempts times, waiting RetryBackoff (doubling, jittered)
+	// before each round.
+	MaxAttempts  int           `mapstructure:"max_attempts"`
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+
+	// ControlSocket is the path of a Unix socket accepting pause, resume and
+	// status commands during a run. Empty disables it.
+	ControlSocket string `mapstructure:"control_socket"`
+
+	// UploadWorkers is the number of files uploaded concurrently. With
+	// PerWorkerClients each worker gets its own S3 clients and connection
+	// pools instead of sharing one.
+	UploadWorkers    int  `mapstructure:"upload_workers"`
+	PerWorkerClients bool `mapstructure:"per_worker_clients"`
+
+	// MetadataFields lists which optional fields (ctime, mtime, atime,
+	// btime, uid, gid, acl, fileflags, quickhash, inode) are stored with
+	// each file. Empty stores all of them. A quick hash is only trusted
+	// along with the mtime, ctime and inode it was recorded with.
+	MetadataFields []string `mapstructure:"metadata_fields"`
+
+	// Bundle packs the files of each directory into one compressed tar
+	// object instead of storing an object per file.
+	Bundle bool `mapstructure:"bundle"`
+
+	// MountPolicy is what the walk does with mount points inside a source:
+	// descend into them, skip them, or record them as a boundary.
+	MountPolicy string `mapstructure:"mount_policy"`
+
+	// PreserveFileFlags records inode flags such as immutable and
+	// append-only with each file. Restoring them takes root.
+	PreserveFileFlags bool `mapstructure:"preserve_file_flags"`
+
+	// ChangingFiles is what happens to files that change while they are
+	// hashed, including ones that are truncated or grow between the stat
+	// and the read: flag, skip or copy. Flagged files are recorded with the
+	// size that was read.
+	ChangingFiles string `mapstructure:"changing_files"`
+
+	// Normalizers rewrite the content of matching files before it is
+	// hashed, so logically identical files dedupe. Stored bytes are not
+	// affected, and normalized files aren't hashed with checkpoints.
+	Normalizers []NormalizerConfig `mapstructure:"normalizers"`
+
+	// MinFreeSpaceBytes is the free space kept on the temp dir's
+	// filesystem. Below it the scan pauses until space is freed, or the
+	// run stops, as MinFreeSpaceAction says. 0 disables the guard.
+	MinFreeSpaceBytes  int64  `mapstructure:"min_free_space_bytes"`
+	MinFreeSpaceAction string `mapstructure:"min_free_space_action"`
+
+	// StreamUpload hashes files while they are uploaded instead of reading
+	// them twice. Objects go to a temporary key first and are copied to
+	// their hash key once it is known. It needs a single destination and
+	// can't be combined with bundling.
+	StreamUpload bool `mapstructure:"stream_upload"`
+
+	// Files larger than BlockHashBytes also get a hash per block of that
+	// many bytes, for verify --blocks. Files hashed with checkpoints or a
+	// normalizer don't. 0 disables block hashes.
+	BlockHashBytes int64 `mapstructure:"block_hash_bytes"`
+
+	// DedupScope is how far identical content is shared. global, the
+	// default, stores it once for all snapshots: the least space, but an
+	// object can only be pruned once no snapshot refers to it. snapshot
+	// stores it once per snapshot, so deleting a snapshot's objects never
+	// affects another one, at the cost of storing unchanged content again
+	// with every snapshot. none doesn't share objects at all, not even
+	// between identical files of one snapshot.
+	DedupScope string `mapstructure:"dedup_scope"`
+
+	// DedupCacheSize is how many recently stored objects a run remembers,
+	// so files with the same content aren't looked up again. Objects not
+	// remembered are looked up with a HeadObject per destination, and 0
+	// looks up every file. It doesn't turn dedup off, dedup_scope none
+	// does.
+	DedupCacheSize int `mapstructure:"dedup_cache_size"`
+
+	// DedupRevalidateInterval is how often a long run looks up a sample of
+	// the objects it remembers again, and forgets those deleted behind
+	// its back so their content is stored again. 0 never looks again.
+	DedupRevalidateInterval time.Duration `mapstructure:"dedup_revalidate_interval"`
+
+	// MaxFilesPerSnapshot splits a run into linked snapshots of at most
+	// this many files each. Reading the first one covers all of them. 0
+	// never splits.
+	MaxFilesPerSnapshot int64 `mapstructure:"max_files_per_snapshot"`
+
+	// OnMissingSource is what happens when a source doesn't exist: abort
+	// the run, the default, or skip-warn to back up the other sources.
+	OnMissingSource string `mapstructure:"on_missing_source"`
+
+	// KeyStrategy is how object keys and file identities are derived:
+	// content-hash, the default, hashes the content and dedupes identical
+	// files; path-mtime derives them from path, size and mtime without
+	// reading the file, which disables dedup.
+	KeyStrategy string `mapstructure:"key_strategy"`
+
+	// HashAlgorithm is what file content is hashed with, sha256 or
+	// sha512. Each snapshot records the one it used, so changing it
+	// doesn't affect reading older snapshots, but content already stored
+	// under the other algorithm's hash is stored again.
+	HashAlgorithm string `mapstructure:"hash_algorithm"`
+
+	// MaxConcurrency caps hashing and uploading combined, on top of
+	// UploadWorkers and the single scanner. Each destination upload of
+	// a file takes its own slot. 0 means no global cap.
+	MaxConcurrency int `mapstructure:"max_concurrency"`
+
+	// UploadWindows are the daily time ranges, like "22:00-06:00", uploads
+	// run in. Outside of them uploads wait, and so does the scan with
+	// UploadWindowsPauseScan. The times are in UploadWindowsTimezone, an
+	// IANA name, or local time when it is empty. No ranges means uploads
+	// always run.
+	UploadWindows          []string `mapstructure:"upload_windows"`
+	UploadWindowsTimezone  string   `mapstructure:"upload_windows_timezone"`
+	UploadWindowsPauseScan bool     `mapstructure:"upload_windows_pause_scan"`
+
+	// ChecksumRetries is how many times an upload the server rejects for a
+	// checksum mismatch is sent again. OnChecksumMismatch is what happens
+	// when it still fails: abort the run, the default, or skip to record
+	// the file as not stored and go on.
+	ChecksumRetries    int    `mapstructure:"checksum_retries"`
+	OnChecksumMismatch string `mapstructure:"on_checksum_mismatch"`
+
+	// IntentLog records every object in MongoDB before it is uploaded and
+	// clears the records once the run's metadata is inserted. The next run
+	// reconciles what an interrupted one left, once its heartbeat in
+	// MongoDB stops: objects no snapshot refers to are deleted, recorded
+	// objects that are missing uploaded again.
+	IntentLog bool `mapstructure:"intent_log"`
+
+	// DeterministicSnapshotID derives the snapshot ID from the content of
+	// the sources instead of the start time, which hashes them an extra
+	// time first. A run whose content matches an existing snapshot reuses
+	// it rather than recording a duplicate. It can't be used with
+	// StreamUpload or command sources, whose content isn't known ahead.
+	DeterministicSnapshotID bool `mapstructure:"deterministic_snapshot_id"`
+
+	// MemoryBudgetMB caps the memory held together by metadata batches,
+	// the dedup cache and the buffers of multipart and single PutObject
+	// uploads. They are shrunk to fit it, which trades speed and
+	// HeadObjects for memory. 0 means no cap.
+	MemoryBudgetMB int64 `mapstructure:"memory_budget_mb"`
+}
+
+// ReplicaConfig is the disaster-recovery bucket objects are mirrored to.
+type ReplicaConfig struct {
+	S3     S3Config `mapstructure:",squash"`
+	Bucket string   `mapstructure:"bucket"`
 }
 
 type Config struct {
 	S3      S3Config      `mapstructure:"s3"`
 	MongoDB MongoDBConfig `mapstructure:"mongodb"`
+	Backup  BackupConfig  `mapstructure:"backup"`
+	Replica ReplicaConfig `mapstructure:"replica"`
+	Cost    CostConfig    `mapstructure:"cost"`
+	Log     LogConfig     `mapstructure:"log"`
+
+	// Tenant isolates a deployment's snapshots in their own MongoDB
+	// database and their objects under their own key prefix, so users
+	// sharing the same servers and buckets never see each other's data.
+	Tenant string `mapstructure:"tenant"`
 }
 
 func InitConfig(cfgFile string) error {
+	return loadConfig(viper.GetViper(), cfgFile, &Cfg)
+}
+
+// loadConfig reads the config file into cfg through v, and validates and
+// completes it. The config is reloaded with a fresh v and cfg.
+func loadConfig(v *viper.Viper, cfgFile string, cfg *Config) error {
 	if cfgFile == "" {
-		viper.SetConfigName("datahaven")
-		viper.SetConfigType("toml")
-		viper.AddConfigPath("$HOME/.datahaven")
-		viper.AddConfigPath("/etc")
+		v.SetConfigName("datahaven")
+		v.SetConfigType("toml")
+		v.AddConfigPath("$HOME/.datahaven")
+		v.AddConfigPath("/etc")
 	} else {
-		viper.SetConfigFile(cfgFile)
+		v.SetConfigFile(cfgFile)
 	}
 
-	if err := viper.ReadInConfig(); err != nil {
+	v.SetDefault("backup.bucket", "datahaven")
+	v.SetDefault("backup.upload_workers", 8)
+	v.SetDefault("backup.mount_policy", mountDescend)
+	v.SetDefault("backup.changing_files", changingFlag)
+	v.SetDefault("backup.min_free_space_action", spacePause)
+	v.SetDefault("backup.key_strategy", keyContentHash)
+	v.SetDefault("backup.hash_algorithm", defaultHashAlgorithm)
+	v.SetDefault("backup.checksum_retries", 3)
+	v.SetDefault("backup.on_checksum_mismatch", checksumAbort)
+	v.SetDefault("backup.on_missing_source", missingAbort)
+	v.SetDefault("backup.dedup_cache_size", 100000)
+	v.SetDefault("backup.dedup_scope", dedupGlobal)
+	v.SetDefault("backup.max_attempts", 3)
+	v.SetDefault("backup.retry_backoff", "5s")
+	v.SetDefault("mongodb.batch_size", 100)
+	v.SetDefault("mongodb.max_batch_bytes", 8*1024*1024)
+	v.SetDefault("mongodb.shard_count", 8)
+
+	if err := v.ReadInConfig(); err != nil {
 		return err
 	}
 
-	if err := viper.Unmarshal(&Cfg); err != nil {
+	if err := v.Unmarshal(cfg); err != nil {
 		return err
 	}
 
+	if err := resolveSecrets(credentialValues(cfg), secretResolvers); err != nil {
+		return err
+	}
+
+	if cfg.Backup.InlineThresholdBytes >= maxBSONDocumentSize {
+		return fmt.Errorf("backup.inline_threshold_bytes must be below %d", maxBSONDocumentSize)
+	}
+
+	if err := validateTenant(cfg.Tenant); err != nil {
+		return fmt.Errorf("tenant: %w", err)
+	}
+
+	if err := validateShardBy(&cfg.MongoDB); err != nil {
+		return fmt.Errorf("mongodb: %w", err)
+	}
+
+	if err := validateMountPolicy(cfg.Backup.MountPolicy); err != nil {
+		return fmt.Errorf("backup.mount_policy: %w", err)
+	}
+
+	if cfg.Backup.MinFreeSpaceBytes < 0 {
+		return fmt.Errorf("backup.min_free_space_bytes must not be negative")
+	}
+	if err := validateSpaceAction(cfg.Backup.MinFreeSpaceAction); err != nil {
+		return fmt.Errorf("backup.min_free_space_action: %w", err)
+	}
+
+	for i := range cfg.Backup.Sources {
+		if err := validateCommandSource(&cfg.Backup.Sources[i]); err != nil {
+			return fmt.Errorf("backup.sources: %w", err)
+		}
+	}
+	if err := validateDeterministicSnapshotID(&cfg.Backup, cfg.Backup.Sources); err != nil {
+		return err
+	}
+
+	if _, err := NewUploadWindows(cfg.Backup.UploadWindows, cfg.Backup.UploadWindowsTimezone); err != nil {
+		return fmt.Errorf("backup.upload_windows: %w", err)
+	}
+
+	if cfg.Backup.ChecksumRetries < 0 {
+		return fmt.Errorf("backup.checksum_retries must not be negative")
+	}
+	if err := validateChecksumPolicy(cfg.Backup.OnChecksumMismatch); err != nil {
+		return fmt.Errorf("backup.on_checksum_mismatch: %w", err)
+	}
+
+	if _, err := NewPipeline(cfg.Backup.Transforms); err != nil {
+		return fmt.Errorf("backup.transforms: %w", err)
+	}
+	for _, name := range cfg.Backup.Transforms {
+		if name != "aes-gcm" {
+			continue
+		}
+		if _, err := parseEncryptionKey(cfg.Backup.EncryptionKey); err != nil {
+			return fmt.Errorf("backup.encryption_key: %w", err)
+		}
+	}
+
+	if err := validateHashAlgorithm(cfg.Backup.HashAlgorithm); err != nil {
+		return fmt.Errorf("backup.hash_algorithm: %w", err)
+	}
+	if err := validateKeyStrategy(cfg.Backup.KeyStrategy); err != nil {
+		return fmt.Errorf("backup.key_strategy: %w", err)
+	}
+
+	if err := validateNormalizers(cfg.Backup.Normalizers); err != nil {
+		return fmt.Errorf("backup.normalizers: %w", err)
+	}
+
+	if err := validateChangingPolicy(cfg.Backup.ChangingFiles); err != nil {
+		return fmt.Errorf("backup.changing_files: %w", err)
+	}
+
+	if cfg.Backup.StreamUpload {
+		switch {
+		case len(cfg.Backup.Destinations) > 0:
+			return fmt.Errorf("backup.stream_upload can't be used with backup.destinations")
+		case cfg.Backup.Bundle:
+			return fmt.Errorf("backup.stream_upload can't be used with backup.bundle")
+		case cfg.Backup.KeyStrategy != keyContentHash:
+			return fmt.Errorf("backup.stream_upload needs backup.key_strategy %s", keyContentHash)
+		case cfg.Backup.DedupScope != dedupGlobal:
+			return fmt.Errorf("backup.stream_upload needs backup.dedup_scope %s", dedupGlobal)
+		case cfg.Backup.IntentLog:
+			return fmt.Errorf("backup.stream_upload can't be combined with backup.intent_log")
+		}
+	}
+
+	if cfg.Backup.BlockHashBytes < 0 {
+		return fmt.Errorf("backup.block_hash_bytes must not be negative")
+	}
+
+	if err := validateDedupScope(cfg.Backup.DedupScope); err != nil {
+		return fmt.Errorf("backup.dedup_scope: %w", err)
+	}
+
+	if cfg.Backup.DedupCacheSize < 0 {
+		return fmt.Errorf("backup.dedup_cache_size must not be negative")
+	}
+	if cfg.Backup.DedupRevalidateInterval < 0 {
+		return fmt.Errorf("backup.dedup_revalidate_interval must not be negative")
+	}
+
+	if err := validateMissingSourcePolicy(cfg.Backup.OnMissingSource); err != nil {
+		return fmt.Errorf("backup.on_missing_source: %w", err)
+	}
+
+	if _, err := metadataOmissions(cfg.Backup.MetadataFields); err != nil {
+		return fmt.Errorf("backup.metadata_fields: %w", err)
+	}
+
+	if cfg.Backup.UploadWorkers < 1 {
+		return fmt.Errorf("backup.upload_workers must be at least 1")
+	}
+	if cfg.Backup.MaxConcurrency < 0 {
+		return fmt.Errorf("backup.max_concurrency must not be negative")
+	}
+	if cfg.Backup.MemoryBudgetMB < 0 {
+		return fmt.Errorf("backup.memory_budget_mb must not be negative")
+	}
+	if cfg.Backup.MemoryBudgetMB > 0 {
+		fitMemoryBudget(cfg, cfg.Backup.MemoryBudgetMB<<20)
+	}
+	// Every worker runs up to partConcurrency part uploads at once through
+	// the client it uses.
+	connections := cfg.S3.partConcurrency()
+	if !cfg.Backup.PerWorkerClients {
+		connections *= cfg.Backup.UploadWorkers
+	}
+	for _, c := range append([]*S3Config{&cfg.S3}, destinationS3Configs(&cfg.Backup)...) {
+		if c.MaxConnections == 0 {
+			c.MaxConnections = connections
+		}
+	}
+
+	if err := cfg.S3.validate(); err != nil {
+		return fmt.Errorf("s3: %w", err)
+	}
+	if err := cfg.S3.validateBucket(cfg.Backup.Bucket); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if err := cfg.Replica.S3.validate(); err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	if err := cfg.Replica.S3.validateBucket(cfg.Replica.Bucket); err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	for _, d := range cfg.Backup.Destinations {
+		if d.Path != "" {
+			if d.Bucket != "" {
+				return fmt.Errorf("destination %s: path and bucket can't both be set", d.Name)
+			}
+			continue
+		}
+		if err := d.S3.validate(); err != nil {
+			return fmt.Errorf("destination %s: %w", d.Name, err)
+		}
+		if err := d.S3.validateBucket(d.Bucket); err != nil {
+			return fmt.Errorf("destination %s: %w", d.Name, err)
+		}
+	}
+
+	if cfg.Backup.DenyHashesFile != "" {
+		hashes, err := readPatternFile(cfg.Backup.DenyHashesFile)
+		if err != nil {
+			return err
+		}
+		cfg.Backup.DenyHashes = append(cfg.Backup.DenyHashes, hashes...)
+	}
+	// Deny-listed hashes are content hashes, which path-mtime keys never
+	// are.
+	if len(cfg.Backup.DenyHashes) > 0 && cfg.Backup.KeyStrategy == keyPathMtime {
+		return fmt.Errorf("backup.deny_hashes can't be used with backup.key_strategy %s", keyPathMtime)
+	}
+	if err := validateDenyHashes(cfg.Backup.DenyHashes, cfg.Backup.HashAlgorithm); err != nil {
+		return fmt.Errorf("backup.deny_hashes: %w", err)
+	}
+
+	if cfg.Backup.ExcludeFile != "" {
+		patterns, err := readPatternFile(cfg.Backup.ExcludeFile)
+		if err != nil {
+			return err
+		}
+		cfg.Backup.Exclude = append(cfg.Backup.Exclude, patterns...)
+	}
+	if err := validateExcludes(cfg.Backup.Exclude); err != nil {
+		return fmt.Errorf("backup.exclude: %w", err)
+	}
+
 	return nil
 }
 
@@ -69,26 +605,124 @@ type FileMetadata struct {
 	Ctime int64
 	Mtime int64
 	Atime int64
+	Btime int64 `bson:",omitempty"`
 	Name  string
 	Path  string
 	Size  int64
 	Uid   int
 	Gid   int
-	Hash  string
+	// Mode are the file's permission bits, with setuid, setgid and sticky.
+	Mode uint32 `bson:",omitempty"`
+	Hash string
+	ACL  []byte
+	// FileFlags are the file's inode flags (FS_IOC_GETFLAGS).
+	FileFlags uint32 `bson:",omitempty"`
+
+	// RelPath is Path relative to its source, under the source's root name
+	// when the source is configured with include_root.
+	RelPath   string
+	QuickHash string `bson:",omitempty"`
+	// Inode is the file's inode number, recorded with QuickHash so that a
+	// file replaced by another isn't taken for unchanged.
+	Inode uint64 `bson:",omitempty"`
+
+	// BlockHashes are the hex sha256 hashes of every BlockSize bytes of
+	// the file, so a corrupt block can be found without reading the rest.
+	BlockSize   int64    `bson:",omitempty"`
+	BlockHashes []string `bson:",omitempty"`
+
+	Transforms []TransformInfo
+	Inline     bool   `bson:",omitempty"`
+	InlineData []byte `bson:",omitempty"`
+
+	Destinations []DestinationStatus `bson:",omitempty"`
+	Denied       bool                `bson:",omitempty"`
+	// ChecksumFailed marks a file that wasn't stored because its upload
+	// kept failing the server's checksum check.
+	ChecksumFailed bool `bson:",omitempty"`
+
+	// BundleKey is the object holding the file when it was stored in its
+	// directory's bundle, and BundlePath its member name in the tar.
+	BundleKey  string `bson:",omitempty"`
+	BundlePath string `bson:",omitempty"`
+
+	// ObjectKey is the key the content is stored under when it isn't
+	// Hash, as with a dedup scope other than global.
+	ObjectKey string `bson:",omitempty"`
+
+	// MountPoint marks a directory recorded as a mount boundary. The walk
+	// doesn't go below it.
+	MountPoint bool `bson:",omitempty"`
+
+	// Normalizer names the normalizer Hash was computed with, if any.
+	Normalizer string `bson:",omitempty"`
+
+	// Inconsistent marks a file that changed while it was backed up, so
+	// its stored content may not match Hash.
+	Inconsistent bool `bson:",omitempty"`
+	// StatSize is the size the file was stat'ed with when fewer or more
+	// bytes were read from it. Size is what was read.
+	StatSize int64 `bson:",omitempty"`
+
+	// ContentPath is a copy to read the content from instead of Path. It
+	// is removed once the file is stored.
+	ContentPath string `bson:"-"`
+
+	// Annotation is a free-form note attached with the annotate command.
+	Annotation string `bson:",omitempty"`
+
+	// VersionID pins the version of the object that is read back, in a
+	// versioned bucket. It is set with the versions command.
+	VersionID string `bson:",omitempty"`
+}
+
+// objectKey returns the key of the object holding the file's content, or ""
+// when its content isn't stored in an object.
+func (m *FileMetadata) objectKey() string {
+	switch {
+	case m.Denied, m.ChecksumFailed, m.Inline, m.MountPoint:
+		return ""
+	case m.BundleKey != "":
+		return m.BundleKey
+	case m.ObjectKey != "":
+		return m.ObjectKey
+	default:
+		return m.Hash
+	}
+}
+
+// contentPath returns the file to read metadata's content from.
+func (m *FileMetadata) contentPath() string {
+	if m.ContentPath != "" {
+		return m.ContentPath
+	}
+	return m.Path
 }
 
 // MongoDBClient represents the interface for MongoDB operations.
 type MongoDBClient interface {
 	InsertOne(collectionName string, document interface{}) error
+	InsertMany(collectionName string, documents []interface{}) error
+	UpdateMany(collectionName string, filter, update interface{}) (int64, error)
+	DeleteMany(collectionName string, filter interface{}) (int64, error)
+	Find(collectionName string, filter, results interface{}) error
+	FindSnapshot(id string) (*Snapshot, error)
+	ForEachFile(snapshotID string, fn func(*FileMetadata) error) error
+	ForEachSnapshot(fn func(*Snapshot) error) error
+	CountFiles(snapshotID string) (int64, error)
+	ListDir(snapshotID, dir string) ([]SnapshotEntry, error)
+	DeleteSnapshot(id string) error
 	Close()
 }
 
 // MongoClient implements the MongoDBClient interface.
 type MongoClient struct {
 	client *mongo.Client
+	tenant string
 }
 
-// NewMongoClient creates a new instance of MongoClient.
+// NewMongoClient creates a new instance of MongoClient for the configured
+// tenant.
 func NewMongoClient(cfg *MongoDBConfig) (*MongoClient, error) {
 	uri := fmt.Sprintf("mongodb://%s:%s@%s:%d", cfg.User, cfg.Password, cfg.Host, cfg.Port)
 
@@ -97,16 +731,196 @@ func NewMongoClient(cfg *MongoDBConfig) (*MongoClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MongoClient{client: client}, nil
+	return &MongoClient{client: client, tenant: Cfg.Tenant}, nil
 }
 
 // InsertOne inserts a document into the specified collection.
 func (mc *MongoClient) InsertOne(collectionName string, document interface{}) error {
-	collection := mc.client.Database("datahaven").Collection(collectionName)
+	collection := mc.database().Collection(collectionName)
 	_, err := collection.InsertOne(context.Background(), document)
 	return err
 }
 
+// InsertMany inserts documents into the specified collection.
+func (mc *MongoClient) InsertMany(collectionName string, documents []interface{}) error {
+	collection := mc.database().Collection(collectionName)
+	_, err := collection.InsertMany(context.Background(), documents)
+	return err
+}
+
+// UpdateMany applies update to the documents of the collection matching
+// filter and returns how many matched.
+func (mc *MongoClient) UpdateMany(collectionName string, filter, update interface{}) (int64, error) {
+	collection := mc.database().Collection(collectionName)
+	result, err := collection.UpdateMany(context.Background(), filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+// DeleteMany deletes the documents of the collection matching filter and
+// returns how many were deleted.
+func (mc *MongoClient) DeleteMany(collectionName string, filter interface{}) (int64, error) {
+	collection := mc.database().Collection(collectionName)
+	result, err := collection.DeleteMany(context.Background(), filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Find decodes every document of the collection matching filter into
+// results, a pointer to a slice.
+func (mc *MongoClient) Find(collectionName string, filter, results interface{}) error {
+	collection := mc.database().Collection(collectionName)
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	return cursor.All(context.Background(), results)
+}
+
+// FindSnapshot returns the snapshot with the given ID, or the most recent
+// snapshot when id is empty. The parts continuing a split snapshot are
+// only found by their ID.
+func (mc *MongoClient) FindSnapshot(id string) (*Snapshot, error) {
+	collection := mc.database().Collection(snapshotsCollection)
+
+	filter := bson.M{"continues": bson.M{"$exists": false}}
+	if id != "" {
+		filter = bson.M{"_id": id}
+	}
+	opts := options.FindOne().SetSort(bson.M{"starttime": -1})
+
+	var snapshot Snapshot
+	if err := collection.FindOne(context.Background(), filter, opts).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// fileCollections returns the collections holding a snapshot's files, as
+// registered on its snapshot document, followed by those of its parts.
+func (mc *MongoClient) fileCollections(snapshotID string) ([]string, error) {
+	snapshot, err := mc.FindSnapshot(snapshotID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return []string{snapshotID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	collections := snapshot.fileCollections()
+	for _, part := range snapshot.Parts {
+		partCollections, err := mc.fileCollections(part)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, partCollections...)
+	}
+	return collections, nil
+}
+
+// ForEachFile calls fn for every file metadata record of a snapshot, across
+// all collections it is sharded over. Records are streamed from the
+// collections rather than loaded at once, always in the same order, so a
+// walk over them can resume by position.
+func (mc *MongoClient) ForEachFile(snapshotID string, fn func(*FileMetadata) error) error {
+	collections, err := mc.fileCollections(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range collections {
+		if err := mc.forEachFileIn(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mc *MongoClient) forEachFileIn(collectionName string, fn func(*FileMetadata) error) error {
+	collection := mc.database().Collection(collectionName)
+	cursor, err := collection.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var metadata FileMetadata
+		if err := cursor.Decode(&metadata); err != nil {
+			return err
+		}
+		if err := fn(&metadata); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ForEachSnapshot calls fn for every snapshot, oldest first.
+func (mc *MongoClient) ForEachSnapshot(fn func(*Snapshot) error) error {
+	collection := mc.database().Collection(snapshotsCollection)
+	opts := options.Find().SetSort(bson.M{"starttime": 1})
+	cursor, err := collection.Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var snapshot Snapshot
+		if err := cursor.Decode(&snapshot); err != nil {
+			return err
+		}
+		if err := fn(&snapshot); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// CountFiles returns the number of file metadata records of a snapshot.
+func (mc *MongoClient) CountFiles(snapshotID string) (int64, error) {
+	collections, err := mc.fileCollections(snapshotID)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, name := range collections {
+		count, err := mc.database().Collection(name).CountDocuments(context.Background(), bson.M{})
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// DeleteSnapshot removes a snapshot document, and those of its parts, and
+// drops their file collections.
+func (mc *MongoClient) DeleteSnapshot(id string) error {
+	collections, err := mc.fileCollections(id)
+	if err != nil {
+		return err
+	}
+
+	db := mc.database()
+	for _, name := range collections {
+		if err := db.Collection(name).Drop(context.Background()); err != nil {
+			return err
+		}
+	}
+	_, err = db.Collection(snapshotsCollection).DeleteMany(context.Background(), bson.M{"$or": bson.A{
+		bson.M{"_id": id},
+		bson.M{"continues": id},
+	}})
+	return err
+}
+
 // Close closes the MongoDB client connection.
 func (mc *MongoClient) Close() {
 	if mc.client != nil {
@@ -114,7 +928,28 @@ func (mc *MongoClient) Close() {
 	}
 }
 
-func calculateSHA256Hash(filePath string) (string, error) {
+// calculateHash hashes the content of filePath with algorithm and returns
+// the hash along with the number of bytes read.
+func calculateHash(filePath, algorithm string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := newHash(algorithm)
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return formatHash(algorithm, hash), n, nil
+}
+
+// calculateQuickHash hashes the file size together with the first, middle
+// and last blockSize bytes of the file. It is cheap to compute for large files
+// and changes whenever the size or any of the sampled blocks change.
+func calculateQuickHash(filePath string, size, blockSize int64) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -122,117 +957,629 @@ func calculateSHA256Hash(filePath string) (string, error) {
 	defer file.Close()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if err := binary.Write(hash, binary.BigEndian, size); err != nil {
 		return "", err
 	}
 
+	offsets := []int64{0}
+	if size > blockSize {
+		offsets = append(offsets, (size-blockSize)/2, size-blockSize)
+	}
+	for _, offset := range offsets {
+		if _, err := io.Copy(hash, io.NewSectionReader(file, offset, blockSize)); err != nil {
+			return "", err
+		}
+	}
+
 	hashBytes := hash.Sum(nil)
-	return "sha256:" + hex.EncodeToString(hashBytes), nil
+	return "quick-sha256:" + hex.EncodeToString(hashBytes), nil
 }
 
-func scanDir(dir string, metadataChan chan FileMetadata) {
-	filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+// scanSources scans every source in turn and closes metadataChan when done.
+// Every source is walked in full, even after an interrupted run: each run
+// records a new snapshot rather than resuming one, and a directory's mtime
+// doesn't change when a file below it is edited, so an unchanged mtime
+// can't tell that a subtree walked before still holds the same files.
+func scanSources(sources []SourceConfig, cfg *BackupConfig, tracer *Tracer, gate *Gate, budget *Budget, space *SpaceGuard, metadataChan chan FileMetadata) {
+	for i := range sources {
+		if command, ok := sources[i].command(); ok {
+			scanCommand(&sources[i], command, cfg, tracer, budget, metadataChan)
+			continue
+		}
+		scanDir(&sources[i], cfg, tracer, gate, budget, space, metadataChan)
+	}
+	close(metadataChan)
+}
+
+func scanDir(source *SourceConfig, cfg *BackupConfig, tracer *Tracer, gate *Gate, budget *Budget, space *SpaceGuard, metadataChan chan FileMetadata) {
+	dir := source.Path
+
+	excludes := selfExcludes(dir, workingPaths(cfg))
+	for _, exclude := range excludes {
+		log.Printf("[%s] is a datahaven working path, excluding it from the backup", exclude)
+	}
+	denied := denySet(cfg.DenyHashes)
+
+	var rootDevice uint64
+	if cfg.MountPolicy != mountDescend {
+		info, err := os.Stat(dir)
 		if err != nil {
-			return err
+			log.Printf("source [%s] failed: %v", dir, err)
+			source.failed = err
+			return
 		}
+		rootDevice = deviceOf(info)
+	}
 
-		if info.IsDir() {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		// What can't be read is left out and the rest is scanned, but the
+		// source is marked as failed, which fails the run.
+		if err != nil {
+			source.fail(path, "reading", err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		hash, err := calculateSHA256Hash(path)
+		for _, exclude := range excludes {
+			if path == exclude {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != "." && excluded(cfg.excludePatterns(), rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if cfg.MountPolicy == mountDescend {
+				return nil
+			}
+			// Skipping or recording stops at the first mount point, so
+			// every directory visited is on the source's device.
+			info, err := d.Info()
+			if err != nil || deviceOf(info) == rootDevice {
+				return nil
+			}
+			log.Printf("[%s] is a mount point, not descending into it", path)
+			if cfg.MountPolicy == mountRecord {
+				metadataChan <- FileMetadata{
+					Mtime:      info.ModTime().UnixNano(),
+					Name:       info.Name(),
+					Path:       path,
+					RelPath:    source.relPath(path),
+					MountPoint: true,
+				}
+			}
+			return filepath.SkipDir
+		}
+
+		gate.Wait()
+		if err := space.Check(); err != nil {
+			log.Printf("stopping the scan of [%s]: %v", dir, err)
+			return err
+		}
+
+		endSpan := tracer.Start(path, "stat")
+		info, err := d.Info()
+		endSpan()
 		if err != nil {
+			source.fail(path, "stat of", err)
+			return nil
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if !ownerIncluded(cfg, int(stat.Uid), int(stat.Gid)) {
 			return nil
 		}
 
+		var hash, normalizer, quickHash string
+		var blocks []string
+		size := info.Size()
+		read := size
+		streamed := false
+		if cfg.KeyStrategy != keyPathMtime {
+			normalizer = normalizerFor(path, cfg.Normalizers)
+		}
+		if cfg.QuickHashBytes > 0 && cfg.KeyStrategy != keyPathMtime {
+			release := budget.Acquire()
+			endSpan = tracer.Start(path, "quick-hash")
+			quickHash, err = calculateQuickHash(path, size, cfg.QuickHashBytes)
+			endSpan()
+			release()
+			if err != nil {
+				source.fail(path, "quick hash of", err)
+				return nil
+			}
+		}
+		previous, unchanged := cfg.quickHashes.lookup(path, info, quickHash, normalizer)
+		switch {
+		case cfg.KeyStrategy == keyPathMtime:
+			hash = pathMtimeKey(path, info)
+		case unchanged:
+			// Stat and sampled blocks are as the previous snapshot
+			// recorded them, so is the content.
+			hash = previous.Hash
+			if previous.BlockSize == cfg.BlockHashBytes {
+				blocks = previous.BlockHashes
+			}
+		case streamable(path, info, cfg):
+			// The Uploader hashes it while uploading it.
+			streamed = true
+		default:
+			release := budget.Acquire()
+			endSpan = tracer.Start(path, "hash")
+			if normalizer != "" {
+				hash, read, err = calculateNormalizedHash(path, normalizer, cfg.HashAlgorithm)
+			} else if cfg.HashCheckpointBytes > 0 && info.Size() > cfg.HashCheckpointBytes {
+				hash, read, err = calculateHashResumable(path, info, cfg.HashAlgorithm, filepath.Join(tempDir(cfg), "hash-checkpoints"), cfg.HashCheckpointBytes)
+			} else if cfg.BlockHashBytes > 0 && info.Size() > cfg.BlockHashBytes {
+				hash, read, blocks, err = calculateHashWithBlocks(path, cfg.HashAlgorithm, cfg.BlockHashBytes)
+			} else {
+				hash, read, err = calculateHash(path, cfg.HashAlgorithm)
+			}
+			endSpan()
+			release()
+			if err != nil {
+				source.fail(path, "hashing", err)
+				return nil
+			}
+		}
+
+		var contentPath string
+		inconsistent := false
+		var statSize int64
+		// Keys by path and mtime and streamed files don't read the content
+		// here, so there is no hash it could have changed under. Reading
+		// other than the stat's size means it changed in between.
+		changed, err := fileChanged(path, info)
+		if !streamed && cfg.KeyStrategy != keyPathMtime && ((err == nil && changed) || read != size) {
+			// Whatever happens, the block hashes describe content that
+			// is gone.
+			blocks = nil
+			switch cfg.ChangingFiles {
+			case changingSkip:
+				log.Printf("[%s] changed while it was hashed, skipping it", path)
+				return nil
+			case changingCopy:
+				release := budget.Acquire()
+				contentPath, size, hash, err = copyAndHash(path, tempDir(cfg), cfg.HashAlgorithm)
+				if err == nil && normalizer != "" {
+					hash, _, err = calculateNormalizedHash(contentPath, normalizer, cfg.HashAlgorithm)
+				}
+				if err == nil && quickHash != "" {
+					quickHash, err = calculateQuickHash(contentPath, size, cfg.QuickHashBytes)
+				}
+				release()
+				if err != nil {
+					source.fail(path, "copying changing file", err)
+					return nil
+				}
+			default:
+				// The hash describes what was read, so the size does too.
+				if read != size {
+					log.Printf("[%s] was stat'ed at %d bytes but %d were read", path, size, read)
+					statSize, size = size, read
+				}
+				log.Printf("[%s] changed while it was hashed, its content may not match its hash", path)
+				inconsistent = true
+				// Nor the quick hash, sampled before it changed.
+				quickHash = ""
+			}
+		}
+
+		times, err := readFileTimes(path, info)
+		if err != nil {
+			log.Printf("statx of [%s] failed, using stat times: %v", path, err)
+		}
+
 		metadata := FileMetadata{
-			Ctime: info.Sys().(*syscall.Stat_t).Mtim.Nano(),
-			Mtime: info.Sys().(*syscall.Stat_t).Mtim.Nano(),
-			Atime: info.Sys().(*syscall.Stat_t).Atim.Nano(),
-			Name:  info.Name(),
-			Path:  path,
-			Size:  info.Size(),
-			Uid:   int(info.Sys().(*syscall.Stat_t).Uid),
-			Gid:   int(info.Sys().(*syscall.Stat_t).Gid),
-			Hash:  hash,
+			Ctime:   times.Ctime,
+			Mtime:   times.Mtime,
+			Atime:   times.Atime,
+			Name:    info.Name(),
+			Path:    path,
+			RelPath: source.relPath(path),
+			Size:    size,
+			Uid:     int(stat.Uid),
+			Gid:     int(stat.Gid),
+			Mode:    stat.Mode & 0o7777,
+			Hash:    hash,
+
+			Normalizer:   normalizer,
+			Inconsistent: inconsistent,
+			StatSize:     statSize,
+			ContentPath:  contentPath,
+			QuickHash:    quickHash,
+		}
+		if quickHash != "" {
+			metadata.Inode = stat.Ino
+		}
+		if len(blocks) > 0 {
+			metadata.BlockSize = cfg.BlockHashBytes
+			metadata.BlockHashes = blocks
+		}
+
+		if _, ok := denied[hash]; ok {
+			log.Printf("[%s] matches deny-listed hash %s, it won't be uploaded", path, hash)
+			metadata.Denied = true
+			metadataChan <- metadata
+			return nil
+		}
+
+		if cfg.RecordBtime {
+			metadata.Btime = times.Btime
+		}
+
+		if cfg.PreserveACLs {
+			endSpan = tracer.Start(path, "acl")
+			acl, err := readACL(path)
+			endSpan()
+			if err != nil {
+				log.Printf("read acl of [%s] failed: %v", path, err)
+			}
+			metadata.ACL = acl
+		}
+
+		if cfg.PreserveFileFlags {
+			endSpan = tracer.Start(path, "file-flags")
+			flags, err := readFileFlags(path)
+			endSpan()
+			if err != nil {
+				log.Printf("read file flags of [%s] failed: %v", path, err)
+			}
+			metadata.FileFlags = flags
 		}
 
 		metadataChan <- metadata
 		return nil
 	})
 
-	close(metadataChan)
-	log.Println("scan dir completed")
+	log.Printf("scan dir [%s] completed", dir)
 }
 
 type S3Client struct {
 	svc *s3.S3
+	cfg S3Config
+	// prefix scopes every key to the configured tenant.
+	prefix string
 }
 
 func NewS3Client(cfg *S3Config) *S3Client {
+	// The default transport keeps only two idle connections per host, which
+	// serializes concurrent uploads on reconnects.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.MaxConnections > 0 {
+		transport.MaxIdleConns = cfg.MaxConnections
+		transport.MaxIdleConnsPerHost = cfg.MaxConnections
+	}
+
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region:           aws.String(cfg.Region),
 		Endpoint:         aws.String(cfg.Endpoint),
 		S3ForcePathStyle: aws.Bool(true),
+		S3UseARNRegion:   aws.Bool(cfg.UseARNRegion),
 		Credentials:      credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""),
+		HTTPClient:       &http.Client{Transport: transport},
 	}))
 
-	return &S3Client{svc: s3.New(sess)}
+	svc := s3.New(sess)
+	handleClockSkew(svc, cfg.CorrectClockSkew)
+	return &S3Client{svc: svc, cfg: *cfg, prefix: keyPrefix(Cfg.Tenant)}
+}
+
+// Exists reports whether the object key is present in the bucket.
+func (c *S3Client) Exists(bucketName, key string) (bool, error) {
+	output, err := c.Head(bucketName, key)
+	return output != nil, err
+}
+
+// objectACL returns the ACL value to set on every request writing an
+// object.
+func (c *S3Client) objectACL() *string {
+	if c.cfg.ObjectACL != "" {
+		return aws.String(c.cfg.ObjectACL)
+	}
+	return nil
 }
 
-func (c *S3Client) UploadLargeFile(bucketName, key, filePath string) error {
+// requestPayer returns the RequestPayer value to set on every request.
+func (c *S3Client) requestPayer() *string {
+	if c.cfg.RequestPayer {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
+// Head returns the object's metadata, or nil when it doesn't exist.
+func (c *S3Client) Head(bucketName, key string) (*s3.HeadObjectOutput, error) {
+	return c.HeadVersion(bucketName, key, "")
+}
+
+// HeadVersion is Head for versionID of the object, or its latest version
+// when versionID is "".
+func (c *S3Client) HeadVersion(bucketName, key, versionID string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(key)),
+		RequestPayer: c.requestPayer(),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	output, err := c.svc.HeadObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+// Download opens the object's content for streaming. The caller closes it.
+func (c *S3Client) Download(bucketName, key string) (io.ReadCloser, error) {
+	return c.DownloadVersion(bucketName, key, "")
+}
+
+// UploadLargeFile uploads filePath through the transform pipeline and returns
+// the chain of transforms applied to the stored object. Files below the
+// multipart threshold are sent with a single, MD5-checked PutObject.
+func (c *S3Client) UploadLargeFile(bucketName, key, filePath string, pipeline *Pipeline) ([]TransformInfo, error) {
 	log.Printf("upload large file [%s] to s3", filePath)
 	file, err := os.Open(filePath)
 	if err != nil {
 		log.Println("Error opening file:", err)
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
-	uploader := s3manager.NewUploaderWithClient(c.svc)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-		Body:   file,
-	})
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	body, transforms, err := pipeline.Wrap(file)
+	if err != nil {
+		log.Println("Error transforming file:", err)
+		return nil, err
+	}
+	// An upload that fails stops reading the body.
+	defer body.Close()
+
+	metadata := transformsMetadata(transforms)
+	if info.Size() < c.cfg.multipartThreshold() {
+		// Untransformed content is sent from the file itself. Transformed
+		// content isn't the same when read twice, encryption picks a new
+		// nonce each time, so it is held in memory.
+		var content io.ReadSeeker = file
+		if len(transforms) > 0 {
+			content, err = readAllSeeker(body)
+		} else {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = c.putObject(bucketName, key, content, metadata)
+		}
+	} else {
+		uploader := s3manager.NewUploaderWithClient(c.svc, func(u *s3manager.Uploader) {
+			u.PartSize = c.cfg.partSize()
+			u.Concurrency = c.cfg.partConcurrency()
+		})
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket:       aws.String(bucketName),
+			Key:          aws.String(c.objectKey(key)),
+			Body:         body,
+			Metadata:     metadata,
+			ACL:          c.objectACL(),
+			RequestPayer: c.requestPayer(),
+		})
+	}
 	if err != nil {
 		log.Println("Error uploading file to S3:", err)
-		return err
+		return nil, err
 	}
 
 	log.Printf("Large file uploaded to S3: s3://%s/%s\n", bucketName, key)
-	return nil
+	return transforms, nil
+}
+
+// readAllSeeker reads r into memory, for content that can't be read twice.
+func readAllSeeker(r io.Reader) (io.ReadSeeker, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// putObject uploads body in a single request. A first pass over body
+// computes the Content-MD5 S3 verifies, the request then reads it again from
+// the start.
+func (c *S3Client) putObject(bucketName, key string, body io.ReadSeeker, metadata map[string]*string) error {
+	h := md5.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := c.svc.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(key)),
+		Body:         body,
+		ContentMD5:   aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil))),
+		Metadata:     metadata,
+		ACL:          c.objectACL(),
+		RequestPayer: c.requestPayer(),
+	})
+	return err
 }
 
 func main() {
 	if err := InitConfig("datahaven.toml"); err != nil {
 		panic(err)
 	}
+	setupLogging(&Cfg.Log)
 
-	client, err := NewMongoClient(&Cfg.MongoDB)
-	if err != nil {
-		fmt.Println("Error creating MongoDB client:", err)
-		return
+	command := "backup"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	if strings.HasPrefix(command, "-") {
+		// Flags without a command belong to backup.
+		os.Args = append([]string{os.Args[0], "backup"}, os.Args[1:]...)
+		command = "backup"
 	}
-	defer client.Close()
 
-	s3Client := NewS3Client(&Cfg.S3)
+	var err error
+	switch command {
+	case "backup":
+		err = runBackup(os.Args[2:])
+	case "replicate":
+		err = runReplicate()
+	case "cost":
+		err = runCost(os.Args[2:])
+	case "orphans":
+		err = runOrphans(os.Args[2:])
+	case "verify":
+		err = runVerify(os.Args[2:])
+	case "annotate":
+		err = runAnnotate(os.Args[2:])
+	case "versions":
+		err = runVersions(os.Args[2:])
+	case "compact":
+		err = runCompact(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "restore":
+		err = runRestore(os.Args[2:])
+	case "browse":
+		err = runBrowse(os.Args[2:])
+	case "mount":
+		err = runMount(os.Args[2:])
+	case "restore-export":
+		err = runRestoreExport(os.Args[2:])
+	case "gc":
+		err = runGC(os.Args[2:])
+	case "cleanup-incomplete-uploads":
+		err = runCleanupIncompleteUploads(os.Args[2:])
+	case "print-config":
+		err = runPrintConfig(os.Args[2:])
+	default:
+		fmt.Println("Unknown command:", command)
+		os.Exit(2)
+	}
 
-	metadataChan := make(chan FileMetadata, 1)
+	if err != nil {
+		log.Printf("error: %v", err)
+		os.Exit(1)
+	}
+}
 
-	go scanDir("/home/skyline93/workspace/datahaven/testdata", metadataChan)
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	traceFile := fs.String("trace", "", "write per-file phase timings as JSON lines to `file` (- for stderr)")
+	dryRunMode := fs.Bool("dry-run", false, "scan and hash without uploading or recording anything")
+	planFile := fs.String("plan", "", "with --dry-run, write the planned action per file as JSON lines to `file` (- for stdout)")
+	note := fs.String("note", "", "attach a free-form note to the snapshot")
+	snapshotID := fs.String("snapshot-id", "", "record the snapshot as `id`, replacing an existing snapshot with that ID")
+	wait := fs.Bool("wait", false, "wait for another backup of the same sources to finish instead of failing")
+	failIfLocked := fs.Bool("fail-if-locked", true, "fail if another backup of the same sources is running; false is the same as --wait")
+	fs.Parse(args)
+	if *snapshotID != "" {
+		if err := validateSnapshotID(*snapshotID); err != nil {
+			return fmt.Errorf("--snapshot-id: %w", err)
+		}
+	}
 
-	for metadata := range metadataChan {
-		log.Printf("save metadata to mongodb, file: [%s]", metadata.Name)
-		collectionName := "1"
-		err = client.InsertOne(collectionName, metadata)
+	var tracer *Tracer
+	switch *traceFile {
+	case "":
+	case "-":
+		tracer = NewTracer(logOutput)
+	default:
+		f, err := os.Create(*traceFile)
 		if err != nil {
-			fmt.Println("Error inserting metadata:", err)
-			continue
+			return fmt.Errorf("creating trace file: %w", err)
+		}
+		defer f.Close()
+		tracer = NewTracer(f)
+	}
+
+	sources, err := existingSources(backupSources(&Cfg.Backup), Cfg.Backup.OnMissingSource)
+	if err != nil {
+		return err
+	}
+
+	if *dryRunMode {
+		// The summary doesn't go where the plan does.
+		plan, report := io.Discard, io.Writer(os.Stdout)
+		switch *planFile {
+		case "":
+		case "-":
+			plan, report = os.Stdout, os.Stderr
+		default:
+			f, err := os.Create(*planFile)
+			if err != nil {
+				return fmt.Errorf("creating plan file: %w", err)
+			}
+			defer f.Close()
+			plan = f
+		}
+		var store MongoDBClient
+		if Cfg.Backup.DedupScope == dedupGlobal {
+			client, err := NewMongoClient(&Cfg.MongoDB)
+			if err != nil {
+				return fmt.Errorf("creating MongoDB client: %w", err)
+			}
+			defer client.Close()
+			store = client
 		}
+		return dryRun(sources, &Cfg.S3, &Cfg.Backup, tracer, store, plan, report)
+	}
 
-		go s3Client.UploadLargeFile("datahaven", metadata.Hash, metadata.Path)
+	unlock, err := acquireLock(lockPath(&Cfg.Backup, viper.ConfigFileUsed(), sources), *wait || !*failIfLocked)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// A collection of the bucket is waited for, whatever the flags say.
+	unlockBucket, err := acquireBucketLock(bucketLockPath(&Cfg.Backup, Cfg.S3.Endpoint, Cfg.Backup.Bucket), false, true)
+	if err != nil {
+		return err
 	}
+	defer unlockBucket()
 
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	stats := NewStats()
+	stopStats := reportStatsOnSignal(stats)
+	defer stopStats()
+
+	engine := NewEngine(&Cfg, client, func() []Storage {
+		return newDestinations(NewS3Client(&Cfg.S3), &Cfg.Backup)
+	})
+	stopReload := reloadConfigOnSignal(newConfigReloader(engine, viper.GetViper(), &Cfg))
+	defer stopReload()
+
+	summary, err := engine.Backup(context.Background(), sources, BackupOptions{Note: *note, SnapshotID: *snapshotID, Tracer: tracer, Stats: stats})
+	for _, item := range summary.Failed {
+		log.Printf("backing up [%s] failed after %d attempts: %v", item.Metadata.Path, item.Attempts, item.Err)
+	}
+	if err != nil {
+		return err
+	}
 	fmt.Println("Metadata inserted successfully.")
+	return nil
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig loads a config file with content the way InitConfig does.
+func loadTestConfig(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "datahaven.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	return cfg, loadConfig(viper.New(), path, cfg)
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"deny-list under path-mtime", `
+[backup]
+key_strategy = "path-mtime"
+deny_hashes = ["sha256:00"]
+`, "backup.deny_hashes"},
+		{"deny-list of another algorithm", `
+[backup]
+hash_algorithm = "sha512"
+deny_hashes = ["00ff"]
+`, "backup.deny_hashes"},
+		{"unknown object ACL", `
+[s3]
+object_acl = "everyone"
+`, "object_acl"},
+		{"deterministic snapshot IDs of streamed uploads", `
+[backup]
+deterministic_snapshot_id = true
+stream_upload = true
+`, "backup.deterministic_snapshot_id"},
+		{"deterministic snapshot IDs of a command", `
+[backup]
+deterministic_snapshot_id = true
+sources = [{path = "cmd:pg_dump mydb", label = "mydb.sql"}]
+`, "backup.deterministic_snapshot_id"},
+	}
+	for _, tt := range tests {
+		if _, err := loadTestConfig(t, tt.config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: loadConfig = %v, want an error about %s", tt.name, err, tt.want)
+		}
+	}
+	if _, err := loadTestConfig(t, "[backup]\nkey_strategy = \"path-mtime\"\n"); err != nil {
+		t.Fatalf("loadConfig with path-mtime alone = %v", err)
+	}
+	if _, err := loadTestConfig(t, "[backup]\nhash_algorithm = \"sha512\"\ndeny_hashes = [\"sha512:00ff\"]\n"); err != nil {
+		t.Fatalf("loadConfig with a sha512 deny-list = %v", err)
+	}
+}
+
+func TestRequestPayer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewPipeline(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, requestPayer := range []bool{false, true} {
+		s3 := newFakeS3(t)
+		client := NewS3Client(&S3Config{Region: "us-east-1", Endpoint: s3.server.URL, AccessKey: "access", SecretKey: "secret", RequestPayer: requestPayer})
+		if _, err := client.UploadLargeFile("datahaven", "key", path, pipeline); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Head("datahaven", "key"); err != nil {
+			t.Fatal(err)
+		}
+		body, err := client.Download("datahaven", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, body)
+		body.Close()
+		if _, err := findGarbage(newMemStore(), client, "datahaven", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, op := range []string{"PUT", "HEAD", "GET", "LIST"} {
+			want := 0
+			if requestPayer {
+				want = s3.count(op)
+			}
+			if got := s3.countPaid(op); got != want || s3.count(op) == 0 {
+				t.Errorf("request_payer %v: %d of %d %s requests with the requester paying, want %d", requestPayer, got, s3.count(op), op, want)
+			}
+		}
+	}
+}
+
+func TestObjectACL(t *testing.T) {
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small"), filepath.Join(dir, "large")
+	if err := os.WriteFile(small, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(large, testLines(1, 6<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewPipeline(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, acl := range []string{"", s3.ObjectCannedACLBucketOwnerFullControl} {
+		fake := newFakeS3(t)
+		client := NewS3Client(&S3Config{Region: "us-east-1", Endpoint: fake.server.URL, AccessKey: "access", SecretKey: "secret", ObjectACL: acl})
+		// The large file goes up in parts, the ACL set when it's created.
+		for _, path := range []string{small, large} {
+			if _, err := client.UploadLargeFile("datahaven", filepath.Base(path), path, pipeline); err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.get("datahaven", filepath.Base(path)).acl; got != acl {
+				t.Errorf("object_acl %q: %s written with ACL %q", acl, filepath.Base(path), got)
+			}
+		}
+		if fake.count("CREATE-MULTIPART") != 1 {
+			t.Fatalf("%d multipart uploads, want the large file's", fake.count("CREATE-MULTIPART"))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Rough in-memory sizes used to fit a run into backup.memory_budget_mb.
+const (
+	// dedupEntryBytes is what a DedupCache entry takes: key, transforms,
+	// list element and map bucket.
+	dedupEntryBytes = 256
+	// batchDocumentBytes is the typical marshalled size of one file's
+	// metadata.
+	batchDocumentBytes = 512
+)
+
+// fitMemoryBudget shrinks the metadata batches, the dedup cache and the
+// multipart upload buffers of cfg until they fit in budget bytes together.
+// Uploads get half of it, batches and the cache a quarter each. Settings
+// that already fit are left as they are. A tight budget means smaller
+// inserts, more HeadObjects for objects the cache forgot and slower
+// multipart uploads, not a failed run.
+func fitMemoryBudget(cfg *Config, budget int64) {
+	fitUploadBuffers(cfg, budget/2)
+	fitMetadataBatches(&cfg.MongoDB, budget/4)
+	fitDedupCache(&cfg.Backup, budget/4)
+}
+
+// fitUploadBuffers lowers the parts uploaded at once, then the part size,
+// until every worker can buffer a multipart upload in share bytes, and the
+// multipart threshold until it can buffer a single PutObject: transformed
+// content below the threshold is held in memory whole. The threshold stays
+// at least the part size.
+func fitUploadBuffers(cfg *Config, share int64) {
+	workers := int64(cfg.Backup.UploadWorkers)
+	for _, c := range append([]*S3Config{&cfg.S3}, destinationS3Configs(&cfg.Backup)...) {
+		perWorker := share / workers
+		concurrency, partSize := c.partConcurrency(), c.partSize()
+		for concurrency > 1 && int64(concurrency)*partSize > perWorker {
+			concurrency--
+		}
+		if partSize > perWorker {
+			partSize = perWorker
+		}
+		if partSize < s3manager.MinUploadPartSize {
+			partSize = s3manager.MinUploadPartSize
+		}
+		if concurrency != c.partConcurrency() || partSize != c.partSize() {
+			log.Printf("memory budget: uploading %d parts of %d bytes at once per worker", concurrency, partSize)
+		}
+		c.uploadConcurrency = concurrency
+		c.PartSize = partSize
+
+		threshold := c.multipartThreshold()
+		if threshold > perWorker {
+			threshold = perWorker
+		}
+		if threshold < partSize {
+			threshold = partSize
+		}
+		if threshold != c.multipartThreshold() {
+			log.Printf("memory budget: uploading objects of %d bytes and more in parts", threshold)
+			c.MultipartThreshold = threshold
+		}
+	}
+}
+
+// fitMetadataBatches lowers the batch limits so every collection's pending
+// batch fits in share bytes.
+func fitMetadataBatches(cfg *MongoDBConfig, share int64) {
+	collections := int64(1)
+	if cfg.ShardBy == shardPathHash && cfg.ShardCount > 1 {
+		collections = int64(cfg.ShardCount)
+	}
+	perCollection := share / collections
+	if perCollection < batchDocumentBytes {
+		perCollection = batchDocumentBytes
+	}
+
+	maxBytes := int64(cfg.MaxBatchBytes)
+	if maxBytes <= 0 || maxBytes > maxBSONDocumentSize {
+		maxBytes = maxBSONDocumentSize
+	}
+	if maxBytes > perCollection {
+		cfg.MaxBatchBytes = int(perCollection)
+		log.Printf("memory budget: inserting metadata batches of at most %d bytes", cfg.MaxBatchBytes)
+	}
+	if count := perCollection / batchDocumentBytes; int64(cfg.BatchSize) > count {
+		cfg.BatchSize = int(count)
+		log.Printf("memory budget: inserting metadata batches of at most %d documents", cfg.BatchSize)
+	}
+}
+
+// fitDedupCache lowers the dedup cache size to what share bytes hold. The
+// cache keeps at least one entry, none would look up every file again.
+func fitDedupCache(cfg *BackupConfig, share int64) {
+	if cfg.DedupCacheSize == 0 {
+		return
+	}
+	entries := share / dedupEntryBytes
+	if entries < 1 {
+		entries = 1
+	}
+	if int64(cfg.DedupCacheSize) > entries {
+		cfg.DedupCacheSize = int(entries)
+		log.Printf("memory budget: remembering at most %d stored objects", cfg.DedupCacheSize)
+	}
+}
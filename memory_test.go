@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	unbudgeted, err := loadTestConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgeted, err := loadTestConfig(t, "[backup]\nmemory_budget_mb = 8\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := unbudgeted.Backup.DedupCacheSize; got != 100000 {
+		t.Errorf("dedup cache without a budget %d, want the default", got)
+	}
+	// A quarter of 8 MB each for the batches and the cache.
+	if got, want := budgeted.Backup.DedupCacheSize, (2<<20)/dedupEntryBytes; got != want {
+		t.Errorf("dedup cache %d, want %d", got, want)
+	}
+	if got, want := budgeted.MongoDB.MaxBatchBytes, 2<<20; got != want || unbudgeted.MongoDB.MaxBatchBytes <= want {
+		t.Errorf("batches of %d bytes with the budget and %d without, want %d with", got, unbudgeted.MongoDB.MaxBatchBytes, want)
+	}
+	// Half for 8 workers' uploads leaves a part at a time, no smaller than
+	// S3 allows.
+	if got := budgeted.S3.partConcurrency(); got != 1 || unbudgeted.S3.partConcurrency() <= 1 {
+		t.Errorf("%d parts at once with the budget and %d without, want 1 with", got, unbudgeted.S3.partConcurrency())
+	}
+	if got := budgeted.S3.partSize(); got != s3manager.MinUploadPartSize {
+		t.Errorf("part size %d, want the minimum %d", got, s3manager.MinUploadPartSize)
+	}
+}
+
+func TestTightMemoryBudgetKeepsDedup(t *testing.T) {
+	cfg := &Config{Backup: BackupConfig{UploadWorkers: 4, DedupCacheSize: 1000}, MongoDB: MongoDBConfig{BatchSize: 100}}
+	fitMemoryBudget(cfg, 1024)
+	if cfg.Backup.DedupCacheSize != 1 {
+		t.Errorf("dedup cache %d, want it shrunk to 1 rather than off", cfg.Backup.DedupCacheSize)
+	}
+	if cfg.MongoDB.BatchSize != 1 || cfg.MongoDB.MaxBatchBytes != batchDocumentBytes {
+		t.Errorf("batches of %d documents and %d bytes, want 1 document", cfg.MongoDB.BatchSize, cfg.MongoDB.MaxBatchBytes)
+	}
+}
+
+func TestMemoryBudgetLowersMultipartThreshold(t *testing.T) {
+	cfg := &Config{
+		Backup: BackupConfig{UploadWorkers: 4},
+		S3:     S3Config{PartSize: 8 << 20, MultipartThreshold: 1 << 30},
+	}
+	// 64 MB for uploads leaves each of 4 workers 16 MB, for parts or for
+	// a single PutObject.
+	fitUploadBuffers(cfg, 64<<20)
+	if got := cfg.S3.multipartThreshold(); got != 16<<20 {
+		t.Errorf("threshold %d, want 16 MB", got)
+	}
+	if got := cfg.S3.partSize(); got != 8<<20 {
+		t.Errorf("part size %d, want it kept", got)
+	}
+
+	// Never below the part size, however tight.
+	fitUploadBuffers(cfg, 4<<20)
+	if got, want := cfg.S3.multipartThreshold(), cfg.S3.partSize(); got != want {
+		t.Errorf("threshold %d, want the part size %d", got, want)
+	}
+	if err := cfg.S3.validate(); err != nil {
+		t.Error(err)
+	}
+}
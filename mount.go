@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// Mount policies, chosen with backup.mount_policy, for directories on a
+// different device than the source they are found in.
+const (
+	mountDescend = "descend"
+	mountSkip    = "skip"
+	mountRecord  = "record"
+)
+
+func validateMountPolicy(policy string) error {
+	switch policy {
+	case mountDescend, mountSkip, mountRecord:
+		return nil
+	default:
+		return fmt.Errorf("unknown mount policy %q, expected %s, %s or %s", policy, mountDescend, mountSkip, mountRecord)
+	}
+}
+
+// deviceOf returns the ID of the device info's file lives on.
+func deviceOf(info fs.FileInfo) uint64 {
+	return uint64(info.Sys().(*syscall.Stat_t).Dev)
+}
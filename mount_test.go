@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountPolicy(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"root.txt": "on the source", "mnt/hidden.txt": "under the mount"})
+	mnt := filepath.Join(src, "mnt")
+	if err := unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount a tmpfs: %v", err)
+	}
+	t.Cleanup(func() { unix.Unmount(mnt, 0) })
+	if err := os.WriteFile(filepath.Join(mnt, "mounted.txt"), []byte("on the mount"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{mountDescend, []string{"mnt/mounted.txt", "root.txt"}},
+		{mountSkip, []string{"root.txt"}},
+		{mountRecord, []string{"mnt", "root.txt"}},
+	}
+	for _, tt := range tests {
+		cfg := testBackupConfig(t)
+		cfg.MountPolicy = tt.policy
+		files := scanFiles(t, []SourceConfig{{Path: src}}, cfg)
+		if got := relPaths(files); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: scanned %v, want %v", tt.policy, got, tt.want)
+			continue
+		}
+		if tt.policy == mountRecord && (!files[0].MountPoint || files[0].Hash != "") {
+			t.Errorf("%s: mount point recorded as %+v", tt.policy, files[0])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A normalizer rewrites a file's content on its way into the hash, so files
+// that only differ in insignificant bytes get the same hash and dedupe. The
+// content that is stored is never normalized. Close flushes whatever the
+// normalizer still holds back.
+type normalizer func(w io.Writer) io.WriteCloser
+
+var normalizerRegistry = map[string]normalizer{
+	"strip-trailing-nuls": newTrailingNULStripper,
+}
+
+// NormalizerConfig applies the normalizer called Name to the files with
+// Extension, e.g. ".img".
+type NormalizerConfig struct {
+	Extension string `mapstructure:"extension"`
+	Name      string `mapstructure:"name"`
+}
+
+func validateNormalizers(normalizers []NormalizerConfig) error {
+	for _, n := range normalizers {
+		if _, ok := normalizerRegistry[n.Name]; !ok {
+			return fmt.Errorf("unknown normalizer %q", n.Name)
+		}
+		if !strings.HasPrefix(n.Extension, ".") {
+			return fmt.Errorf("extension %q of normalizer %s must start with a dot", n.Extension, n.Name)
+		}
+	}
+	return nil
+}
+
+// normalizerFor returns the name of the normalizer configured for path's
+// extension, or "" if there is none.
+func normalizerFor(path string, normalizers []NormalizerConfig) string {
+	ext := filepath.Ext(path)
+	for _, n := range normalizers {
+		if strings.EqualFold(ext, n.Extension) {
+			return n.Name
+		}
+	}
+	return ""
+}
+
+// calculateNormalizedHash hashes the content of filePath as rewritten by
+// the named normalizer, with algorithm. It returns the number of bytes
+// read, before normalizing.
+func calculateNormalizedHash(filePath, name, algorithm string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := newHash(algorithm)
+	w := normalizerRegistry[name](h)
+	n, err := io.Copy(w, file)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := w.Close(); err != nil {
+		return "", 0, err
+	}
+	return formatHash(algorithm, h), n, nil
+}
+
+// trailingNULStripper drops the NUL bytes at the end of a stream. Runs of
+// NULs are held back until a non-NUL byte shows they aren't trailing.
+type trailingNULStripper struct {
+	w       io.Writer
+	pending int64
+}
+
+func newTrailingNULStripper(w io.Writer) io.WriteCloser {
+	return &trailingNULStripper{w: w}
+}
+
+var zeros = make([]byte, 32*1024)
+
+func (s *trailingNULStripper) Write(p []byte) (int, error) {
+	last := len(p) - 1
+	for last >= 0 && p[last] == 0 {
+		last--
+	}
+	if last < 0 {
+		s.pending += int64(len(p))
+		return len(p), nil
+	}
+
+	for s.pending > 0 {
+		n := int64(len(zeros))
+		if s.pending < n {
+			n = s.pending
+		}
+		if _, err := s.w.Write(zeros[:n]); err != nil {
+			return 0, err
+		}
+		s.pending -= n
+	}
+	if _, err := s.w.Write(p[:last+1]); err != nil {
+		return 0, err
+	}
+	s.pending = int64(len(p) - last - 1)
+	return len(p), nil
+}
+
+func (s *trailingNULStripper) Close() error {
+	return nil
+}
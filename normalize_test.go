@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNormalizedPaddingDedupes(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"a.img":   "disk image" + strings.Repeat("\x00", 3),
+		"b.img":   "disk image" + strings.Repeat("\x00", 100),
+		"nul.img": "disk\x00image",
+		"c.bin":   "disk image" + strings.Repeat("\x00", 3),
+	})
+	cfg := testBackupConfig(t)
+	cfg.Normalizers = []NormalizerConfig{{Extension: ".img", Name: "strip-trailing-nuls"}}
+	cfg.DedupCacheSize = 100
+	cfg.UploadWorkers = 1
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := map[string]string{}
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		hashes[metadata.RelPath] = metadata.Hash
+		return nil
+	})
+	if hashes["a.img"] != sha256Hash("disk image") || hashes["b.img"] != hashes["a.img"] {
+		t.Errorf("padded images hash to %s and %s, want both %s", hashes["a.img"], hashes["b.img"], sha256Hash("disk image"))
+	}
+	// NULs that aren't trailing, and files without the normalizer, hash
+	// as they are.
+	if hashes["nul.img"] != sha256Hash("disk\x00image") || hashes["c.bin"] != sha256Hash("disk image\x00\x00\x00") {
+		t.Errorf("hashes %v", hashes)
+	}
+	if keys := s3.keys(cfg.Bucket); len(keys) != 3 {
+		t.Fatalf("bucket holds %v, want the padded images stored once", keys)
+	}
+
+	// The deduped image reads back its twin's bytes, which are of another
+	// size but hash the same.
+	verified, err := engine.Verify(NewVerifier(s3.client(), cfg.Bucket, true, false), summary.SnapshotID, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.ContentVerified != 4 || verified.Corrupt != 0 {
+		t.Fatalf("deep verify: %#v", verified)
+	}
+}
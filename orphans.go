@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// findOrphanedSnapshots returns the snapshots without any file records that
+// started at least minAge ago. The age guard keeps snapshots of runs still in
+// progress from being reported.
+func findOrphanedSnapshots(client MongoDBClient, minAge time.Duration) ([]*Snapshot, error) {
+	cutoff := time.Now().Add(-minAge).UnixNano()
+
+	var orphans []*Snapshot
+	err := client.ForEachSnapshot(func(snapshot *Snapshot) error {
+		if snapshot.StartTime > cutoff {
+			return nil
+		}
+		count, err := client.CountFiles(snapshot.ID)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			orphans = append(orphans, snapshot)
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+func runOrphans(args []string) error {
+	fs := flag.NewFlagSet("orphans", flag.ExitOnError)
+	del := fs.Bool("delete", false, "delete the orphaned snapshots")
+	yes := fs.Bool("yes", false, "don't ask for confirmation before deleting")
+	minAge := fs.Duration("min-age", 24*time.Hour, "only consider snapshots started at least this long ago")
+	var olderThan ageFlag
+	fs.Var(&olderThan, "older-than", "only consider snapshots started longer ago than this, like 30d, 6m or 1y")
+	fs.Parse(args)
+	if time.Duration(olderThan) > *minAge {
+		*minAge = time.Duration(olderThan)
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	orphans, err := findOrphanedSnapshots(client, *minAge)
+	if err != nil {
+		return fmt.Errorf("finding orphaned snapshots: %w", err)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned snapshots.")
+		return nil
+	}
+
+	for _, snapshot := range orphans {
+		fmt.Printf("%s  %s  %s\n", snapshot.ID, time.Unix(0, snapshot.StartTime).Format(time.RFC3339), strings.Join(snapshot.SourcePaths(), ", "))
+	}
+
+	if !*del {
+		return nil
+	}
+	if !*yes {
+		fmt.Printf("Delete %d orphaned snapshots? [y/N] ", len(orphans))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			return nil
+		}
+	}
+
+	for _, snapshot := range orphans {
+		if err := client.DeleteSnapshot(snapshot.ID); err != nil {
+			return fmt.Errorf("deleting snapshot %s: %w", snapshot.ID, err)
+		}
+	}
+	fmt.Printf("Deleted %d orphaned snapshots.\n", len(orphans))
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrphanedSnapshots(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).UnixNano()
+	store := newMemStore()
+	store.addSnapshot(&Snapshot{ID: "empty", StartTime: old}, nil)
+	store.addSnapshot(&Snapshot{ID: "full", StartTime: old}, []FileMetadata{{Path: "/src/a"}})
+	// A run still in progress hasn't recorded its files yet.
+	store.addSnapshot(&Snapshot{ID: "running", StartTime: time.Now().UnixNano()}, nil)
+
+	orphans, err := findOrphanedSnapshots(store, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != "empty" {
+		t.Fatalf("orphans %v, want the empty snapshot", orphans)
+	}
+
+	if err := store.DeleteSnapshot(orphans[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindSnapshot("empty"); err == nil {
+		t.Fatal("orphaned snapshot still there after deleting it")
+	}
+	if orphans, _ := findOrphanedSnapshots(store, 24*time.Hour); len(orphans) != 0 {
+		t.Fatalf("orphans %v after deleting", orphans)
+	}
+}
+
+func TestOrphanedSnapshotsOlderThan(t *testing.T) {
+	store := newMemStore()
+	for id, age := range map[string]time.Duration{"last-week": 7 * day, "last-year": 400 * day} {
+		store.addSnapshot(&Snapshot{ID: id, StartTime: time.Now().Add(-age).UnixNano()}, nil)
+	}
+	olderThan, err := parseAge("30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := findOrphanedSnapshots(store, olderThan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != "last-year" {
+		t.Fatalf("orphans %v, want only the one of last year", orphans)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+// ownerIncluded reports whether a file owned by uid and gid is backed up.
+// When OnlyUIDs or OnlyGIDs are set the owner must be in them, and it
+// must not be in ExcludeUIDs or ExcludeGIDs.
+func ownerIncluded(cfg *BackupConfig, uid, gid int) bool {
+	if len(cfg.OnlyUIDs) > 0 && !containsID(cfg.OnlyUIDs, uid) {
+		return false
+	}
+	if len(cfg.OnlyGIDs) > 0 && !containsID(cfg.OnlyGIDs, gid) {
+		return false
+	}
+	return !containsID(cfg.ExcludeUIDs, uid) && !containsID(cfg.ExcludeGIDs, gid)
+}
+
+func containsID(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOwnerFilters(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("giving files other owners takes root")
+	}
+	src := t.TempDir()
+	owners := map[string][2]int{
+		"alice":       {1001, 100},
+		"bob":         {1002, 100},
+		"carol-staff": {1003, 50},
+	}
+	for name, owner := range owners {
+		writeFiles(t, src, map[string]string{name: name})
+		if err := os.Chown(filepath.Join(src, name), owner[0], owner[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter func(cfg *BackupConfig)
+		want   []string
+	}{
+		{"only uids", func(cfg *BackupConfig) { cfg.OnlyUIDs = []int{1001, 1003} }, []string{"alice", "carol-staff"}},
+		{"only gids", func(cfg *BackupConfig) { cfg.OnlyGIDs = []int{100} }, []string{"alice", "bob"}},
+		{"exclude uids", func(cfg *BackupConfig) { cfg.ExcludeUIDs = []int{1002} }, []string{"alice", "carol-staff"}},
+		{"exclude gids", func(cfg *BackupConfig) { cfg.ExcludeGIDs = []int{100} }, []string{"carol-staff"}},
+		{"only and exclude", func(cfg *BackupConfig) {
+			cfg.OnlyGIDs = []int{100}
+			cfg.ExcludeUIDs = []int{1001}
+		}, []string{"bob"}},
+	}
+	for _, tt := range tests {
+		cfg := testBackupConfig(t)
+		tt.filter(cfg)
+		var trace lockedBuffer
+		metadataChan := make(chan FileMetadata, 1)
+		go scanSources([]SourceConfig{{Path: src}}, cfg, NewTracer(&trace), NewGate(), nil, nil, metadataChan)
+		var files []FileMetadata
+		for metadata := range metadataChan {
+			files = append(files, metadata)
+		}
+		got := relPaths(files)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: backed up %v, want %v", tt.name, got, tt.want)
+		}
+
+		// Files left out aren't even hashed.
+		hashed := map[string]bool{}
+		dec := json.NewDecoder(strings.NewReader(trace.String()))
+		for dec.More() {
+			var span traceSpan
+			if err := dec.Decode(&span); err != nil {
+				t.Fatal(err)
+			}
+			if span.Phase == "hash" {
+				hashed[filepath.Base(span.Path)] = true
+			}
+		}
+		for _, name := range got {
+			delete(hashed, name)
+		}
+		if len(hashed) > 0 {
+			t.Errorf("%s: files left out were hashed: %v", tt.name, hashed)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// sensitiveKeyParts mark config keys whose values print-config redacts.
+var sensitiveKeyParts = []string{"password", "secret", "access_key", "token", "encryption_key"}
+
+func runPrintConfig(args []string) error {
+	fs := flag.NewFlagSet("print-config", flag.ExitOnError)
+	fs.Parse(args)
+
+	printConfig(os.Stdout, viper.GetViper())
+	return nil
+}
+
+// printConfig writes every effective config key of v with its value and where
+// the value came from: the config file, a built-in default, or a secret
+// backend. Credentials are redacted.
+func printConfig(w io.Writer, v *viper.Viper) {
+	fmt.Fprintf(w, "# config file: %s\n", v.ConfigFileUsed())
+
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := v.Get(key)
+
+		source := "default"
+		if v.InConfig(key) {
+			source = "file"
+		}
+		if s, ok := value.(string); ok {
+			if scheme, _, ok := strings.Cut(s, ":"); ok {
+				if _, ok := secretResolvers[scheme]; ok {
+					// The reference itself is safe to show and says more
+					// than a redacted value.
+					fmt.Fprintf(w, "%s = %q # %s via %s\n", key, s, scheme, source)
+					continue
+				}
+			}
+		}
+
+		fmt.Fprintf(w, "%s = %s # %s\n", key, formatConfigValue(key, value), source)
+	}
+}
+
+func formatConfigValue(key string, value interface{}) string {
+	if isSensitiveKey(key) {
+		if s, ok := value.(string); !ok || s != "" {
+			return `"<redacted>"`
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatConfigValue(key, item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]string, len(names))
+		for i, name := range names {
+			fields[i] = name + " = " + formatConfigValue(name, v[name])
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
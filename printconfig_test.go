@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPrintConfigSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datahaven.toml")
+	config := `
+[s3]
+access_key = "AKIA"
+secret_key = "vault:secret/data/s3#secret_key"
+
+[backup]
+upload_workers = 4
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetDefault("backup.bucket", "datahaven")
+	v.SetDefault("backup.upload_workers", 8)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	printConfig(&buf, v)
+	for _, want := range []string{
+		`backup.bucket = "datahaven" # default`,
+		`backup.upload_workers = 4 # file`,
+		`s3.access_key = "<redacted>" # file`,
+		`s3.secret_key = "vault:secret/data/s3#secret_key" # vault via file`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("print-config output lacks %q:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "AKIA") {
+		t.Errorf("print-config shows a credential:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Intervals between progress reports. A terminal gets a bar redrawn in
+// place, anything else a log line now and then.
+const (
+	progressBarInterval = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+	progressBarWidth    = 30
+)
+
+// reportProgress reports the progress tracked by stats to stderr until the
+// returned function is called, which also reports the final state. The
+// totals are what stats has scanned.
+func reportProgress(stats *Stats, what string) func() {
+	tty := false
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		tty = true
+	}
+	interval := progressLogInterval
+	if tty {
+		interval = progressBarInterval
+	}
+	return startProgress(stats, what, tty, interval)
+}
+
+// startProgress reports progress every interval, as a bar for a terminal
+// and as log lines otherwise.
+func startProgress(stats *Stats, what string, tty bool, interval time.Duration) func() {
+	report := func() {
+		if tty {
+			fmt.Fprintf(logOutput, "\r%s %s", what, progressBar(stats.Snapshot()))
+		} else {
+			log.Printf("%s: %s", what, stats.Snapshot())
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+		report()
+		if tty {
+			io.WriteString(logOutput, "\n")
+		}
+	}
+}
+
+// progressBar renders ss as a single terminal line.
+func progressBar(ss StatsSnapshot) string {
+	fraction := 1.0
+	if ss.BytesScanned > 0 {
+		fraction = float64(ss.BytesDone) / float64(ss.BytesScanned)
+	}
+	filled := int(fraction * progressBarWidth)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	return fmt.Sprintf("[%s%s] %3.0f%% files %d/%d, bytes %d/%d, eta %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), fraction*100,
+		ss.FilesDone, ss.FilesScanned, ss.BytesDone, ss.BytesScanned, ss.ETA().Round(time.Second))
+}
+
+// progressSink counts the files written through an OutputSink as done.
+type progressSink struct {
+	OutputSink
+	stats *Stats
+}
+
+func (s progressSink) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	// A file kept as it was is done with too.
+	err := s.OutputSink.WriteFile(metadata, content)
+	if err != nil && !errors.Is(err, errConflictSkipped) {
+		return err
+	}
+	s.stats.AddDone(metadata.Size)
+	return err
+}
+
+func (s progressSink) Link(from, metadata *FileMetadata) error {
+	err := linkFile(s.OutputSink, from, metadata)
+	if err != nil && !errors.Is(err, errConflictSkipped) {
+		return err
+	}
+	s.stats.AddDone(metadata.Size)
+	return err
+}
+
+func (s progressSink) String() string {
+	return fmt.Sprint(s.OutputSink)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowSink takes a while over every file, so progress is reported while a
+// restore runs.
+type slowSink struct {
+	OutputSink
+}
+
+func (s slowSink) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	time.Sleep(30 * time.Millisecond)
+	return s.OutputSink.WriteFile(metadata, content)
+}
+
+func TestRestoreProgressLogged(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a": "first file", "b": "second file", "c": "third"})
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureOutput(t)
+	stats := NewStats()
+	stop := startProgress(stats, "restoring", false, 10*time.Millisecond)
+	sink := progressSink{slowSink{NewLocalSink(t.TempDir(), conflictOverwrite)}, stats}
+	err = RestoreFromBundle(bundle, sink, stats)
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Contains(line, "restoring: ") {
+			lines = append(lines, line)
+		}
+	}
+	// Reports while restoring, then the final one.
+	if len(lines) < 2 {
+		t.Fatalf("%d progress lines, want some before the last:\n%s", len(lines), out.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "files ") || !strings.Contains(line, "eta ") {
+			t.Errorf("progress line %q doesn't report files, bytes and eta", line)
+		}
+	}
+	// The totals are the snapshot's.
+	total := len("first file") + len("second file") + len("third")
+	if want := fmt.Sprintf("files 3/3 (0 failed), bytes %d/%d", total, total); !strings.Contains(lines[len(lines)-1], want) {
+		t.Errorf("last progress line %q, want %q", lines[len(lines)-1], want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// optionalMetadataFields are the FileMetadata fields, by BSON key, that can be
+// left out of stored documents. Everything else is needed to find, verify or
+// restore a file and is always stored.
+var optionalMetadataFields = []string{"ctime", "mtime", "atime", "btime", "uid", "gid", "mode", "acl", "fileflags", "quickhash", "inode"}
+
+// metadataOmissions returns the optional fields not listed in fields. An
+// empty list stores every field.
+func metadataOmissions(fields []string) (map[string]struct{}, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	keep := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		field = strings.ToLower(field)
+		if !isOptionalMetadataField(field) {
+			return nil, fmt.Errorf("unknown metadata field %q, expected one of %s", field, strings.Join(optionalMetadataFields, ", "))
+		}
+		keep[field] = struct{}{}
+	}
+
+	omit := make(map[string]struct{})
+	for _, field := range optionalMetadataFields {
+		if _, ok := keep[field]; !ok {
+			omit[field] = struct{}{}
+		}
+	}
+	return omit, nil
+}
+
+func isOptionalMetadataField(field string) bool {
+	for _, f := range optionalMetadataFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// projectMetadata returns the document to store for metadata with the
+// omitted fields removed.
+func projectMetadata(metadata *FileMetadata, omit map[string]struct{}) (interface{}, error) {
+	if len(omit) == 0 {
+		return metadata, nil
+	}
+
+	raw, err := bson.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	projected := doc[:0]
+	for _, e := range doc {
+		if _, ok := omit[e.Key]; !ok {
+			projected = append(projected, e)
+		}
+	}
+	return projected, nil
+}
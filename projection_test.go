@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestProjectMetadata(t *testing.T) {
+	metadata := &FileMetadata{
+		Ctime: 1, Mtime: 2, Atime: 3, Btime: 4, Uid: 5, Gid: 6, ACL: []byte("acl"), FileFlags: 7, QuickHash: "quick", Inode: 8,
+		Name: "file", Path: "/src/file", RelPath: "file", Size: 4, Hash: sha256Hash("data"),
+	}
+	tests := []struct {
+		fields  []string
+		omitted []string
+	}{
+		{nil, nil},
+		{[]string{"mtime", "UID"}, []string{"ctime", "atime", "btime", "gid", "acl", "fileflags", "quickhash", "inode"}},
+	}
+	for _, tt := range tests {
+		omit, err := metadataOmissions(tt.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := projectMetadata(metadata, omit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored bson.M
+		if err := bson.Unmarshal(raw, &stored); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range tt.omitted {
+			if _, ok := stored[field]; ok {
+				t.Errorf("fields %v: %s stored", tt.fields, field)
+			}
+		}
+		for _, field := range append(tt.fields, "path", "relpath", "size", "hash") {
+			if _, ok := stored[strings.ToLower(field)]; !ok {
+				t.Errorf("fields %v: %s not stored", tt.fields, field)
+			}
+		}
+	}
+
+	if _, err := metadataOmissions([]string{"hash"}); err == nil {
+		t.Error("metadataOmissions accepted a required field")
+	}
+}
+
+func TestRestoreWithoutTimes(t *testing.T) {
+	files := []*FileMetadata{{RelPath: "file", Size: 4, Hash: sha256Hash("data")}}
+	bundle := writeTestBundle(t, &Snapshot{ID: "s1"}, files, map[string][]byte{sha256Hash("data"): []byte("data")})
+	dst := t.TempDir()
+	before := time.Now().Add(-time.Minute)
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a stored mtime the file keeps the time it was restored at
+	// rather than the epoch.
+	if info.ModTime().Before(before) {
+		t.Fatalf("restored file has mtime %v", info.ModTime())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"syscall"
+)
+
+// quickHashRecord is what the previous snapshot recorded of a file, enough
+// to reuse its hash when neither the file's stat nor its quick hash changed.
+type quickHashRecord struct {
+	Size        int64
+	Mtime       int64
+	Ctime       int64
+	Inode       uint64
+	QuickHash   string
+	Hash        string
+	Normalizer  string
+	BlockSize   int64
+	BlockHashes []string
+}
+
+// quickHashIndex maps the path of every file of the previous snapshot that
+// has a quick hash to its record. A nil index matches nothing.
+type quickHashIndex map[string]quickHashRecord
+
+// loadQuickHashes indexes the files of the latest snapshot that were
+// fully hashed with algorithm and have a quick hash.
+func loadQuickHashes(store MongoDBClient, algorithm string) (quickHashIndex, error) {
+	var latest *Snapshot
+	err := store.ForEachSnapshot(func(snapshot *Snapshot) error {
+		if snapshot.Continues == "" {
+			latest = snapshot
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finding the previous snapshot: %w", err)
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	index := quickHashIndex{}
+	err = store.ForEachFile(latest.ID, func(metadata *FileMetadata) error {
+		// A file that changed while it was hashed may not have the
+		// hash of its content.
+		if metadata.QuickHash == "" || metadata.Inconsistent || !strings.HasPrefix(metadata.Hash, algorithm+":") {
+			return nil
+		}
+		index[metadata.Path] = quickHashRecord{
+			Size:        metadata.Size,
+			Mtime:       metadata.Mtime,
+			Ctime:       metadata.Ctime,
+			Inode:       metadata.Inode,
+			QuickHash:   metadata.QuickHash,
+			Hash:        metadata.Hash,
+			Normalizer:  metadata.Normalizer,
+			BlockSize:   metadata.BlockSize,
+			BlockHashes: metadata.BlockHashes,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot %s: %w", latest.ID, err)
+	}
+	log.Printf("loaded %d quick hashes from snapshot %s", len(index), latest.ID)
+	return index, nil
+}
+
+// lookup returns the record of the file at path if it is still the same
+// inode, with the size, modification and change times of info, still has
+// quickHash and would be hashed with the same normalizer, so its recorded
+// hash can be used without reading the file. The quick hash only samples
+// the file, a same-size edit elsewhere is only told by the times.
+func (x quickHashIndex) lookup(path string, info fs.FileInfo, quickHash, normalizer string) (quickHashRecord, bool) {
+	record, ok := x[path]
+	if !ok || record.QuickHash != quickHash || record.Normalizer != normalizer {
+		return quickHashRecord{}, false
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if record.Size != info.Size() || record.Mtime != stat.Mtim.Nano() || record.Ctime != stat.Ctim.Nano() || record.Inode != stat.Ino {
+		return quickHashRecord{}, false
+	}
+	return record, true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuickHashDetectsMiddleChange(t *testing.T) {
+	dir := t.TempDir()
+	content := testLines(1, 64<<10)
+	writeFiles(t, dir, map[string]string{"big": string(content)})
+	path := filepath.Join(dir, "big")
+
+	before, err := calculateQuickHash(path, int64(len(content)), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)/2] ^= 1
+	writeFiles(t, dir, map[string]string{"big": string(content)})
+	after, err := calculateQuickHash(path, int64(len(content)), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("quick hash unchanged after a change in the middle block")
+	}
+}
+
+func TestScanReusesUnchangedHash(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"same":    string(testLines(1, 64<<10)),
+		"changed": string(testLines(2, 64<<10)),
+		"grown":   string(testLines(3, 64<<10)),
+	})
+	cfg := testBackupConfig(t)
+	cfg.QuickHashBytes = 4096
+	sources := []SourceConfig{{Path: dir}}
+
+	// The previous snapshot records a hash that can't be computed from
+	// the content, so a file whose hash is reused is told apart.
+	previous := scanFiles(t, sources, cfg)
+	for i := range previous {
+		previous[i].Hash = "sha256:previous-" + previous[i].Name
+	}
+	store := newMemStore()
+	store.addSnapshot(&Snapshot{ID: "previous"}, previous)
+
+	changed := testLines(2, 64<<10)
+	changed[len(changed)/2] ^= 1
+	writeFiles(t, dir, map[string]string{"changed": string(changed)})
+	f, err := os.OpenFile(filepath.Join(dir, "grown"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("more")
+	f.Close()
+
+	cfg.quickHashes, err = loadQuickHashes(store, cfg.HashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := map[string]string{}
+	for _, metadata := range scanFiles(t, sources, cfg) {
+		if metadata.QuickHash == "" {
+			t.Errorf("%s: no quick hash", metadata.Name)
+		}
+		hashes[metadata.Name] = metadata.Hash
+	}
+	if hashes["same"] != "sha256:previous-same" {
+		t.Errorf("unchanged file hashed again: %s", hashes["same"])
+	}
+	for _, name := range []string{"changed", "grown"} {
+		want, _, err := calculateHash(filepath.Join(dir, name), cfg.HashAlgorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[name] != want {
+			t.Errorf("%s: hash %s, want %s", name, hashes[name], want)
+		}
+	}
+}
+
+func TestScanRehashesChangeOutsideQuickHash(t *testing.T) {
+	dir := t.TempDir()
+	original := testLines(1, 64<<10)
+	writeFiles(t, dir, map[string]string{"edited": string(original), "replaced": string(original)})
+	cfg := testBackupConfig(t)
+	cfg.QuickHashBytes = 4096
+	modified := time.Now().Add(-time.Hour)
+	for _, name := range []string{"edited", "replaced"} {
+		if err := os.Chtimes(filepath.Join(dir, name), modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources := []SourceConfig{{Path: dir}}
+	previous := scanFiles(t, sources, cfg)
+	store := newMemStore()
+	store.addSnapshot(&Snapshot{ID: "previous"}, previous)
+
+	// A quarter in is none of the first, middle or last blocks the quick
+	// hash samples.
+	changed := testLines(1, 64<<10)
+	changed[len(changed)/4] ^= 1
+	// Rewritten in place, its mtime moves on.
+	edited := filepath.Join(dir, "edited")
+	if err := os.WriteFile(edited, changed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(edited, modified.Add(time.Minute), modified.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// Replaced by another file with the mtime it had, only its inode
+	// tells.
+	tmp := filepath.Join(t.TempDir(), "replaced")
+	if err := os.WriteFile(tmp, changed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmp, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "replaced")); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	cfg.quickHashes, err = loadQuickHashes(store, cfg.HashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256Hash(string(changed))
+	for _, metadata := range scanFiles(t, sources, cfg) {
+		if metadata.Hash != want {
+			t.Errorf("%s: hash %s of the previous content, want %s", metadata.Name, metadata.Hash, want)
+		}
+	}
+}
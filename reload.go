@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// hotReloadKeys are the config keys a reload applies to a running backup.
+// Changes to any other key take effect after a restart.
+var hotReloadKeys = map[string]bool{
+	"backup.exclude":                   true,
+	"backup.exclude_file":              true,
+	"backup.max_concurrency":           true,
+	"backup.upload_windows":            true,
+	"backup.upload_windows_timezone":   true,
+	"backup.upload_windows_pause_scan": true,
+	"log.microseconds":                 true,
+}
+
+// configReloader re-reads the config file and applies what changed in it
+// to a running backup.
+type configReloader struct {
+	engine *Engine
+	// started is the config the process started with, which settings
+	// that can't be reloaded are still in effect from, and applied the
+	// one last reloaded.
+	started *viper.Viper
+	applied *viper.Viper
+	exclude []string
+}
+
+func newConfigReloader(engine *Engine, v *viper.Viper, cfg *Config) *configReloader {
+	return &configReloader{engine: engine, started: v, applied: v, exclude: cfg.Backup.Exclude}
+}
+
+// reload reads the config file again. An invalid config is logged and
+// leaves everything as it was.
+func (r *configReloader) reload() {
+	v := viper.New()
+	var next Config
+	if err := loadConfig(v, r.started.ConfigFileUsed(), &next); err != nil {
+		log.Printf("reloading config failed, keeping the current one: %v", err)
+		return
+	}
+
+	// The excludes are compared as loaded, which covers what the exclude
+	// file lists.
+	var applied, restart []string
+	if !reflect.DeepEqual(r.exclude, next.Backup.Exclude) {
+		applied = append(applied, "backup.exclude")
+	}
+	for _, key := range unionKeys(r.started, v) {
+		switch {
+		case key == "backup.exclude" || key == "backup.exclude_file":
+		case hotReloadKeys[key]:
+			if !reflect.DeepEqual(r.applied.Get(key), v.Get(key)) {
+				applied = append(applied, key)
+			}
+		case !reflect.DeepEqual(r.started.Get(key), v.Get(key)):
+			restart = append(restart, key)
+		}
+	}
+	if len(applied) > 0 {
+		setupLogging(&next.Log)
+		if err := r.engine.Reload(&next); err != nil {
+			log.Printf("reloading config failed, keeping the current one: %v", err)
+			return
+		}
+		r.applied = v
+		r.exclude = next.Backup.Exclude
+		log.Printf("config reloaded, applied %s", strings.Join(applied, ", "))
+	} else {
+		log.Printf("config reloaded, nothing to apply")
+	}
+	if len(restart) > 0 {
+		log.Printf("changed settings that take effect after a restart: %s", strings.Join(restart, ", "))
+	}
+}
+
+// unionKeys returns the keys set in either a or b, sorted.
+func unionKeys(a, b *viper.Viper) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, key := range append(a.AllKeys(), b.AllKeys()...) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// reloadConfigOnSignal reloads the config every time the process receives
+// SIGHUP. The returned function stops the reloading.
+func reloadConfigOnSignal(reloader *configReloader) func() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				reloader.reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
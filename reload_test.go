@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	out := captureOutput(t)
+	path := filepath.Join(t.TempDir(), "datahaven.toml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("[backup]\nmax_concurrency = 2\n")
+	v := viper.New()
+	cfg := &Config{}
+	if err := loadConfig(v, path, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A backup is running.
+	engine := NewEngine(cfg, newMemStore(), nil)
+	budget := NewBudget(cfg.Backup.MaxConcurrency)
+	cfg.Backup.excludes = newPatternSet(cfg.Backup.Exclude)
+	engine.setLive(&liveBackup{cfg: &cfg.Backup, budget: budget, uploads: NewGate(), scan: NewGate()})
+	stop := reloadConfigOnSignal(newConfigReloader(engine, v, cfg))
+	defer stop()
+
+	writeConfig("[backup]\nmax_concurrency = 5\nexclude = [\"*.tmp\"]\nhash_algorithm = \"sha512\"\n")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	// What needs a restart is logged last.
+	if !eventually(t, func() bool { return strings.Contains(out.String(), "after a restart") }) {
+		t.Fatalf("config not reloaded after SIGHUP: %q", out.String())
+	}
+
+	budget.mu.Lock()
+	limit := budget.limit
+	budget.mu.Unlock()
+	if limit != 5 {
+		t.Errorf("concurrency %d after the reload, want 5", limit)
+	}
+	if got := cfg.Backup.excludePatterns(); !reflect.DeepEqual(got, []string{"*.tmp"}) {
+		t.Errorf("excludes %v after the reload, want *.tmp", got)
+	}
+	if cfg.Backup.HashAlgorithm != defaultHashAlgorithm {
+		t.Errorf("hash algorithm changed to %s without a restart", cfg.Backup.HashAlgorithm)
+	}
+	for _, want := range []string{
+		"config reloaded, applied backup.exclude, backup.max_concurrency",
+		"take effect after a restart: backup.hash_algorithm",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log %q doesn't mention %q", out.String(), want)
+		}
+	}
+}
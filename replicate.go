@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// maxCopyObjectSize is the largest object a single CopyObject can copy.
+const maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+// Replicate copies every object of srcBucket that is missing from dstBucket.
+// Objects are copied server-side when both clients talk to the same endpoint
+// with the same credentials, and streamed through this host otherwise. Objects
+// already in dstBucket are skipped, so an interrupted replication resumes by
+// running it again.
+func Replicate(src, dst *S3Client, srcBucket, dstBucket string) error {
+	serverSide := src.cfg.sameAccount(&dst.cfg)
+
+	var listed, copied int
+	var copyErr error
+	err := src.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:       aws.String(srcBucket),
+		Prefix:       aws.String(src.prefix),
+		RequestPayer: src.requestPayer(),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if !src.ownsKey(aws.StringValue(object.Key)) {
+				continue
+			}
+			listed++
+			key := src.unprefixed(aws.StringValue(object.Key))
+
+			exists, err := dst.Exists(dstBucket, key)
+			if err != nil {
+				copyErr = err
+				return false
+			}
+			if exists {
+				continue
+			}
+
+			if serverSide && aws.Int64Value(object.Size) <= maxCopyObjectSize {
+				err = dst.copyObject(srcBucket, key, dstBucket, key)
+			} else {
+				err = streamCopyObject(src, dst, srcBucket, dstBucket, key)
+			}
+			if err != nil {
+				copyErr = fmt.Errorf("copy %s: %w", key, err)
+				return false
+			}
+
+			copied++
+			log.Printf("replicated s3://%s/%s to s3://%s/%s (%d copied, %d listed)", srcBucket, key, dstBucket, key, copied, listed)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+
+	log.Printf("replication completed, %d objects listed, %d copied", listed, copied)
+	return nil
+}
+
+// sameAccount reports whether c and other reach the same endpoint with the
+// same credentials, which is what copying between their buckets needs.
+// Tuning, such as part sizes and connections, doesn't matter.
+func (c *S3Config) sameAccount(other *S3Config) bool {
+	return c.Endpoint == other.Endpoint && c.Region == other.Region &&
+		c.AccessKey == other.AccessKey && c.SecretKey == other.SecretKey
+}
+
+func (c *S3Client) copyObject(srcBucket, srcKey, dstBucket, dstKey string) error {
+	_, err := c.svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:       aws.String(dstBucket),
+		Key:          aws.String(c.objectKey(dstKey)),
+		CopySource:   aws.String(copySource(srcBucket, c.objectKey(srcKey))),
+		ACL:          c.objectACL(),
+		RequestPayer: c.requestPayer(),
+	})
+	return err
+}
+
+// copySource returns the CopySource of key in bucket. Objects behind an
+// access point are addressed through the access point ARN.
+func copySource(bucket, key string) string {
+	if isBucketARN(bucket) {
+		return url.PathEscape(bucket + "/object/" + key)
+	}
+	return url.PathEscape(bucket + "/" + key)
+}
+
+// streamCopyObject downloads key from src and uploads it to dst with its
+// user metadata, the transform chain among it, and content type.
+func streamCopyObject(src, dst *S3Client, srcBucket, dstBucket, key string) error {
+	object, err := src.svc.GetObject(&s3.GetObjectInput{
+		Bucket:       aws.String(srcBucket),
+		Key:          aws.String(src.objectKey(key)),
+		RequestPayer: src.requestPayer(),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	uploader := s3manager.NewUploaderWithClient(dst.svc)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket:       aws.String(dstBucket),
+		Key:          aws.String(dst.objectKey(key)),
+		Body:         object.Body,
+		Metadata:     object.Metadata,
+		ContentType:  object.ContentType,
+		ACL:          dst.objectACL(),
+		RequestPayer: dst.requestPayer(),
+	})
+	return err
+}
+
+func runReplicate() error {
+	if Cfg.Replica.Bucket == "" {
+		return fmt.Errorf("replica.bucket is not configured")
+	}
+
+	src := NewS3Client(&Cfg.S3)
+	dst := NewS3Client(&Cfg.Replica.S3)
+
+	if err := Replicate(src, dst, Cfg.Backup.Bucket, Cfg.Replica.Bucket); err != nil {
+		return fmt.Errorf("replicating: %w", err)
+	}
+	return nil
+}
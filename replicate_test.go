@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReplicateCopiesMissingObjects(t *testing.T) {
+	transforms := map[string]string{"Datahaven-Transforms": `[{"Name":"gzip"}]`}
+	tests := []struct {
+		name     string
+		sameHost bool
+		op       string
+	}{
+		{"server-side", true, "COPY"},
+		{"streamed", false, "PUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcS3 := newFakeS3(t)
+			dstS3 := srcS3
+			if !tt.sameHost {
+				dstS3 = newFakeS3(t)
+			}
+			srcS3.put("src", "a", []byte("content a"), transforms)
+			srcS3.put("src", "b", []byte("content b"), transforms)
+			srcS3.put("src", "c", []byte("content c"), nil)
+			dstS3.put("dst", "b", []byte("already there"), nil)
+
+			if err := Replicate(srcS3.client(), dstS3.client(), "src", "dst"); err != nil {
+				t.Fatal(err)
+			}
+			if got := dstS3.keys("dst"); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+				t.Fatalf("destination holds %v", got)
+			}
+			if n := dstS3.count(tt.op); n != 2 {
+				t.Errorf("%d %s requests, want 2 for the missing objects", n, tt.op)
+			}
+			if got := dstS3.get("dst", "b").data; !bytes.Equal(got, []byte("already there")) {
+				t.Errorf("existing object rewritten to %q", got)
+			}
+			a := dstS3.get("dst", "a")
+			if !bytes.Equal(a.data, []byte("content a")) {
+				t.Errorf("replicated content %q", a.data)
+			}
+			if !reflect.DeepEqual(a.metadata, transforms) {
+				t.Errorf("replicated metadata %v, want %v", a.metadata, transforms)
+			}
+
+			// Everything is there now, a second run copies nothing.
+			before := dstS3.count(tt.op)
+			if err := Replicate(srcS3.client(), dstS3.client(), "src", "dst"); err != nil {
+				t.Fatal(err)
+			}
+			if n := dstS3.count(tt.op) - before; n != 0 {
+				t.Errorf("second run sent %d %s requests", n, tt.op)
+			}
+		})
+	}
+}
+
+func TestReplicateServerSideDespiteTuning(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.put("src", "a", []byte("content a"), nil)
+	src := fake.client()
+	// The replica's config is filled in and budgeted differently, as
+	// loadConfig leaves it.
+	tuned := src.cfg
+	tuned.MaxConnections = 64
+	tuned.PartSize = 16 << 20
+	tuned.uploadConcurrency = 1
+	tuned.ObjectACL = "bucket-owner-full-control"
+	tuned.CorrectClockSkew = true
+	dst := NewS3Client(&tuned)
+
+	if err := Replicate(src, dst, "src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if n, streamed := fake.count("COPY"), fake.count("PUT"); n != 1 || streamed != 0 {
+		t.Errorf("%d copies and %d puts, want the object copied server-side", n, streamed)
+	}
+}
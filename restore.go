@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// restoreRun restores the files of a snapshot to a sink. Files stored in an
+// object are grouped by its key as they are added, and written once the
+// object is read, so an object shared by many files is read once.
+type restoreRun struct {
+	sink     OutputSink
+	stats    *Stats
+	hardLink bool
+	// paths are the relative paths restored, with what is below them, or
+	// nil for all of them.
+	paths []string
+	// byKey holds the files waiting for their object, keys the order the
+	// objects were first referred to in.
+	byKey    map[string][]*FileMetadata
+	keys     []string
+	restored int
+	kept     int
+}
+
+func newRestoreRun(sink OutputSink, stats *Stats, hardLink bool) *restoreRun {
+	return &restoreRun{sink: sink, stats: stats, hardLink: hardLink, byKey: make(map[string][]*FileMetadata)}
+}
+
+// add restores a file of the catalog that isn't stored in an object, and
+// holds on to one that is until its object is read.
+func (r *restoreRun) add(metadata *FileMetadata) error {
+	if !selectedPath(metadata.RelPath, r.paths) {
+		return nil
+	}
+	if !metadata.MountPoint && !metadata.Denied && !metadata.ChecksumFailed {
+		r.stats.AddScanned(metadata.Size)
+	}
+	switch {
+	case metadata.MountPoint:
+		return r.sink.Mkdir(metadata)
+	case metadata.Denied, metadata.ChecksumFailed:
+		return nil
+	case metadata.Inline:
+		content, err := Unwrap(bytes.NewReader(metadata.InlineData), metadata.Transforms)
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", metadata.RelPath, err)
+		}
+		err = r.sink.WriteFile(metadata, content)
+		if errors.Is(err, errConflictSkipped) {
+			log.Printf("[%s] exists, keeping it", metadata.RelPath)
+			r.kept++
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.restored++
+		return nil
+	default:
+		key := metadata.objectKey()
+		if _, ok := r.byKey[key]; !ok {
+			r.keys = append(r.keys, key)
+		}
+		r.byKey[key] = append(r.byKey[key], metadata)
+		return nil
+	}
+}
+
+// selectedPath reports whether relPath is one of paths or below one of them.
+// Every path is selected when paths is empty.
+func selectedPath(relPath string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, path := range paths {
+		if relPath == path || strings.HasPrefix(relPath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// object writes the files stored in the object key, read from object.
+func (r *restoreRun) object(key string, object io.Reader) error {
+	n, skipped, err := restoreObject(object, r.sink, r.byKey[key], r.hardLink)
+	if err != nil {
+		return fmt.Errorf("restoring object %s: %w", key, err)
+	}
+	r.restored += n
+	r.kept += skipped
+	delete(r.byKey, key)
+	return nil
+}
+
+// RestoreSnapshot restores every file of a snapshot to sink, at its
+// relative path, reading the objects from objects. Each object is
+// downloaded once however many files share it: the first of them is
+// written from the download and the others are copied from it, or hard
+// linked to it with opts.HardLink.
+func RestoreSnapshot(client MongoDBClient, objects ObjectReader, snapshotID string, sink OutputSink, opts RestoreOptions) error {
+	snapshot, err := client.FindSnapshot(snapshotID)
+	if err != nil {
+		return fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	stats := opts.Stats
+	if stats == nil {
+		stats = NewStats()
+	}
+	run := newRestoreRun(sink, stats, opts.HardLink)
+	run.paths = opts.Paths
+	err = client.ForEachFile(snapshot.ID, run.add)
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	restore := func(key string) error {
+		// The first file of an object decides which version is read.
+		body, err := objects.Download(key, run.byKey[key][0].VersionID)
+		if err != nil {
+			return fmt.Errorf("downloading %s: %w", key, err)
+		}
+		defer body.Close()
+		return run.object(key, body)
+	}
+	// Archived objects are thawed together once the others are restored.
+	thawing, canThaw := objects.(thawingReader)
+	var archived []thawObject
+	for _, key := range run.keys {
+		err := restore(key)
+		if errors.Is(err, errObjectArchived) && canThaw && opts.Thaw != nil {
+			archived = append(archived, thawObject{key: key, version: run.byKey[key][0].VersionID})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(archived) > 0 {
+		if err := thawing.Thaw(archived, *opts.Thaw); err != nil {
+			return err
+		}
+		for _, object := range archived {
+			if err := restore(object.key); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("restored %d files of snapshot %s to [%s] from %d objects, kept %d existing files", run.restored, snapshot.ID, sink, len(run.keys), run.kept)
+	return nil
+}
+
+// snapshotRestoreSize returns how many bytes restoring the snapshot writes,
+// the sum of the sizes of its restorable files.
+func snapshotRestoreSize(client MongoDBClient, snapshotID string) (int64, error) {
+	var total int64
+	err := client.ForEachFile(snapshotID, func(metadata *FileMetadata) error {
+		if !metadata.MountPoint && !metadata.Denied && !metadata.ChecksumFailed {
+			total += metadata.Size
+		}
+		return nil
+	})
+	return total, err
+}
+
+// openRestoreDestination returns the sink restoring to target, a local
+// directory or an sftp:// URL, and the func closing it. A local directory
+// must have room for the need bytes unless force is set; the free space of
+// a remote destination isn't known.
+func openRestoreDestination(target, onConflict, sshKey, knownHosts string, force bool, need func() (int64, error)) (OutputSink, func(), error) {
+	if strings.HasPrefix(target, "sftp://") {
+		remote, err := DialSFTPSink(target, sshKey, knownHosts, onConflict)
+		if err != nil {
+			return nil, nil, err
+		}
+		return remote, func() { remote.Close() }, nil
+	}
+	size, err := need()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkRestoreSpace(target, size, unix.Statfs); err != nil {
+		if !force {
+			return nil, nil, fmt.Errorf("%w, run with --force to restore anyway", err)
+		}
+		log.Printf("restoring anyway: %v", err)
+	}
+	return NewLocalSink(target, onConflict), func() {}, nil
+}
+
+// restoreFlags are the flags of how files are restored, shared by the
+// commands restoring them.
+type restoreFlags struct {
+	force      *bool
+	verify     *bool
+	onConflict *string
+	hardLink   *bool
+	sshKey     *string
+	knownHosts *string
+	thawTier   *string
+	thawDays   *int64
+	thawPoll   *time.Duration
+}
+
+func addRestoreFlags(fs *flag.FlagSet) *restoreFlags {
+	return &restoreFlags{
+		force:      fs.Bool("force", false, "restore even if the destination doesn't have enough free space"),
+		verify:     fs.Bool("verify-on-restore", true, "check that the content of every file hashes to its recorded hash before writing it"),
+		onConflict: fs.String("on-conflict", conflictOverwrite, "what to do with files that exist in the destination: overwrite, skip, rename (restore next to them with a suffix) or newer (overwrite only with a newer backup)"),
+		hardLink:   fs.Bool("hard-link", false, "restore files of the same content as hard links to one file rather than copies"),
+		sshKey:     fs.String("ssh-key", "", "private key to authenticate to an sftp:// destination with, in addition to the keys of the SSH agent"),
+		knownHosts: fs.String("known-hosts", filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), "file holding the host key of an sftp:// destination"),
+		thawTier:   fs.String("thaw-tier", thawStandard, "tier to thaw objects archived in Glacier or Deep Archive with: Expedited, Standard or Bulk"),
+		thawDays:   fs.Int64("thaw-days", 7, "days a thawed copy of an archived object stays readable"),
+		thawPoll:   fs.Duration("thaw-poll", 15*time.Minute, "how often to check whether archived objects are thawed"),
+	}
+}
+
+// validate checks the parsed flags.
+func (f *restoreFlags) validate() error {
+	if err := validateConflictPolicy(*f.onConflict); err != nil {
+		return fmt.Errorf("--on-conflict: %w", err)
+	}
+	if err := validateThawTier(*f.thawTier); err != nil {
+		return fmt.Errorf("--thaw-tier: %w", err)
+	}
+	if *f.thawDays < 1 {
+		return fmt.Errorf("--thaw-days must be at least 1")
+	}
+	return nil
+}
+
+// open returns the sink restoring to target, counting what is restored in
+// stats, and the func closing it. need returns how many bytes the restore
+// writes, for the free space check.
+func (f *restoreFlags) open(target string, stats *Stats, need func() (int64, error)) (OutputSink, func(), error) {
+	destination, closeDestination, err := openRestoreDestination(target, *f.onConflict, *f.sshKey, *f.knownHosts, *f.force, need)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sink OutputSink = progressSink{destination, stats}
+	if *f.verify {
+		sink = hashCheckSink{sink}
+	}
+	return sink, closeDestination, nil
+}
+
+// options returns the RestoreOptions of a restore of paths, the whole
+// snapshot when empty, tracked by stats.
+func (f *restoreFlags) options(stats *Stats, paths []string) RestoreOptions {
+	return RestoreOptions{
+		HardLink: *f.hardLink,
+		Stats:    stats,
+		Paths:    paths,
+		Thaw:     &ThawOptions{Tier: *f.thawTier, Days: *f.thawDays, Poll: *f.thawPoll},
+	}
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	sourceRoot := fs.String("verify-against-source", "", "compare every restored file with the file at the same path below this directory, if it still exists")
+	flags := addRestoreFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven restore [--force] [--hard-link] [--on-conflict policy] [--verify-on-restore=false] [--verify-against-source dir] [--thaw-tier tier] [--thaw-days n] [--thaw-poll interval] <dir|sftp://user@host/dir> [snapshot-id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a destination directory and optionally a snapshot")
+	}
+	if err := flags.validate(); err != nil {
+		return err
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	snapshot, err := client.FindSnapshot(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	stats := NewStats()
+	sink, closeDestination, err := flags.open(fs.Arg(0), stats, func() (int64, error) {
+		return snapshotRestoreSize(client, snapshot.ID)
+	})
+	if err != nil {
+		return err
+	}
+	defer closeDestination()
+	stopProgress := reportProgress(stats, "restoring")
+	defer stopProgress()
+
+	var check *sourceCheckSink
+	if *sourceRoot != "" {
+		check = newSourceCheckSink(sink, *sourceRoot)
+		sink = check
+	}
+	engine := NewEngine(&Cfg, client, func() []Storage {
+		return newDestinations(NewS3Client(&Cfg.S3), &Cfg.Backup)
+	})
+	if err := engine.RestoreSnapshot(snapshot.ID, sink, flags.options(stats, nil)); err != nil {
+		return err
+	}
+	if check != nil {
+		return check.Err()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRestoreSnapshotDownloadsEachObjectOnce(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"other": "other content"}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("dir%d/copy%d", i%4, i)] = "the same content"
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gets := s3.count("GET")
+	dst := t.TempDir()
+	stats := NewStats()
+	sink := hashCheckSink{progressSink{NewLocalSink(dst, conflictOverwrite), stats}}
+	if err := RestoreSnapshot(store, NewS3Storage("", s3.client(), cfg.Bucket), summary.SnapshotID, sink, RestoreOptions{Stats: stats}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("GET") - gets; n != 2 {
+		t.Errorf("%d downloads for 21 files of two contents, want 2", n)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+	if ss := stats.Snapshot(); ss.FilesDone != 21 {
+		t.Errorf("%d files done, want 21", ss.FilesDone)
+	}
+}
+
+func TestRestoreSnapshotHardLinks(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a": "shared", "sub/b": "shared", "sub/c": "shared", "other": "other"}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	// A file in the way is replaced by the link.
+	writeFiles(t, dst, map[string]string{"sub/b": "old"})
+	stats := NewStats()
+	sink := hashCheckSink{progressSink{NewLocalSink(dst, conflictOverwrite), stats}}
+	if err := RestoreSnapshot(store, NewS3Storage("", s3.client(), cfg.Bucket), summary.SnapshotID, sink, RestoreOptions{HardLink: true, Stats: stats}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+
+	stat := func(name string) os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	a := stat("a")
+	if !os.SameFile(a, stat("sub/b")) || !os.SameFile(a, stat("sub/c")) {
+		t.Error("files of the same content aren't linked")
+	}
+	if os.SameFile(a, stat("other")) {
+		t.Error("files of other content are linked")
+	}
+	if ss := stats.Snapshot(); ss.FilesDone != 4 {
+		t.Errorf("%d files done, want 4", ss.FilesDone)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// hashCheckSink re-hashes the content of every file restored through it and
+// fails the write of one that doesn't hash to its recorded hash, catching a
+// corrupted or wrong object before it replaces anything in the destination.
+// Files whose recorded hash isn't of their plain content, normalized ones,
+// those keyed by path and mtime and those that changed while they were
+// backed up, are written unchecked.
+type hashCheckSink struct {
+	OutputSink
+}
+
+func (s hashCheckSink) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	algorithm, _, _ := strings.Cut(metadata.Hash, ":")
+	if _, ok := hashAlgorithms[algorithm]; !ok || metadata.Normalizer != "" || metadata.Inconsistent {
+		return s.OutputSink.WriteFile(metadata, content)
+	}
+	return s.OutputSink.WriteFile(metadata, &hashCheckReader{
+		r:         content,
+		hash:      newHash(algorithm),
+		algorithm: algorithm,
+		want:      metadata.Hash,
+		relPath:   metadata.RelPath,
+	})
+}
+
+// Link links a file written, and so checked, before.
+func (s hashCheckSink) Link(from, metadata *FileMetadata) error {
+	return linkFile(s.OutputSink, from, metadata)
+}
+
+func (s hashCheckSink) String() string {
+	return fmt.Sprint(s.OutputSink)
+}
+
+// hashCheckReader hashes what is read through it and turns the end of the
+// content into an error if the hash isn't want.
+type hashCheckReader struct {
+	r         io.Reader
+	hash      hash.Hash
+	algorithm string
+	want      string
+	relPath   string
+}
+
+func (h *hashCheckReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := formatHash(h.algorithm, h.hash); got != h.want {
+			return n, fmt.Errorf("restored content of %s hashes to %s, expected %s", h.relPath, got, h.want)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sha256Hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestRestoreCatchesWrongContent(t *testing.T) {
+	files := []*FileMetadata{
+		{RelPath: "good", Size: 4, Hash: sha256Hash("good")},
+		{RelPath: "bad", Size: 4, Hash: sha256Hash("good!")},
+	}
+	// The object stored for bad's hash holds other content, as a provider
+	// handing out the wrong object would.
+	bundle := writeTestBundle(t, &Snapshot{ID: "s1"}, files, map[string][]byte{
+		sha256Hash("good"):  []byte("good"),
+		sha256Hash("good!"): []byte("evil"),
+	})
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bad": "existing"})
+	err := RestoreFromBundle(bundle, hashCheckSink{NewLocalSink(dir, conflictOverwrite)}, NewStats())
+	if err == nil || !strings.Contains(err.Error(), "hashes to "+sha256Hash("evil")) {
+		t.Fatalf("RestoreFromBundle = %v, want a hash mismatch", err)
+	}
+	// Nothing of the wrong content is left, and the file it would have
+	// replaced is intact.
+	if got, want := readDir(t, dir), map[string]string{"good": "good", "bad": "existing"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destination holds %v after the mismatch, want %v", got, want)
+	}
+
+	// Unchecked, the wrong content is restored.
+	dir = t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dir, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readDir(t, dir), map[string]string{"good": "good", "bad": "evil"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %v, want %v", got, want)
+	}
+}
+
+func TestRestoreCheckSkipsUncheckableHashes(t *testing.T) {
+	files := []*FileMetadata{
+		{RelPath: "normalized", Size: 4, Hash: sha256Hash("norm"), Normalizer: "crlf"},
+		{RelPath: "mtime", Size: 4, Hash: keyPathMtime + ":0123"},
+		{RelPath: "changing", Size: 4, Hash: sha256Hash("once"), Inconsistent: true},
+	}
+	objects := map[string][]byte{}
+	for _, metadata := range files {
+		objects[metadata.Hash] = []byte("data")
+	}
+	bundle := writeTestBundle(t, &Snapshot{ID: "s1"}, files, objects)
+
+	dir := t.TempDir()
+	if err := RestoreFromBundle(bundle, hashCheckSink{NewLocalSink(dir, conflictOverwrite)}, NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dir); len(got) != 3 {
+		t.Fatalf("restored %v, want all 3 files", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryQueue holds files that failed during the main pass. They are retried
+// after it, so transient problems have had time to clear.
+type RetryQueue struct {
+	maxAttempts int
+	backoff     time.Duration
+
+	mu      sync.Mutex
+	pending []*RetryItem
+}
+
+// RetryItem is a queued file and the last error it failed with.
+type RetryItem struct {
+	Metadata FileMetadata
+	Attempts int
+	Err      error
+}
+
+// NewRetryQueue creates a new instance of RetryQueue. maxAttempts counts the
+// attempt made in the main pass.
+func NewRetryQueue(maxAttempts int, backoff time.Duration) *RetryQueue {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryQueue{maxAttempts: maxAttempts, backoff: backoff}
+}
+
+// Push queues a file whose first attempt failed with err.
+func (q *RetryQueue) Push(metadata FileMetadata, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, &RetryItem{Metadata: metadata, Attempts: 1, Err: err})
+}
+
+// Drain retries the queued files in rounds until they succeed or run out of
+// attempts. Each round waits an exponentially growing, jittered delay first,
+// then retries the files with workers goroutines, calling process with the
+// index of the worker. It returns the files that succeeded and the ones that
+// still fail.
+func (q *RetryQueue) Drain(workers int, process func(worker int, metadata FileMetadata) error) (succeeded []FileMetadata, failed []*RetryItem) {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+	if workers < 1 {
+		workers = 1
+	}
+
+	for attempt := 2; attempt <= q.maxAttempts && len(pending) > 0; attempt++ {
+		delay := jitter(q.backoff << (attempt - 2))
+		log.Printf("retrying %d failed files in %s (attempt %d of %d)", len(pending), delay.Round(time.Millisecond), attempt, q.maxAttempts)
+		time.Sleep(delay)
+
+		items := make(chan *RetryItem)
+		var wg sync.WaitGroup
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for item := range items {
+					item.Attempts++
+					item.Err = process(worker, item.Metadata)
+				}
+			}(worker)
+		}
+		for _, item := range pending {
+			items <- item
+		}
+		close(items)
+		wg.Wait()
+
+		var next []*RetryItem
+		for _, item := range pending {
+			if item.Err == nil {
+				succeeded = append(succeeded, item.Metadata)
+			} else {
+				next = append(next, item)
+			}
+		}
+		pending = next
+	}
+
+	return succeeded, pending
+}
+
+// jitter spreads d randomly over [d/2, 3d/2) so retries don't hit the
+// backend in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryQueueSucceedsOnLateAttempt(t *testing.T) {
+	queue := NewRetryQueue(4, time.Millisecond)
+	errFlaky := errors.New("flaky")
+	queue.Push(FileMetadata{Path: "late"}, errFlaky)
+	queue.Push(FileMetadata{Path: "broken"}, errFlaky)
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	succeeded, failed := queue.Drain(2, func(worker int, metadata FileMetadata) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[metadata.Path]++
+		// The main pass made the first attempt, this is the fourth.
+		if metadata.Path == "late" && calls[metadata.Path] == 3 {
+			return nil
+		}
+		return errFlaky
+	})
+
+	if len(succeeded) != 1 || succeeded[0].Path != "late" {
+		t.Fatalf("succeeded %v, want late", succeeded)
+	}
+	if len(failed) != 1 || failed[0].Metadata.Path != "broken" || failed[0].Attempts != 4 || failed[0].Err != errFlaky {
+		t.Fatalf("failed %+v, want broken after 4 attempts", failed)
+	}
+	if calls["late"] != 3 || calls["broken"] != 3 {
+		t.Fatalf("retried %v", calls)
+	}
+}
+
+func TestRetryQueueBoundsWorkers(t *testing.T) {
+	queue := NewRetryQueue(2, 0)
+	for i := 0; i < 50; i++ {
+		queue.Push(FileMetadata{Path: fmt.Sprint(i)}, errors.New("failed"))
+	}
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	workers := map[int]bool{}
+	succeeded, _ := queue.Drain(3, func(worker int, metadata FileMetadata) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		workers[worker] = true
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	if len(succeeded) != 50 {
+		t.Fatalf("%d of 50 retried", len(succeeded))
+	}
+	if most > 3 {
+		t.Errorf("%d retries ran at once with 3 workers", most)
+	}
+	for worker := range workers {
+		if worker < 0 || worker >= 3 {
+			t.Errorf("retry ran on worker %d", worker)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretResolver looks up the value a secret reference points to. A
+// reference is written as scheme:ref in a credential config value, e.g.
+// vault:secret/data/s3#access_key.
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// secretResolvers maps reference schemes to their backend. Values with any
+// other prefix are used as they are.
+var secretResolvers = map[string]SecretResolver{
+	"vault": &vaultResolver{},
+}
+
+// credentialValues returns the config values that may hold secret
+// references.
+func credentialValues(cfg *Config) []*string {
+	values := []*string{
+		&cfg.S3.AccessKey, &cfg.S3.SecretKey,
+		&cfg.Replica.S3.AccessKey, &cfg.Replica.S3.SecretKey,
+		&cfg.MongoDB.User, &cfg.MongoDB.Password,
+		&cfg.Backup.EncryptionKey,
+	}
+	for i := range cfg.Backup.Destinations {
+		s3 := &cfg.Backup.Destinations[i].S3
+		values = append(values, &s3.AccessKey, &s3.SecretKey)
+	}
+	return values
+}
+
+// resolveSecrets replaces every secret reference in values with the secret
+// it points to.
+func resolveSecrets(values []*string, resolvers map[string]SecretResolver) error {
+	for _, value := range values {
+		scheme, ref, ok := strings.Cut(*value, ":")
+		if !ok {
+			continue
+		}
+		resolver, ok := resolvers[scheme]
+		if !ok {
+			continue
+		}
+		secret, err := resolver.Resolve(ref)
+		if err != nil {
+			return fmt.Errorf("resolving %s secret %s: %w", scheme, ref, err)
+		}
+		*value = secret
+	}
+	return nil
+}
+
+// vaultResolver reads secrets from HashiCorp Vault, addressed by VAULT_ADDR
+// and authenticated with VAULT_TOKEN. References are path#key, where path
+// is the API path after /v1/ and key a field of the secret; KV version 1
+// and 2 engines both work. Secrets are cached until their lease runs out,
+// so reloading the config only asks Vault again for expired ones.
+type vaultResolver struct {
+	mu    sync.Mutex
+	cache map[string]vaultSecret
+}
+
+type vaultSecret struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+func (v *vaultResolver) Resolve(ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("expected a reference of the form path#key")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	secret, ok := v.cache[path]
+	if !ok || (!secret.expires.IsZero() && time.Now().After(secret.expires)) {
+		var err error
+		secret, err = readVaultSecret(path)
+		if err != nil {
+			return "", err
+		}
+		if v.cache == nil {
+			v.cache = make(map[string]vaultSecret)
+		}
+		v.cache[path] = secret
+	}
+
+	value, ok := secret.data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no string field %q", path, key)
+	}
+	return value, nil
+}
+
+func readVaultSecret(path string) (vaultSecret, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return vaultSecret{}, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return vaultSecret{}, fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var body struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return vaultSecret{}, fmt.Errorf("decoding vault response: %w", err)
+	}
+
+	// KV version 2 nests the fields one level deeper, next to the secret's
+	// metadata.
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	secret := vaultSecret{data: data}
+	if body.LeaseDuration > 0 {
+		secret.expires = time.Now().Add(time.Duration(body.LeaseDuration) * time.Second)
+	}
+	return secret, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// mapResolver resolves references to the secrets it holds.
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(ref string) (string, error) {
+	secret, ok := m[ref]
+	if !ok {
+		return "", errors.New("no such secret")
+	}
+	return secret, nil
+}
+
+func TestResolveSecrets(t *testing.T) {
+	cfg := &Config{}
+	cfg.S3.AccessKey = "mock:s3#access_key"
+	cfg.S3.SecretKey = "static secret"
+	cfg.MongoDB.Password = "mock:mongo#password"
+	// Other schemes, like a URL, are left alone.
+	cfg.MongoDB.User = "https://example.com"
+	resolvers := map[string]SecretResolver{"mock": mapResolver{"s3#access_key": "AKIA", "mongo#password": "hunter2"}}
+
+	if err := resolveSecrets(credentialValues(cfg), resolvers); err != nil {
+		t.Fatal(err)
+	}
+	got := [...]string{cfg.S3.AccessKey, cfg.S3.SecretKey, cfg.MongoDB.Password, cfg.MongoDB.User}
+	want := [...]string{"AKIA", "static secret", "hunter2", "https://example.com"}
+	if got != want {
+		t.Fatalf("resolved %q, want %q", got, want)
+	}
+
+	cfg.S3.AccessKey = "mock:missing"
+	if err := resolveSecrets(credentialValues(cfg), resolvers); err == nil {
+		t.Fatal("resolving a missing secret succeeded")
+	}
+}
+
+func TestVaultResolver(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/secret/data/s3" || r.Header.Get("X-Vault-Token") != "token" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"lease_duration": 3600, "data": {"data": {"access_key": "AKIA"}, "metadata": {"version": 1}}}`)
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+
+	resolver := &vaultResolver{}
+	for i := 0; i < 2; i++ {
+		secret, err := resolver.Resolve("secret/data/s3#access_key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "AKIA" {
+			t.Fatalf("resolved %q, want AKIA", secret)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("%d requests to Vault, want the leased secret cached", requests)
+	}
+	if _, err := resolver.Resolve("secret/data/s3#secret_key"); err == nil {
+		t.Fatal("resolved a field the secret doesn't have")
+	}
+}
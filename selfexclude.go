@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempDir returns the directory datahaven keeps its working files in.
+func tempDir(cfg *BackupConfig) string {
+	if cfg.TempDir != "" {
+		return cfg.TempDir
+	}
+	return os.TempDir()
+}
+
+// workingPaths returns the files and dirs datahaven itself writes during a
+// run: the temp dir and, when stderr is redirected to a file, the log file.
+func workingPaths(cfg *BackupConfig) []string {
+	paths := []string{tempDir(cfg)}
+
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode().IsRegular() {
+		if logFile, err := os.Readlink("/proc/self/fd/2"); err == nil {
+			paths = append(paths, logFile)
+		}
+	}
+
+	return paths
+}
+
+// selfExcludes returns the working paths that lie within dir, expressed as
+// paths under dir so they can be matched against the walk.
+func selfExcludes(dir string, paths []string) []string {
+	root, err := canonicalPath(dir)
+	if err != nil {
+		return nil
+	}
+
+	var excludes []string
+	for _, p := range paths {
+		canonical, err := canonicalPath(p)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, canonical)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		excludes = append(excludes, filepath.Join(dir, rel))
+	}
+	return excludes
+}
+
+func canonicalPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
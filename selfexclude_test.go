@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelfExcludes(t *testing.T) {
+	source := t.TempDir()
+	outside := t.TempDir()
+	nested := filepath.Join(source, "cache", "datahaven")
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{"outside the source", []string{outside}, nil},
+		{"nested in the source", []string{nested, outside}, []string{nested}},
+		{"the source itself", []string{source}, []string{source}},
+		{"sibling with a common prefix", []string{source + "-other"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selfExcludes(source, tt.paths); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("selfExcludes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanSkipsNestedTempDir(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{
+		"keep.txt":                   "keep",
+		"work/tmp/hash-checkpoint-1": "working file",
+		"work/other.txt":             "other",
+	})
+	cfg := testBackupConfig(t)
+	cfg.TempDir = filepath.Join(source, "work", "tmp")
+
+	out := captureOutput(t)
+	files := scanFiles(t, []SourceConfig{{Path: source}}, cfg)
+	if got, want := relPaths(files), []string{"keep.txt", "work/other.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("scanned %v, want %v", got, want)
+	}
+	if _, err := os.Stat(cfg.TempDir); err != nil {
+		t.Fatal(err)
+	}
+	if want := "is a datahaven working path, excluding it"; !strings.Contains(out.String(), want) {
+		t.Fatalf("log %q doesn't mention the auto-exclusion", out.String())
+	}
+}
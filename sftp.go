@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/sys/unix"
+)
+
+// OpenSSH extensions SFTPSink uses when the server offers them.
+const (
+	sftpPosixRename = "posix-rename@openssh.com"
+	sftpHardlink    = "hardlink@openssh.com"
+)
+
+// SFTPSink restores to a directory of a remote machine over SFTP. Files
+// whose path exists are handled by the onConflict policy. Restored files get
+// the recorded mode and times; their owner, ACL and inode flags aren't
+// restored.
+type SFTPSink struct {
+	client     *sftp.Client
+	name       string
+	root       string
+	onConflict string
+	closer     io.Closer
+	mu         sync.Mutex
+	// renamed maps the relative path of files written elsewhere than
+	// their path, to avoid a conflict, to where they were written.
+	renamed map[string]string
+}
+
+// NewSFTPSink creates a new instance of SFTPSink restoring below root, the
+// remote path, through client. name is what the sink is called in the log.
+func NewSFTPSink(client *sftp.Client, name, root, onConflict string) *SFTPSink {
+	return &SFTPSink{client: client, name: name, root: path.Clean(root), onConflict: onConflict, renamed: make(map[string]string)}
+}
+
+// DialSFTPSink connects to the server of target, an sftp://user@host:port/path
+// URL, and returns a sink restoring below its path. The server's host key
+// must be in the knownHosts file. It authenticates with the private key in
+// keyFile, if any, and the keys of the running SSH agent.
+func DialSFTPSink(target, keyFile, knownHosts, onConflict string) (*SFTPSink, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "sftp" || u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("%s is not an sftp://user@host/path URL", target)
+	}
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", keyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{User: username, Auth: auth, HostKeyCallback: hostKeys, Timeout: 30 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", address, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("starting sftp on %s: %w", address, err)
+	}
+	sink := NewSFTPSink(client, "sftp://"+u.Host+u.Path, u.Path, onConflict)
+	sink.closer = conn
+	return sink, nil
+}
+
+// Close closes the session and the connection to the server.
+func (s *SFTPSink) Close() error {
+	err := s.client.Close()
+	if s.closer != nil {
+		err = s.closer.Close()
+	}
+	return err
+}
+
+func (s *SFTPSink) String() string {
+	return s.name
+}
+
+// path returns where metadata's file is restored, refusing relative paths
+// that would leave the root.
+func (s *SFTPSink) path(metadata *FileMetadata) (string, error) {
+	target := path.Join(s.root, metadata.RelPath)
+	if !strings.HasPrefix(target, strings.TrimSuffix(s.root, "/")+"/") {
+		return "", fmt.Errorf("%s would be restored outside %s", metadata.RelPath, s.root)
+	}
+	return target, nil
+}
+
+// target returns where metadata's file is written, after the onConflict
+// policy, creating its parent directories.
+func (s *SFTPSink) target(metadata *FileMetadata) (string, error) {
+	target, err := s.path(metadata)
+	if err != nil {
+		return "", err
+	}
+	if err := s.client.MkdirAll(path.Dir(target)); err != nil {
+		return "", fmt.Errorf("creating %s: %w", path.Dir(target), err)
+	}
+	written, err := resolveConflict(s.onConflict, metadata, target, s.client.Lstat)
+	if err != nil {
+		return "", err
+	}
+	if written != target {
+		s.mu.Lock()
+		s.renamed[metadata.RelPath] = written
+		s.mu.Unlock()
+	}
+	return written, nil
+}
+
+// written returns where metadata's file was written.
+func (s *SFTPSink) written(metadata *FileMetadata) (string, error) {
+	target, err := s.path(metadata)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if renamed, ok := s.renamed[metadata.RelPath]; ok {
+		return renamed, nil
+	}
+	return target, nil
+}
+
+// tempPath returns a name next to target to write it under first.
+func tempPath(target, suffix string) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return path.Join(path.Dir(target), "."+path.Base(target)+suffix+hex.EncodeToString(random))
+}
+
+func (s *SFTPSink) Mkdir(metadata *FileMetadata) error {
+	target, err := s.path(metadata)
+	if err != nil {
+		return err
+	}
+	if err := s.client.MkdirAll(target); err != nil {
+		return fmt.Errorf("creating %s: %w", target, err)
+	}
+	return nil
+}
+
+// replace renames from to to, replacing to if it exists. Only the
+// posix-rename extension replaces a file in one step: without it a file in
+// the way is an error rather than removed first, which would leave neither
+// file if the rename failed.
+func (s *SFTPSink) replace(from, to string) error {
+	if _, ok := s.client.HasExtension(sftpPosixRename); ok {
+		return s.client.PosixRename(from, to)
+	}
+	if _, err := s.client.Lstat(to); err == nil {
+		return fmt.Errorf("%s exists and the server can't replace it in one step, it lacks %s", to, sftpPosixRename)
+	}
+	return s.client.Rename(from, to)
+}
+
+// WriteFile writes content next to the file's path and renames it over the
+// path once complete, like LocalSink, so a failed write never leaves a
+// partial file behind.
+func (s *SFTPSink) WriteFile(metadata *FileMetadata, content io.Reader) (err error) {
+	target, err := s.target(metadata)
+	if err != nil {
+		return err
+	}
+	tmp := tempPath(target, ".restoring-")
+	f, err := s.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", tmp, err)
+	}
+	defer func() {
+		if err != nil {
+			s.client.Remove(tmp)
+		}
+	}()
+
+	// The writes are pipelined rather than waiting for each one's answer.
+	if _, err := f.ReadFromWithConcurrency(content, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", target, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", target, err)
+	}
+
+	mode := fs.FileMode(0o644)
+	if metadata.Mode != 0 {
+		mode = sftpMode(metadata.Mode)
+	}
+	if err := s.client.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("setting the mode of %s: %w", target, err)
+	}
+	if metadata.Mtime != 0 {
+		atime := metadata.Atime
+		if atime == 0 {
+			atime = metadata.Mtime
+		}
+		if err := s.client.Chtimes(tmp, time.Unix(0, atime), time.Unix(0, metadata.Mtime)); err != nil {
+			return fmt.Errorf("setting the times of %s: %w", target, err)
+		}
+	}
+	return s.replace(tmp, target)
+}
+
+// sftpMode returns the recorded permission bits of mode, setuid, setgid and
+// sticky included, as the client passes them to the server.
+func sftpMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&unix.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+func (s *SFTPSink) Open(metadata *FileMetadata) (io.ReadCloser, error) {
+	target, err := s.written(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Open(target)
+}
+
+// Link makes the file of metadata a hard link to the file of from, if the
+// server offers the hardlink extension. Linked files are one file, so they
+// share the mode and times from's file was restored with.
+func (s *SFTPSink) Link(from, metadata *FileMetadata) error {
+	if _, ok := s.client.HasExtension(sftpHardlink); !ok {
+		return errLinkUnsupported
+	}
+	source, err := s.written(from)
+	if err != nil {
+		return err
+	}
+	target, err := s.target(metadata)
+	if err != nil {
+		return err
+	}
+	// A link can't replace an existing file, so it is made next to target
+	// and renamed over it.
+	tmp := tempPath(target, ".linking-")
+	if err := s.client.Link(source, tmp); err != nil {
+		return err
+	}
+	// Renaming a link over another link to the same file leaves both.
+	err = s.replace(tmp, target)
+	s.client.Remove(tmp)
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestSFTPClient starts an SFTP server offering extensions, serving the
+// local files in place of a remote machine's, and returns a client
+// connected to it.
+func newTestSFTPClient(t *testing.T, extensions ...string) *sftp.Client {
+	t.Helper()
+	// The server reads the extensions it offers from a package variable
+	// when the client connects.
+	if err := sftp.SetSFTPExtensions(extensions...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sftp.SetSFTPExtensions(sftpHardlink, sftpPosixRename, "statvfs@openssh.com") })
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func TestRestoreToSFTPSink(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "shared", "sub/b.txt": "shared", "sub/c.txt": "only c"}
+	writeFiles(t, src, files)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "sub/c.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "sub/c.txt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, extensions := range [][]string{{sftpPosixRename}, {sftpPosixRename, sftpHardlink}} {
+		dst := filepath.Join(t.TempDir(), "restore")
+		// A file in the way is replaced.
+		writeFiles(t, dst, map[string]string{"a.txt": "old"})
+		sink := NewSFTPSink(newTestSFTPClient(t, extensions...), "sftp://test"+dst, dst, conflictOverwrite)
+		if err := RestoreSnapshot(store, NewS3Storage("", s3.client(), cfg.Bucket), summary.SnapshotID, hashCheckSink{sink}, RestoreOptions{HardLink: true}); err != nil {
+			t.Fatalf("extensions %v: %v", extensions, err)
+		}
+
+		if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+			t.Fatalf("extensions %v: remote holds %v, want %v", extensions, got, files)
+		}
+		info, err := os.Stat(filepath.Join(dst, "sub/c.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 || !info.ModTime().Equal(mtime) {
+			t.Errorf("extensions %v: c.txt has mode %v and mtime %v", extensions, info.Mode(), info.ModTime())
+		}
+		a, _ := os.Stat(filepath.Join(dst, "a.txt"))
+		b, _ := os.Stat(filepath.Join(dst, "sub/b.txt"))
+		if linked := os.SameFile(a, b); linked != (len(extensions) == 2) {
+			t.Errorf("extensions %v: shared files linked %v", extensions, linked)
+		}
+		if a.Sys().(*syscall.Stat_t).Nlink > 2 {
+			t.Errorf("extensions %v: a temporary link was left behind", extensions)
+		}
+	}
+}
+
+func TestSFTPSinkConflictAndRoot(t *testing.T) {
+	remote := t.TempDir()
+	writeFiles(t, remote, map[string]string{"restore/kept": "existing"})
+	root := filepath.Join(remote, "restore")
+	sink := NewSFTPSink(newTestSFTPClient(t), "sftp://test"+root, root, conflictSkip)
+
+	if err := sink.WriteFile(&FileMetadata{RelPath: "kept"}, errReader{}); !errors.Is(err, errConflictSkipped) {
+		t.Fatalf("writing over an existing file = %v, want it kept", err)
+	}
+	if err := sink.WriteFile(&FileMetadata{RelPath: "dir/new"}, io.LimitReader(zeroReader{}, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := sink.Open(&FileMetadata{RelPath: "dir/new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || len(data) != 100000 {
+		t.Fatalf("read back %d bytes, %v", len(data), err)
+	}
+	for _, rel := range []string{"../escaped", "dir/../../escaped"} {
+		if err := sink.WriteFile(&FileMetadata{RelPath: rel}, errReader{}); err == nil {
+			t.Errorf("writing %s succeeded", rel)
+		}
+	}
+	if got, want := readDir(t, remote), map[string]string{"restore/kept": "existing", "restore/dir/new": string(make([]byte, 100000))}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remote holds %d files, want kept and dir/new", len(got))
+	}
+}
+
+func TestSFTPSinkReplacesOnlyInOneStep(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"existing": "old"})
+	sink := NewSFTPSink(newTestSFTPClient(t), "sftp://test"+root, root, conflictOverwrite)
+
+	if err := sink.WriteFile(&FileMetadata{RelPath: "new"}, io.LimitReader(zeroReader{}, 10)); err != nil {
+		t.Fatal(err)
+	}
+	// Without posix-rename the file in the way isn't removed to make room.
+	if err := sink.WriteFile(&FileMetadata{RelPath: "existing"}, io.LimitReader(zeroReader{}, 10)); err == nil {
+		t.Fatal("replaced a file without posix-rename")
+	}
+	if got, want := readDir(t, root), map[string]string{"existing": "old", "new": string(make([]byte, 10))}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remote holds %q, want %q", got, want)
+	}
+}
+
+// errReader fails the write of a file that shouldn't be read.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("content read") }
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
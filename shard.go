@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+)
+
+// How file metadata is spread over collections, chosen with
+// mongodb.shard_by.
+const (
+	// shardNone keeps all files of a snapshot in the collection named
+	// after it.
+	shardNone = ""
+	// shardHost names the collection after the snapshot and the host
+	// that took it, so hosts of a fleet never write to the same one.
+	shardHost = "host"
+	// shardPathHash spreads the files of a snapshot over ShardCount
+	// collections by a hash of their path.
+	shardPathHash = "path-hash"
+)
+
+func validateShardBy(cfg *MongoDBConfig) error {
+	switch cfg.ShardBy {
+	case shardNone, shardHost:
+		return nil
+	case shardPathHash:
+		if cfg.ShardCount < 1 {
+			return fmt.Errorf("shard_count must be at least 1")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown shard_by %q, expected %s or %s", cfg.ShardBy, shardHost, shardPathHash)
+	}
+}
+
+// shardCollections returns the collections a new snapshot's files are
+// written to, or nil when they go to the collection named after it.
+func shardCollections(snapshotID string, cfg *MongoDBConfig) ([]string, error) {
+	switch cfg.ShardBy {
+	case shardHost:
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("reading hostname: %w", err)
+		}
+		return []string{snapshotID + "." + host}, nil
+	case shardPathHash:
+		collections := make([]string, cfg.ShardCount)
+		for i := range collections {
+			collections[i] = snapshotID + "." + strconv.Itoa(i)
+		}
+		return collections, nil
+	default:
+		return nil, nil
+	}
+}
+
+// fileCollections returns every collection holding the snapshot's files.
+func (s *Snapshot) fileCollections() []string {
+	if len(s.Collections) == 0 {
+		return []string{s.ID}
+	}
+	return s.Collections
+}
+
+// collectionFor returns the collection the metadata of the file at path is
+// written to.
+func (s *Snapshot) collectionFor(path string) string {
+	collections := s.fileCollections()
+	if len(collections) == 1 {
+		return collections[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return collections[h.Sum32()%uint32(len(collections))]
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShardCollections(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cfg  MongoDBConfig
+		want []string
+	}{
+		{MongoDBConfig{}, nil},
+		{MongoDBConfig{ShardBy: shardHost}, []string{"s1." + host}},
+		{MongoDBConfig{ShardBy: shardPathHash, ShardCount: 3}, []string{"s1.0", "s1.1", "s1.2"}},
+	}
+	for _, tt := range tests {
+		got, err := shardCollections("s1", &tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("shard_by %q: collections %v, want %v", tt.cfg.ShardBy, got, tt.want)
+		}
+	}
+}
+
+func TestShardedSnapshotRoutesAndFansOut(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 40; i++ {
+		files[fmt.Sprintf("file%d", i)] = fmt.Sprintf("content %d", i)
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	engine.cfg.MongoDB = MongoDBConfig{BatchSize: 7, ShardBy: shardPathHash, ShardCount: 4}
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := store.FindSnapshot(summary.SnapshotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Collections) != 4 {
+		t.Fatalf("snapshot registers collections %v, want 4", snapshot.Collections)
+	}
+	// Every file is written to the collection its path hashes to.
+	for _, collection := range snapshot.Collections {
+		held := store.collections[collection]
+		if len(held) == 0 || len(held) == 40 {
+			t.Errorf("collection %s holds %d of the 40 files", collection, len(held))
+		}
+		for _, metadata := range held {
+			if want := snapshot.collectionFor(metadata.Path); want != collection {
+				t.Errorf("%s written to %s, routed to %s", metadata.RelPath, collection, want)
+			}
+		}
+	}
+
+	// Reads cover every collection.
+	if n, err := store.CountFiles(snapshot.ID); err != nil || n != 40 {
+		t.Fatalf("CountFiles = %d, %v, want 40", n, err)
+	}
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, snapshot.ID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %d files, want the 40", len(got))
+	}
+}
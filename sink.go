@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OutputSink is where restored files are written. Files are addressed by
+// their metadata and land at its RelPath below the sink's root, so restore
+// never deals with where that root is.
+type OutputSink interface {
+	// Mkdir creates the directory of metadata and its parents.
+	Mkdir(metadata *FileMetadata) error
+	// WriteFile writes content as the file of metadata, with its times.
+	// It returns errConflictSkipped, without reading content, for a file
+	// the sink leaves as it is.
+	WriteFile(metadata *FileMetadata, content io.Reader) error
+	// Open reads back a file written before.
+	Open(metadata *FileMetadata) (io.ReadCloser, error)
+}
+
+// LocalSink restores to a directory of the local filesystem. Files whose
+// path exists are handled by the onConflict policy. Restored files get the
+// recorded mode, ACL, times and inode flags, and their owner when restoring
+// as root.
+type LocalSink struct {
+	root       string
+	onConflict string
+	mu         sync.Mutex
+	// renamed maps the relative path of files written elsewhere than
+	// their path, to avoid a conflict, to where they were written.
+	renamed map[string]string
+}
+
+// NewLocalSink creates a new instance of LocalSink restoring below root.
+func NewLocalSink(root, onConflict string) *LocalSink {
+	return &LocalSink{root: root, onConflict: onConflict, renamed: make(map[string]string)}
+}
+
+func (s *LocalSink) String() string {
+	return s.root
+}
+
+// path returns where metadata's file is restored, refusing relative paths
+// that would leave the root.
+func (s *LocalSink) path(metadata *FileMetadata) (string, error) {
+	target := filepath.Join(s.root, filepath.FromSlash(metadata.RelPath))
+	if !isWithin(target, s.root) {
+		return "", fmt.Errorf("%s would be restored outside %s", metadata.RelPath, s.root)
+	}
+	return target, nil
+}
+
+func (s *LocalSink) Mkdir(metadata *FileMetadata) error {
+	target, err := s.path(metadata)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0o755)
+}
+
+// target returns where metadata's file is written, after the onConflict
+// policy, creating its parent directories.
+func (s *LocalSink) target(metadata *FileMetadata) (string, error) {
+	target, err := s.path(metadata)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+	written, err := resolveConflict(s.onConflict, metadata, target, os.Lstat)
+	if err != nil {
+		return "", err
+	}
+	if written != target {
+		log.Printf("[%s] exists, restoring to [%s]", target, written)
+		s.mu.Lock()
+		s.renamed[metadata.RelPath] = written
+		s.mu.Unlock()
+	}
+	return written, nil
+}
+
+func (s *LocalSink) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	target, err := s.target(metadata)
+	if err != nil {
+		return err
+	}
+	if err := writeReplacing(target, content); err != nil {
+		return err
+	}
+	// Changing the owner clears setuid and setgid, so it comes before the
+	// mode.
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, metadata.Uid, metadata.Gid); err != nil {
+			log.Printf("chown of [%s] failed: %v", target, err)
+		}
+	}
+	if metadata.Mode != 0 {
+		if err := unix.Chmod(target, metadata.Mode); err != nil {
+			log.Printf("chmod of [%s] failed: %v", target, err)
+		}
+	}
+	// Filesystems without ACLs can't take the file's, which leaves it with
+	// its mode bits.
+	if len(metadata.ACL) > 0 {
+		if err := writeACL(target, metadata.ACL); err != nil {
+			log.Printf("write acl of [%s] failed: %v", target, err)
+		}
+	}
+	// Linux has no call setting a file's birth time, so a recorded Btime
+	// stays in the catalog only.
+	if metadata.Mtime != 0 {
+		atime := metadata.Atime
+		if atime == 0 {
+			atime = metadata.Mtime
+		}
+		os.Chtimes(target, time.Unix(0, atime), time.Unix(0, metadata.Mtime))
+	}
+	// An immutable or append-only file takes no other change, so its
+	// flags go last.
+	if metadata.FileFlags != 0 {
+		if err := writeFileFlags(target, metadata.FileFlags); err != nil {
+			log.Printf("write file flags of [%s] failed: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// writeReplacing writes content next to target and renames it over target
+// once complete, so a failed write never leaves a partial file behind or
+// destroys the one it would have replaced.
+func writeReplacing(target string, content io.Reader) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".restoring-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", target, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
+
+// written returns where metadata's file was written.
+func (s *LocalSink) written(metadata *FileMetadata) (string, error) {
+	target, err := s.path(metadata)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if renamed, ok := s.renamed[metadata.RelPath]; ok {
+		return renamed, nil
+	}
+	return target, nil
+}
+
+func (s *LocalSink) Open(metadata *FileMetadata) (io.ReadCloser, error) {
+	target, err := s.written(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(target)
+}
+
+// Link makes the file of metadata a hard link to the file of from. Linked
+// files are one file, so they share the mode, owner and times from's file
+// was restored with.
+func (s *LocalSink) Link(from, metadata *FileMetadata) error {
+	source, err := s.written(from)
+	if err != nil {
+		return err
+	}
+	target, err := s.target(metadata)
+	if err != nil {
+		return err
+	}
+	// Linked next to target and renamed over it, like writeReplacing, as
+	// a link can't replace an existing file.
+	tmp := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".linking")
+	os.Remove(tmp)
+	if err := os.Link(source, tmp); err != nil {
+		return err
+	}
+	// Renaming a link over another link to the same file leaves both.
+	err = os.Rename(tmp, target)
+	os.Remove(tmp)
+	return err
+}
+
+// linkingSink is an OutputSink that can make a file the same file as one it
+// wrote before, rather than a copy of it.
+type linkingSink interface {
+	Link(from, metadata *FileMetadata) error
+}
+
+// errLinkUnsupported is returned linking files in a sink that can't.
+var errLinkUnsupported = errors.New("sink can't link files")
+
+// linkFile makes the file of metadata a link to the file of from in sink,
+// if the sink can link files.
+func linkFile(sink OutputSink, from, metadata *FileMetadata) error {
+	linker, ok := sink.(linkingSink)
+	if !ok {
+		return errLinkUnsupported
+	}
+	return linker.Link(from, metadata)
+}
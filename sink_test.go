@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// remoteSink stands in for an SFTP server: files are written below a remote
+// root the test never sees as a local directory.
+type remoteSink struct {
+	root  string
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func newRemoteSink(root string) *remoteSink {
+	return &remoteSink{root: root, files: map[string][]byte{}, dirs: map[string]bool{}}
+}
+
+func (s *remoteSink) Mkdir(metadata *FileMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirs[path.Join(s.root, metadata.RelPath)] = true
+	return nil
+}
+
+func (s *remoteSink) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path.Join(s.root, metadata.RelPath)] = data
+	return nil
+}
+
+func (s *remoteSink) Open(metadata *FileMetadata) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[path.Join(s.root, metadata.RelPath)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestRestoreToRemoteSink(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"a.txt":     "shared",
+		"sub/b.txt": "shared",
+		"sub/c.txt": "only c",
+	})
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newRemoteSink("/srv/restore")
+	if err := engine.Restore(bundle, sink, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for name, data := range sink.files {
+		got[name] = string(data)
+	}
+	want := map[string]string{
+		"/srv/restore/a.txt":     "shared",
+		"/srv/restore/sub/b.txt": "shared",
+		"/srv/restore/sub/c.txt": "only c",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("remote holds %v, want %v", got, want)
+	}
+}
+
+func TestLocalSinkStaysInRoot(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "restore")
+	sink := NewLocalSink(root, conflictOverwrite)
+
+	if err := sink.WriteFile(&FileMetadata{RelPath: "dir/file"}, bytes.NewReader([]byte("content"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, root); !reflect.DeepEqual(got, map[string]string{"dir/file": "content"}) {
+		t.Fatalf("restored %v", got)
+	}
+	r, err := sink.Open(&FileMetadata{RelPath: "dir/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "content" {
+		t.Fatalf("read back %q", data)
+	}
+
+	for _, rel := range []string{"../escaped", "dir/../../escaped"} {
+		if err := sink.WriteFile(&FileMetadata{RelPath: rel}, bytes.NewReader([]byte("x"))); err == nil {
+			t.Errorf("writing %s succeeded", rel)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(base, "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("a file was written outside the root: %v", err)
+	}
+}
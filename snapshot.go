@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const snapshotsCollection = "snapshots"
+
+// Snapshot describes a single backup run. The metadata of the files backed
+// up by the run is stored in the collection named after the snapshot ID, or
+// in the Collections it was sharded over. A run split over several
+// snapshots lists the others in Parts, and each of them names the first in
+// Continues.
+type Snapshot struct {
+	ID          string `bson:"_id"`
+	Sources     []SnapshotSource
+	StartTime   int64
+	Collections []string `bson:",omitempty"`
+	Parts       []string `bson:",omitempty"`
+	Continues   string   `bson:",omitempty"`
+	// HashAlgorithm is what the content of the snapshot's files was
+	// hashed with, sha256 when it is empty.
+	HashAlgorithm string `bson:",omitempty"`
+	// Note is a free-form description of the snapshot, e.g. why it was
+	// taken.
+	Note string `bson:",omitempty"`
+}
+
+// SnapshotSource is a source directory covered by a snapshot.
+type SnapshotSource struct {
+	Path string
+	Git  *GitInfo `bson:",omitempty"`
+}
+
+// NewSnapshot creates a new instance of Snapshot for a run over sources.
+func NewSnapshot(sources []SourceConfig, cfg *BackupConfig) *Snapshot {
+	now := time.Now()
+	snapshot := &Snapshot{
+		ID:            newSnapshotID(now),
+		StartTime:     now.UnixNano(),
+		HashAlgorithm: cfg.HashAlgorithm,
+	}
+
+	for _, source := range sources {
+		snapshotSource := SnapshotSource{Path: source.Path}
+		if _, ok := source.command(); !ok && cfg.GitAware {
+			git, err := readGitInfo(source.Path)
+			if err != nil {
+				log.Printf("read git info of [%s] failed: %v", source.Path, err)
+			}
+			snapshotSource.Git = git
+		}
+		snapshot.Sources = append(snapshot.Sources, snapshotSource)
+	}
+
+	return snapshot
+}
+
+// SourcePaths returns the paths of the snapshot's sources.
+func (s *Snapshot) SourcePaths() []string {
+	paths := make([]string, len(s.Sources))
+	for i, source := range s.Sources {
+		paths[i] = source.Path
+	}
+	return paths
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// snapshotFSDownloads bounds the objects a snapshotFS downloads at once,
+// however many of its files are opened together.
+const snapshotFSDownloads = 4
+
+// snapshotFS is a read-only view of the files of a snapshot, as the tree of
+// their relative paths. The content of a file is only read when it is
+// opened: its object is downloaded once and every file it holds, a bundle's
+// members or files of the same content, is kept in the cache directory, so
+// opening them again doesn't download it again.
+type snapshotFS struct {
+	snapshot *Snapshot
+	objects  ObjectReader
+	root     *pathNode
+	// nodes are the nodes by inode number, the root's being 1.
+	nodes []*pathNode
+	// byKey are the records of the files stored in each object.
+	byKey    map[string][]*FileMetadata
+	cacheDir string
+	fetching *keyLocks
+	// downloads holds a slot for every object being downloaded.
+	downloads chan struct{}
+}
+
+// newSnapshotFS reads the records of the snapshot into its tree, with the
+// cached content of its files kept below cacheDir.
+func newSnapshotFS(client MongoDBClient, objects ObjectReader, snapshotID, cacheDir string) (*snapshotFS, error) {
+	snapshot, err := client.FindSnapshot(snapshotID)
+	if err != nil {
+		return nil, fmt.Errorf("finding snapshot: %w", err)
+	}
+	s := &snapshotFS{
+		snapshot:  snapshot,
+		objects:   objects,
+		root:      newPathDir("", nil),
+		byKey:     make(map[string][]*FileMetadata),
+		cacheDir:  cacheDir,
+		fetching:  newKeyLocks(),
+		downloads: make(chan struct{}, snapshotFSDownloads),
+	}
+	err = client.ForEachFile(snapshot.ID, func(metadata *FileMetadata) error {
+		// The content of a denied file or one that failed its checksum
+		// was never stored.
+		if metadata.Denied || metadata.ChecksumFailed {
+			return nil
+		}
+		node := s.root.add(metadata.RelPath, metadata.Size, metadata.MountPoint)
+		if node.metadata != nil || node == s.root {
+			return nil
+		}
+		node.metadata = metadata
+		if key := metadata.objectKey(); key != "" {
+			s.byKey[key] = append(s.byKey[key], metadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	s.number(s.root)
+	return s, nil
+}
+
+// number gives n and the nodes below it their inode numbers.
+func (s *snapshotFS) number(n *pathNode) {
+	s.nodes = append(s.nodes, n)
+	n.ino = uint64(len(s.nodes))
+	for _, child := range n.entries() {
+		s.number(child)
+	}
+}
+
+// node returns the node of inode number ino.
+func (s *snapshotFS) node(ino uint64) (*pathNode, bool) {
+	if ino == 0 || ino > uint64(len(s.nodes)) {
+		return nil, false
+	}
+	return s.nodes[ino-1], true
+}
+
+// info returns the file info of n: the recorded mode, owner and times of a
+// file or a recorded directory, and those of the snapshot for a directory
+// only leading to files.
+func (s *snapshotFS) info(n *pathNode) snapshotFileInfo {
+	info := snapshotFileInfo{node: n, mode: 0o555 | fs.ModeDir, mtime: time.Unix(0, s.snapshot.StartTime)}
+	if n.metadata != nil {
+		info.mtime = time.Unix(0, n.metadata.Mtime)
+		info.uid, info.gid = n.metadata.Uid, n.metadata.Gid
+		if n.metadata.Mode != 0 {
+			info.mode = fs.FileMode(n.metadata.Mode & 0o777)
+		} else {
+			info.mode = 0o444
+		}
+		if n.isDir() {
+			info.mode |= fs.ModeDir
+		}
+	} else {
+		info.uid, info.gid = os.Getuid(), os.Getgid()
+	}
+	return info
+}
+
+// content opens the cached content of the file n, reading its object into
+// the cache first if it isn't there.
+func (s *snapshotFS) content(n *pathNode) (*os.File, error) {
+	if n.isDir() || n.metadata == nil {
+		return nil, fmt.Errorf("%s is a directory", n.path())
+	}
+	if f, err := os.Open(s.cached(n)); err == nil {
+		return f, nil
+	}
+
+	key := n.metadata.objectKey()
+	if key == "" {
+		key = "inline:" + strconv.FormatUint(n.ino, 10)
+	}
+	// Files of the same object opened together wait for one download.
+	unlock := s.fetching.Lock(key)
+	defer unlock()
+	if f, err := os.Open(s.cached(n)); err == nil {
+		return f, nil
+	}
+	if err := s.fetch(n); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", n.path(), err)
+	}
+	return os.Open(s.cached(n))
+}
+
+// fetch reads the content of n, and of the other files of its object, into
+// the cache.
+func (s *snapshotFS) fetch(n *pathNode) error {
+	cache := snapshotCache{s}
+	if n.metadata.Inline {
+		content, err := Unwrap(bytes.NewReader(n.metadata.InlineData), n.metadata.Transforms)
+		if err != nil {
+			return err
+		}
+		return cache.WriteFile(n.metadata, content)
+	}
+
+	s.downloads <- struct{}{}
+	defer func() { <-s.downloads }()
+	key := n.metadata.objectKey()
+	files := s.byKey[key]
+	// The first file of an object decides which version is read.
+	body, err := s.objects.Download(key, files[0].VersionID)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", key, err)
+	}
+	defer body.Close()
+	_, _, err = restoreObject(body, cache, files, true)
+	return err
+}
+
+// cached returns the file holding the content of n in the cache.
+func (s *snapshotFS) cached(n *pathNode) string {
+	return filepath.Join(s.cacheDir, strconv.FormatUint(n.ino, 10))
+}
+
+// Open opens the file or directory at name, as fs.FS.
+func (s *snapshotFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := s.root.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.isDir() {
+		return &snapshotDir{s: s, node: n}, nil
+	}
+	f, err := s.content(n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return snapshotFile{File: f, info: s.info(n)}, nil
+}
+
+// snapshotCache is the sink the content of the files of a snapshotFS is
+// read into, one cache file per inode.
+type snapshotCache struct {
+	s *snapshotFS
+}
+
+func (c snapshotCache) node(metadata *FileMetadata) (*pathNode, error) {
+	n, ok := c.s.root.lookup(metadata.RelPath)
+	if !ok || n.isDir() {
+		return nil, fmt.Errorf("%s isn't a file of the snapshot", metadata.RelPath)
+	}
+	return n, nil
+}
+
+func (c snapshotCache) Mkdir(*FileMetadata) error {
+	return nil
+}
+
+func (c snapshotCache) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	n, err := c.node(metadata)
+	if err != nil {
+		return err
+	}
+	return writeReplacing(c.s.cached(n), content)
+}
+
+func (c snapshotCache) Open(metadata *FileMetadata) (io.ReadCloser, error) {
+	n, err := c.node(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(c.s.cached(n))
+}
+
+// Link caches files of the same content once.
+func (c snapshotCache) Link(from, metadata *FileMetadata) error {
+	source, err := c.node(from)
+	if err != nil {
+		return err
+	}
+	n, err := c.node(metadata)
+	if err != nil {
+		return err
+	}
+	if source == n {
+		return nil
+	}
+	err = os.Link(c.s.cached(source), c.s.cached(n))
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (c snapshotCache) String() string {
+	return c.s.cacheDir
+}
+
+// snapshotFileInfo is the fs.FileInfo of a node of a snapshotFS.
+type snapshotFileInfo struct {
+	node     *pathNode
+	mode     fs.FileMode
+	mtime    time.Time
+	uid, gid int
+}
+
+func (i snapshotFileInfo) Name() string {
+	if i.node.parent == nil {
+		return "."
+	}
+	return i.node.name
+}
+
+func (i snapshotFileInfo) Size() int64 {
+	if i.node.isDir() {
+		return 0
+	}
+	return i.node.size
+}
+
+func (i snapshotFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i snapshotFileInfo) ModTime() time.Time { return i.mtime }
+func (i snapshotFileInfo) IsDir() bool        { return i.node.isDir() }
+func (i snapshotFileInfo) Sys() any           { return nil }
+
+// snapshotFile is an open file of a snapshotFS, read from the cache.
+type snapshotFile struct {
+	*os.File
+	info snapshotFileInfo
+}
+
+func (f snapshotFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// snapshotDir is an open directory of a snapshotFS.
+type snapshotDir struct {
+	s    *snapshotFS
+	node *pathNode
+	// read is how many entries ReadDir returned.
+	read int
+}
+
+func (d *snapshotDir) Stat() (fs.FileInfo, error) {
+	return d.s.info(d.node), nil
+}
+
+func (d *snapshotDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.path(), Err: fs.ErrInvalid}
+}
+
+func (d *snapshotDir) Close() error {
+	return nil
+}
+
+func (d *snapshotDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.node.entries()[d.read:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.read += len(entries)
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i, entry := range entries {
+		dirEntries[i] = fs.FileInfoToDirEntry(d.s.info(entry))
+	}
+	return dirEntries, nil
+}
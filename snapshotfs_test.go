@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestSnapshotFSReadsObjectsLazilyOnce(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a/one":      "first of a",
+		"a/two":      "second of a",
+		"a/deep/dup": "only of b",
+		"b/only":     "only of b",
+		"top":        "top level",
+	}
+	writeFiles(t, src, files)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "a/two"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "a/two"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testBackupConfig(t)
+	cfg.Bundle = true
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gets := s3.count("GET")
+	fsys, err := newSnapshotFS(store, NewS3Storage("", s3.client(), cfg.Bucket), summary.SnapshotID, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("GET") - gets; n != 0 {
+		t.Fatalf("%d objects read before any file was opened", n)
+	}
+
+	info, err := fs.Stat(fsys, "a/two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0o640 || !info.ModTime().Equal(mtime) || info.Size() != int64(len("second of a")) {
+		t.Errorf("a/two has mode %v, mtime %v and size %d", info.Mode(), info.ModTime(), info.Size())
+	}
+	data, err := fs.ReadFile(fsys, "a/two")
+	if err != nil || string(data) != files["a/two"] {
+		t.Fatalf("a/two reads %q, %v", data, err)
+	}
+	// The bundle of a holds the other files of a, read with a/two.
+	if n := s3.count("GET") - gets; n != 1 {
+		t.Errorf("%d objects read for a/two, want its bundle", n)
+	}
+
+	if err := fstest.TestFS(fsys, "a/one", "a/two", "a/deep/dup", "b/only", "top"); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if data, err := fs.ReadFile(fsys, name); err != nil || string(data) != content {
+			t.Errorf("%s reads %q, %v", name, data, err)
+		}
+	}
+	// One bundle per directory, each read once however often its files
+	// are.
+	if n := s3.count("GET") - gets; n != 4 {
+		t.Errorf("%d objects read, want 4", n)
+	}
+}
+
+func TestSnapshotFSInlineAndInodes(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"dir/small": "inline", "dir/sub/other": "also inline"})
+	cfg := testBackupConfig(t)
+	cfg.InlineThresholdBytes = 4096
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := newSnapshotFS(store, NewS3Storage("", s3.client(), cfg.Bucket), summary.SnapshotID, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "dir/small"); err != nil || string(data) != "inline" {
+		t.Fatalf("dir/small reads %q, %v", data, err)
+	}
+	if n := s3.count("GET"); n != 0 {
+		t.Errorf("%d objects read for inline content", n)
+	}
+
+	for _, name := range []string{".", "dir", "dir/small", "dir/sub", "dir/sub/other"} {
+		n, ok := fsys.root.lookup(name)
+		if !ok {
+			t.Fatalf("%s not found", name)
+		}
+		if got, ok := fsys.node(n.ino); !ok || got != n {
+			t.Errorf("inode %d of %s is %v", n.ino, name, got)
+		}
+	}
+	if root, _ := fsys.node(1); root != fsys.root {
+		t.Error("inode 1 isn't the root")
+	}
+	if _, ok := fsys.node(6); ok {
+		t.Error("found an inode past the last node")
+	}
+	if _, err := fsys.Open("dir/missing"); err == nil {
+		t.Error("opened dir/missing")
+	}
+}
+
+func TestSnapshotFSSharedContentReadOnce(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "shared", "sub/b.txt": "shared", "sub/deep/c.txt": "only c"}
+	writeFiles(t, src, files)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "sub/deep/c.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "sub/deep/c.txt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := newSnapshotFS(store, NewS3Storage("", s3.client(), cfg.Bucket), summary.SnapshotID, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gets := s3.count("GET")
+	got := make(map[string]string)
+	for name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[name] = string(data)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("snapshot holds %v, want %v", got, files)
+	}
+	if n := s3.count("GET") - gets; n != 2 {
+		t.Errorf("%d objects read for two contents, want 2", n)
+	}
+	info, err := fs.Stat(fsys, "sub/deep/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0o600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("c.txt has mode %v and mtime %v", info.Mode(), info.ModTime())
+	}
+}
+
+// slowReader is an ObjectReader recording how many downloads it serves at
+// once.
+type slowReader struct {
+	ObjectReader
+	mu           sync.Mutex
+	active, most int
+}
+
+func (r *slowReader) Download(key, versionID string) (io.ReadCloser, error) {
+	r.mu.Lock()
+	r.active++
+	if r.active > r.most {
+		r.most = r.active
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.active--
+		r.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	return r.ObjectReader.Download(key, versionID)
+}
+
+func TestSnapshotFSBoundsDownloads(t *testing.T) {
+	src := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 3*snapshotFSDownloads; i++ {
+		files[fmt.Sprintf("f%d", i)] = fmt.Sprintf("content %d", i)
+	}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := &slowReader{ObjectReader: NewS3Storage("", s3.client(), cfg.Bucket)}
+	fsys, err := newSnapshotFS(store, objects, summary.SnapshotID, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for name, content := range files {
+		name, content := name, content
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := fs.ReadFile(fsys, name); err != nil || string(data) != content {
+				t.Errorf("%s reads %q, %v", name, data, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if objects.most > snapshotFSDownloads {
+		t.Errorf("%d objects downloaded at once, want at most %d", objects.most, snapshotFSDownloads)
+	}
+}
+
+func TestMountCacheDirKeepsGivenDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"mine": "not the cache's"})
+	cache, err := mountCacheDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(cache) != dir {
+		t.Fatalf("cache %s isn't a new directory below %s", cache, dir)
+	}
+	writeFiles(t, cache, map[string]string{"1": "cached"})
+	if err := os.RemoveAll(cache); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dir); !reflect.DeepEqual(got, map[string]string{"mine": "not the cache's"}) {
+		t.Errorf("%s holds %v after removing the cache", dir, got)
+	}
+}
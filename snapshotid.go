@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotIDPattern is what a chosen snapshot ID may look like. Snapshot IDs
+// name MongoDB collections and, with a dedup scope other than global, prefix
+// object keys, so they are kept to characters valid in both.
+var snapshotIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// snapshotIDInvalid matches what a host name may contain that a snapshot ID
+// may not.
+var snapshotIDInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// maxSnapshotIDHost bounds the host part of a generated snapshot ID, which
+// keeps the ID within the 64 characters validateSnapshotID allows.
+const maxSnapshotIDHost = 40
+
+// newSnapshotID returns the ID of a snapshot started at now: the time to
+// the second, the short host name and a random suffix, so runs starting
+// in the same second, on one host or many, don't collide.
+func newSnapshotID(now time.Time) string {
+	id := now.Format("20060102150405")
+	if host, err := os.Hostname(); err == nil {
+		host, _, _ = strings.Cut(host, ".")
+		host = snapshotIDInvalid.ReplaceAllString(host, "-")
+		if len(host) > maxSnapshotIDHost {
+			host = host[:maxSnapshotIDHost]
+		}
+		if host != "" {
+			id += "-" + host
+		}
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		// Without randomness the nanoseconds still tell runs apart.
+		return fmt.Sprintf("%s-%09d", id, now.Nanosecond())
+	}
+	return id + "-" + hex.EncodeToString(suffix)
+}
+
+func validateSnapshotID(id string) error {
+	if !snapshotIDPattern.MatchString(id) {
+		return fmt.Errorf("%q must be up to 64 letters, digits, dashes and underscores, starting with a letter or digit", id)
+	}
+	return nil
+}
+
+// validateDeterministicSnapshotID declines content derived snapshot IDs
+// where the content isn't known before the backup: streamed uploads are
+// only hashed while they are stored, and commands would have to run an
+// extra time, which may be expensive or have side effects.
+func validateDeterministicSnapshotID(cfg *BackupConfig, sources []SourceConfig) error {
+	if !cfg.DeterministicSnapshotID {
+		return nil
+	}
+	if cfg.StreamUpload {
+		return fmt.Errorf("backup.deterministic_snapshot_id can't be used with backup.stream_upload")
+	}
+	for _, source := range sources {
+		if _, ok := source.command(); ok {
+			return fmt.Errorf("backup.deterministic_snapshot_id can't be used with command source %s", source.Path)
+		}
+	}
+	return nil
+}
+
+// contentSnapshotID derives a snapshot ID from what a backup of sources
+// would store: the sorted paths and content hashes of their files. Sources
+// are scanned and hashed for it, before the backup scans them again, so the
+// same content always yields the same ID. It also returns the number of
+// files the backup would record. Sources must be accepted by
+// validateDeterministicSnapshotID.
+func contentSnapshotID(sources []SourceConfig, cfg *BackupConfig) (string, int64) {
+	var entries []string
+	var files int64
+	for _, source := range sources {
+		entries = append(entries, "source\x00"+source.Path)
+	}
+
+	metadataChan := make(chan FileMetadata, 1)
+	go scanSources(sources, cfg, nil, NewGate(), nil, nil, metadataChan)
+	for metadata := range metadataChan {
+		if metadata.ContentPath != "" {
+			os.Remove(metadata.ContentPath)
+		}
+		files++
+		entries = append(entries, "file\x00"+metadata.Path+"\x00"+metadata.Hash)
+	}
+	sort.Strings(entries)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", cfg.HashAlgorithm)
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%s\n", entry)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], files
+}
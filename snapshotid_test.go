@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeterministicSnapshotID(t *testing.T) {
+	captureOutput(t)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"})
+	cfg := testBackupConfig(t)
+	cfg.DeterministicSnapshotID = true
+	engine, store, _ := testEngine(t, cfg)
+	backup := func() string {
+		t.Helper()
+		summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary.SnapshotID
+	}
+	countSnapshots := func() int {
+		n := 0
+		store.ForEachSnapshot(func(*Snapshot) error {
+			n++
+			return nil
+		})
+		return n
+	}
+
+	first, second := backup(), backup()
+	if first != second {
+		t.Fatalf("identical runs recorded %s and %s", first, second)
+	}
+	if n := countSnapshots(); n != 1 {
+		t.Fatalf("identical runs left %d snapshots, want 1", n)
+	}
+	if count, _ := store.CountFiles(first); count != 2 {
+		t.Fatalf("snapshot %s records %d files, want 2", first, count)
+	}
+
+	// Changed content is another snapshot.
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed := backup(); changed == first || countSnapshots() != 2 {
+		t.Fatalf("changed content recorded as %s among %d snapshots", changed, countSnapshots())
+	}
+}
+
+func TestDeterministicSnapshotIDOfCommand(t *testing.T) {
+	cfg := testBackupConfig(t)
+	cfg.DeterministicSnapshotID = true
+	engine, _, _ := testEngine(t, cfg)
+	source := SourceConfig{Path: "cmd:echo dump", Label: "dump.sql"}
+	_, err := engine.Backup(context.Background(), []SourceConfig{source}, BackupOptions{})
+	if err == nil || !strings.Contains(err.Error(), "backup.deterministic_snapshot_id") {
+		t.Fatalf("Backup = %v, want deterministic IDs declined", err)
+	}
+}
+
+func TestNewSnapshotID(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := newSnapshotID(now)
+		if err := validateSnapshotID(id); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(id, "20261014120000-") {
+			t.Fatalf("ID %s doesn't start with its time", id)
+		}
+		if seen[id] {
+			t.Fatalf("ID %s generated twice in the same second", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+)
+
+// sniffBytes is how much of the content is looked at to decide whether it
+// is worth compressing.
+const sniffBytes = 4096
+
+// compressedMagic are the leading bytes of formats that are compressed
+// already.
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},           // gzip
+	{'P', 'K', 0x03, 0x04}, // zip, and the formats built on it
+	{0xff, 0xd8, 0xff},     // jpeg
+	{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}, // png
+	{0x28, 0xb5, 0x2f, 0xfd},                      // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},              // xz
+	{'B', 'Z', 'h'},                               // bzip2
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},            // 7z
+}
+
+// maxCompressibleEntropy is the entropy, in bits per byte, above which
+// content of an unknown format is taken to be compressed or encrypted.
+const maxCompressibleEntropy = 7.5
+
+// incompressible reports whether content starting with head is already
+// compressed, judged by its magic number or, for unknown formats, by the
+// entropy of head.
+func incompressible(head []byte) bool {
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	// ISO media files, mp4, mov and heic among them, start with an ftyp box.
+	if len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp")) {
+		return true
+	}
+
+	// Too little content says nothing about its entropy.
+	if len(head) < 512 {
+		return false
+	}
+	return entropy(head) > maxCompressibleEntropy
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// sniff returns the first bytes of r along with a reader that still yields
+// all of r.
+func sniff(r io.Reader) ([]byte, io.Reader, error) {
+	br := bufio.NewReaderSize(r, sniffBytes)
+	head, err := br.Peek(sniffBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	return head, br, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestIncompressible(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(testLines(1, 10000))
+	zw.Close()
+	random := make([]byte, sniffBytes)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"gzip", gzipped.Bytes(), true},
+		{"zip", []byte("PK\x03\x04\x14\x00\x00\x00"), true},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), true},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), true},
+		{"mp4", []byte("\x00\x00\x00\x18ftypmp42"), true},
+		// Without a known magic number, high entropy gives it away.
+		{"random", random, true},
+		{"text", testLines(2, sniffBytes), false},
+		{"zeros", make([]byte, sniffBytes), false},
+		// Too short to judge by entropy.
+		{"short random", random[:100], false},
+	}
+	for _, tt := range tests {
+		if got := incompressible(tt.head); got != tt.want {
+			t.Errorf("%s: incompressible = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineSkipsCompressedContent(t *testing.T) {
+	pipeline, err := NewPipeline([]string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 3*sniffBytes)
+	rand.New(rand.NewSource(1)).Read(random)
+	jpeg := append([]byte("\xff\xd8\xff\xe0"), testLines(3, 10000)...)
+
+	tests := []struct {
+		name       string
+		content    []byte
+		compressed bool
+	}{
+		{"text", testLines(4, 3*sniffBytes), true},
+		{"jpeg", jpeg, false},
+		{"random", random, false},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		body, chain, err := pipeline.Wrap(bytes.NewReader(tt.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := len(chain) == 1; compressed != tt.compressed {
+			t.Fatalf("%s: chain %+v, compressed %v, want %v", tt.name, chain, compressed, tt.compressed)
+		}
+		// Skipped content is stored whole, sniffed bytes included.
+		if !tt.compressed && !bytes.Equal(stored, tt.content) {
+			t.Fatalf("%s: stored %d bytes differ from the %d original", tt.name, len(stored), len(tt.content))
+		}
+		restored, err := Unwrap(bytes.NewReader(stored), chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(restored); !bytes.Equal(got, tt.content) {
+			t.Fatalf("%s: restored content differs", tt.name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What a backup does when a source doesn't exist, chosen with
+// backup.on_missing_source.
+const (
+	missingAbort    = "abort"
+	missingSkipWarn = "skip-warn"
+)
+
+// defaultSource is backed up when no backup.sources are configured.
+const defaultSource = "/home/skyline93/workspace/datahaven/testdata"
+
+// SourceConfig is a directory tree to back up, or a command whose output is
+// backed up.
+type SourceConfig struct {
+	Path string `mapstructure:"path"`
+	// IncludeRoot prefixes each file's RelPath with the root name, so files
+	// from sources sharing relative paths don't collide when restored to one
+	// destination. The root name is Label, or the basename of Path.
+	IncludeRoot bool   `mapstructure:"include_root"`
+	Label       string `mapstructure:"label"`
+
+	// failed is set by the scan when the source couldn't be backed up as
+	// a whole, like a command that exited with an error or a directory
+	// that couldn't be read.
+	failed error
+}
+
+// fail logs that path is left out of the backup because what failed
+// failed, and marks the source as failed, keeping the first error.
+func (s *SourceConfig) fail(path, what string, err error) {
+	log.Printf("%s [%s] failed, leaving it out: %v", what, path, err)
+	if s.failed == nil {
+		s.failed = fmt.Errorf("%s %s: %w", what, path, err)
+	}
+}
+
+func (s *SourceConfig) rootName() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return filepath.Base(filepath.Clean(s.Path))
+}
+
+// relPath returns the path stored for a file found at path under the source.
+func (s *SourceConfig) relPath(path string) string {
+	rel, err := filepath.Rel(s.Path, path)
+	if err != nil {
+		rel = path
+	}
+	if s.IncludeRoot {
+		rel = filepath.Join(s.rootName(), rel)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// backupSources returns the sources to back up with their paths
+// canonicalized. A source that is the same as, or nested inside, another
+// one is dropped with a warning, so every file is scanned once.
+func backupSources(cfg *BackupConfig) []SourceConfig {
+	if len(cfg.Sources) == 0 {
+		return []SourceConfig{{Path: defaultSource}}
+	}
+
+	sources := make([]SourceConfig, len(cfg.Sources))
+	for i, source := range cfg.Sources {
+		if _, ok := source.command(); ok {
+			sources[i] = source
+			continue
+		}
+		if canonical, err := canonicalPath(source.Path); err == nil {
+			source.Path = canonical
+		}
+		sources[i] = source
+	}
+
+	var kept []SourceConfig
+	for i, source := range sources {
+		covered := false
+		if _, ok := source.command(); ok {
+			kept = append(kept, source)
+			continue
+		}
+		for j, other := range sources {
+			if i == j {
+				continue
+			}
+			// Of two identical sources the first one is kept.
+			if (source.Path == other.Path && j < i) || isWithin(source.Path, other.Path) {
+				log.Printf("source [%s] is already covered by source [%s], skipping it", cfg.Sources[i].Path, cfg.Sources[j].Path)
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			kept = append(kept, source)
+		}
+	}
+	return kept
+}
+
+// isWithin reports whether path lies strictly inside dir.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func validateMissingSourcePolicy(policy string) error {
+	switch policy {
+	case missingAbort, missingSkipWarn:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q, expected %s or %s", policy, missingAbort, missingSkipWarn)
+	}
+}
+
+// existingSources returns the sources that exist. A missing source is
+// dropped with a warning under skip-warn and fails the run under abort,
+// before anything is recorded.
+func existingSources(sources []SourceConfig, policy string) ([]SourceConfig, error) {
+	var kept []SourceConfig
+	for _, source := range sources {
+		if _, ok := source.command(); ok {
+			kept = append(kept, source)
+			continue
+		}
+		_, err := os.Stat(source.Path)
+		if err == nil {
+			kept = append(kept, source)
+			continue
+		}
+		if !os.IsNotExist(err) || policy == missingAbort {
+			return nil, fmt.Errorf("source %s: %w", source.Path, err)
+		}
+		log.Printf("source [%s] does not exist, skipping it", source.Path)
+	}
+	return kept, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIncludeRootAvoidsCollisions(t *testing.T) {
+	base := t.TempDir()
+	docs, photos := filepath.Join(base, "docs"), filepath.Join(base, "photos")
+	writeFiles(t, docs, map[string]string{"same.txt": "from docs"})
+	writeFiles(t, photos, map[string]string{"same.txt": "from photos"})
+	sources := []SourceConfig{
+		{Path: docs, IncludeRoot: true},
+		{Path: photos, IncludeRoot: true, Label: "pictures"},
+	}
+
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), sources, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"docs/same.txt": "from docs", "pictures/same.txt": "from photos"}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %v, want %v", got, want)
+	}
+}
+
+func TestRelPath(t *testing.T) {
+	tests := []struct {
+		source SourceConfig
+		want   string
+	}{
+		{SourceConfig{Path: "/data/docs"}, "a/b.txt"},
+		{SourceConfig{Path: "/data/docs", IncludeRoot: true}, "docs/a/b.txt"},
+		{SourceConfig{Path: "/data/docs/", IncludeRoot: true}, "docs/a/b.txt"},
+		{SourceConfig{Path: "/data/docs", IncludeRoot: true, Label: "work"}, "work/a/b.txt"},
+	}
+	for _, tt := range tests {
+		if got := tt.source.relPath("/data/docs/a/b.txt"); got != tt.want {
+			t.Errorf("%+v: relPath = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestOverlappingSourcesScannedOnce(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	writeFiles(t, root, map[string]string{"top.txt": "top", "nested/inner.txt": "inner"})
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatal(err)
+	}
+	canonical, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testBackupConfig(t)
+	cfg.Sources = []SourceConfig{
+		{Path: filepath.Join(root, "nested")},
+		{Path: root + "/./"},
+		{Path: link},
+	}
+	sources := backupSources(cfg)
+	if len(sources) != 1 || sources[0].Path != canonical {
+		t.Fatalf("sources %+v, want only %s", sources, canonical)
+	}
+	files := scanFiles(t, sources, cfg)
+	if got, want := relPaths(files), []string{"nested/inner.txt", "top.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("scanned %v, want each file once: %v", got, want)
+	}
+}
+
+func TestMissingSource(t *testing.T) {
+	present := t.TempDir()
+	missing := filepath.Join(t.TempDir(), "unmounted")
+	sources := []SourceConfig{{Path: present}, {Path: missing}}
+
+	if _, err := existingSources(sources, missingAbort); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("abort: existingSources = %v, want an error naming %s", err, missing)
+	}
+
+	out := captureOutput(t)
+	kept, err := existingSources(sources, missingSkipWarn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || kept[0].Path != present {
+		t.Errorf("skip-warn: kept %+v, want only %s", kept, present)
+	}
+	if !strings.Contains(out.String(), "source ["+missing+"] does not exist") {
+		t.Errorf("skip-warn: no warning about %s in %q", missing, out.String())
+	}
+}
+
+func TestUnreadableSourceFailsRun(t *testing.T) {
+	captureOutput(t)
+	// A source gone by the time it is scanned, under either mount policy.
+	for _, policy := range []string{mountDescend, mountRecord} {
+		cfg := testBackupConfig(t)
+		cfg.MountPolicy = policy
+		engine, _, _ := testEngine(t, cfg)
+		missing := filepath.Join(t.TempDir(), "gone")
+		if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: missing}}, BackupOptions{}); err == nil {
+			t.Errorf("%s: backup of a source that can't be read succeeded", policy)
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root reads unreadable directories")
+	}
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "alpha", "locked/b.txt": "beta", "z/c.txt": "gamma"})
+	locked := filepath.Join(src, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0o755)
+	cfg := testBackupConfig(t)
+	engine, store, _ := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Fatalf("Backup = %v, want the unreadable directory reported", err)
+	}
+	// The rest of the tree is still backed up.
+	var files []FileMetadata
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		files = append(files, *metadata)
+		return nil
+	})
+	paths := relPaths(files)
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, []string{"a.txt", "z/c.txt"}) {
+		t.Errorf("recorded %v", paths)
+	}
+}
+
+// removeAfterStat is a trace output that deletes the file at path once it
+// is stat'ed, as if it were deleted in the middle of the scan.
+type removeAfterStat struct {
+	path string
+}
+
+func (r removeAfterStat) Write(p []byte) (int, error) {
+	var span traceSpan
+	if err := json.Unmarshal(p, &span); err == nil && span.Phase == "stat" && span.Path == r.path {
+		os.Remove(r.path)
+	}
+	return len(p), nil
+}
+
+func TestFileUnreadableAfterStatFailsRun(t *testing.T) {
+	out := captureOutput(t)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+	cfg := testBackupConfig(t)
+	engine, store, _ := testEngine(t, cfg)
+	gone := filepath.Join(src, "b.txt")
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Tracer: NewTracer(removeAfterStat{path: gone})})
+	if err == nil || !strings.Contains(err.Error(), "b.txt") {
+		t.Fatalf("Backup = %v, want the file that couldn't be hashed reported", err)
+	}
+	if !strings.Contains(out.String(), "hashing ["+gone+"] failed") {
+		t.Errorf("failing to hash isn't logged: %q", out.String())
+	}
+	var files []FileMetadata
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		files = append(files, *metadata)
+		return nil
+	})
+	if paths := relPaths(files); !reflect.DeepEqual(paths, []string{"a.txt"}) {
+		t.Errorf("recorded %v", paths)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// sourceCheckSink compares every file restored through it with the file at
+// the same relative path below a source root, to catch restores that don't
+// reproduce what was backed up. Files missing from the source are skipped,
+// they may have been removed since the backup.
+type sourceCheckSink struct {
+	OutputSink
+	root       string
+	mu         sync.Mutex
+	compared   int
+	mismatches int
+}
+
+func newSourceCheckSink(sink OutputSink, root string) *sourceCheckSink {
+	return &sourceCheckSink{OutputSink: sink, root: root}
+}
+
+func (s *sourceCheckSink) WriteFile(metadata *FileMetadata, content io.Reader) error {
+	if err := s.OutputSink.WriteFile(metadata, content); err != nil {
+		return err
+	}
+
+	source := filepath.Join(s.root, filepath.FromSlash(metadata.RelPath))
+	want, _, err := calculateHash(source, defaultHashAlgorithm)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("hashing source %s: %w", source, err)
+	}
+	got, err := s.restoredHash(metadata)
+	if err != nil {
+		return fmt.Errorf("hashing restored %s: %w", metadata.RelPath, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compared++
+	if got != want {
+		s.mismatches++
+		log.Printf("[%s] restored content %s doesn't match source %s", metadata.RelPath, got, want)
+	}
+	return nil
+}
+
+// Link links a file without comparing it, it is the file of from, which
+// was.
+func (s *sourceCheckSink) Link(from, metadata *FileMetadata) error {
+	return linkFile(s.OutputSink, from, metadata)
+}
+
+func (s *sourceCheckSink) String() string {
+	return fmt.Sprint(s.OutputSink)
+}
+
+// Err reports the mismatches found, if any.
+func (s *sourceCheckSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log.Printf("compared %d restored files with [%s], %d mismatches", s.compared, s.root, s.mismatches)
+	if s.mismatches > 0 {
+		return fmt.Errorf("%d restored files don't match the source", s.mismatches)
+	}
+	return nil
+}
+
+func (s *sourceCheckSink) restoredHash(metadata *FileMetadata) (string, error) {
+	r, err := s.OutputSink.Open(metadata)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAgainstSource(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "alpha", "sub/b.txt": "beta", "sub/c.txt": "gamma"})
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+	if err := ExportBundle(store, s3.client(), cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	// Against the untouched source every file matches.
+	check := newSourceCheckSink(NewLocalSink(t.TempDir(), conflictOverwrite), src)
+	if err := RestoreFromBundle(bundle, check, NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if err := check.Err(); err != nil || check.compared != 3 {
+		t.Fatalf("compared %d files: %v, want 3 matching", check.compared, err)
+	}
+
+	// A changed source file is reported, a removed one skipped.
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(src, "sub", "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	out := captureOutput(t)
+	check = newSourceCheckSink(NewLocalSink(t.TempDir(), conflictOverwrite), src)
+	if err := RestoreFromBundle(bundle, check, NewStats()); err != nil {
+		t.Fatal(err)
+	}
+	if err := check.Err(); err == nil || check.compared != 2 || check.mismatches != 1 {
+		t.Fatalf("compared %d files, %d mismatches: %v, want 2 and 1", check.compared, check.mismatches, err)
+	}
+	if !strings.Contains(out.String(), "[a.txt] restored content") {
+		t.Fatalf("mismatch of a.txt not reported: %q", out.String())
+	}
+}
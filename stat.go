@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileTimes are a file's timestamps in nanoseconds. Btime is 0 when the
+// kernel or filesystem doesn't report a birth time.
+type fileTimes struct {
+	Atime int64
+	Mtime int64
+	Ctime int64
+	Btime int64
+}
+
+const statxTimes = unix.STATX_ATIME | unix.STATX_MTIME | unix.STATX_CTIME | unix.STATX_BTIME
+
+// readFileTimes reads the timestamps of path with statx. Kernels without
+// statx, and timestamps statx doesn't report, fall back to the stat info the
+// walk already has.
+func readFileTimes(path string, info fs.FileInfo) (fileTimes, error) {
+	st := info.Sys().(*syscall.Stat_t)
+	times := fileTimes{
+		Atime: st.Atim.Nano(),
+		Mtime: st.Mtim.Nano(),
+		Ctime: st.Ctim.Nano(),
+	}
+
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, statxTimes, &stx)
+	if err == unix.ENOSYS {
+		return times, nil
+	}
+	if err != nil {
+		return times, err
+	}
+
+	if stx.Mask&unix.STATX_ATIME != 0 {
+		times.Atime = statxNano(stx.Atime)
+	}
+	if stx.Mask&unix.STATX_MTIME != 0 {
+		times.Mtime = statxNano(stx.Mtime)
+	}
+	if stx.Mask&unix.STATX_CTIME != 0 {
+		times.Ctime = statxNano(stx.Ctime)
+	}
+	if stx.Mask&unix.STATX_BTIME != 0 {
+		times.Btime = statxNano(stx.Btime)
+	}
+	return times, nil
+}
+
+func statxNano(ts unix.StatxTimestamp) int64 {
+	return ts.Sec*1e9 + int64(ts.Nsec)
+}
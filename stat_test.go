@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBirthTimeRecorded(t *testing.T) {
+	src := t.TempDir()
+	before := time.Now().Add(-time.Second)
+	writeFiles(t, src, map[string]string{"file": "content"})
+	after := time.Now().Add(time.Second)
+
+	path := filepath.Join(src, "file")
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := readFileTimes(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times.Btime == 0 {
+		t.Skip("filesystem doesn't report birth times")
+	}
+	if btime := time.Unix(0, times.Btime); btime.Before(before) || btime.After(after) {
+		t.Fatalf("btime %v, want between %v and %v", btime, before, after)
+	}
+
+	cfg := testBackupConfig(t)
+	files := scanFiles(t, []SourceConfig{{Path: src}}, cfg)
+	if files[0].Btime != 0 {
+		t.Errorf("btime recorded without backup.record_btime")
+	}
+	cfg.RecordBtime = true
+	files = scanFiles(t, []SourceConfig{{Path: src}}, cfg)
+	if files[0].Btime != times.Btime {
+		t.Errorf("recorded btime %d, want %d", files[0].Btime, times.Btime)
+	}
+}
+
+func TestFileTimesMatchStat(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "content"})
+	path := filepath.Join(src, "file")
+	// An mtime with nanoseconds, which the stat fields of some platforms
+	// would drop.
+	mtime := time.Unix(1600000000, 123456789)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := readFileTimes(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times.Mtime != info.ModTime().UnixNano() || times.Mtime != mtime.UnixNano() {
+		t.Fatalf("mtime %d, os.Stat says %d, set to %d", times.Mtime, info.ModTime().UnixNano(), mtime.UnixNano())
+	}
+	if times.Atime != mtime.UnixNano() {
+		t.Errorf("atime %d, set to %d", times.Atime, mtime.UnixNano())
+	}
+	// The ctime is when the times were set, not the mtime.
+	if times.Ctime == times.Mtime {
+		t.Fatalf("ctime is the mtime %d", times.Mtime)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := readFileTimes(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Ctime <= times.Ctime {
+		t.Errorf("ctime %d after chmod, %d before", changed.Ctime, times.Ctime)
+	}
+	if changed.Mtime != times.Mtime {
+		t.Errorf("chmod changed the mtime from %d to %d", times.Mtime, changed.Mtime)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Stats tracks the progress of a backup or restore run. Counters are
+// updated atomically so a snapshot can be taken at any time without
+// stopping the workers.
+type Stats struct {
+	start time.Time
+
+	filesScanned atomic.Int64
+	bytesScanned atomic.Int64
+	filesDone    atomic.Int64
+	bytesDone    atomic.Int64
+	filesFailed  atomic.Int64
+}
+
+// NewStats creates a new instance of Stats starting its clock now.
+func NewStats() *Stats {
+	return &Stats{start: time.Now()}
+}
+
+// AddScanned records a file that has been scanned and queued for upload.
+func (s *Stats) AddScanned(size int64) {
+	s.filesScanned.Add(1)
+	s.bytesScanned.Add(size)
+}
+
+// AddDone records a file whose upload has completed.
+func (s *Stats) AddDone(size int64) {
+	s.filesDone.Add(1)
+	s.bytesDone.Add(size)
+}
+
+// AddFailed records a file that couldn't be backed up.
+func (s *Stats) AddFailed() {
+	s.filesFailed.Add(1)
+}
+
+// StatsSnapshot is a point-in-time copy of the Stats counters.
+type StatsSnapshot struct {
+	FilesScanned int64
+	BytesScanned int64
+	FilesDone    int64
+	BytesDone    int64
+	FilesFailed  int64
+	Elapsed      time.Duration
+}
+
+// Snapshot reads the current counters.
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		FilesScanned: s.filesScanned.Load(),
+		BytesScanned: s.bytesScanned.Load(),
+		FilesDone:    s.filesDone.Load(),
+		BytesDone:    s.bytesDone.Load(),
+		FilesFailed:  s.filesFailed.Load(),
+		Elapsed:      time.Since(s.start),
+	}
+}
+
+// Rate returns the upload throughput in bytes per second.
+func (ss StatsSnapshot) Rate() float64 {
+	if ss.Elapsed <= 0 {
+		return 0
+	}
+	return float64(ss.BytesDone) / ss.Elapsed.Seconds()
+}
+
+// ETA estimates the time left to upload everything scanned so far. The scan
+// runs ahead of the uploads, so the estimate grows while the walk is still
+// discovering files.
+func (ss StatsSnapshot) ETA() time.Duration {
+	rate := ss.Rate()
+	if rate == 0 {
+		return 0
+	}
+	remaining := ss.BytesScanned - ss.BytesDone
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+func (ss StatsSnapshot) String() string {
+	return fmt.Sprintf("files %d/%d (%d failed), bytes %d/%d, rate %.0f B/s, elapsed %s, eta %s",
+		ss.FilesDone, ss.FilesScanned, ss.FilesFailed, ss.BytesDone, ss.BytesScanned,
+		ss.Rate(), ss.Elapsed.Round(time.Second), ss.ETA().Round(time.Second))
+}
+
+// reportStatsOnSignal prints a stats snapshot to stderr every time the
+// process receives SIGUSR1. The returned function stops the reporting.
+func reportStatsOnSignal(stats *Stats) func() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				fmt.Fprintln(logOutput, "stats:", stats.Snapshot())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
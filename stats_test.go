@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to read while other goroutines write.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureOutput sends what is written to logOutput, log lines included, to
+// the returned buffer for the rest of the test.
+func captureOutput(t testing.TB) *lockedBuffer {
+	t.Helper()
+	setupLogging(&LogConfig{})
+	var buf lockedBuffer
+	logOutput.mu.Lock()
+	prev := logOutput.w
+	logOutput.w = &buf
+	logOutput.mu.Unlock()
+	t.Cleanup(func() {
+		logOutput.mu.Lock()
+		logOutput.w = prev
+		logOutput.mu.Unlock()
+	})
+	return &buf
+}
+
+// eventually polls cond until it holds or a few seconds have passed.
+func eventually(t *testing.T, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestStatsReportedOnSIGUSR1(t *testing.T) {
+	out := captureOutput(t)
+
+	stats := NewStats()
+	stop := reportStatsOnSignal(stats)
+	defer stop()
+
+	stats.AddScanned(300)
+	stats.AddScanned(200)
+	stats.AddDone(300)
+	stats.AddFailed()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(t, func() bool { return strings.Contains(out.String(), "stats:") }) {
+		t.Fatal("no stats line printed after SIGUSR1")
+	}
+	if want := "files 1/2 (1 failed), bytes 300/500"; !strings.Contains(out.String(), want) {
+		t.Fatalf("stats line %q doesn't contain %q", out.String(), want)
+	}
+}
+
+func TestStatsSnapshotETA(t *testing.T) {
+	ss := StatsSnapshot{BytesScanned: 1000, BytesDone: 500, Elapsed: 5 * time.Second}
+	if rate := ss.Rate(); rate != 100 {
+		t.Fatalf("Rate = %v, want 100", rate)
+	}
+	if eta := ss.ETA(); eta != 5*time.Second {
+		t.Fatalf("ETA = %v, want 5s", eta)
+	}
+	if eta := (StatsSnapshot{BytesScanned: 10}).ETA(); eta != 0 {
+		t.Fatalf("ETA without progress = %v, want 0", eta)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// ObjectReader reads stored objects back, exactly as they are stored. An
+// empty versionID reads the current version.
+type ObjectReader interface {
+	Download(key, versionID string) (io.ReadCloser, error)
+}
+
+// Storage is a destination backed up objects are written to, and read back
+// from by restore.
+type Storage interface {
+	ObjectReader
+	Name() string
+	Upload(key, filePath string, pipeline *Pipeline) ([]TransformInfo, error)
+	// Stored reports whether key is stored, and with which transforms.
+	Stored(key string) ([]TransformInfo, bool, error)
+	Delete(key string) error
+}
+
+// DestinationConfig is an additional bucket every object is also written to,
+// or with Path, a directory of the local filesystem.
+type DestinationConfig struct {
+	Name   string   `mapstructure:"name"`
+	S3     S3Config `mapstructure:",squash"`
+	Bucket string   `mapstructure:"bucket"`
+	Path   string   `mapstructure:"path"`
+}
+
+// S3Storage stores objects in an S3 bucket.
+type S3Storage struct {
+	name   string
+	client *S3Client
+	bucket string
+}
+
+// NewS3Storage creates a new instance of S3Storage. An empty name defaults to
+// the bucket URL.
+func NewS3Storage(name string, client *S3Client, bucket string) *S3Storage {
+	if name == "" {
+		name = fmt.Sprintf("s3://%s", bucket)
+	}
+	return &S3Storage{name: name, client: client, bucket: bucket}
+}
+
+func (s *S3Storage) Name() string {
+	return s.name
+}
+
+func (s *S3Storage) Upload(key, filePath string, pipeline *Pipeline) ([]TransformInfo, error) {
+	return s.client.UploadLargeFile(s.bucket, key, filePath, pipeline)
+}
+
+func (s *S3Storage) Stored(key string) ([]TransformInfo, bool, error) {
+	return s.client.StoredTransforms(s.bucket, key)
+}
+
+func (s *S3Storage) Download(key, versionID string) (io.ReadCloser, error) {
+	body, err := s.client.DownloadVersion(s.bucket, key, versionID)
+	return body, archivedError(err)
+}
+
+func (s *S3Storage) Delete(key string) error {
+	return s.client.deleteObject(s.bucket, key)
+}
+
+// streamingStorage is a Storage that can hash a file while storing it.
+type streamingStorage interface {
+	StreamUpload(filePath, algorithm string, pipeline *Pipeline, keep func(hash string) bool) (streamResult, error)
+}
+
+func (s *S3Storage) StreamUpload(filePath, algorithm string, pipeline *Pipeline, keep func(hash string) bool) (streamResult, error) {
+	return s.client.StreamUpload(s.bucket, filePath, algorithm, pipeline, keep)
+}
+
+func destinationS3Configs(cfg *BackupConfig) []*S3Config {
+	var configs []*S3Config
+	for i := range cfg.Destinations {
+		if cfg.Destinations[i].Path == "" {
+			configs = append(configs, &cfg.Destinations[i].S3)
+		}
+	}
+	return configs
+}
+
+// newDestinations returns the primary bucket followed by every configured
+// additional destination.
+func newDestinations(primary *S3Client, cfg *BackupConfig) []Storage {
+	destinations := []Storage{NewS3Storage("", primary, cfg.Bucket)}
+	for i := range cfg.Destinations {
+		d := &cfg.Destinations[i]
+		if d.Path != "" {
+			destinations = append(destinations, NewLocalStorage(d.Name, d.Path))
+			continue
+		}
+		destinations = append(destinations, NewS3Storage(d.Name, NewS3Client(&d.S3), d.Bucket))
+	}
+	return destinations
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBackupToSeveralDestinations(t *testing.T) {
+	tests := []struct {
+		name            string
+		minDestinations int
+		secondFails     bool
+		wantErr         bool
+	}{
+		{name: "both stored"},
+		{name: "one of two required", minDestinations: 1, secondFails: true},
+		{name: "both required", secondFails: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			writeFiles(t, src, map[string]string{"file": strings.Repeat("content ", 100)})
+			hash := sha256Hash(strings.Repeat("content ", 100))
+
+			second := newFakeS3(t)
+			if tt.secondFails {
+				second.fail("PUT", "AccessDenied")
+			}
+			cfg := testBackupConfig(t)
+			cfg.MaxAttempts = 1
+			cfg.MinDestinations = tt.minDestinations
+			cfg.Destinations = []DestinationConfig{{
+				Name:   "second",
+				Bucket: "mirror",
+				S3:     S3Config{Region: "us-east-1", Endpoint: second.server.URL, AccessKey: "access", SecretKey: "secret"},
+			}}
+			engine, store, primary := testEngine(t, cfg)
+
+			summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Backup = %v, want error %v", err, tt.wantErr)
+			}
+			if primary.get(cfg.Bucket, hash) == nil {
+				t.Error("file isn't in the primary bucket")
+			}
+			if got := second.get("mirror", hash) != nil; got == tt.secondFails {
+				t.Errorf("file in the second destination: %v", got)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var statuses []DestinationStatus
+			store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+				statuses = metadata.Destinations
+				return nil
+			})
+			if len(statuses) != 2 || statuses[0] != (DestinationStatus{Name: "s3://datahaven"}) || statuses[1].Name != "second" {
+				t.Fatalf("destination statuses %+v", statuses)
+			}
+			if failed := statuses[1].Error != ""; failed != tt.secondFails {
+				t.Errorf("second destination status %+v", statuses[1])
+			}
+		})
+	}
+}
+
+func TestNewDestinations(t *testing.T) {
+	cfg := &BackupConfig{Bucket: "primary", Destinations: []DestinationConfig{{Name: "dr", Bucket: "mirror"}}}
+	var names, buckets []string
+	for _, destination := range newDestinations(NewS3Client(&S3Config{Region: "us-east-1"}), cfg) {
+		s := destination.(*S3Storage)
+		names = append(names, s.Name())
+		buckets = append(buckets, s.bucket)
+	}
+	if !reflect.DeepEqual(buckets, []string{"primary", "mirror"}) || names[1] != "dr" {
+		t.Fatalf("destinations %v in buckets %v", names, buckets)
+	}
+}
+
+func TestStoreOnlyToDestinationsMissingObject(t *testing.T) {
+	content := strings.Repeat("content ", 100)
+	hash := sha256Hash(content)
+
+	second := newFakeS3(t)
+	cfg := testBackupConfig(t)
+	engine, store, primary := testEngine(t, cfg)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": content})
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary holds the object already, the destination added since
+	// doesn't.
+	engine.cfg.Backup.Destinations = []DestinationConfig{{
+		Name:   "second",
+		Bucket: "mirror",
+		S3:     S3Config{Region: "us-east-1", Endpoint: second.server.URL, AccessKey: "access", SecretKey: "secret"},
+	}}
+	puts := primary.count("PUT")
+	src = t.TempDir()
+	writeFiles(t, src, map[string]string{"copy": content})
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := primary.count("PUT") - puts; got != 0 {
+		t.Errorf("%d PUTs to the primary, which holds the object already", got)
+	}
+	if second.get("mirror", hash) == nil {
+		t.Fatal("object isn't in the second destination")
+	}
+
+	var metadata *FileMetadata
+	store.ForEachFile(summary.SnapshotID, func(m *FileMetadata) error {
+		metadata = m
+		return nil
+	})
+	if metadata == nil || len(metadata.Destinations) != 2 || !storedInAll(metadata.Destinations) {
+		t.Fatalf("destinations %+v", metadata)
+	}
+	stored, ok, err := newDestinations(second.client(), &BackupConfig{Bucket: "mirror"})[0].Stored(hash)
+	if err != nil || !ok || !sameTransforms(stored, metadata.Transforms) {
+		t.Errorf("second destination holds transforms %v, %v, %v, want %v", stored, ok, err, metadata.Transforms)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// streamTempPrefix is where streamed uploads are written before their hash,
+// and so their key, is known.
+const streamTempPrefix = "incoming/"
+
+// streamable reports whether the file is hashed while it is uploaded rather
+// than before. Normalized files hash differently from what is stored, and
+// objects larger than a single CopyObject can't be moved to their key.
+func streamable(path string, info fs.FileInfo, cfg *BackupConfig) bool {
+	return cfg.StreamUpload &&
+		normalizerFor(path, cfg.Normalizers) == "" &&
+		info.Size() >= cfg.InlineThresholdBytes &&
+		info.Size() <= maxCopyObjectSize
+}
+
+func isStreamTempKey(key string) bool {
+	return strings.HasPrefix(key, streamTempPrefix)
+}
+
+// streamResult is what a streamed upload learned about the file.
+type streamResult struct {
+	Hash       string
+	Size       int64
+	Transforms []TransformInfo
+}
+
+// StreamUpload reads the file at filePath once, hashing it with algorithm
+// while it is uploaded to a temporary key. The object is then copied to its
+// hash key and the temporary one deleted. If the hash key already holds the
+// object, nothing is copied and the result has the transforms it was stored
+// with. If keep rejects the hash, the upload fails on the last read, so the
+// content is never stored. A file that changes while it is read is rolled
+// back and fails with an error.
+func (c *S3Client) StreamUpload(bucketName, filePath, algorithm string, pipeline *Pipeline, keep func(hash string) bool) (streamResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return streamResult{}, err
+	}
+	defer file.Close()
+
+	before, err := file.Stat()
+	if err != nil {
+		return streamResult{}, err
+	}
+
+	h := newHash(algorithm)
+	checked := &keepReader{r: io.TeeReader(file, h), keep: func() bool { return keep(formatHash(algorithm, h)) }}
+	counter := &countingReader{r: checked}
+	body, transforms, err := pipeline.Wrap(counter)
+	if err != nil {
+		return streamResult{}, err
+	}
+	defer body.Close()
+
+	tempKey, err := newStreamTempKey()
+	if err != nil {
+		return streamResult{}, err
+	}
+	// The transforms travel with the object when it is copied to its key.
+	metadata := transformsMetadata(transforms)
+	if before.Size() < c.cfg.multipartThreshold() {
+		// The content is hashed as it is read, so it is read once, into
+		// memory.
+		var content io.ReadSeeker
+		if content, err = readAllSeeker(body); err == nil {
+			err = c.putObject(bucketName, tempKey, content, metadata)
+		}
+	} else {
+		uploader := s3manager.NewUploaderWithClient(c.svc, func(u *s3manager.Uploader) {
+			u.PartSize = c.cfg.partSize()
+			u.Concurrency = c.cfg.partConcurrency()
+		})
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket:       aws.String(bucketName),
+			Key:          aws.String(c.objectKey(tempKey)),
+			Body:         body,
+			Metadata:     metadata,
+			ACL:          c.objectACL(),
+			RequestPayer: c.requestPayer(),
+		})
+	}
+	if checked.rejected {
+		return streamResult{Hash: formatHash(algorithm, h), Size: counter.n}, nil
+	}
+	if err != nil {
+		return streamResult{}, fmt.Errorf("upload to %s: %w", tempKey, err)
+	}
+	defer c.deleteObject(bucketName, tempKey)
+
+	result := streamResult{
+		Hash:       formatHash(algorithm, h),
+		Size:       counter.n,
+		Transforms: transforms,
+	}
+
+	after, err := file.Stat()
+	if err != nil {
+		return streamResult{}, err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) || counter.n != before.Size() {
+		return streamResult{}, fmt.Errorf("%s changed while it was uploaded", filePath)
+	}
+
+	// Other files refer to a stored object with the transforms it was
+	// stored with, so it is kept as it is even if they differ from ours.
+	stored, ok, err := c.StoredTransforms(bucketName, result.Hash)
+	if err != nil {
+		return streamResult{}, err
+	}
+	if ok {
+		if !sameTransforms(stored, transforms) {
+			log.Printf("%s is stored with other transforms, recording those", result.Hash)
+		}
+		result.Transforms = stored
+		return result, nil
+	}
+	if err := c.copyObject(bucketName, tempKey, bucketName, result.Hash); err != nil {
+		return streamResult{}, fmt.Errorf("copy %s to %s: %w", tempKey, result.Hash, err)
+	}
+	return result, nil
+}
+
+func (c *S3Client) deleteObject(bucketName, key string) error {
+	_, err := c.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(key)),
+		RequestPayer: c.requestPayer(),
+	})
+	return err
+}
+
+func newStreamTempKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return streamTempPrefix + hex.EncodeToString(b), nil
+}
+
+// errRejected fails the last read of content keep rejects.
+var errRejected = errors.New("content rejected")
+
+// keepReader asks keep, once r is read to its end, whether the content is
+// to be stored, and fails the read instead of returning io.EOF if not.
+type keepReader struct {
+	r        io.Reader
+	keep     func() bool
+	rejected bool
+}
+
+func (kr *keepReader) Read(p []byte) (int, error) {
+	n, err := kr.r.Read(p)
+	if err == io.EOF && !kr.keep() {
+		kr.rejected = true
+		err = errRejected
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStreamUpload(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "streamed content", "b.txt": "streamed content", "c.txt": "stored before"})
+	pipeline, err := NewPipeline([]string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeS3(t)
+	client := fake.client()
+	keepAll := func(string) bool { return true }
+	hash := sha256Hash("streamed content")
+
+	// A new object lands at its hash key, the temporary one removed.
+	result, err := client.StreamUpload("datahaven", filepath.Join(src, "a.txt"), "", pipeline, keepAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hash != hash || result.Size != 16 || len(result.Transforms) != 1 || result.Transforms[0].Name != "gzip" {
+		t.Fatalf("new object: result %+v", result)
+	}
+	if keys := fake.keys("datahaven"); !reflect.DeepEqual(keys, []string{hash}) {
+		t.Fatalf("new object: bucket holds %q, want only %s", keys, hash)
+	}
+	if fake.count("COPY") != 1 {
+		t.Fatalf("new object: %d copies, want 1", fake.count("COPY"))
+	}
+
+	// The same content again is found at its key and not copied.
+	result, err = client.StreamUpload("datahaven", filepath.Join(src, "b.txt"), "", pipeline, keepAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hash != hash || len(result.Transforms) != 1 || result.Transforms[0].Name != "gzip" {
+		t.Fatalf("dedup hit: result %+v", result)
+	}
+	if keys := fake.keys("datahaven"); !reflect.DeepEqual(keys, []string{hash}) || fake.count("COPY") != 1 {
+		t.Fatalf("dedup hit: bucket holds %q after %d copies", keys, fake.count("COPY"))
+	}
+
+	// An object stored with other transforms is kept, and the file records
+	// those.
+	stored := sha256Hash("stored before")
+	fake.put("datahaven", stored, []byte("stored before"), map[string]string{"Datahaven-Transforms": "[]"})
+	result, err = client.StreamUpload("datahaven", filepath.Join(src, "c.txt"), "", pipeline, keepAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Transforms) != 0 {
+		t.Fatalf("stored with other transforms: result records %+v, want the stored chain", result.Transforms)
+	}
+	if got := fake.get("datahaven", stored); got == nil || string(got.data) != "stored before" || fake.count("COPY") != 1 {
+		t.Fatal("stored with other transforms: the stored object was replaced")
+	}
+}
+
+func TestStreamUploadRejected(t *testing.T) {
+	src := t.TempDir()
+	small := filepath.Join(src, "small.txt")
+	large := filepath.Join(src, "large.bin")
+	if err := os.WriteFile(small, []byte("deny-listed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(large, bytes.Repeat([]byte("deny-listed "), 6<<20/12), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewPipeline(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{small, large} {
+		fake := newFakeS3(t)
+		var asked string
+		result, err := fake.client().StreamUpload("datahaven", path, "", pipeline, func(hash string) bool {
+			asked = hash
+			return false
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if result.Hash == "" || result.Hash != asked {
+			t.Fatalf("%s: result hash %q, keep asked about %q", path, result.Hash, asked)
+		}
+		// Nothing was stored, not even at a temporary key.
+		if keys := fake.keys("datahaven"); len(keys) != 0 {
+			t.Fatalf("%s: bucket holds %q", path, keys)
+		}
+		if fake.count("PUT") != 0 || fake.count("COMPLETE-MULTIPART") != 0 {
+			t.Fatalf("%s: %d PUTs and %d completed multipart uploads", path, fake.count("PUT"), fake.count("COMPLETE-MULTIPART"))
+		}
+		if strings.HasSuffix(path, ".bin") && fake.count("ABORT-MULTIPART") != 1 {
+			t.Fatalf("%s: multipart upload not aborted", path)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tenantName is what a tenant may be called. It has to be valid both in a
+// MongoDB database name and in an S3 key, and can't be confused with the
+// object keys datahaven writes.
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+func validateTenant(tenant string) error {
+	if tenant != "" && !tenantName.MatchString(tenant) {
+		return fmt.Errorf("%q must be up to 40 lowercase letters, digits and dashes, starting with a letter or digit", tenant)
+	}
+	return nil
+}
+
+// databaseName returns the MongoDB database holding the tenant's snapshots.
+// Without a tenant it is the datahaven database.
+func databaseName(tenant string) string {
+	if tenant == "" {
+		return "datahaven"
+	}
+	return "datahaven_" + tenant
+}
+
+// keyPrefix returns the prefix of the tenant's objects in every bucket.
+// Without a tenant objects sit at the top of the bucket.
+func keyPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return tenantsPrefix + tenant + "/"
+}
+
+// tenantsPrefix is where the namespaces of all tenants are.
+const tenantsPrefix = "tenants/"
+
+// ownsKey reports whether a listed key is in the client's namespace. A
+// client without a tenant lists the whole bucket, tenants' objects
+// included, and leaves those alone.
+func (c *S3Client) ownsKey(key string) bool {
+	return strings.HasPrefix(key, c.prefix) && (c.prefix != "" || !strings.HasPrefix(key, tenantsPrefix))
+}
+
+// database returns the tenant's database.
+func (mc *MongoClient) database() *mongo.Database {
+	return mc.client.Database(databaseName(mc.tenant))
+}
+
+// objectKey returns the key key is stored at in the tenant's namespace.
+func (c *S3Client) objectKey(key string) string {
+	return c.prefix + key
+}
+
+// unprefixed turns a listed key back into the key datahaven refers to.
+func (c *S3Client) unprefixed(key string) string {
+	return strings.TrimPrefix(key, c.prefix)
+}
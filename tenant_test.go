@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withTenant sets the tenant for the rest of the test. Clients take it when
+// they are created.
+func withTenant(t *testing.T, tenant string) {
+	t.Helper()
+	prev := Cfg.Tenant
+	Cfg.Tenant = tenant
+	t.Cleanup(func() { Cfg.Tenant = prev })
+}
+
+func TestValidateTenant(t *testing.T) {
+	for _, tenant := range []string{"", "acme", "team-42"} {
+		if err := validateTenant(tenant); err != nil {
+			t.Errorf("validateTenant(%q) = %v", tenant, err)
+		}
+	}
+	for _, tenant := range []string{"Acme", "-acme", "a/b", "a.b", "a_b", "x1234567890123456789012345678901234567890"} {
+		if err := validateTenant(tenant); err == nil {
+			t.Errorf("validateTenant(%q) accepted", tenant)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "the same content"})
+	hash := sha256Hash("the same content")
+	s3 := newFakeS3(t)
+	cfg := testBackupConfig(t)
+	cfg.DedupCacheSize = 100
+
+	// Each tenant has its own database, which a store of its own stands
+	// for, and client.
+	backup := func(tenant string) (*memStore, *S3Client, string) {
+		withTenant(t, tenant)
+		client := s3.client()
+		store := newMemStore()
+		engine := NewEngine(&Config{Backup: *cfg}, store, func() []Storage {
+			return newDestinations(client, cfg)
+		})
+		summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store, client, summary.SnapshotID
+	}
+	backup("acme")
+	storeB, clientB, snapshotB := backup("globex")
+
+	// Identical content is stored per tenant rather than deduped across.
+	want := []string{"tenants/acme/" + hash, "tenants/globex/" + hash}
+	if got := s3.keys("datahaven"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("bucket holds %v, want %v", got, want)
+	}
+	if n := s3.count("PUT"); n != 2 {
+		t.Fatalf("%d PUTs, want one per tenant", n)
+	}
+
+	// A tenant restores from its own objects only, even when another
+	// tenant holds the same content.
+	s3.remove("datahaven", "tenants/globex/"+hash)
+	if err := ExportBundle(storeB, clientB, cfg.Bucket, snapshotB, filepath.Join(t.TempDir(), "export")); err == nil {
+		t.Fatal("exporting read another tenant's object")
+	}
+}
+
+func TestUntenantedListingSkipsTenants(t *testing.T) {
+	s3 := newFakeS3(t)
+	own, tenants := sha256Hash("own"), sha256Hash("a tenant's")
+	s3.put("datahaven", own, []byte("own"), nil)
+	s3.put("datahaven", "tenants/acme/"+tenants, []byte("a tenant's"), nil)
+	withTenant(t, "")
+	client := s3.client()
+
+	// Nothing references either object, but only the untenanted one is
+	// the untenanted deployment's to collect.
+	report, err := findGarbage(newMemStore(), client, "datahaven", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Candidates) != 1 || report.Candidates[0].Key != own {
+		t.Fatalf("gc candidates %+v, want only %s", report.Candidates, own)
+	}
+
+	if err := Replicate(client, client, "datahaven", "replica"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s3.keys("replica"); !reflect.DeepEqual(got, []string{own}) {
+		t.Fatalf("replicated %v, want only %s", got, own)
+	}
+
+	// A tenant's deployment sees its own objects.
+	withTenant(t, "acme")
+	report, err = findGarbage(newMemStore(), s3.client(), "datahaven", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Candidates) != 1 || report.Candidates[0].Key != tenants {
+		t.Fatalf("tenant gc candidates %+v, want only %s", report.Candidates, tenants)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Thaw tiers, how fast and at what cost S3 makes an archived object
+// readable again.
+const (
+	thawExpedited = "Expedited"
+	thawStandard  = "Standard"
+	thawBulk      = "Bulk"
+)
+
+func validateThawTier(tier string) error {
+	switch tier {
+	case thawExpedited, thawStandard, thawBulk:
+		return nil
+	}
+	return fmt.Errorf("unknown thaw tier %q, expected %s, %s or %s", tier, thawExpedited, thawStandard, thawBulk)
+}
+
+// ThawOptions are how the archived objects of a restore are thawed.
+type ThawOptions struct {
+	// Tier is the thaw tier requested, Standard when it is empty.
+	Tier string
+	// Days is how long a thawed copy stays readable.
+	Days int64
+	// Poll is how long to wait between checks of the objects being
+	// thawed. Thaws take minutes to hours depending on the tier.
+	Poll time.Duration
+}
+
+// thawObject is a version of an object to thaw, the latest when version
+// is "".
+type thawObject struct {
+	key     string
+	version string
+}
+
+// errObjectArchived is the error reading an object that must be thawed
+// first.
+var errObjectArchived = errors.New("object is archived")
+
+// archivedError returns err as errObjectArchived when S3 refused a read
+// because the object is archived.
+func archivedError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+		return fmt.Errorf("%w: %v", errObjectArchived, err)
+	}
+	return err
+}
+
+// thawingReader is an ObjectReader of storage that archives objects, which
+// must be thawed before they are read.
+type thawingReader interface {
+	Thaw(objects []thawObject, opts ThawOptions) error
+}
+
+// archived reports whether an object of storage class needs a thaw to be
+// read. Glacier Instant Retrieval objects are read directly.
+func archived(class string) bool {
+	return class == s3.StorageClassGlacier || class == s3.StorageClassDeepArchive
+}
+
+// thawState returns whether the object needs a thaw, whether one was
+// requested and whether it is done. S3 reports a thaw in the object's
+// x-amz-restore header, as ongoing-request="true" until the thawed copy
+// can be read.
+func (c *S3Client) thawState(bucketName string, object thawObject) (needed, requested, done bool, err error) {
+	head, err := c.HeadVersion(bucketName, object.key, object.version)
+	if err != nil {
+		return false, false, false, err
+	}
+	if head == nil {
+		return false, false, false, fmt.Errorf("object %s not found", object.key)
+	}
+	if !archived(aws.StringValue(head.StorageClass)) {
+		return false, false, false, nil
+	}
+	restore := aws.StringValue(head.Restore)
+	return true, restore != "", strings.Contains(restore, `ongoing-request="false"`), nil
+}
+
+// requestThaw asks S3 to thaw the object. A thaw already in progress is
+// left to finish.
+func (c *S3Client) requestThaw(bucketName string, object thawObject, opts ThawOptions) error {
+	input := &s3.RestoreObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(object.key)),
+		RequestPayer: c.requestPayer(),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(opts.Days),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(opts.Tier)},
+		},
+	}
+	if object.version != "" {
+		input.VersionId = aws.String(object.version)
+	}
+	_, err := c.svc.RestoreObject(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+// Thaw makes the archived objects among objects readable. Objects are only
+// passed to it once reading them failed with errObjectArchived, so objects
+// that are never archived cost no HeadObject. A thaw is requested for each that isn't thawed or being thawed, then they are
+// checked every opts.Poll until all of them are done, reporting how many
+// are left.
+func (s *S3Storage) Thaw(objects []thawObject, opts ThawOptions) error {
+	if opts.Tier == "" {
+		opts.Tier = thawStandard
+	}
+	var pending []thawObject
+	for _, object := range objects {
+		needed, requested, done, err := s.client.thawState(s.bucket, object)
+		if err != nil {
+			return fmt.Errorf("checking storage class of %s: %w", object.key, err)
+		}
+		if !needed || done {
+			continue
+		}
+		if !requested {
+			if err := s.client.requestThaw(s.bucket, object, opts); err != nil {
+				return fmt.Errorf("requesting thaw of %s: %w", object.key, err)
+			}
+		}
+		pending = append(pending, object)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	total := len(pending)
+	start := time.Now()
+	log.Printf("thawing %d archived objects of %s, tier %s", total, s.name, opts.Tier)
+	for len(pending) > 0 {
+		log.Printf("thawed %d of %d objects after %s, checking again in %s", total-len(pending), total, time.Since(start).Round(time.Second), opts.Poll)
+		time.Sleep(opts.Poll)
+		var left []thawObject
+		for _, object := range pending {
+			_, _, done, err := s.client.thawState(s.bucket, object)
+			if err != nil {
+				return fmt.Errorf("checking thaw of %s: %w", object.key, err)
+			}
+			if !done {
+				left = append(left, object)
+			}
+		}
+		pending = left
+	}
+	log.Printf("thawed %d objects in %s", total, time.Since(start).Round(time.Second))
+	return nil
+}
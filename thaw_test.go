@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestoreSnapshotThawsArchivedObjects(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"a": "archived content", "b": "archived content", "c": "standard content"}
+	writeFiles(t, src, files)
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archivedKey string
+	err = store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		if metadata.RelPath == "a" {
+			archivedKey = metadata.objectKey()
+		}
+		return nil
+	})
+	if err != nil || archivedKey == "" {
+		t.Fatalf("finding the object of a: %q, %v", archivedKey, err)
+	}
+	// The thaw is in progress for the first two checks.
+	s3.archive(cfg.Bucket, archivedKey, "DEEP_ARCHIVE", 2)
+	storage := NewS3Storage("", s3.client(), cfg.Bucket)
+
+	if err := RestoreSnapshot(store, storage, summary.SnapshotID, NewLocalSink(t.TempDir(), conflictOverwrite), RestoreOptions{}); err == nil {
+		t.Fatal("reading an archived object without a thaw succeeded")
+	}
+	if n := s3.count("RESTORE"); n != 0 {
+		t.Fatalf("%d thaws requested without thawing", n)
+	}
+
+	heads := s3.count("HEAD")
+	dst := t.TempDir()
+	thaw := &ThawOptions{Tier: thawBulk, Days: 3, Poll: time.Millisecond}
+	if err := RestoreSnapshot(store, storage, summary.SnapshotID, hashCheckSink{NewLocalSink(dst, conflictOverwrite)}, RestoreOptions{Thaw: thaw}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Fatalf("restored %v, want %v", got, files)
+	}
+	if n := s3.count("RESTORE"); n != 1 {
+		t.Errorf("%d thaws requested, want 1", n)
+	}
+	if got := s3.get(cfg.Bucket, archivedKey).thaw; got.tier != thawBulk || got.days != 3 {
+		t.Errorf("thaw requested with tier %s for %d days", got.tier, got.days)
+	}
+	// Only the object that failed to be read is checked, then until its
+	// thaw is done: twice in progress and once done.
+	if n := s3.count("HEAD") - heads; n != 1+3 {
+		t.Errorf("%d heads, want 4", n)
+	}
+
+	// A thawed object is read without another thaw.
+	if err := RestoreSnapshot(store, storage, summary.SnapshotID, NewLocalSink(t.TempDir(), conflictOverwrite), RestoreOptions{Thaw: thaw}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.count("RESTORE"); n != 1 {
+		t.Errorf("%d thaws requested after the object was thawed, want 1", n)
+	}
+}
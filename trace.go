@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Tracer writes a JSON line per file processing phase with its duration. A
+// nil Tracer is disabled and costs a nil check per phase.
+type Tracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewTracer creates a new instance of Tracer writing to w.
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{enc: json.NewEncoder(w)}
+}
+
+type traceSpan struct {
+	Path       string    `json:"path"`
+	Phase      string    `json:"phase"`
+	Start      time.Time `json:"start"`
+	DurationUs int64     `json:"duration_us"`
+}
+
+func noopSpanEnd() {}
+
+// Start begins timing phase for path. Calling the returned function ends the
+// span and writes it out.
+func (t *Tracer) Start(path, phase string) func() {
+	if t == nil {
+		return noopSpanEnd
+	}
+
+	start := time.Now()
+	return func() {
+		span := traceSpan{
+			Path:       path,
+			Phase:      phase,
+			Start:      start,
+			DurationUs: time.Since(start).Microseconds(),
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.enc.Encode(span)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraceRecordsPhases(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "content"})
+	cfg := testBackupConfig(t)
+	cfg.DedupCacheSize = 16
+	engine, _, _ := testEngine(t, cfg)
+
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	if _, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{Tracer: tracer}); err != nil {
+		t.Fatal(err)
+	}
+
+	phases := map[string]bool{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var span traceSpan
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("trace line %q: %v", scanner.Text(), err)
+		}
+		if span.Path == filepath.Join(src, "file") {
+			phases[span.Phase] = true
+		}
+	}
+	for _, phase := range []string{"stat", "hash", "dedup-check", "upload:s3://datahaven", "metadata"} {
+		if !phases[phase] {
+			t.Errorf("no %s span for the file, got %v", phase, phases)
+		}
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	tracer.Start("path", "hash")()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// TransformInfo records a transform applied to an object's content, with
+// whatever parameters restore needs to reverse it.
+type TransformInfo struct {
+	Name   string
+	Params map[string]string `bson:",omitempty"`
+}
+
+// Transform rewrites an object's content on its way to storage. Info is
+// the TransformInfo Wrap records, known without wrapping anything.
+type Transform interface {
+	Wrap(r io.Reader) (io.Reader, TransformInfo, error)
+	Info() (TransformInfo, error)
+}
+
+// Transform stages, in the fixed order a pipeline applies them.
+const (
+	stageCompress = iota
+	stageEncrypt
+	stageChunk
+)
+
+type transformFactory struct {
+	stage  int
+	new    func() Transform
+	unwrap func(io.Reader, TransformInfo) (io.Reader, error)
+}
+
+var transformRegistry = map[string]transformFactory{
+	"gzip":    {stage: stageCompress, new: func() Transform { return gzipTransform{} }, unwrap: unwrapGzip},
+	"aes-gcm": {stage: stageEncrypt, new: newEncryptTransform, unwrap: unwrapAESGCM},
+}
+
+// Pipeline composes the configured transforms in stage order.
+type Pipeline struct {
+	transforms []Transform
+	stages     []int
+}
+
+// NewPipeline creates a new instance of Pipeline from transform names. The
+// order of names doesn't matter, transforms are always applied compress →
+// encrypt → chunk, and at most one transform per stage is allowed.
+func NewPipeline(names []string) (*Pipeline, error) {
+	factories := make([]transformFactory, 0, len(names))
+	stages := make(map[int]string)
+	for _, name := range names {
+		factory, ok := transformRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		if other, ok := stages[factory.stage]; ok {
+			return nil, fmt.Errorf("transforms %q and %q can't be combined", other, name)
+		}
+		stages[factory.stage] = name
+		factories = append(factories, factory)
+	}
+
+	sort.Slice(factories, func(i, j int) bool { return factories[i].stage < factories[j].stage })
+
+	p := &Pipeline{}
+	for _, factory := range factories {
+		p.transforms = append(p.transforms, factory.new())
+		p.stages = append(p.stages, factory.stage)
+	}
+	return p, nil
+}
+
+// Wrap applies every transform to r and returns the transformed stream along
+// with the chain of applied transforms, in application order. Restore undoes
+// them in reverse. Content that is compressed already skips the compress
+// stage and isn't part of the chain. The stream must be closed, which stops
+// transforms that run in the background when it isn't read to its end.
+func (p *Pipeline) Wrap(r io.Reader) (io.ReadCloser, []TransformInfo, error) {
+	body := &transformedReader{Reader: r}
+	var chain []TransformInfo
+	for i, t := range p.transforms {
+		if p.stages[i] == stageCompress {
+			head, sniffed, err := sniff(body.Reader)
+			if err != nil {
+				body.Close()
+				return nil, nil, err
+			}
+			body.Reader = sniffed
+			if incompressible(head) {
+				continue
+			}
+		}
+		wrapped, info, err := t.Wrap(body.Reader)
+		if err != nil {
+			body.Close()
+			return nil, nil, err
+		}
+		body.Reader = wrapped
+		if closer, ok := wrapped.(io.Closer); ok {
+			body.closers = append(body.closers, closer)
+		}
+		chain = append(chain, info)
+	}
+	return body, chain, nil
+}
+
+// Applies reports whether chain is what Wrap applies to some content: the
+// pipeline's transforms with the same parameters, such as the encryption
+// key, in order. The compress stage may be missing, as it is for content
+// that is compressed already.
+func (p *Pipeline) Applies(chain []TransformInfo) bool {
+	i := 0
+	for j, t := range p.transforms {
+		info, err := t.Info()
+		if err != nil {
+			return false
+		}
+		if i < len(chain) && sameTransforms(chain[i:i+1], []TransformInfo{info}) {
+			i++
+			continue
+		}
+		if p.stages[j] != stageCompress {
+			return false
+		}
+	}
+	return i == len(chain)
+}
+
+// pipelineFor returns a pipeline that applies chain, so content stored with
+// it can be stored alike elsewhere. It fails when chain can't be applied
+// again, like when it was encrypted with a key no longer configured.
+func pipelineFor(chain []TransformInfo) (*Pipeline, error) {
+	names := make([]string, len(chain))
+	for i, info := range chain {
+		names[i] = info.Name
+	}
+	p, err := NewPipeline(names)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Applies(chain) {
+		return nil, fmt.Errorf("transforms %s can't be applied again", describeTransforms(chain))
+	}
+	return p, nil
+}
+
+// describeTransforms names the transforms of chain for the log, with their
+// parameters.
+func describeTransforms(chain []TransformInfo) string {
+	if len(chain) == 0 {
+		return "none"
+	}
+	names := make([]string, len(chain))
+	for i, info := range chain {
+		names[i] = info.Name
+		if len(info.Params) > 0 {
+			params := make([]string, 0, len(info.Params))
+			for k, v := range info.Params {
+				params = append(params, k+"="+v)
+			}
+			sort.Strings(params)
+			names[i] += "(" + strings.Join(params, ",") + ")"
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// errTransformClosed is what a transform still writing its output sees once
+// the stream is closed.
+var errTransformClosed = errors.New("transformed stream closed")
+
+// transformedReader is the output of a pipeline. Closing it closes the
+// stages that hold resources, last one first.
+type transformedReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (t *transformedReader) Close() error {
+	for i := len(t.closers) - 1; i >= 0; i-- {
+		t.closers[i].Close()
+	}
+	t.closers = nil
+	return nil
+}
+
+// Unwrap reverses a chain of transforms recorded by Pipeline.Wrap, giving
+// back the original content of an object.
+func Unwrap(r io.Reader, chain []TransformInfo) (io.Reader, error) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		factory, ok := transformRegistry[chain[i].Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", chain[i].Name)
+		}
+		unwrapped, err := factory.unwrap(r, chain[i])
+		if err != nil {
+			return nil, err
+		}
+		r = unwrapped
+	}
+	return r, nil
+}
+
+type gzipTransform struct{}
+
+func (gzipTransform) Wrap(r io.Reader) (io.Reader, TransformInfo, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		if _, err := io.Copy(zw, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+	return gzipReader{pr}, TransformInfo{Name: "gzip"}, nil
+}
+
+func (gzipTransform) Info() (TransformInfo, error) {
+	return TransformInfo{Name: "gzip"}, nil
+}
+
+// gzipReader is the read end of gzipTransform's pipe. Closing it before the
+// end makes the compressing goroutine's next write fail, so it exits.
+type gzipReader struct {
+	*io.PipeReader
+}
+
+func (r gzipReader) Close() error {
+	return r.CloseWithError(errTransformClosed)
+}
+
+func unwrapGzip(r io.Reader, _ TransformInfo) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// withEncryptionKey sets backup.encryption_key for the rest of the test.
+func withEncryptionKey(t *testing.T, key string) {
+	t.Helper()
+	prev := Cfg.Backup.EncryptionKey
+	Cfg.Backup.EncryptionKey = key
+	t.Cleanup(func() { Cfg.Backup.EncryptionKey = prev })
+}
+
+// testLines returns n bytes of compressible text, different per seed.
+func testLines(seed int64, n int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, "line %d: value %d\n", b.Len(), r.Intn(1000))
+	}
+	return b.Bytes()[:n]
+}
+
+func TestPipelineRoundTrip(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+
+	contents := map[string][]byte{
+		"empty":            {},
+		"short text":       []byte("hello, hello, hello"),
+		"segment":          bytes.Repeat([]byte("a"), encryptSegmentSize),
+		"several segments": testLines(1, 3*encryptSegmentSize+17),
+	}
+
+	tests := []struct {
+		names []string
+		chain []string
+	}{
+		{nil, nil},
+		{[]string{"gzip"}, []string{"gzip"}},
+		{[]string{"aes-gcm"}, []string{"aes-gcm"}},
+		// The chain is applied in stage order whatever the configured order.
+		{[]string{"aes-gcm", "gzip"}, []string{"gzip", "aes-gcm"}},
+	}
+	for _, tt := range tests {
+		pipeline, err := NewPipeline(tt.names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range contents {
+			body, chain, err := pipeline.Wrap(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := io.ReadAll(body)
+			body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var applied []string
+			for _, info := range chain {
+				applied = append(applied, info.Name)
+			}
+			if strings.Join(applied, ",") != strings.Join(tt.chain, ",") {
+				t.Fatalf("%v %s: chain %v, want %v", tt.names, name, applied, tt.chain)
+			}
+			if len(tt.chain) > 0 && len(content) > 0 && bytes.Equal(stored, content) {
+				t.Fatalf("%v %s: stored content is the plain content", tt.names, name)
+			}
+
+			restored, err := Unwrap(bytes.NewReader(stored), chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(restored)
+			if err != nil {
+				t.Fatalf("%v %s: unwrapping: %v", tt.names, name, err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("%v %s: restored %d bytes differ from the %d original", tt.names, name, len(got), len(content))
+			}
+		}
+	}
+}
+
+func TestNewPipelineRejects(t *testing.T) {
+	for _, names := range [][]string{{"zstd"}, {"gzip", "gzip"}} {
+		if _, err := NewPipeline(names); err == nil {
+			t.Errorf("NewPipeline(%v) = nil error", names)
+		}
+	}
+}
+
+func TestEncryptDetectsTampering(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	pipeline, err := NewPipeline([]string{"aes-gcm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("x"), 2*encryptSegmentSize+5)
+	body, chain, err := pipeline.Wrap(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(body)
+
+	unwrap := func(stored []byte) error {
+		r, err := Unwrap(bytes.NewReader(stored), chain)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(r)
+		return err
+	}
+
+	flipped := append([]byte(nil), stored...)
+	flipped[len(flipped)/2] ^= 1
+	if unwrap(flipped) == nil {
+		t.Error("a flipped byte decrypted without error")
+	}
+	// Cut after the first whole segment: the last one is missing.
+	truncated := stored[:encryptPrefixSize+encryptSegmentSize+16]
+	if unwrap(truncated) == nil {
+		t.Error("content truncated at a segment boundary decrypted without error")
+	}
+
+	withEncryptionKey(t, strings.Repeat("ff", 32))
+	if _, err := Unwrap(bytes.NewReader(stored), chain); err == nil || !strings.Contains(err.Error(), "encrypted with key") {
+		t.Errorf("Unwrap with another key = %v, want a key mismatch", err)
+	}
+}
+
+func TestPipelineCloseStopsGzip(t *testing.T) {
+	pipeline, err := NewPipeline([]string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		body, _, err := pipeline.Wrap(bytes.NewReader(testLines(int64(i), 256<<10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A consumer that gives up after the first bytes, as a failed
+		// upload does.
+		body.Read(make([]byte, 10))
+		body.Close()
+	}
+	if !eventually(t, func() bool { return runtime.NumGoroutine() <= before+2 }) {
+		t.Fatalf("%d goroutines left running after closing, %d before", runtime.NumGoroutine(), before)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// DestinationStatus is the outcome of writing a file to one destination.
+type DestinationStatus struct {
+	Name  string
+	Error string `bson:",omitempty"`
+}
+
+// Uploader stores scanned files in their destinations and records their
+// metadata once stored.
+type Uploader struct {
+	destinations    []Storage
+	minDestinations int
+	pipeline        *Pipeline
+	batch           *MetadataBatch
+	tracer          *Tracer
+	gate            *Gate
+	budget          *Budget
+	dedup           *DedupCache
+	storing         *keyLocks
+	intents         *IntentLog
+	snapshotID      string
+	omit            map[string]struct{}
+	denied          map[string]struct{}
+	cfg             *BackupConfig
+}
+
+// NewUploader creates a new instance of Uploader. A file counts as stored
+// once cfg.MinDestinations destinations hold it, all of them by default.
+// Files whose content every destination already holds, as told by dedup or
+// by asking them, aren't stored again. Uploaders sharing storing store a
+// key one at a time.
+func NewUploader(destinations []Storage, pipeline *Pipeline, batch *MetadataBatch, tracer *Tracer, gate *Gate, budget *Budget, dedup *DedupCache, storing *keyLocks, intents *IntentLog, cfg *BackupConfig) (*Uploader, error) {
+	minDestinations := cfg.MinDestinations
+	if minDestinations <= 0 {
+		minDestinations = len(destinations)
+	}
+	if minDestinations > len(destinations) {
+		return nil, fmt.Errorf("backup.min_destinations is %d but only %d destinations are configured", minDestinations, len(destinations))
+	}
+
+	omit, err := metadataOmissions(cfg.MetadataFields)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Uploader{
+		destinations:    destinations,
+		minDestinations: minDestinations,
+		pipeline:        pipeline,
+		batch:           batch,
+		tracer:          tracer,
+		gate:            gate,
+		budget:          budget,
+		dedup:           dedup,
+		storing:         storing,
+		intents:         intents,
+		snapshotID:      batch.head.ID,
+		omit:            omit,
+		denied:          denySet(cfg.DenyHashes),
+		cfg:             cfg,
+	}, nil
+}
+
+// Process stores a single file and queues its metadata.
+func (u *Uploader) Process(metadata FileMetadata) error {
+	switch planAction(&metadata, u.cfg) {
+	case actionDenied, actionMount:
+		// Denied files and mount points are recorded without storing any
+		// content.
+	case actionBundle:
+		// The Bundler already stored the file as part of its directory's
+		// bundle. If bundling failed it is uploaded on its own.
+		if metadata.BundleKey == "" {
+			if err := u.skipChecksumFailure(&metadata, u.upload(&metadata)); err != nil {
+				return err
+			}
+		}
+	case actionInline:
+		endSpan := u.tracer.Start(metadata.Path, "inline")
+		data, transforms, err := inlineFile(metadata.contentPath(), u.pipeline)
+		endSpan()
+		if err != nil {
+			return fmt.Errorf("inline %s: %w", metadata.Path, err)
+		}
+		metadata.Inline = true
+		metadata.InlineData = data
+		metadata.Transforms = transforms
+	default:
+		if err := u.skipChecksumFailure(&metadata, u.upload(&metadata)); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("save metadata to mongodb, file: [%s]", metadata.Name)
+	document, err := projectMetadata(&metadata, u.omit)
+	if err != nil {
+		return fmt.Errorf("encode metadata of %s: %w", metadata.Path, err)
+	}
+
+	endSpan := u.tracer.Start(metadata.Path, "metadata")
+	err = u.batch.Add(metadata.Path, document)
+	endSpan()
+	if err != nil {
+		return fmt.Errorf("insert metadata of %s: %w", metadata.Path, err)
+	}
+	if metadata.ContentPath != "" {
+		os.Remove(metadata.ContentPath)
+	}
+	return nil
+}
+
+// skipChecksumFailure returns err from uploading metadata's file, unless it
+// is a checksum failure to skip under the configured policy. The file is
+// then recorded as not stored.
+func (u *Uploader) skipChecksumFailure(metadata *FileMetadata, err error) error {
+	var checksumErr *ChecksumError
+	if err == nil || u.cfg.OnChecksumMismatch != checksumSkip || !errors.As(err, &checksumErr) {
+		return err
+	}
+	log.Printf("[%s] is recorded as not stored: %v", metadata.Path, checksumErr)
+	metadata.ChecksumFailed = true
+	metadata.ObjectKey = ""
+	return nil
+}
+
+// upload writes the file to all destinations concurrently and records the
+// per-destination outcome on metadata. The transform chain is only known
+// once the object is written, which is why metadata is saved afterwards.
+func (u *Uploader) upload(metadata *FileMetadata) error {
+	if metadata.Hash == "" {
+		return u.streamUpload(metadata)
+	}
+
+	key := u.scopedKey(metadata.Path, metadata.Hash)
+	if key != metadata.Hash {
+		metadata.ObjectKey = key
+	}
+
+	unlock := u.storing.Lock(key)
+	defer unlock()
+	transforms, held, ok := u.storedAlready(metadata.Path, key, u.pipeline)
+	if ok {
+		metadata.Transforms = transforms
+		return nil
+	}
+
+	transforms, statuses, err := u.store(key, metadata.contentPath(), u.pipeline, held)
+	metadata.Transforms = transforms
+	metadata.Destinations = statuses
+	if err == nil && storedInAll(statuses) {
+		u.dedup.Add(key, transforms)
+	}
+	return err
+}
+
+// storedAlready reports whether key, the content of the file or directory
+// at path, is stored in every destination already, and returns the
+// transforms it was stored with rather than those of pipeline. Destinations
+// are always asked when the dedup cache misses, the cache only saves asking
+// again: storing the content again could change its transforms under the
+// files that already refer to it. When it isn't stored everywhere, what
+// each destination holds is returned for store.
+func (u *Uploader) storedAlready(path, key string, pipeline *Pipeline) ([]TransformInfo, []holding, bool) {
+	if transforms, ok := u.dedup.Get(key); ok {
+		return transforms, nil, true
+	}
+	endSpan := u.tracer.Start(path, "dedup-check")
+	held := u.holdings(key)
+	endSpan()
+	transforms, ok := heldEverywhere(held)
+	if !ok {
+		return nil, held, false
+	}
+	// The object is kept as it is, other files refer to it with the
+	// transforms it was stored with.
+	if !pipeline.Applies(transforms) {
+		log.Printf("[%s] is stored as %s with transforms %s rather than the configured ones, recording those", path, key, describeTransforms(transforms))
+	}
+	u.dedup.Add(key, transforms)
+	return transforms, nil, true
+}
+
+// scopedKey returns the key content keyed key, of the file or directory at
+// path, is stored under in the configured dedup scope.
+func (u *Uploader) scopedKey(path, key string) string {
+	return scopedKey(u.cfg.DedupScope, u.snapshotID, path, key)
+}
+
+// holding is whether a destination holds a key, and with which transforms.
+type holding struct {
+	ok         bool
+	transforms []TransformInfo
+}
+
+// holdings asks every destination whether it holds key. Failing to ask
+// counts as not held.
+func (u *Uploader) holdings(key string) []holding {
+	held := make([]holding, len(u.destinations))
+	for i, destination := range u.destinations {
+		transforms, ok, err := destination.Stored(key)
+		if err == nil && ok {
+			held[i] = holding{ok: true, transforms: transforms}
+		}
+	}
+	return held
+}
+
+// heldEverywhere reports whether every destination holds the key, stored
+// with the same transforms, and returns them.
+func heldEverywhere(held []holding) ([]TransformInfo, bool) {
+	for _, h := range held {
+		if !h.ok || !sameTransforms(h.transforms, held[0].transforms) {
+			return nil, false
+		}
+	}
+	return held[0].transforms, true
+}
+
+// storedEverywhere reports whether every destination holds key, stored with
+// the same transforms, and returns them. Failing to ask counts as not
+// stored.
+func (u *Uploader) storedEverywhere(key string) ([]TransformInfo, bool) {
+	return heldEverywhere(u.holdings(key))
+}
+
+func sameTransforms(a, b []TransformInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || len(a[i].Params) != len(b[i].Params) {
+			return false
+		}
+		for k, v := range a[i].Params {
+			if b[i].Params[k] != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// storedInAll reports whether the outcome of store has every destination
+// holding the object. A single destination reports no statuses.
+func storedInAll(statuses []DestinationStatus) bool {
+	for _, status := range statuses {
+		if status.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// streamUpload stores a file the scan left unhashed, hashing it on the way
+// to the single destination. A file whose hash turns out to be deny-listed
+// is recorded as denied and not kept.
+func (u *Uploader) streamUpload(metadata *FileMetadata) error {
+	destination := u.destinations[0]
+	streamer, ok := destination.(streamingStorage)
+	if !ok {
+		return fmt.Errorf("upload %s: %s can't stream uploads", metadata.Path, destination.Name())
+	}
+
+	u.gate.Wait()
+	release := u.budget.Acquire()
+	endSpan := u.tracer.Start(metadata.Path, "stream:"+destination.Name())
+	result, err := streamer.StreamUpload(metadata.contentPath(), u.cfg.HashAlgorithm, u.pipeline, func(hash string) bool {
+		_, denied := u.denied[hash]
+		return !denied
+	})
+	endSpan()
+	release()
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", metadata.Path, err)
+	}
+
+	metadata.Hash = result.Hash
+	metadata.Size = result.Size
+	if _, ok := u.denied[result.Hash]; ok {
+		log.Printf("[%s] matches deny-listed hash %s, it won't be uploaded", metadata.Path, result.Hash)
+		metadata.Denied = true
+		return nil
+	}
+	metadata.Transforms = result.Transforms
+	return nil
+}
+
+// store writes the file at filePath under key, concurrently, to the
+// destinations held reports without it, or to all of them when held is nil.
+// It returns the transform chain of the first destination holding the
+// object and, when there is more than one destination, the outcome of each.
+// Destinations holding it already keep their object as it is, the others
+// get it stored with the same transforms, so the chain recorded holds for
+// all of them. One holding it with other transforms is reported as failed.
+func (u *Uploader) store(key, filePath string, pipeline *Pipeline, held []holding) ([]TransformInfo, []DestinationStatus, error) {
+	u.gate.Wait()
+
+	if held == nil {
+		held = make([]holding, len(u.destinations))
+	}
+	statuses := make([]DestinationStatus, len(u.destinations))
+	chains := make([][]TransformInfo, len(u.destinations))
+	errs := make([]error, len(u.destinations))
+
+	first := -1
+	var reuseErr error
+	for i, h := range held {
+		statuses[i].Name = u.destinations[i].Name()
+		if !h.ok {
+			continue
+		}
+		if first < 0 {
+			first = i
+			var err error
+			if pipeline, err = pipelineFor(h.transforms); err != nil {
+				reuseErr = fmt.Errorf("%s holds %s stored with transforms %s: %w", statuses[i].Name, key, describeTransforms(h.transforms), err)
+			}
+		} else if !sameTransforms(h.transforms, held[first].transforms) {
+			errs[i] = fmt.Errorf("%s holds %s stored with transforms %s rather than %s", statuses[i].Name, key, describeTransforms(h.transforms), describeTransforms(held[first].transforms))
+			statuses[i].Error = errs[i].Error()
+			continue
+		}
+		chains[i] = h.transforms
+	}
+
+	began := false
+	var wg sync.WaitGroup
+	for i, destination := range u.destinations {
+		if held[i].ok {
+			continue
+		}
+		if reuseErr != nil {
+			// The others can't store the object as it is held already.
+			statuses[i].Error = reuseErr.Error()
+			errs[i] = reuseErr
+			continue
+		}
+		if !began {
+			if err := u.intents.Begin(key, filePath); err != nil {
+				return nil, nil, err
+			}
+			began = true
+		}
+		wg.Add(1)
+		go func(i int, destination Storage) {
+			defer wg.Done()
+			release := u.budget.Acquire()
+			defer release()
+			endSpan := u.tracer.Start(filePath, "upload:"+destination.Name())
+			transforms, err := u.uploadChecked(destination, key, filePath, pipeline)
+			endSpan()
+			if err != nil {
+				statuses[i].Error = err.Error()
+				errs[i] = err
+				return
+			}
+			chains[i] = transforms
+		}(i, destination)
+	}
+	wg.Wait()
+
+	var transforms []TransformInfo
+	succeeded := 0
+	for i, status := range statuses {
+		if status.Error == "" {
+			if succeeded == 0 {
+				transforms = chains[i]
+			}
+			succeeded++
+		}
+	}
+	if len(u.destinations) == 1 {
+		statuses = nil
+	}
+
+	if succeeded < u.minDestinations {
+		err := fmt.Errorf("upload %s: stored in %d of %d destinations, %d required", filePath, succeeded, len(u.destinations), u.minDestinations)
+		// A checksum failure is passed on, it is handled by policy rather
+		// than retried.
+		for _, destErr := range errs {
+			var checksumErr *ChecksumError
+			if errors.As(destErr, &checksumErr) {
+				err = fmt.Errorf("%w: %w", err, checksumErr)
+				break
+			}
+		}
+		return transforms, statuses, err
+	}
+	return transforms, statuses, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMultipartThreshold(t *testing.T) {
+	const partSize = 5 << 20
+	const threshold = 6 << 20
+	tests := []struct {
+		name      string
+		size      int
+		multipart bool
+	}{
+		{"below the threshold", threshold - 1, false},
+		{"at the threshold", threshold, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := newFakeS3(t)
+			client := NewS3Client(&S3Config{
+				Region: "us-east-1", Endpoint: s3.server.URL, AccessKey: "access", SecretKey: "secret",
+				PartSize: partSize, MultipartThreshold: threshold,
+			})
+			content := bytes.Repeat([]byte("x"), tt.size)
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			pipeline, _ := NewPipeline(nil)
+			if _, err := client.UploadLargeFile("bucket", "key", path, pipeline); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s3.count("CREATE-MULTIPART") > 0; got != tt.multipart {
+				t.Errorf("multipart upload: %v, want %v", got, tt.multipart)
+			}
+			if got := s3.count("PUT") > 0; got == tt.multipart {
+				t.Errorf("single PutObject: %v, want %v", got, !tt.multipart)
+			}
+			if object := s3.get("bucket", "key"); object == nil || !bytes.Equal(object.data, content) {
+				t.Fatal("stored object differs from the file")
+			}
+		})
+	}
+}
+
+func TestMultipartThresholdValidated(t *testing.T) {
+	cfg := &S3Config{PartSize: 8 << 20, MultipartThreshold: 6 << 20}
+	if err := cfg.validate(); err == nil {
+		t.Fatal("threshold below the part size accepted")
+	}
+	cfg.MultipartThreshold = 8 << 20
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Larger objects can't be stored with a single PutObject.
+	cfg.MultipartThreshold = maxPutObjectSize + 1
+	if err := cfg.validate(); err == nil {
+		t.Fatal("threshold above the PutObject maximum accepted")
+	}
+}
+
+func TestSinglePutContentMD5(t *testing.T) {
+	withEncryptionKey(t, testEncryptionKey)
+	content := bytes.Repeat([]byte("content "), 1000)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The file is sent as it is, or transformed from memory; either way
+	// the fake checks the Content-MD5 against what it receives.
+	for _, transforms := range [][]string{nil, {"gzip", "aes-gcm"}} {
+		s3 := newFakeS3(t)
+		pipeline, err := NewPipeline(transforms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := s3.client().UploadLargeFile("bucket", "key", path, pipeline)
+		if err != nil {
+			t.Fatalf("transforms %v: %v", transforms, err)
+		}
+		object := s3.get("bucket", "key")
+		if object == nil {
+			t.Fatalf("transforms %v: nothing stored", transforms)
+		}
+		r, err := Unwrap(bytes.NewReader(object.data), chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(r); !bytes.Equal(got, content) {
+			t.Errorf("transforms %v: stored object differs from the file", transforms)
+		}
+	}
+}
+
+// BenchmarkUploadClients uploads from many workers at once through one
+// shared client, with the default and with a tuned connection pool, and
+// through a client per worker.
+func BenchmarkUploadClients(b *testing.B) {
+	const workers = 64
+	captureOutput(b)
+	path := filepath.Join(b.TempDir(), "file")
+	if err := os.WriteFile(path, testLines(1, 64<<10), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	pipeline, err := NewPipeline(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		perWorker   bool
+		connections int
+	}{
+		{"shared default pool", false, 0},
+		{"shared tuned pool", false, workers},
+		{"per-worker", true, 1},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			s3 := newFakeS3(b)
+			cfg := &S3Config{Region: "us-east-1", Endpoint: s3.server.URL, AccessKey: "access", SecretKey: "secret", MaxConnections: tt.connections}
+			clients := make([]*S3Client, workers)
+			for i := range clients {
+				if i == 0 || tt.perWorker {
+					clients[i] = NewS3Client(cfg)
+				} else {
+					clients[i] = clients[0]
+				}
+			}
+
+			b.SetBytes(workers * 64 << 10)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				var wg sync.WaitGroup
+				for i, client := range clients {
+					wg.Add(1)
+					go func(i int, client *S3Client) {
+						defer wg.Done()
+						if _, err := client.UploadLargeFile("datahaven", fmt.Sprintf("object-%d", i), path, pipeline); err != nil {
+							b.Error(err)
+						}
+					}(i, client)
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
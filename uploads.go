@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// incompleteUpload is a multipart upload that was started but neither
+// completed nor aborted, like one of an interrupted backup. S3 keeps, and
+// bills, its parts until it is aborted.
+type incompleteUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// findIncompleteUploads returns the multipart uploads of bucket in the
+// client's namespace that were started longer than olderThan ago. Newer ones
+// may belong to a backup still in progress.
+func findIncompleteUploads(s3Client *S3Client, bucket string, olderThan time.Duration) ([]incompleteUpload, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var uploads []incompleteUpload
+	err := s3Client.svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket:       aws.String(bucket),
+		Prefix:       aws.String(s3Client.prefix),
+		RequestPayer: s3Client.requestPayer(),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			key := aws.StringValue(upload.Key)
+			initiated := aws.TimeValue(upload.Initiated)
+			if !s3Client.ownsKey(key) || initiated.After(cutoff) {
+				continue
+			}
+			uploads = append(uploads, incompleteUpload{
+				Key:       s3Client.unprefixed(key),
+				UploadID:  aws.StringValue(upload.UploadId),
+				Initiated: initiated,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing multipart uploads of %s: %w", bucket, err)
+	}
+	return uploads, nil
+}
+
+// abortUpload aborts the multipart upload, deleting the parts it stored.
+func (c *S3Client) abortUpload(bucketName string, upload incompleteUpload) error {
+	_, err := c.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(upload.Key)),
+		UploadId:     aws.String(upload.UploadID),
+		RequestPayer: c.requestPayer(),
+	})
+	return err
+}
+
+func runCleanupIncompleteUploads(args []string) error {
+	fs := flag.NewFlagSet("cleanup-incomplete-uploads", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list the uploads that would be aborted without aborting them")
+	yes := fs.Bool("yes", false, "don't ask for confirmation before aborting")
+	olderThan := ageFlag(gcGrace)
+	fs.Var(&olderThan, "older-than", "only abort uploads started longer ago than this, like 30d, 6m or 1y")
+	fs.Parse(args)
+
+	s3Client := NewS3Client(&Cfg.S3)
+	uploads, err := findIncompleteUploads(s3Client, Cfg.Backup.Bucket, time.Duration(olderThan))
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		fmt.Printf("%s  %s  started %s\n", upload.Key, upload.UploadID, upload.Initiated.Format(time.RFC3339))
+	}
+	fmt.Printf("%d incomplete uploads started more than %s ago\n", len(uploads), time.Duration(olderThan))
+
+	if *dryRun || len(uploads) == 0 {
+		return nil
+	}
+	if !*yes {
+		fmt.Fprintf(os.Stderr, "Abort %d uploads? [y/N] ", len(uploads))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			return nil
+		}
+	}
+
+	for _, upload := range uploads {
+		if err := s3Client.abortUpload(Cfg.Backup.Bucket, upload); err != nil {
+			return fmt.Errorf("aborting upload %s of %s: %w", upload.UploadID, upload.Key, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Aborted %d uploads.\n", len(uploads))
+	return nil
+}
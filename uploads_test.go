@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestIncompleteUploadsOlderThan(t *testing.T) {
+	fake := newFakeS3(t)
+	client := fake.client()
+	start := func(key string) string {
+		t.Helper()
+		output, err := client.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("datahaven"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aws.StringValue(output.UploadId)
+	}
+	oldID := start("old")
+	start("recent")
+	fake.backdate("datahaven", "old?upload="+oldID, time.Now().Add(-40*day))
+
+	olderThan, err := parseAge("30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := findIncompleteUploads(client, "datahaven", olderThan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || uploads[0].Key != "old" || uploads[0].UploadID != oldID {
+		t.Fatalf("uploads %+v, want only the old one", uploads)
+	}
+
+	if err := client.abortUpload("datahaven", uploads[0]); err != nil {
+		t.Fatal(err)
+	}
+	uploads, err = findIncompleteUploads(client, "datahaven", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, upload := range uploads {
+		keys = append(keys, upload.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"recent"}) {
+		t.Fatalf("uploads of %v left after aborting, want the recent one", keys)
+	}
+}
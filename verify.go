@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// VerifySummary counts the outcome of verifying a snapshot's files. Shallow
+// verification only establishes that objects are present; deep verification
+// also re-hashes their content.
+type VerifySummary struct {
+	Files           int64
+	Present         int64
+	ContentVerified int64
+	Missing         int64
+	Corrupt         int64
+	Skipped         int64
+}
+
+func (vs VerifySummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "files:            %d\n", vs.Files)
+	fmt.Fprintf(&b, "present:          %d\n", vs.Present)
+	fmt.Fprintf(&b, "content-verified: %d\n", vs.ContentVerified)
+	fmt.Fprintf(&b, "missing:          %d\n", vs.Missing)
+	fmt.Fprintf(&b, "corrupt:          %d\n", vs.Corrupt)
+	fmt.Fprintf(&b, "skipped:          %d", vs.Skipped)
+	return b.String()
+}
+
+// Verifier checks that a snapshot's files are intact in storage.
+type Verifier struct {
+	client *S3Client
+	bucket string
+	deep   bool
+	blocks bool
+}
+
+// NewVerifier creates a new instance of Verifier. A shallow verifier issues a
+// HeadObject per file and compares the object with the stored metadata, a
+// deep one downloads each object and re-hashes its content. With blocks,
+// files recorded with block hashes are read and checked block by block,
+// which tells which blocks are corrupt, and other files are checked deep.
+func NewVerifier(client *S3Client, bucket string, deep, blocks bool) *Verifier {
+	return &Verifier{client: client, bucket: bucket, deep: deep || blocks, blocks: blocks}
+}
+
+// verifyResult is the outcome of verifying a single file.
+type verifyResult int
+
+const (
+	verifySkipped verifyResult = iota
+	verifyPresent
+	verifyContentVerified
+	verifyMissing
+	verifyCorrupt
+)
+
+// Verify checks a single file record.
+func (v *Verifier) Verify(metadata *FileMetadata) (verifyResult, error) {
+	if metadata.Denied || metadata.ChecksumFailed || metadata.MountPoint {
+		return verifySkipped, nil
+	}
+
+	if metadata.Inline {
+		if !v.deep {
+			return verifyPresent, nil
+		}
+		return v.verifyContent(metadata, io.NopCloser(bytes.NewReader(metadata.InlineData)))
+	}
+
+	key := metadata.objectKey()
+	head, err := v.client.HeadVersion(v.bucket, key, metadata.VersionID)
+	if err != nil {
+		return 0, err
+	}
+	if head == nil {
+		return verifyMissing, nil
+	}
+	// Without transforms the object is the file itself, so its size must
+	// match the recorded one, unless a normalizer deduped it with a file of
+	// another size.
+	if metadata.BundleKey == "" && len(metadata.Transforms) == 0 && metadata.Normalizer == "" && aws.Int64Value(head.ContentLength) != metadata.Size {
+		return verifyCorrupt, nil
+	}
+	if !v.deep {
+		return verifyPresent, nil
+	}
+
+	if v.blocks && blockCheckable(metadata) {
+		corrupt, err := v.client.corruptBlocks(v.bucket, metadata)
+		if err != nil {
+			return 0, err
+		}
+		if len(corrupt) > 0 {
+			log.Printf("[%s] blocks %v of %d bytes are corrupt", metadata.Path, corrupt, metadata.BlockSize)
+			return verifyCorrupt, nil
+		}
+		return verifyContentVerified, nil
+	}
+
+	body, err := v.client.DownloadVersion(v.bucket, key, metadata.VersionID)
+	if err != nil {
+		return 0, err
+	}
+	return v.verifyContent(metadata, body)
+}
+
+// verifyContent streams body through the inverse of the recorded transforms
+// and compares the hash of the result with the recorded hash.
+func (v *Verifier) verifyContent(metadata *FileMetadata, body io.ReadCloser) (verifyResult, error) {
+	defer body.Close()
+
+	// Without a content hash only the size of the content can be checked.
+	pathMtime := isPathMtimeKey(metadata.Hash)
+	var h hash.Hash
+	var sink io.Writer = io.Discard
+	if !pathMtime {
+		var err error
+		h, err = hasherFor(metadata.Hash)
+		if err != nil {
+			return 0, err
+		}
+		sink = h
+	}
+
+	content, err := Unwrap(body, metadata.Transforms)
+	if err != nil {
+		return verifyCorrupt, nil
+	}
+	if metadata.BundleKey != "" {
+		content, err = bundleMember(content, metadata.BundlePath)
+		if err != nil {
+			return verifyCorrupt, nil
+		}
+	}
+	var w io.WriteCloser = nopWriteCloser{sink}
+	if metadata.Normalizer != "" {
+		normalize, ok := normalizerRegistry[metadata.Normalizer]
+		if !ok {
+			return 0, fmt.Errorf("unknown normalizer %q", metadata.Normalizer)
+		}
+		w = normalize(sink)
+	}
+	n, err := io.Copy(w, content)
+	if err != nil {
+		return verifyCorrupt, nil
+	}
+	if err := w.Close(); err != nil {
+		return verifyCorrupt, nil
+	}
+
+	if pathMtime {
+		if n != metadata.Size {
+			return verifyCorrupt, nil
+		}
+		return verifyContentVerified, nil
+	}
+	// Files with the same normalized content share an object, which may
+	// hold more or fewer bytes than the file had.
+	algorithm, _, _ := strings.Cut(metadata.Hash, ":")
+	if (metadata.Normalizer == "" && n != metadata.Size) || algorithm+":"+hex.EncodeToString(h.Sum(nil)) != metadata.Hash {
+		return verifyCorrupt, nil
+	}
+	return verifyContentVerified, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// hasherFor returns a hash for the algorithm prefixing a content hash.
+func hasherFor(contentHash string) (hash.Hash, error) {
+	algorithm, _, ok := strings.Cut(contentHash, ":")
+	if !ok {
+		return nil, fmt.Errorf("hash %q has no algorithm prefix", contentHash)
+	}
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+	return newHash(algorithm), nil
+}
+
+func (vs *VerifySummary) add(result verifyResult) {
+	vs.Files++
+	switch result {
+	case verifySkipped:
+		vs.Skipped++
+	case verifyPresent:
+		vs.Present++
+	case verifyContentVerified:
+		vs.Present++
+		vs.ContentVerified++
+	case verifyMissing:
+		vs.Missing++
+	case verifyCorrupt:
+		vs.Present++
+		vs.Corrupt++
+	}
+}
+
+// verifyCheckpointEvery is how many files verify checks between saving its
+// checkpoint.
+const verifyCheckpointEvery = 1000
+
+// verifyCheckpoint is the persisted progress of verifying a snapshot: the
+// first Verified files, the last of them Last, were checked with the
+// outcome Summary.
+type verifyCheckpoint struct {
+	SnapshotID string
+	Deep       bool
+	Blocks     bool
+	Verified   int64
+	Last       string
+	Summary    VerifySummary
+}
+
+// loadVerifyCheckpoint returns the checkpoint at path if it was saved
+// verifying the snapshot the way verifier does, an empty one otherwise.
+func loadVerifyCheckpoint(path, snapshotID string, verifier *Verifier) verifyCheckpoint {
+	fresh := verifyCheckpoint{SnapshotID: snapshotID, Deep: verifier.deep, Blocks: verifier.blocks}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fresh
+	}
+	var ckpt verifyCheckpoint
+	if err := json.Unmarshal(data, &ckpt); err != nil || ckpt.SnapshotID != fresh.SnapshotID || ckpt.Deep != fresh.Deep || ckpt.Blocks != fresh.Blocks {
+		return fresh
+	}
+	return ckpt
+}
+
+// verifySnapshot verifies every file of a snapshot with a pool of workers.
+// Records are streamed from MongoDB as the workers take them, so memory
+// doesn't grow with the size of the snapshot. The first error stops it.
+// With a checkpoint path, its progress is saved there every
+// verifyCheckpointEvery files and when it stops, and a run picks up where
+// the checkpoint left off. The checkpoint is removed once every file is
+// verified.
+func verifySnapshot(client MongoDBClient, verifier *Verifier, snapshotID string, workers int, checkpoint string) (VerifySummary, error) {
+	ckpt := verifyCheckpoint{SnapshotID: snapshotID, Deep: verifier.deep, Blocks: verifier.blocks}
+	if checkpoint != "" {
+		ckpt = loadVerifyCheckpoint(checkpoint, snapshotID, verifier)
+		if ckpt.Verified > 0 {
+			log.Printf("resuming verify of snapshot %s after %d files, the last [%s]", snapshotID, ckpt.Verified, ckpt.Last)
+		}
+	}
+	save := func() error {
+		if checkpoint == "" {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(checkpoint), 0o700); err != nil {
+			return err
+		}
+		return saveCheckpoint(checkpoint, &ckpt)
+	}
+
+	// Files finish out of order, so the checkpoint only covers those up
+	// to the first one still being checked. done holds the outcomes of the
+	// files finished after it, by position.
+	type outcome struct {
+		path   string
+		result verifyResult
+	}
+	var (
+		mu       sync.Mutex
+		done     = make(map[int64]outcome)
+		firstErr error
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	type job struct {
+		position int64
+		metadata *FileMetadata
+	}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				metadata := j.metadata
+				result, err := verifier.Verify(metadata)
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("verifying %s: %w", metadata.Path, err)
+					}
+					mu.Unlock()
+					continue
+				}
+				done[j.position] = outcome{path: metadata.Path, result: result}
+				for next, ok := done[ckpt.Verified]; ok; next, ok = done[ckpt.Verified] {
+					delete(done, ckpt.Verified)
+					ckpt.Summary.add(next.result)
+					ckpt.Last = next.path
+					ckpt.Verified++
+					if ckpt.Verified%verifyCheckpointEvery == 0 {
+						if err := save(); err != nil && firstErr == nil {
+							firstErr = fmt.Errorf("saving verify checkpoint: %w", err)
+						}
+					}
+				}
+				mu.Unlock()
+
+				switch result {
+				case verifyMissing:
+					log.Printf("[%s] object %s is missing", metadata.Path, metadata.objectKey())
+				case verifyCorrupt:
+					log.Printf("[%s] object %s is corrupt", metadata.Path, metadata.objectKey())
+				}
+			}
+		}()
+	}
+
+	errStop := errors.New("stopped")
+	var position int64
+	err := client.ForEachFile(snapshotID, func(metadata *FileMetadata) error {
+		if failed() {
+			return errStop
+		}
+		position++
+		if position <= ckpt.Verified {
+			return nil
+		}
+		jobs <- job{position: position - 1, metadata: metadata}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = err
+	}
+	if firstErr != nil {
+		if saveErr := save(); saveErr != nil {
+			log.Printf("saving verify checkpoint failed: %v", saveErr)
+		}
+		return ckpt.Summary, firstErr
+	}
+	if checkpoint != "" {
+		os.Remove(checkpoint)
+	}
+	return ckpt.Summary, nil
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	deep := fs.Bool("deep", false, "download every object and re-hash its content")
+	shallow := fs.Bool("shallow", false, "only check that objects are present and match the stored metadata, the default")
+	blocks := fs.Bool("blocks", false, "like --deep, but check files with block hashes block by block and report the corrupt blocks")
+	workers := fs.Int("workers", 8, "number of files to verify concurrently")
+	restart := fs.Bool("restart", false, "verify every file again rather than resume an interrupted verify of the snapshot")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven verify [--shallow|--deep|--blocks] [--workers n] [--restart] [snapshot-id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if *shallow && (*deep || *blocks) {
+		return fmt.Errorf("--shallow can't be combined with --deep or --blocks")
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	snapshot, err := client.FindSnapshot(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	// An interrupted verify leaves its checkpoint behind for the next
+	// verify of the snapshot to resume from.
+	checkpoint := filepath.Join(tempDir(&Cfg.Backup), "verify-checkpoints", snapshot.ID+".json")
+	if *restart {
+		os.Remove(checkpoint)
+	}
+
+	verifier := NewVerifier(NewS3Client(&Cfg.S3), Cfg.Backup.Bucket, *deep, *blocks)
+	summary, err := NewEngine(&Cfg, client, nil).Verify(verifier, snapshot.ID, *workers, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("snapshot:         %s\n", snapshot.ID)
+	fmt.Printf("hash algorithm:   %s\n", snapshot.hashAlgorithm())
+	fmt.Println(summary)
+	if summary.Missing > 0 || summary.Corrupt > 0 {
+		return fmt.Errorf("%d missing and %d corrupt objects", summary.Missing, summary.Corrupt)
+	}
+	return nil
+}
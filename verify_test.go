@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyDepths(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"intact": "intact content", "corrupt": "corrupt content", "missing": "missing content"})
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]string{}
+	store.ForEachFile(summary.SnapshotID, func(metadata *FileMetadata) error {
+		keys[metadata.RelPath] = metadata.objectKey()
+		return nil
+	})
+	// Same size, other content: only re-hashing tells.
+	s3.put(cfg.Bucket, keys["corrupt"], []byte("CORRUPT content"), nil)
+	s3.remove(cfg.Bucket, keys["missing"])
+
+	tests := []struct {
+		deep bool
+		want VerifySummary
+	}{
+		{false, VerifySummary{Files: 3, Present: 2, Missing: 1}},
+		{true, VerifySummary{Files: 3, Present: 2, ContentVerified: 1, Missing: 1, Corrupt: 1}},
+	}
+	for _, tt := range tests {
+		gets := s3.count("GET")
+		got, err := engine.Verify(NewVerifier(s3.client(), cfg.Bucket, tt.deep, false), summary.SnapshotID, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("deep %v: summary %+v, want %+v", tt.deep, got, tt.want)
+		}
+		if downloads := s3.count("GET") - gets; !tt.deep && downloads != 0 {
+			t.Errorf("shallow verify downloaded %d objects", downloads)
+		}
+	}
+}
+
+func TestVerifyWorkersCheckEachFileOnce(t *testing.T) {
+	s3 := newFakeS3(t)
+	store := newMemStore()
+	var files []FileMetadata
+	for i := 0; i < 100; i++ {
+		content := fmt.Sprintf("content %d", i)
+		files = append(files, FileMetadata{Path: fmt.Sprintf("/src/%d", i), Size: int64(len(content)), Hash: sha256Hash(content)})
+		// Every tenth object is lost.
+		if i%10 != 0 {
+			s3.put("datahaven", sha256Hash(content), []byte(content), nil)
+		}
+	}
+	store.addSnapshot(&Snapshot{ID: "s1"}, files)
+
+	summary, err := verifySnapshot(store, NewVerifier(s3.client(), "datahaven", true, false), "s1", 8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (VerifySummary{Files: 100, Present: 90, ContentVerified: 90, Missing: 10}); summary != want {
+		t.Fatalf("summary %+v, want %+v", summary, want)
+	}
+	if heads, gets := s3.count("HEAD"), s3.count("GET"); heads != 100 || gets != 90 {
+		t.Fatalf("%d heads and %d downloads, want every file checked once", heads, gets)
+	}
+}
+
+func TestVerifyResumesFromCheckpoint(t *testing.T) {
+	s3 := newFakeS3(t)
+	var files []FileMetadata
+	for i := 0; i < 100; i++ {
+		content := fmt.Sprintf("content %d", i)
+		files = append(files, FileMetadata{Path: fmt.Sprintf("/src/%d", i), Size: int64(len(content)), Hash: sha256Hash(content)})
+		s3.put("datahaven", sha256Hash(content), []byte(content), nil)
+	}
+	// A hash deep verify can't check stops the first run at the 51st file.
+	broken := append([]FileMetadata(nil), files...)
+	broken[50].ObjectKey, broken[50].Hash = broken[50].Hash, "unprefixed"
+	store := newMemStore()
+	store.addSnapshot(&Snapshot{ID: "s1"}, broken)
+
+	checkpoint := filepath.Join(t.TempDir(), "verify.json")
+	verifier := NewVerifier(s3.client(), "datahaven", true, false)
+	if _, err := verifySnapshot(store, verifier, "s1", 8, checkpoint); err == nil {
+		t.Fatal("verify of the unprefixed hash succeeded")
+	}
+	ckpt := loadVerifyCheckpoint(checkpoint, "s1", verifier)
+	if ckpt.Verified != 50 || ckpt.Last != "/src/49" || ckpt.Summary.ContentVerified != 50 {
+		t.Fatalf("checkpoint %+v, want the first 50 files", ckpt)
+	}
+	// Another depth starts over.
+	if other := loadVerifyCheckpoint(checkpoint, "s1", NewVerifier(s3.client(), "datahaven", false, false)); other.Verified != 0 {
+		t.Errorf("shallow verify resumes the deep one's checkpoint %+v", other)
+	}
+
+	fixed := newMemStore()
+	fixed.addSnapshot(&Snapshot{ID: "s1"}, files)
+	heads := s3.count("HEAD")
+	summary, err := verifySnapshot(fixed, verifier, "s1", 8, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (VerifySummary{Files: 100, Present: 100, ContentVerified: 100}); summary != want {
+		t.Errorf("summary %+v, want %+v", summary, want)
+	}
+	if got := s3.count("HEAD") - heads; got != 50 {
+		t.Errorf("resumed verify checked %d files, want the 50 left", got)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after verify completed: %v", err)
+	}
+}
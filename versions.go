@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ObjectVersion is one stored version of an object in a versioned bucket.
+type ObjectVersion struct {
+	VersionID    string
+	Size         int64
+	LastModified time.Time
+	Latest       bool
+}
+
+// ListObjectVersions returns the versions of key, newest first, as S3 lists
+// them. Delete markers aren't included.
+func (c *S3Client) ListObjectVersions(bucketName, key string) ([]ObjectVersion, error) {
+	var versions []ObjectVersion
+	err := c.svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket:       aws.String(bucketName),
+		Prefix:       aws.String(c.objectKey(key)),
+		RequestPayer: c.requestPayer(),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			// The prefix also matches longer keys.
+			if aws.StringValue(v.Key) != c.objectKey(key) {
+				continue
+			}
+			versions = append(versions, ObjectVersion{
+				VersionID:    aws.StringValue(v.VersionId),
+				Size:         aws.Int64Value(v.Size),
+				LastModified: aws.TimeValue(v.LastModified),
+				Latest:       aws.BoolValue(v.IsLatest),
+			})
+		}
+		return true
+	})
+	return versions, err
+}
+
+// DownloadVersion returns the content of versionID of key, or of its latest
+// version when versionID is "".
+func (c *S3Client) DownloadVersion(bucketName, key, versionID string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(c.objectKey(key)),
+		RequestPayer: c.requestPayer(),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	output, err := c.svc.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+func runVersions(args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	path := fs.String("path", "", "the file, by path or relative path, whose object versions are listed")
+	pin := fs.String("pin", "", "read this version of the file's object when verifying and exporting it for restore")
+	unpin := fs.Bool("unpin", false, "read the latest version of the file's object again")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: datahaven versions --path path [--pin version-id|--unpin] [snapshot-id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" {
+		fs.Usage()
+		return fmt.Errorf("missing --path")
+	}
+
+	client, err := NewMongoClient(&Cfg.MongoDB)
+	if err != nil {
+		return fmt.Errorf("creating MongoDB client: %w", err)
+	}
+	defer client.Close()
+
+	snapshot, err := client.FindSnapshot(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("finding snapshot: %w", err)
+	}
+
+	var file *FileMetadata
+	errFound := errors.New("found")
+	err = client.ForEachFile(snapshot.ID, func(metadata *FileMetadata) error {
+		if metadata.Path == *path || metadata.RelPath == *path {
+			file = metadata
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return fmt.Errorf("reading files: %w", err)
+	}
+	if file == nil {
+		return fmt.Errorf("no file %s in snapshot %s", *path, snapshot.ID)
+	}
+	key := file.objectKey()
+	if key == "" {
+		return fmt.Errorf("%s has no object", *path)
+	}
+
+	if *pin != "" || *unpin {
+		filter := bson.M{"$or": bson.A{bson.M{"path": *path}, bson.M{"relpath": *path}}}
+		update := bson.M{"$set": bson.M{"versionid": *pin}}
+		if *unpin {
+			update = bson.M{"$unset": bson.M{"versionid": ""}}
+		}
+		for _, collection := range snapshot.fileCollections() {
+			if _, err := client.UpdateMany(collection, filter, update); err != nil {
+				return fmt.Errorf("pinning version: %w", err)
+			}
+		}
+		if *unpin {
+			fmt.Printf("Unpinned %s in snapshot %s.\n", *path, snapshot.ID)
+		} else {
+			fmt.Printf("Pinned %s in snapshot %s to version %s.\n", *path, snapshot.ID, *pin)
+		}
+		return nil
+	}
+
+	versions, err := NewS3Client(&Cfg.S3).ListObjectVersions(Cfg.Backup.Bucket, key)
+	if err != nil {
+		return fmt.Errorf("listing versions of %s: %w", key, err)
+	}
+	fmt.Printf("object: %s\n", key)
+	for _, v := range versions {
+		marker := ""
+		if v.Latest {
+			marker = " (latest)"
+		}
+		if v.VersionID == file.VersionID {
+			marker += " (pinned)"
+		}
+		fmt.Printf("%s  %s  %d bytes%s\n", v.VersionID, v.LastModified.Format(time.RFC3339), v.Size, marker)
+	}
+	return nil
+}
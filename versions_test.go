@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestObjectVersions(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "original content"})
+	cfg := testBackupConfig(t)
+	engine, store, s3 := testEngine(t, cfg)
+	summary, err := engine.Backup(context.Background(), []SourceConfig{{Path: src}}, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sha256Hash("original content")
+	stored := s3.get(cfg.Bucket, key)
+
+	// The bucket is versioned and the object was overwritten later. A key
+	// extending it isn't one of its versions.
+	s3.putVersion(cfg.Bucket, key, "v1", stored.data, stored.metadata)
+	s3.putVersion(cfg.Bucket, key, "v2", []byte("overwritten!!!!!"), stored.metadata)
+	s3.putVersion(cfg.Bucket, key+"-other", "v3", []byte("other"), nil)
+
+	client := s3.client()
+	versions, err := client.ListObjectVersions(cfg.Bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, v := range versions {
+		ids = append(ids, v.VersionID)
+	}
+	if !reflect.DeepEqual(ids, []string{"v2", "v1"}) || !versions[0].Latest || versions[1].Latest {
+		t.Fatalf("versions %+v, want v2 latest then v1", versions)
+	}
+
+	body, err := client.DownloadVersion(cfg.Bucket, key, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "original content" {
+		t.Fatalf("version v1 reads %q", data)
+	}
+
+	restore := func() string {
+		t.Helper()
+		bundle := filepath.Join(t.TempDir(), "snapshot.dhexport")
+		if err := ExportBundle(store, client, cfg.Bucket, summary.SnapshotID, bundle); err != nil {
+			t.Fatal(err)
+		}
+		dst := t.TempDir()
+		if err := RestoreFromBundle(bundle, NewLocalSink(dst, conflictOverwrite), NewStats()); err != nil {
+			t.Fatal(err)
+		}
+		return readDir(t, dst)["file"]
+	}
+	if got := restore(); got != "overwritten!!!!!" {
+		t.Fatalf("unpinned restore reads %q, want the latest version", got)
+	}
+	// Pinned, as versions --pin does, the file is restored from v1.
+	if _, err := store.UpdateMany(summary.SnapshotID, bson.M{"relpath": "file"}, bson.M{"$set": bson.M{"versionid": "v1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := restore(); got != "original content" {
+		t.Fatalf("pinned restore reads %q, want version v1", got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// windowRecheck bounds how long a gate outside of its windows sleeps before
+// looking at the clock and its windows again, so clock changes and config
+// reloads don't leave it asleep.
+const windowRecheck = time.Minute
+
+// timeWindow is a daily range of minutes since midnight. A window whose end
+// is before its start runs past midnight.
+type timeWindow struct {
+	start, end int
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// parseTimeWindow parses a range like "22:00-06:00".
+func parseTimeWindow(s string) (timeWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("window %q isn't of the form hh:mm-hh:mm", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	w := timeWindow{start: start.Hour()*60 + start.Minute(), end: end.Hour()*60 + end.Minute()}
+	if w.start == w.end {
+		return timeWindow{}, fmt.Errorf("window %q is empty", s)
+	}
+	return w, nil
+}
+
+// UploadWindows holds a Gate closed outside of daily time ranges. A nil
+// UploadWindows is always open.
+type UploadWindows struct {
+	windows []timeWindow
+	loc     *time.Location
+	now     func() time.Time
+}
+
+// NewUploadWindows creates a new instance of UploadWindows for the ranges
+// in windows, in the time zone named by timezone, or returns nil when there
+// are no ranges. An empty timezone is the local one.
+func NewUploadWindows(windows []string, timezone string) (*UploadWindows, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+	w := &UploadWindows{loc: loc, now: time.Now}
+	for _, s := range windows {
+		window, err := parseTimeWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		w.windows = append(w.windows, window)
+	}
+	return w, nil
+}
+
+// Open reports whether now lies in one of the windows.
+func (w *UploadWindows) Open() bool {
+	if w == nil {
+		return true
+	}
+	now := w.now().In(w.loc)
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range w.windows {
+		if window.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// untilOpen returns how long it is until the next window starts.
+func (w *UploadWindows) untilOpen() time.Duration {
+	now := w.now().In(w.loc)
+	var next time.Duration
+	for i, window := range w.windows {
+		start := time.Date(now.Year(), now.Month(), now.Day(), window.start/60, window.start%60, 0, 0, w.loc)
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if d := start.Sub(now); i == 0 || d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// recheckIn returns how long to wait before checking the windows again.
+func (w *UploadWindows) recheckIn() time.Duration {
+	d := w.untilOpen()
+	if d > windowRecheck {
+		d = windowRecheck
+	}
+	return d
+}
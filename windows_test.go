@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		in     []int
+		out    []int
+	}{
+		{"09:00-17:30", []int{9 * 60, 17*60 + 29}, []int{9*60 - 1, 17*60 + 30}},
+		// Past midnight.
+		{"22:00-06:00", []int{22 * 60, 23*60 + 59, 0, 6*60 - 1}, []int{6 * 60, 22*60 - 1}},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, minute := range tt.in {
+			if !w.contains(minute) {
+				t.Errorf("%s doesn't contain minute %d", tt.window, minute)
+			}
+		}
+		for _, minute := range tt.out {
+			if w.contains(minute) {
+				t.Errorf("%s contains minute %d", tt.window, minute)
+			}
+		}
+	}
+	for _, window := range []string{"22:00", "25:00-06:00", "08:00-08:00"} {
+		if _, err := parseTimeWindow(window); err == nil {
+			t.Errorf("parseTimeWindow(%q) succeeded", window)
+		}
+	}
+}
+
+func TestUploadWindowsTimezone(t *testing.T) {
+	windows, err := NewUploadWindows([]string{"22:00-23:00"}, "Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// 13:30 UTC is 22:30 in Tokyo.
+	windows.now = func() time.Time { return time.Date(2026, 1, 1, 13, 30, 0, 0, time.UTC) }
+	if !windows.Open() {
+		t.Error("window closed at 22:30 Tokyo time")
+	}
+	windows.now = func() time.Time { return time.Date(2026, 1, 1, 22, 30, 0, 0, time.UTC) }
+	if windows.Open() {
+		t.Error("window open at 07:30 Tokyo time")
+	}
+}
+
+func TestUploadsDeferredOutsideWindow(t *testing.T) {
+	captureOutput(t)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"file": "content"})
+	cfg := testBackupConfig(t)
+	files := scanFiles(t, []SourceConfig{{Path: src}}, cfg)
+
+	// The clock is just short of the window, which opens while the upload
+	// waits.
+	windows, err := NewUploadWindows([]string{"22:00-23:00"}, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wait = 300 * time.Millisecond
+	start := time.Now()
+	opens := time.Date(2026, 1, 1, 22, 0, 0, 0, time.UTC)
+	windows.now = func() time.Time { return opens.Add(time.Since(start) - wait) }
+	gate := NewGate()
+	gate.SetWindows(windows)
+
+	s3 := newFakeS3(t)
+	pipeline, err := NewPipeline(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := NewMetadataBatch(newMemStore(), &Snapshot{ID: "s1"}, &MongoDBConfig{BatchSize: 1}, 0)
+	uploader, err := NewUploader(newDestinations(s3.client(), cfg), pipeline, batch, nil, gate, NewBudget(0), NewDedupCache(0), nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- uploader.Process(files[0]) }()
+
+	time.Sleep(wait / 3)
+	select {
+	case err := <-done:
+		t.Fatalf("upload finished outside of the window: %v", err)
+	default:
+	}
+	if n := s3.count("PUT"); n != 0 {
+		t.Fatalf("%d puts outside of the window", n)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload still waiting after the window opened")
+	}
+	if elapsed := time.Since(start); elapsed < wait {
+		t.Errorf("upload done after %s, before the window opened", elapsed)
+	}
+	if n := s3.count("PUT"); n != 1 {
+		t.Errorf("%d puts inside the window, want 1", n)
+	}
+}